@@ -1,223 +1,1705 @@
-// Copyright 2020 John McKenzie
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// 	http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package main
-
-import (
-	"encoding/json"
-	"log"
-	"net/http"
-	"os/exec"
-	"strings"
-	"time"
-)
-
-const (
-	listenAddress = "0.0.0.0:4778"
-	version       = "0.0.1"
-)
-
-// Widget represents a generic object.
-type Widget struct {
-	ID string `json:"id"`
-
-	Name string `json:"name"`
-
-	Description string `json:"description"`
-}
-
-// WidgetHandler handles Widget requests.
-type WidgetHandler struct {
-	widgets map[string]Widget
-}
-
-// NewWidgetHandler will construct a new WidgetHandler.
-func NewWidgetHandler() WidgetHandler {
-	return WidgetHandler{
-		widgets: make(map[string]Widget, 0),
-	}
-}
-
-func (h WidgetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.EscapedPath()
-	id := strings.Replace(path, "/widgets/", "", 1)
-	log.Printf("path: %s method: %s id: %s", path, r.Method, id)
-
-	switch r.Method {
-	case http.MethodGet:
-		if len(id) > 0 {
-			h.get(w, r, id)
-		} else {
-			h.list(w, r)
-		}
-		return
-	case http.MethodPost:
-		if len(id) > 0 {
-			break
-		}
-		h.create(w, r)
-		return
-	case http.MethodPut:
-		if len(id) <= 0 {
-			break
-		}
-		h.update(w, r, id)
-		return
-	case http.MethodDelete:
-		if len(id) <= 0 {
-			break
-		}
-		h.delete(w, r, id)
-		return
-	default:
-		// default method not allowed...
-	}
-
-	writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed for this resource.")
-}
-
-func main() {
-	http.HandleFunc("/", index)
-	http.Handle("/widgets/", NewWidgetHandler())
-
-	log.Printf("listening for connections at %s", listenAddress)
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
-}
-
-func index(w http.ResponseWriter, r *http.Request) {
-	log.Printf("URL Path: %s Method: %s", r.URL.Path, r.Method)
-	if r.URL.Path != "/" {
-		writeJSONError(w, http.StatusNotFound, "The requested resource could not be located.")
-		return
-	}
-
-	if r.Method != http.MethodOptions && r.Method != http.MethodGet {
-		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed for this resource.")
-		return
-	}
-
-	payload := map[string]string{
-		"timestamp": time.Now().String(),
-		"version":   version,
-	}
-
-	if err := writeJSON(w, http.StatusOK, payload); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-	}
-}
-
-func (h WidgetHandler) list(w http.ResponseWriter, r *http.Request) {
-	widgets := make([]Widget, 0)
-	for _, widget := range h.widgets {
-		widgets = append(widgets, widget)
-	}
-
-	payload := map[string]interface{}{
-		"widgets": widgets,
-		"count":   len(widgets),
-	}
-
-	if err := writeJSON(w, http.StatusOK, payload); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-	}
-}
-
-func (h WidgetHandler) get(w http.ResponseWriter, r *http.Request, id string) {
-	widget, ok := h.widgets[id]
-	if !ok {
-		log.Printf("unable to find widget with id %s", id)
-		writeJSONError(w, http.StatusNotFound, "The requested resource could not be located.")
-		return
-	}
-
-	if err := writeJSON(w, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-	}
-}
-
-func (h WidgetHandler) create(w http.ResponseWriter, r *http.Request) {
-	var widget Widget
-
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&widget); err != nil {
-		log.Printf("unable to parse widget %s", err)
-		writeJSONError(w, http.StatusBadRequest, err.Error())
-		return
-	}
-
-	uuid, err := exec.Command("uuidgen").Output()
-	if err != nil {
-		log.Printf("unable to generate uuid %x", err)
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	widget.ID = strings.TrimSpace(string(uuid))
-	h.widgets[widget.ID] = widget
-
-	if err := writeJSON(w, http.StatusCreated, map[string]Widget{"widget": widget}); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-	}
-}
-
-func (h WidgetHandler) update(w http.ResponseWriter, r *http.Request, id string) {
-	widget, ok := h.widgets[id]
-	if !ok {
-		log.Printf("unable to find widget with id %s", id)
-		writeJSONError(w, http.StatusNotFound, "The requested resource could not be located.")
-		return
-	}
-
-	var updWidget Widget
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&updWidget); err != nil {
-		log.Printf("unable to parse widget %s", err)
-		writeJSONError(w, http.StatusBadRequest, err.Error())
-		return
-	}
-
-	widget.Name = updWidget.Name
-	widget.Description = updWidget.Description
-	h.widgets[widget.ID] = widget
-
-	if err := writeJSON(w, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-	}
-}
-
-func (h WidgetHandler) delete(w http.ResponseWriter, r *http.Request, id string) {
-	widget, ok := h.widgets[id]
-	if !ok {
-		log.Printf("unable to find widget with id %s", id)
-		writeJSONError(w, http.StatusNotFound, "The requested resource could not be located.")
-		return
-	}
-	delete(h.widgets, id)
-
-	if err := writeJSON(w, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
-		writeJSONError(w, http.StatusInternalServerError, err.Error())
-	}
-}
-
-func writeJSON(w http.ResponseWriter, status int, payload interface{}) error {
-	log.Printf("writing json response code %d with payload %s", status, payload)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	return json.NewEncoder(w).Encode(payload)
-}
-
-func writeJSONError(w http.ResponseWriter, status int, message string) error {
-	return writeJSON(w, status, map[string]string{
-		"error": message,
-	})
-}
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	listenAddress = "0.0.0.0:4778"
+	version       = "0.0.1"
+)
+
+// Widget represents a generic object.
+type Widget struct {
+	ID string `json:"id"`
+
+	Name string `json:"name"`
+
+	Description string `json:"description"`
+
+	// Quantity is how many of the widget there are.
+	Quantity int `json:"quantity"`
+
+	// Status is the widget's lifecycle state: draft, active or retired.
+	Status string `json:"status"`
+
+	// Tags are short lowercase labels, kept in the order first given.
+	Tags []string `json:"tags,omitempty"`
+
+	// Attributes holds custom fields, as defined by the configured field
+	// definitions.
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+
+	// Revision counts the times the widget has been stored, starting at 1.
+	// It is set by the store.
+	Revision int `json:"revision"`
+
+	// CreatedAt and UpdatedAt are set by the store when the widget is first
+	// stored and whenever it is stored again.
+	CreatedAt Time `json:"created_at"`
+	UpdatedAt Time `json:"updated_at"`
+
+	// ClientToken is an optional token chosen by the client on create so that
+	// the create can be retried without making a duplicate widget.
+	ClientToken string `json:"client_token,omitempty"`
+
+	// OwnerID is the user that created the widget, taken from X-User.
+	OwnerID string `json:"owner_id,omitempty"`
+
+	// seq records the order in which the widget was created.
+	seq uint64
+}
+
+// WidgetHandler handles Widget requests.
+type WidgetHandler struct {
+	store  Store
+	ids    IDGenerator
+	cfg    Config
+	dedup  *createDeduper
+	waits  *waitLimit
+	router *router
+}
+
+// NewWidgetHandler will construct a new WidgetHandler backed by the given Store
+// that names new widgets using ids.
+func NewWidgetHandler(store Store, ids IDGenerator, cfg Config) WidgetHandler {
+	h := WidgetHandler{
+		store:  store,
+		ids:    ids,
+		cfg:    cfg,
+		dedup:  newCreateDeduper(cfg.DedupWindow),
+		waits:  newWaitLimit(cfg.MaxListWaiters),
+		router: newRouter(),
+	}
+
+	h.router.methodNotAllowed = h.methodNotAllowed
+	h.router.handle(http.MethodGet, "/widgets/", h.list)
+	h.router.handle(http.MethodPost, "/widgets/", h.create)
+	h.router.handle(http.MethodPatch, "/widgets/", h.bulkUpdate)
+	h.router.handle(http.MethodGet, "/widgets/export", h.export)
+	h.router.handle(http.MethodGet, "/widgets/stats", h.stats)
+	h.router.handle(http.MethodPost, "/widgets/reset", h.reset)
+	h.router.handle(http.MethodPost, "/widgets/validate", h.validate)
+	h.router.handle(http.MethodPost, "/widgets/validate-all", h.validateAll)
+	h.router.handle(http.MethodGet, "/widgets/{id}", withID(h.get))
+	h.router.handle(http.MethodPut, "/widgets/{id}", withID(h.update))
+	h.router.handle(http.MethodDelete, "/widgets/{id}", withID(h.delete))
+	h.router.handle("PURGE", "/widgets/{id}", withID(h.purge))
+	h.router.handle(http.MethodPost, "/widgets/{id}/clone", withID(h.clone))
+	h.router.handle(http.MethodGet, "/widgets/{id}/diff", withID(h.diff))
+	h.router.handle(http.MethodPost, "/widgets/{id}/quantity", withID(h.adjustQuantity))
+	h.router.handle(http.MethodPost, "/widgets/{id}/touch", withID(h.touch))
+	h.router.handle(http.MethodPost, "/widgets/{id}/rename", withID(h.rename))
+	h.router.handle(http.MethodGet, graphQLPath, h.graphql)
+	h.router.handle(http.MethodPost, graphQLPath, h.graphql)
+	return h
+}
+
+func (h WidgetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// responses depend on the owner filter, so shared caches must key on it
+	w.Header().Add("Vary", "X-User, Authorization")
+
+	// GraphQL queries are sent with POST too, so mutations are refused by
+	// the GraphQL handler instead.
+	if h.cfg.ReadOnly && !isReadMethod(r.Method) && r.URL.Path != graphQLPath {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		writeAPIError(w, r, http.StatusMethodNotAllowed, codeReadOnly, "The service is read-only, so widgets cannot be changed.")
+		return
+	}
+
+	if err := checkCharset(r.Header.Get("Content-Type")); err != nil {
+		writeJSONError(w, r, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+
+	h.router.ServeHTTP(w, r)
+}
+
+// methodNotAllowed explains the two common mistakes of creating a widget at a
+// chosen id and changing a widget without one, answering them with the
+// configured status. Any other method mismatch is a plain 405.
+func (h WidgetHandler) methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) {
+	segments := splitPath(r.URL.EscapedPath())
+
+	var message string
+	switch {
+	case r.Method == http.MethodPost && len(segments) == 2:
+		message = "Widgets cannot be created at a chosen id. POST to /widgets/ instead."
+	case len(segments) == 1 && (r.Method == http.MethodPut || r.Method == http.MethodDelete || r.Method == "PURGE"):
+		message = "A widget id is required in the path, as in /widgets/{id}."
+	default:
+		writeMethodNotAllowed(w, r, allowed)
+		return
+	}
+
+	if h.cfg.IDMismatchStatus == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
+	writeJSONError(w, r, h.cfg.IDMismatchStatus, message)
+}
+
+// isReadMethod reports whether method only reads, and so is allowed when the
+// service is read-only.
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkCharset rejects request bodies declared in a charset other than UTF-8.
+// Bodies without a declared charset are taken to be UTF-8.
+func checkCharset(contentType string) error {
+	if len(contentType) == 0 {
+		return nil
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return errors.New("The Content-Type header is not valid.")
+	}
+	switch strings.ToLower(params["charset"]) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return nil
+	}
+	return errors.New("The request body must be encoded as UTF-8.")
+}
+
+// withID adapts a handler that takes the widget id from the {id} path
+// parameter.
+func withID(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, pathParam(r, "id"))
+	}
+}
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Fatalf("invalid configuration: %s", err)
+	}
+	if len(cfg.LogFile) > 0 {
+		logFile, err := newRotatingWriter(cfg.LogFile, int64(cfg.LogMaxBytes), cfg.LogMaxFiles)
+		if err != nil {
+			log.Fatalf("unable to open log file %s", err)
+		}
+		defer logFile.Close()
+		if cfg.LogToStderr {
+			log.SetOutput(io.MultiWriter(logFile, os.Stderr))
+		} else {
+			log.SetOutput(logFile)
+		}
+	}
+
+	output := newOutputOptions(cfg)
+
+	ips, err := newClientIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("invalid configuration: %s", err)
+	}
+
+	ids, err := newIDGenerator(cfg.IDScheme, cfg.IDSequenceFile)
+	if err != nil {
+		log.Fatalf("invalid configuration: %s", err)
+	}
+
+	if cfg.EnableTestEndpoints {
+		log.Printf("warning: test endpoints are enabled")
+	}
+
+	var tracer trace.Tracer
+	if len(cfg.OTLPEndpoint) > 0 {
+		provider, err := newOTLPTracerProvider(cfg.OTLPEndpoint)
+		if err != nil {
+			log.Fatalf("invalid configuration: API_OTLP_ENDPOINT: %s", err)
+		}
+		defer stopTracing(provider, cfg.ShutdownTimeout)
+		tracer = provider.Tracer(tracerName)
+	}
+
+	var store Store = newMemoryStore()
+	if len(cfg.StoreFile) > 0 {
+		fs, err := openFileStore(cfg.StoreFile)
+		if err != nil {
+			log.Fatalf("unable to open store file %s", err)
+		}
+		widgetCount.Set(int64(len(fs.widgets)))
+		store = fs
+	}
+	if seq, ok := ids.(*sequenceGenerator); ok {
+		widgets, err := store.List(context.Background())
+		if err != nil {
+			log.Fatalf("unable to list stored widgets %s", err)
+		}
+		for _, widget := range widgets {
+			seq.skip(widget.ID)
+		}
+	}
+	if len(cfg.ArchiveFile) > 0 {
+		archive, err := openArchiveFile(cfg.ArchiveFile)
+		if err != nil {
+			log.Fatalf("unable to open archive file %s", err)
+		}
+		store = newArchivingStore(store, archive, cfg.ArchiveRequired)
+	}
+	if len(cfg.EncryptionKey) > 0 {
+		c, err := newFieldCipher(cfg.EncryptionKey)
+		if err != nil {
+			log.Fatalf("invalid configuration: API_ENCRYPTION_KEY: %s", err)
+		}
+		if store, err = newEncryptingStore(store, c, cfg.EncryptedFields); err != nil {
+			log.Fatalf("invalid configuration: API_ENCRYPTED_FIELDS: %s", err)
+		}
+	}
+	if cfg.CacheTTL > 0 {
+		store = newCachingStore(store, cfg.CacheTTL)
+	}
+	store = newCoalescingStore(store)
+	if len(cfg.WebhookURL) > 0 {
+		sender := newWebhookSender(cfg.WebhookURL, cfg.WebhookSecret, cfg.WebhookWorkers, cfg.WebhookQueueSize, cfg.WebhookBlockWhenFull, output)
+		store = newWebhookStore(store, sender)
+	}
+	if cfg.MaxWidgets > 0 {
+		if store, err = newCapacityStore(context.Background(), store, cfg.MaxWidgets, cfg.EvictWhenFull); err != nil {
+			log.Fatalf("unable to count stored widgets %s", err)
+		}
+	}
+	if tracer != nil {
+		store = newTracingStore(store, tracer)
+	}
+	if cfg.ServerTiming {
+		store = newTimingStore(store)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", root)
+	mux.HandleFunc("/livez", livez)
+	mux.HandleFunc("/ui", ui)
+	draining := &drainFlag{}
+	mux.Handle("/readyz", NewReadyHandler(store, draining))
+	mux.Handle("/debug/vars", expvar.Handler())
+	api := NewWidgetHandler(store, ids, cfg)
+	widgets := limitInFlight(chaos(cacheControl(api, readCachePolicy(cfg.ReadMaxAge)), cfg.Chaos), cfg.MaxInFlight)
+	mux.Handle("/widgets/", widgets)
+	mux.Handle(graphQLPath, widgets)
+
+	if cfg.Chaos.Enabled {
+		log.Printf("warning: chaos is enabled, widget requests will be delayed and failed at random")
+	}
+	if cfg.CORS.OriginsFile != nil {
+		cfg.CORS.OriginsFile.reloadOnHangup()
+	}
+
+	var recent *requestRing
+	if cfg.EnableRecentRequests {
+		log.Printf("warning: recent requests are exposed at /debug/requests")
+		recent = newRequestRing(cfg.RecentRequests)
+		mux.Handle("/debug/requests", recent)
+	}
+	mountPprof(mux, cfg.EnablePprof)
+
+	srv := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: withOutput(requestIDs(recordRequests(logRequests(serverTiming(traceRequests(gzipResponses(cors(securityHeaders(cacheControl(recoverPanics(requireAcceptable(limitBody(limitQuery(limitPath(mux, cfg.MaxPathLen), cfg.MaxQueryLen), int64(cfg.MaxBodyBytes)), cfg.StrictAccept, mimeNDJSON)), readCachePolicy(0)), cfg.Security), cfg.CORS), cfg.GzipLevel), tracer), cfg.ServerTiming), ips, cfg.SlowRequest), recent), cfg.RequestIDHeaders, cfg.RequestIDResponseHeader), output),
+	}
+
+	if len(cfg.GRPCListenAddress) > 0 {
+		grpcLn, err := net.Listen("tcp", cfg.GRPCListenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcSrv := newGRPCServer(api)
+		log.Printf("listening for gRPC connections at %s", grpcLn.Addr())
+		go func() {
+			if err := grpcSrv.Serve(grpcLn); err != nil {
+				log.Printf("gRPC server stopped %s", err)
+			}
+		}()
+		defer stopGRPC(grpcSrv, cfg.ShutdownTimeout)
+	}
+
+	ln, err := listen(cfg.ListenNetwork, cfg.ListenAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening for connections at %s", ln.Addr())
+	if err := serve(srv, ln, cfg.ShutdownTimeout, cfg.PreShutdownDelay, draining); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// root receives every request that no other route matched. Only the exact
+// path / is the index; anything else is not found.
+func root(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		notFound(w, r)
+		return
+	}
+	index(w, r)
+}
+
+// mountPprof registers the net/http/pprof handlers under /debug/pprof/ when
+// enabled, warning that they are exposed.
+func mountPprof(mux *http.ServeMux, enabled bool) {
+	if !enabled {
+		return
+	}
+	log.Printf("warning: pprof endpoints are exposed at /debug/pprof/")
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// notFound answers requests for paths that do not match any route.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, r, http.StatusNotFound, "The requested resource could not be located.")
+}
+
+// indexTimeLayout is the layout of time.Time's String method, which the index
+// timestamp has always used.
+const indexTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// indexVersion is the end of a JSON index response, with the version quoted
+// once rather than on every request.
+var indexVersion = func() string {
+	quoted, _ := json.Marshal(version)
+	return `","version":` + string(quoted) + "}\n"
+}()
+
+// indexBuffers holds the buffers JSON index responses are built in. The index
+// is polled by health checks, so it avoids allocating where it can.
+var indexBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 128)
+		return &b
+	},
+}
+
+func index(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, OPTIONS")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "Method not allowed for this resource.")
+		return
+	}
+
+	now := time.Now().In(outputFor(r).zone)
+	if mime, _ := negotiateFormat(r.Header.Get("Accept")); mime != mimeJSON {
+		payload := map[string]string{
+			"timestamp": now.Format(indexTimeLayout),
+			"version":   version,
+		}
+		if err := writeResponse(w, r, http.StatusOK, payload); err != nil {
+			writeInternalError(w, r, err)
+		}
+		return
+	}
+
+	// JSON, the common case, is written directly rather than encoded.
+	buf := indexBuffers.Get().(*[]byte)
+	b := append((*buf)[:0], `{"timestamp":"`...)
+	b = now.AppendFormat(b, indexTimeLayout)
+	b = append(b, indexVersion...)
+
+	h := w.Header()
+	h.Add("Vary", "Accept")
+	h.Set("Content-Type", mimeJSON)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		log.Printf("unable to write index %s", err)
+	}
+	*buf = b
+	indexBuffers.Put(buf)
+}
+
+func (h WidgetHandler) list(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["ids"]; ok {
+		h.batchGet(w, r)
+		return
+	}
+
+	p, err := parsePage(r.URL.Query(), h.cfg.DefaultPageSize, h.cfg.MaxPageSize)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	f, err := parseFilter(r.URL.Query(), h.cfg.DefaultSort, h.cfg.MaxListFilters)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	wait, err := parseWait(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The version is read before the list so that a change made in between
+	// can only make the ETag older than the list, never newer.
+	version, err := h.store.Version(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	q := requesterFor(r, h.cfg.AdminToken)
+	mime, _ := negotiateFormat(r.Header.Get("Accept"))
+	etag := listETag(version, q, r.URL.Query(), mime, outputFor(r))
+	setSurrogateKeys(w, surrogateCollectionKey)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); etagMatches(ifNoneMatch, etag) {
+		// A long poll holds the request until the list changes.
+		if wait == 0 {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if !h.waits.acquire() {
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, r, http.StatusServiceUnavailable, "Too many requests are waiting for changes. Try again without wait.")
+			return
+		}
+		// The waiter limit bounds long polls, so waiting does not hold
+		// one of the in-flight slots.
+		releaseInFlight(r)
+		err := waitForChange(r.Context(), h.store, wait, func(version uint64) bool {
+			etag = listETag(version, q, r.URL.Query(), mime, outputFor(r))
+			return !etagMatches(ifNoneMatch, etag)
+		})
+		h.waits.release()
+		if err == errWaitTimeout {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	w.Header().Set("ETag", etag)
+
+	stored, err := h.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	all := make([]Widget, 0)
+	for _, widget := range stored {
+		if q.canAccess(widget) && f.match(widget) {
+			all = append(all, widget)
+		}
+	}
+	f.order(all)
+	widgets, next := p.apply(all)
+	if len(f.sort) > 0 {
+		// Cursors follow insertion order, so sorted lists page by offset.
+		next = ""
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(all)))
+
+	fields := map[string]interface{}{}
+	if len(next) > 0 {
+		fields["next_cursor"] = next
+	}
+
+	// Only JSON is streamed; other formats encode the whole list at once.
+	if mime, f := negotiateFormat(r.Header.Get("Accept")); mime != mimeJSON {
+		fields["widgets"] = widgets
+		fields["count"] = len(widgets)
+		w.Header().Add("Vary", "Accept")
+		if err := writeFormatted(w, r, http.StatusOK, mime, f, fields); err != nil {
+			log.Printf("unable to write widgets %s", err)
+		}
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if err := writeWidgetStream(w, r, http.StatusOK, widgets, fields); err != nil {
+		log.Printf("unable to stream widgets %s", err)
+	}
+}
+
+// batchGetResult reports whether one of the ids in a batch get was found.
+type batchGetResult struct {
+	ID string `json:"id"`
+
+	Found bool `json:"found"`
+
+	Widget *Widget `json:"widget,omitempty"`
+}
+
+// batchGet returns the widgets named by the comma separated ids parameter, in
+// the order given, noting each id that was not found.
+func (h WidgetHandler) batchGet(w http.ResponseWriter, r *http.Request) {
+	if err := checkSingleValues(r.URL.Query(), "ids"); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); len(id) > 0 && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		writeJSONError(w, r, http.StatusBadRequest, "The ids parameter must list at least one id.")
+		return
+	}
+	if len(ids) > h.cfg.MaxBatchIDs {
+		writeJSONError(w, r, http.StatusBadRequest, fmt.Sprintf("The ids parameter must list at most %d ids.", h.cfg.MaxBatchIDs))
+		return
+	}
+
+	results := make([]batchGetResult, len(ids))
+	keys := []string{surrogateCollectionKey}
+	missing := 0
+	for i, id := range ids {
+		results[i].ID = id
+		widget, err := h.find(r, id)
+		if err == ErrNotFound {
+			missing++
+			continue
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		results[i].Found = true
+		results[i].Widget = &widget
+		keys = append(keys, widgetSurrogateKey(widget.ID))
+	}
+	setSurrogateKeys(w, keys...)
+
+	payload := map[string]interface{}{"results": results, "missing": missing}
+	if err := writeResponse(w, r, http.StatusOK, payload); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// find returns the widget with the given id when the requester may access it.
+// Widgets owned by someone else are reported as ErrNotFound.
+func (h WidgetHandler) find(r *http.Request, id string) (Widget, error) {
+	widget, err := h.store.Get(r.Context(), id)
+	if err != nil {
+		return Widget{}, err
+	}
+	if !requesterFor(r, h.cfg.AdminToken).canAccess(widget) {
+		return Widget{}, ErrNotFound
+	}
+	return widget, nil
+}
+
+func (h WidgetHandler) get(w http.ResponseWriter, r *http.Request, id string) {
+	widget, err := h.find(r, id)
+	if err != nil {
+		log.Printf("unable to find widget with id %s", id)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	setSurrogateKeys(w, widgetSurrogateKey(widget.ID))
+	if err := writeResponse(w, r, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+func (h WidgetHandler) create(w http.ResponseWriter, r *http.Request) {
+	widget, err := decodeWidgetWithDefaults(r.Body, h.cfg.Defaults, h.cfg.MaxJSONDepth)
+	if err != nil {
+		log.Printf("unable to parse widget %s", err)
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	widget, status, err := h.saveNew(w, r, widget)
+	if err != nil {
+		writeSaveError(w, r, err)
+		return
+	}
+	if err := writeResponse(w, r, status, h.withWarnings(w, r, widget)); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// saveNew validates and stores a decoded widget as create does, returning it
+// with 201, or with 200 when it was already created through its client token
+// or within the dedup window. REST creates, gRPC calls and GraphQL mutations
+// share it.
+func (h WidgetHandler) saveNew(w http.ResponseWriter, r *http.Request, widget Widget) (Widget, int, error) {
+	if len(widget.Status) == 0 {
+		widget.Status = statusDraft
+	}
+	widget = h.truncate(w, widget.normalizeTags())
+	if err := widget.Validate(h.cfg.Limits); err != nil {
+		log.Printf("invalid widget %s", err)
+		return widget, 0, statusError{status: http.StatusUnprocessableEntity, message: err.Error()}
+	}
+
+	widget.OwnerID = requesterFor(r, h.cfg.AdminToken).user
+
+	// Creates with a client token are already idempotent and may be meant
+	// as distinct widgets, so only those without one are deduplicated.
+	key := dedupKey(widget)
+	if len(widget.ClientToken) == 0 {
+		if id, ok := h.dedup.lookup(key); ok {
+			if existing, err := h.store.Get(r.Context(), id); err == nil {
+				log.Printf("widget %s already created within the dedup window", id)
+				return existing, http.StatusOK, nil
+			}
+		}
+	}
+
+	id, err := h.ids.NewID()
+	if err != nil {
+		log.Printf("unable to generate id %s", err)
+		return widget, 0, err
+	}
+	widget.ID = id
+
+	widget, created, err := h.store.Create(r.Context(), widget)
+	if err != nil {
+		return widget, 0, err
+	}
+	if !created {
+		log.Printf("widget %s already exists for client token %s", widget.ID, widget.ClientToken)
+		return widget, http.StatusOK, nil
+	}
+	recordCreate()
+	if len(widget.ClientToken) == 0 {
+		h.dedup.remember(key, widget.ID)
+	}
+	return widget, http.StatusCreated, nil
+}
+
+func (h WidgetHandler) update(w http.ResponseWriter, r *http.Request, id string) {
+	var updWidget Widget
+	if err := decodeJSON(r.Body, &updWidget, h.cfg.MaxJSONDepth); err != nil {
+		log.Printf("unable to parse widget %s", err)
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	widget, warnings, err := h.saveChanges(w, r, id, updWidget.Revision, replacing(updWidget))
+	if err != nil {
+		writeSaveError(w, r, err)
+		return
+	}
+	if err := writeResponse(w, r, http.StatusOK, h.withWarnings(w, r, widget, warnings...)); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// replacing returns the change an update makes: every field a client sets is
+// replaced by that of replacement, except that an empty status is kept.
+func replacing(replacement Widget) func(Widget) Widget {
+	return func(widget Widget) Widget {
+		widget.Name = replacement.Name
+		widget.Description = replacement.Description
+		widget.Quantity = replacement.Quantity
+		widget.Tags = replacement.Tags
+		widget.Attributes = replacement.Attributes
+		if len(replacement.Status) > 0 {
+			widget.Status = replacement.Status
+		}
+		return widget
+	}
+}
+
+// saveChanges applies change to the widget with the given id and stores it as
+// update does, returning the stored widget and any warnings about the update.
+// A revision other than zero is the one the client read; updates based on an
+// older one are handled as configured by StaleUpdates. REST updates, gRPC
+// calls and GraphQL mutations share it.
+func (h WidgetHandler) saveChanges(w http.ResponseWriter, r *http.Request, id string, revision int, change func(Widget) Widget) (Widget, []string, error) {
+	widget, err := h.find(r, id)
+	if err != nil {
+		log.Printf("unable to find widget with id %s", id)
+		return widget, nil, err
+	}
+
+	// If the widget has been stored since the given revision, the update
+	// would overwrite a change the client never saw.
+	var warnings []string
+	if revision > 0 && revision != widget.Revision {
+		switch h.cfg.StaleUpdates {
+		case staleReject:
+			return widget, nil, staleRevisionError(widget.Revision, revision)
+		case staleWarn:
+			warnings = append(warnings, fmt.Sprintf("The widget was changed after revision %d was read.", revision))
+		}
+	}
+
+	previous := widget.Status
+	widget = h.truncate(w, change(widget).normalizeTags())
+	if err := widget.Validate(h.cfg.Limits); err != nil {
+		log.Printf("invalid widget %s", err)
+		return widget, nil, statusError{status: http.StatusUnprocessableEntity, message: err.Error()}
+	}
+	if err := checkTransition(previous, widget.Status); err != nil {
+		return widget, nil, statusError{status: http.StatusConflict, code: clientErrorCode(err), message: err.Error()}
+	}
+
+	if h.cfg.StaleUpdates == staleReject && revision > 0 {
+		// Check again as the widget is stored, in case another update
+		// got in since it was read.
+		replacement := widget
+		var current int
+		widget, err = h.store.Update(r.Context(), id, func(stored Widget) (Widget, error) {
+			if current = stored.Revision; current != revision {
+				return stored, errStaleRevision
+			}
+			return replacement, nil
+		})
+		if errors.Is(err, errStaleRevision) {
+			return widget, nil, staleRevisionError(current, revision)
+		}
+	} else {
+		widget, err = h.store.Put(r.Context(), widget)
+	}
+	return widget, warnings, err
+}
+
+// writeSaveError writes the response for an error from saveNew or
+// saveChanges: the carried status for a statusError and the store's status
+// for anything else.
+func writeSaveError(w http.ResponseWriter, r *http.Request, err error) {
+	var serr statusError
+	if errors.As(err, &serr) {
+		writeAPIError(w, r, serr.status, clientErrorCode(serr), serr.message)
+		return
+	}
+	writeStoreError(w, r, err)
+}
+
+// withWarnings returns the response payload for a stored widget, listing any
+// warnings about it, after the given ones, both in the payload and in Warning
+// headers.
+func (h WidgetHandler) withWarnings(w http.ResponseWriter, r *http.Request, widget Widget, warnings ...string) map[string]interface{} {
+	payload := map[string]interface{}{"widget": widget}
+	warnings = append(warnings, widget.Warnings(h.cfg.Limits)...)
+	if len(warnings) == 0 {
+		return payload
+	}
+
+	translated := make([]string, len(warnings))
+	for i, warning := range warnings {
+		// Header values stay in English, since they must be ASCII.
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", warning))
+		translated[i] = translate(r, warning)
+	}
+	payload["warnings"] = translated
+	return payload
+}
+
+func (h WidgetHandler) delete(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.find(r, id); err != nil {
+		log.Printf("unable to find widget with id %s", id)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	widget, err := h.store.Delete(r.Context(), id)
+	if err != nil {
+		log.Printf("unable to delete widget with id %s", id)
+		writeStoreError(w, r, err)
+		return
+	}
+	recordDelete()
+
+	if err := writeResponse(w, r, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// truncatedHeader lists the fields that were shortened to fit their limits.
+const truncatedHeader = "X-Truncated-Fields"
+
+// truncate shortens an over-long description when truncation is enabled,
+// noting it in the response headers. Otherwise the widget is left for
+// validation to reject.
+func (h WidgetHandler) truncate(w http.ResponseWriter, widget Widget) Widget {
+	if !h.cfg.TruncateDescription {
+		return widget
+	}
+	widget, truncated := widget.truncateDescription(h.cfg.Limits.MaxDescriptionLen)
+	if truncated {
+		w.Header().Set(truncatedHeader, "description")
+	}
+	return widget
+}
+
+// validate checks a widget body the way create would, without storing
+// anything. It responds {"valid": true}, or 422 with the violations found.
+func (h WidgetHandler) validate(w http.ResponseWriter, r *http.Request) {
+	widget, err := decodeWidgetWithDefaults(r.Body, h.cfg.Defaults, h.cfg.MaxJSONDepth)
+	if err == nil {
+		if len(widget.Status) == 0 {
+			widget.Status = statusDraft
+		}
+		widget = h.truncate(w, widget.normalizeTags())
+		err = widget.Validate(h.cfg.Limits)
+	}
+
+	var verr ValidationError
+	if errors.As(err, &verr) {
+		violations := make([]string, len(verr.Violations))
+		for i, violation := range verr.Violations {
+			violations[i] = translate(r, violation)
+		}
+		if err := writeResponse(w, r, http.StatusUnprocessableEntity, map[string]interface{}{
+			"valid":      false,
+			"violations": violations,
+		}); err != nil {
+			log.Printf("unable to write validation result %s", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("unable to parse widget %s", err)
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	if err := writeResponse(w, r, http.StatusOK, map[string]bool{"valid": true}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// invalidWidget reports why a stored widget fails validation.
+type invalidWidget struct {
+	ID string `json:"id"`
+
+	Violations []string `json:"violations"`
+}
+
+// validateAll checks every stored widget against the current limits and
+// reports those that fail, such as after the limits were tightened. Nothing
+// is changed. It requires the admin token.
+func (h WidgetHandler) validateAll(w http.ResponseWriter, r *http.Request) {
+	if !requesterFor(r, h.cfg.AdminToken).admin {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, r, http.StatusUnauthorized, "Valid credentials are required for this resource.")
+		return
+	}
+
+	widgets, err := h.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	invalid := make([]invalidWidget, 0)
+	for _, widget := range widgets {
+		var verr ValidationError
+		if err := widget.Validate(h.cfg.Limits); errors.As(err, &verr) {
+			violations := make([]string, len(verr.Violations))
+			for i, violation := range verr.Violations {
+				violations[i] = translate(r, violation)
+			}
+			invalid = append(invalid, invalidWidget{ID: widget.ID, Violations: violations})
+		}
+	}
+	log.Printf("validated %d stored widgets, %d invalid", len(widgets), len(invalid))
+
+	if err := writeResponse(w, r, http.StatusOK, map[string]interface{}{
+		"checked": len(widgets),
+		"invalid": invalid,
+	}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// cloneRequest is the optional body of a clone request.
+type cloneRequest struct {
+	Name *string `json:"name"`
+}
+
+// clone creates a new widget from the fields of the widget with the given id.
+// The new widget gets a fresh id, belongs to the requester and has no client
+// token. The body may override the name; an empty body copies it as is.
+func (h WidgetHandler) clone(w http.ResponseWriter, r *http.Request, id string) {
+	source, err := h.find(r, id)
+	if err != nil {
+		log.Printf("unable to find widget with id %s", id)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	var req cloneRequest
+	if err := decodeJSON(r.Body, &req, h.cfg.MaxJSONDepth); err != nil && err != io.EOF {
+		log.Printf("unable to parse clone request %s", err)
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	widget := Widget{Name: source.Name, Description: source.Description, Quantity: source.Quantity, Tags: source.Tags, Attributes: source.Attributes, Status: statusDraft}
+	if req.Name != nil {
+		widget.Name = *req.Name
+	}
+
+	if err := widget.Validate(h.cfg.Limits); err != nil {
+		log.Printf("invalid widget %s", err)
+		writeJSONError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	widget.ID, err = h.ids.NewID()
+	if err != nil {
+		log.Printf("unable to generate id %s", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	widget.OwnerID = requesterFor(r, h.cfg.AdminToken).user
+
+	widget, _, err = h.store.Create(r.Context(), widget)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	recordCreate()
+
+	if err := writeResponse(w, r, http.StatusCreated, map[string]Widget{"widget": widget}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// quantityAdjustment is the body of a quantity adjustment.
+type quantityAdjustment struct {
+	Delta *int `json:"delta"`
+}
+
+// Ways of handling a PUT whose body names a revision older than the stored
+// one.
+const (
+	staleIgnore = "ignore"
+	staleWarn   = "warn"
+	staleReject = "reject"
+)
+
+// errStaleRevision is returned when the stored widget is no longer at the
+// revision an update was based on.
+var errStaleRevision = errors.New("widget revision is stale")
+
+// staleRevisionError is the 409 for an update based on an old revision.
+func staleRevisionError(current, given int) error {
+	return statusError{status: http.StatusConflict, code: codeStaleRevision, message: fmt.Sprintf("The widget is at revision %d, not %d. Get it again before updating.", current, given)}
+}
+
+// errNegativeQuantity is returned when an adjustment would take a quantity
+// below zero.
+var errNegativeQuantity = errors.New("quantity would be negative")
+
+// adjustQuantity adds delta to the quantity of the widget with the given id.
+// The change is made atomically in the store, so concurrent adjustments never
+// lose each other's updates. An adjustment below zero is a conflict.
+func (h WidgetHandler) adjustQuantity(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.find(r, id); err != nil {
+		log.Printf("unable to find widget with id %s", id)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	var adj quantityAdjustment
+	if err := decodeJSON(r.Body, &adj, h.cfg.MaxJSONDepth); err != nil {
+		log.Printf("unable to parse quantity adjustment %s", err)
+		writeDecodeError(w, r, err)
+		return
+	}
+	if adj.Delta == nil {
+		writeJSONError(w, r, http.StatusUnprocessableEntity, "The delta field is required.")
+		return
+	}
+
+	widget, err := h.store.Update(r.Context(), id, func(widget Widget) (Widget, error) {
+		quantity := widget.Quantity + *adj.Delta
+		if quantity < 0 {
+			return widget, errNegativeQuantity
+		}
+		widget.Quantity = quantity
+		return widget, widget.Validate(h.cfg.Limits)
+	})
+	if err != nil {
+		var verr ValidationError
+		switch {
+		case errors.Is(err, errNegativeQuantity):
+			writeAPIError(w, r, http.StatusConflict, codeNegativeQuantity, "The quantity cannot go below zero.")
+		case errors.As(err, &verr):
+			writeJSONError(w, r, http.StatusUnprocessableEntity, verr.Error())
+		default:
+			writeStoreError(w, r, err)
+		}
+		return
+	}
+
+	if err := writeResponse(w, r, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// touch marks the widget with the given id as modified without changing any
+// of its fields. Storing it again moves UpdatedAt to now and bumps its
+// revision and the store version, so ETags change too.
+func (h WidgetHandler) touch(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := h.find(r, id); err != nil {
+		log.Printf("unable to find widget with id %s", id)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	widget, err := h.store.Update(r.Context(), id, func(widget Widget) (Widget, error) {
+		return widget, nil
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if err := writeResponse(w, r, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// renameRequest is the body of a rename request.
+type renameRequest struct {
+	ID *string `json:"id"`
+}
+
+// maxIDLen is the most characters a widget id chosen by a rename may have.
+const maxIDLen = 64
+
+// checkNewID returns why id cannot be given to a widget, or nil. Ids are
+// limited to unreserved URL characters so they never need escaping, may not
+// shadow a fixed path such as /widgets/stats, and may not be made only of
+// digits, since the sequence scheme could later hand out the same id to a new
+// widget.
+func (h WidgetHandler) checkNewID(id string) error {
+	if len(id) > maxIDLen {
+		return fmt.Errorf("The id must be at most %d characters.", maxIDLen)
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+		default:
+			return errors.New("The id may only use letters, digits, hyphens, underscores, dots and tildes.")
+		}
+	}
+	if id == "." || id == ".." {
+		return fmt.Errorf("The id %s is reserved.", id)
+	}
+	if strings.Trim(id, "0123456789") == "" {
+		return errors.New("The id may not be made only of digits.")
+	}
+	for _, route := range h.router.routes {
+		if len(route.segments) == 2 && route.segments[1] == id {
+			return fmt.Errorf("The id %s is reserved.", id)
+		}
+	}
+	return nil
+}
+
+// rename moves the widget with the given id to the id in the body, answering
+// with the moved widget and its new Location. The store moves the widget in
+// one step as a new revision, so it keeps its history and creation time.
+func (h WidgetHandler) rename(w http.ResponseWriter, r *http.Request, id string) {
+	widget, err := h.find(r, id)
+	if err != nil {
+		log.Printf("unable to find widget with id %s", id)
+		writeStoreError(w, r, err)
+		return
+	}
+
+	var req renameRequest
+	if err := decodeJSON(r.Body, &req, h.cfg.MaxJSONDepth); err != nil {
+		log.Printf("unable to parse rename request %s", err)
+		writeDecodeError(w, r, err)
+		return
+	}
+	if req.ID == nil || len(*req.ID) == 0 {
+		writeJSONError(w, r, http.StatusUnprocessableEntity, "The id field is required.")
+		return
+	}
+	newID := *req.ID
+	if err := h.checkNewID(newID); err != nil {
+		writeJSONError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	if newID != id {
+		renamer, ok := h.store.(Renamer)
+		if !ok {
+			writeJSONError(w, r, http.StatusNotImplemented, "The store cannot rename widgets.")
+			return
+		}
+		widget, err = renamer.Rename(r.Context(), id, newID)
+		switch {
+		case errors.Is(err, ErrConflict):
+			writeIDTaken(w, r, newID)
+			return
+		case errors.Is(err, ErrNoRename):
+			writeJSONError(w, r, http.StatusNotImplemented, "The store cannot rename widgets.")
+			return
+		case err != nil:
+			writeStoreError(w, r, err)
+			return
+		}
+		log.Printf("renamed widget %s to %s", id, newID)
+	}
+
+	w.Header().Set("Location", "/widgets/"+widget.ID)
+	if err := writeResponse(w, r, http.StatusOK, map[string]Widget{"widget": widget}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// writeIDTaken writes the 409 for a rename to an id another widget holds.
+func writeIDTaken(w http.ResponseWriter, r *http.Request, id string) {
+	writeAPIError(w, r, http.StatusConflict, codeIDTaken, fmt.Sprintf("The id %s is already taken.", id))
+}
+
+// purge evicts the widget with the given id from the store's cache, if it has
+// one, without deleting the widget. It requires the admin token.
+func (h WidgetHandler) purge(w http.ResponseWriter, r *http.Request, id string) {
+	if !requesterFor(r, h.cfg.AdminToken).admin {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, r, http.StatusUnauthorized, "Valid credentials are required for this resource.")
+		return
+	}
+
+	if purger, ok := h.store.(Purger); ok {
+		purger.Purge(id)
+	}
+
+	if err := writeResponse(w, r, http.StatusOK, map[string]string{"purged": id}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// reset removes every widget and restarts the id sequence. It exists for
+// integration tests and is not found unless test endpoints are enabled.
+func (h WidgetHandler) reset(w http.ResponseWriter, r *http.Request) {
+	if !h.cfg.EnableTestEndpoints {
+		notFound(w, r)
+		return
+	}
+
+	if err := h.store.Reset(r.Context()); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if ids, ok := h.ids.(resetter); ok {
+		ids.Reset()
+	}
+	widgetCount.Set(0)
+	log.Printf("store reset by test endpoint")
+
+	if err := writeResponse(w, r, http.StatusOK, map[string]bool{"reset": true}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// widgetChanges is a partial update to a Widget. Only the fields present are
+// applied.
+type widgetChanges struct {
+	Name *string `json:"name"`
+
+	Description *string `json:"description"`
+
+	Quantity *int `json:"quantity"`
+
+	Status *string `json:"status"`
+
+	Tags *[]string `json:"tags"`
+
+	// Attributes replaces all of the widget's attributes, not just those
+	// given.
+	Attributes *map[string]interface{} `json:"attributes"`
+}
+
+// apply returns a copy of the given widget with the changes applied.
+func (c widgetChanges) apply(widget Widget) Widget {
+	if c.Name != nil {
+		widget.Name = *c.Name
+	}
+	if c.Description != nil {
+		widget.Description = *c.Description
+	}
+	if c.Quantity != nil {
+		widget.Quantity = *c.Quantity
+	}
+	if c.Status != nil {
+		widget.Status = *c.Status
+	}
+	if c.Tags != nil {
+		widget.Tags = *c.Tags
+	}
+	if c.Attributes != nil {
+		widget.Attributes = *c.Attributes
+	}
+	return widget
+}
+
+// bulkUpdateItem is a single entry in a bulk update request.
+type bulkUpdateItem struct {
+	ID string `json:"id"`
+
+	Changes json.RawMessage `json:"changes"`
+}
+
+// bulkUpdateResult reports the outcome of a single bulk update entry.
+type bulkUpdateResult struct {
+	ID string `json:"id"`
+
+	Success bool `json:"success"`
+
+	Widget *Widget `json:"widget,omitempty"`
+
+	Code string `json:"code,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// bulkUpdate applies partial updates to many widgets. Each entry is validated
+// and applied independently unless the atomic query parameter is set, in which
+// case nothing is applied if any entry fails validation, and entries already
+// stored are rolled back if storing a later one fails.
+func (h WidgetHandler) bulkUpdate(w http.ResponseWriter, r *http.Request) {
+	if err := checkSingleValues(r.URL.Query(), "atomic"); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	atomic := false
+	if v := r.URL.Query().Get("atomic"); len(v) > 0 {
+		var err error
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "The atomic parameter must be a boolean.")
+			return
+		}
+	}
+
+	var items []bulkUpdateItem
+	if err := decodeJSON(r.Body, &items, h.cfg.MaxJSONDepth); err != nil {
+		log.Printf("unable to parse bulk update %s", err)
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	results := make([]bulkUpdateResult, len(items))
+	updated := make([]Widget, len(items))
+	pending := make(map[string]Widget, len(items))
+	originals := make(map[string]Widget, len(items))
+	failed := 0
+	for i, item := range items {
+		results[i].ID = item.ID
+
+		widget, err := h.prepareBulkUpdate(w, r, item, pending, originals)
+		if err != nil {
+			results[i].Code = clientErrorCode(err)
+			results[i].Error = translate(r, err.Error())
+			failed++
+			continue
+		}
+		updated[i] = widget
+		pending[widget.ID] = widget
+		results[i].Success = true
+	}
+
+	if atomic && failed > 0 {
+		for i := range results {
+			if results[i].Success {
+				results[i].Success = false
+				results[i].Code = codeNotApplied
+				results[i].Error = translate(r, "Not applied because another update in the batch failed.")
+			}
+		}
+		writeNotApplied(w, r, http.StatusUnprocessableEntity, results)
+		return
+	}
+
+	var stored []string
+	for i := range results {
+		if !results[i].Success {
+			continue
+		}
+		widget, err := h.store.Put(r.Context(), updated[i])
+		if err != nil {
+			status, message := storeErrorStatus(err)
+			results[i].Success = false
+			results[i].Code = errorCode(status)
+			results[i].Error = translate(r, message)
+			failed++
+			if atomic {
+				h.rollBack(r.Context(), stored, originals)
+				for j := range results {
+					if j != i {
+						results[j].Success = false
+						results[j].Widget = nil
+						results[j].Code = codeNotApplied
+						results[j].Error = translate(r, "Not applied because another update in the batch failed.")
+					}
+				}
+				writeNotApplied(w, r, status, results)
+				return
+			}
+			continue
+		}
+		results[i].Widget = &widget
+		stored = append(stored, widget.ID)
+	}
+
+	payload := map[string]interface{}{
+		"results": results,
+		"failed":  failed,
+	}
+
+	if err := writeResponse(w, r, http.StatusOK, payload); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// writeNotApplied writes the response for an atomic bulk update that was not
+// applied, where every entry counts as failed.
+func writeNotApplied(w http.ResponseWriter, r *http.Request, status int, results []bulkUpdateResult) {
+	if err := writeResponse(w, r, status, map[string]interface{}{
+		"results": results,
+		"failed":  len(results),
+	}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// rollBack puts back the originals of the widgets with the given ids, most
+// recently stored first, after an atomic bulk update failed partway. A widget
+// that cannot be put back is logged, since the batch has already failed.
+func (h WidgetHandler) rollBack(ctx context.Context, ids []string, originals map[string]Widget) {
+	restored := make(map[string]bool, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		if restored[id] {
+			continue
+		}
+		restored[id] = true
+		if _, err := h.store.Put(ctx, originals[id]); err != nil {
+			log.Printf("unable to roll back widget %s %s", id, err)
+		}
+	}
+}
+
+// prepareBulkUpdate validates a bulk update entry and returns the widget with
+// its changes applied, without storing it. Widgets already changed earlier in
+// the batch are taken from pending so that their changes accumulate, and each
+// widget is recorded in originals as it was first found.
+func (h WidgetHandler) prepareBulkUpdate(w http.ResponseWriter, r *http.Request, item bulkUpdateItem, pending map[string]Widget, originals map[string]Widget) (Widget, error) {
+	if len(item.ID) <= 0 {
+		return Widget{}, errors.New("The id field is required.")
+	}
+
+	widget, ok := pending[item.ID]
+	if !ok {
+		var err error
+		if widget, err = h.find(r, item.ID); err != nil {
+			status, message := storeErrorStatus(err)
+			return Widget{}, statusError{status: status, message: message}
+		}
+		if _, ok := originals[item.ID]; !ok {
+			originals[item.ID] = widget
+		}
+	}
+
+	if len(item.Changes) <= 0 {
+		return Widget{}, errors.New("The changes field is required.")
+	}
+
+	var changes widgetChanges
+	decoder := json.NewDecoder(bytes.NewReader(item.Changes))
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	if err := decoder.Decode(&changes); err != nil {
+		return Widget{}, err
+	}
+
+	previous := widget.Status
+	widget = h.truncate(w, changes.apply(widget).normalizeTags())
+	if err := widget.Validate(h.cfg.Limits); err != nil {
+		return Widget{}, err
+	}
+	if err := checkTransition(previous, widget.Status); err != nil {
+		return Widget{}, err
+	}
+	return widget, nil
+}
+
+// decodeJSON decodes a JSON request body into v. When the body is an array but
+// v expects an object, or the other way around, a descriptive error is returned
+// instead of the decoder's type error. A body that is not valid UTF-8 is
+// reported as a ValidationError, since the decoder would otherwise replace the
+// invalid bytes without telling anyone. Objects and arrays may nest at most
+// maxDepth levels deep, since encoding/json sets no limit of its own.
+func decodeJSON(body io.Reader, v interface{}, maxDepth int) error {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(b) {
+		return ValidationError{Violations: []string{"The request body must be valid UTF-8."}}
+	}
+	if jsonDepth(b) > maxDepth {
+		return fmt.Errorf("The request body must be nested at most %d levels deep.", maxDepth)
+	}
+
+	trimmed := bytes.TrimLeft(b, " \t\r\n")
+	if len(trimmed) > 0 {
+		wantArray := isSliceTarget(v)
+		if trimmed[0] == '[' && !wantArray {
+			return errors.New("The request body must be a JSON object, not an array.")
+		}
+		if trimmed[0] == '{' && wantArray {
+			return errors.New("The request body must be a JSON array, not an object.")
+		}
+	}
+
+	// Numbers decoded into interface{} stay json.Number rather than float64,
+	// so large integers are never rounded.
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// decodeWidgetWithDefaults decodes a widget from a JSON request body. Fields
+// missing from the body are taken from defaults; fields the client sent, even
+// as empty values, are kept.
+func decodeWidgetWithDefaults(body io.Reader, defaults map[string]json.RawMessage, maxDepth int) (Widget, error) {
+	var widget Widget
+
+	var fields map[string]json.RawMessage
+	if err := decodeJSON(body, &fields, maxDepth); err != nil {
+		return widget, err
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage, len(defaults))
+	}
+	for key, value := range defaults {
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return widget, err
+	}
+	err = unmarshalNumbers(b, &widget)
+	return widget, err
+}
+
+// unmarshalNumbers is json.Unmarshal, except that numbers decoded into
+// interface{} stay json.Number, as they do in decodeJSON. Widgets decoded
+// again after being encoded use it so that large integer attributes are not
+// rounded on the way.
+func unmarshalNumbers(b []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// writeStoreError writes the response for an error returned by the store.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := storeErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		writeInternalError(w, r, err)
+		return
+	}
+	if status == http.StatusServiceUnavailable {
+		log.Printf("store error %s", err)
+	}
+	writeJSONError(w, r, status, message)
+}
+
+// storeErrorStatus maps an error returned by the store to an HTTP status and
+// a message for the client. Unknown errors are internal server errors.
+func storeErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, "The requested resource could not be located."
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, "The request conflicts with the current state of the resource."
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable, "The service is temporarily unavailable."
+	case errors.Is(err, ErrFull):
+		return http.StatusInsufficientStorage, "No more widgets can be stored."
+	}
+	return http.StatusInternalServerError, internalErrorMessage
+}
+
+// writeDecodeError writes the response for a request body that could not be
+// decoded: 422 for a ValidationError, the carried status for a statusError
+// such as a body over the size limit, and 400 for anything else.
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(ValidationError); ok {
+		writeJSONError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	var serr statusError
+	if errors.As(err, &serr) {
+		writeAPIError(w, r, serr.status, clientErrorCode(serr), serr.message)
+		return
+	}
+	writeJSONError(w, r, http.StatusBadRequest, err.Error())
+}
+
+// jsonDepth returns how deeply the objects and arrays in b nest, without
+// decoding it. Brackets inside strings are skipped.
+func jsonDepth(b []byte) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, c := range b {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			if depth++; depth > deepest {
+				deepest = depth
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+// isSliceTarget reports whether v is a pointer to a slice.
+func isSliceTarget(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	return t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice
+}
+
+// writeJSON writes payload as JSON whatever the client accepts. It is used for
+// errors and other responses that are not negotiated.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, payload interface{}) error {
+	return writeFormatted(w, r, status, mimeJSON, formatters[mimeJSON], payload)
+}
+
+// streamFlushEvery is how many widgets writeWidgetStream writes between
+// flushes. Each flush also ends a compressed block when the response is
+// gzipped, so flushing after every widget would undo most of the compression.
+const streamFlushEvery = 50
+
+// writeWidgetStream writes widgets as {"widgets":[...],"count":n} followed by
+// any extra fields. Widgets are encoded one at a time so a large list is
+// never buffered in full. The opening is flushed right away so the first
+// bytes are sent, and then every streamFlushEvery widgets. The count is
+// written after the widgets, once it is known.
+func writeWidgetStream(w http.ResponseWriter, r *http.Request, status int, widgets []Widget, fields map[string]interface{}) error {
+	output := outputFor(r)
+	log.Printf("streaming json response code %d with %d widgets", status, len(widgets))
+	w.Header().Set("Content-Type", mimeJSON)
+	w.WriteHeader(status)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	if _, err := fmt.Fprintf(w, `{"%s":[`, output.fieldName("widgets")); err != nil {
+		return err
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+	count := 0
+	for _, widget := range widgets {
+		if count > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(output.apply(widget)); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%streamFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+
+	fields["count"] = count
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := json.Marshal(output.apply(fields[key]))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, `,"%s":%s`, output.fieldName(key), value); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
+
+// writeJSONError writes an error response with the default code for status.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, message string) error {
+	return writeAPIError(w, r, status, errorCode(status), message)
+}
+
+// writeAPIError writes an error response as {"code": code, "error": message},
+// with the message in the client's language.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code string, message string) error {
+	w.Header().Add("Vary", "Accept-Language")
+	return writeJSON(w, r, status, map[string]string{
+		"code":  code,
+		"error": translate(r, message),
+	})
+}
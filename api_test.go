@@ -0,0 +1,1006 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkResponse is the body of a bulk update response.
+type bulkResponse struct {
+	Results []bulkUpdateResult `json:"results"`
+	Failed  int                `json:"failed"`
+}
+
+func TestBulkUpdateReportsMixedResults(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+
+	w := do(h, http.MethodPatch, "/widgets/", `[{"id":"`+a.ID+`","changes":{"quantity":5}},{"id":"missing","changes":{"quantity":1}},{"id":"`+a.ID+`","changes":{"quantity":-1}}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var resp bulkResponse
+	decodeBody(t, w, &resp)
+	if resp.Failed != 2 {
+		t.Errorf("got %d failed, want 2", resp.Failed)
+	}
+	if r := resp.Results[0]; !r.Success || r.Widget == nil || r.Widget.Quantity != 5 {
+		t.Errorf("first result %+v, want quantity 5", r)
+	}
+	if r := resp.Results[1]; r.Success || r.Code != codeNotFound {
+		t.Errorf("second result %+v, want not found", r)
+	}
+	if r := resp.Results[2]; r.Success || r.Code != codeValidationFailed {
+		t.Errorf("third result %+v, want a validation failure", r)
+	}
+}
+
+func TestBulkUpdateAccumulatesChangesToOneWidget(t *testing.T) {
+	store := newMemoryStore()
+	h := newTestHandler(t, store, nil)
+	a := createWidget(t, h, `{"name":"a","description":"old"}`)
+
+	w := do(h, http.MethodPatch, "/widgets/", `[{"id":"`+a.ID+`","changes":{"name":"a2"}},{"id":"`+a.ID+`","changes":{"description":"new"}}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if got, _ := store.Get(context.Background(), a.ID); got.Name != "a2" || got.Description != "new" {
+		t.Errorf("got %+v, want both changes applied", got)
+	}
+}
+
+func TestBulkUpdateAtomicAppliesNothingWhenOneIsInvalid(t *testing.T) {
+	store := newMemoryStore()
+	h := newTestHandler(t, store, nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+	b := createWidget(t, h, `{"name":"b"}`)
+
+	w := do(h, http.MethodPatch, "/widgets/?atomic=true", `[{"id":"`+a.ID+`","changes":{"quantity":5}},{"id":"`+b.ID+`","changes":{"quantity":-1}}]`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want 422: %s", w.Code, w.Body.String())
+	}
+	var resp bulkResponse
+	decodeBody(t, w, &resp)
+	if resp.Failed != 2 || resp.Results[0].Code != codeNotApplied {
+		t.Errorf("got results %+v, want every entry failed", resp.Results)
+	}
+	if got, _ := store.Get(context.Background(), a.ID); got.Quantity != 0 || got.Revision != 1 {
+		t.Errorf("first widget was changed to %+v", got)
+	}
+}
+
+func TestBodyShapeMismatches(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+
+	for _, tc := range []struct {
+		method, target, body, want string
+	}{
+		{http.MethodPatch, "/widgets/", `{"id":"` + a.ID + `","changes":{"quantity":5}}`, "must be a JSON array, not an object"},
+		{http.MethodPost, "/widgets/", `[{"name":"b"}]`, "must be a JSON object, not an array"},
+		{http.MethodPut, "/widgets/" + a.ID, ` [{"name":"b"}]`, "must be a JSON object, not an array"},
+	} {
+		e := expectError(t, do(h, tc.method, tc.target, tc.body), http.StatusBadRequest, codeBadRequest)
+		if !strings.Contains(e.Error, tc.want) {
+			t.Errorf("%s %s: got %q, want it to say the body %s", tc.method, tc.target, e.Error, tc.want)
+		}
+	}
+}
+
+func TestListStreamParses(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		createWidget(t, h, `{"name":"`+name+`","description":"`+name+`, \"quoted\"]"}`)
+	}
+
+	w := do(h, http.MethodGet, "/widgets/?limit=2", "")
+	if w.Code != http.StatusOK || !w.Flushed {
+		t.Fatalf("got status %d, flushed %t", w.Code, w.Flushed)
+	}
+	var resp struct {
+		Widgets    []Widget `json:"widgets"`
+		Count      int      `json:"count"`
+		NextCursor string   `json:"next_cursor"`
+	}
+	decodeBody(t, w, &resp)
+	if widgetNames(resp.Widgets) != "a,b" || resp.Count != 2 || resp.NextCursor == "" {
+		t.Errorf("got %+v", resp)
+	}
+	if got := resp.Widgets[1].Description; got != `b, "quoted"]` {
+		t.Errorf("got description %q", got)
+	}
+
+	// An empty list is still a complete document.
+	w = do(h, http.MethodGet, "/widgets/?offset=10", "")
+	decodeBody(t, w, &resp)
+	if len(resp.Widgets) != 0 || resp.Count != 0 {
+		t.Errorf("got %+v for an empty page", resp)
+	}
+}
+
+// flushCounter is a ResponseRecorder that counts flushes.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestWidgetStreamFlushesInBatches(t *testing.T) {
+	widgets := make([]Widget, 2*streamFlushEvery+1)
+	for i := range widgets {
+		widgets[i] = Widget{ID: strconv.Itoa(i)}
+	}
+	w := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	if err := writeWidgetStream(w, httptest.NewRequest(http.MethodGet, "/widgets/", nil), http.StatusOK, widgets, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if w.flushes != 3 {
+		t.Errorf("flushed %d times for %d widgets, want after the opening and every %d widgets", w.flushes, len(widgets), streamFlushEvery)
+	}
+	var resp struct {
+		Count int `json:"count"`
+	}
+	decodeBody(t, w.ResponseRecorder, &resp)
+	if resp.Count != len(widgets) {
+		t.Errorf("got count %d", resp.Count)
+	}
+}
+
+func TestListTotalCountHeader(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	for i := 0; i < 3; i++ {
+		createWidget(t, h, `{"name":"a","quantity":`+strconv.Itoa(i)+`}`)
+	}
+
+	w := do(h, http.MethodGet, "/widgets/?limit=1", "")
+	if got := w.Header().Get("X-Total-Count"); got != "3" {
+		t.Errorf("got X-Total-Count %q, want the count before paging", got)
+	}
+	w = do(h, http.MethodGet, "/widgets/?min_quantity=1", "")
+	if got := w.Header().Get("X-Total-Count"); got != "2" {
+		t.Errorf("got X-Total-Count %q, want the count of matching widgets", got)
+	}
+}
+
+func TestRootOptionsAndGet(t *testing.T) {
+	h := http.HandlerFunc(root)
+
+	w := do(h, http.MethodOptions, "/", "")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("got OPTIONS status %d with body %q, want 204 and no body", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Allow"); got != "GET, OPTIONS" {
+		t.Errorf("got Allow %q on OPTIONS", got)
+	}
+
+	w = do(h, http.MethodGet, "/", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got GET status %d", w.Code)
+	}
+	var index struct {
+		Timestamp string `json:"timestamp"`
+		Version   string `json:"version"`
+	}
+	decodeBody(t, w, &index)
+	if index.Version != version {
+		t.Errorf("got version %q, want %q", index.Version, version)
+	}
+	if _, err := time.Parse(indexTimeLayout, index.Timestamp); err != nil {
+		t.Errorf("got timestamp %q: %s", index.Timestamp, err)
+	}
+
+	w = do(h, http.MethodPost, "/", "")
+	expectError(t, w, http.StatusMethodNotAllowed, codeMethodNotAllowed)
+	if got := w.Header().Get("Allow"); got != "GET, OPTIONS" {
+		t.Errorf("got Allow %q on 405", got)
+	}
+}
+
+func TestCreateWithClientTokenIsRetrySafe(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	body := `{"name":"a","client_token":"retry-1"}`
+
+	first := do(h, http.MethodPost, "/widgets/", body, "X-User", "alice")
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first create answered %d: %s", first.Code, first.Body.String())
+	}
+	var created, retried struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, first, &created)
+
+	retry := do(h, http.MethodPost, "/widgets/", `{"name":"changed","client_token":"retry-1"}`, "X-User", "alice")
+	if retry.Code != http.StatusOK {
+		t.Fatalf("retry answered %d, want 200: %s", retry.Code, retry.Body.String())
+	}
+	decodeBody(t, retry, &retried)
+	if retried.Widget.ID != created.Widget.ID || retried.Widget.Name != "a" {
+		t.Errorf("got %+v on retry, want the widget first created", retried.Widget)
+	}
+	var page listPage
+	decodeBody(t, do(h, http.MethodGet, "/widgets/", "", "X-User", "alice"), &page)
+	if len(page.Widgets) != 1 {
+		t.Errorf("got %d widgets after a retry, want 1", len(page.Widgets))
+	}
+
+	// Tokens are chosen by clients, so another user's token never matches.
+	other := do(h, http.MethodPost, "/widgets/", body, "X-User", "bob")
+	if other.Code != http.StatusCreated {
+		t.Errorf("create by another user with the same token answered %d", other.Code)
+	}
+}
+
+func TestUnmatchedPathsAnswerNotFound(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", root)
+	mux.Handle("/widgets/", h)
+
+	for _, target := range []string{"/nope", "/index.html", "/widgets/a/b/c/d", "/widgets/1/unknown", "/widgetsx"} {
+		w := do(mux, http.MethodGet, target, "")
+		e := expectError(t, w, http.StatusNotFound, codeNotFound)
+		if e.Error != "The requested resource could not be located." {
+			t.Errorf("%s: got message %q", target, e.Error)
+		}
+		if got := w.Header().Get("Content-Type"); got != mimeJSON {
+			t.Errorf("%s: got Content-Type %q", target, got)
+		}
+	}
+}
+
+func TestResetEndpoint(t *testing.T) {
+	disabled := newTestHandler(t, nil, nil)
+	createWidget(t, disabled, `{"name":"a"}`)
+	expectError(t, do(disabled, http.MethodPost, "/widgets/reset", ""), http.StatusNotFound, codeNotFound)
+	if got := len(listWidgets(t, disabled, "/widgets/").Widgets); got != 1 {
+		t.Errorf("got %d widgets, want the disabled reset to keep them", got)
+	}
+
+	h := newTestHandler(t, nil, map[string]string{"API_ENABLE_TEST_ENDPOINTS": "true"})
+	createWidget(t, h, `{"name":"a"}`)
+	createWidget(t, h, `{"name":"b"}`)
+	if w := do(h, http.MethodPost, "/widgets/reset", ""); w.Code != http.StatusOK {
+		t.Fatalf("reset answered %d: %s", w.Code, w.Body.String())
+	}
+	if got := len(listWidgets(t, h, "/widgets/").Widgets); got != 0 {
+		t.Errorf("got %d widgets after reset, want none", got)
+	}
+	if widget := createWidget(t, h, `{"name":"c"}`); widget.ID != "1" {
+		t.Errorf("got id %s after reset, want the sequence restarted", widget.ID)
+	}
+}
+
+func TestCreateDefaultsApplyOnlyToAbsentFields(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_WIDGET_DEFAULTS": `{"description":"TBD","quantity":1,"tags":["new"]}`})
+
+	widget := createWidget(t, h, `{"name":"a"}`)
+	if widget.Description != "TBD" || widget.Quantity != 1 || len(widget.Tags) != 1 || widget.Tags[0] != "new" {
+		t.Errorf("got %+v, want the defaults applied", widget)
+	}
+
+	// Fields the client sends are kept, even when empty.
+	widget = createWidget(t, h, `{"name":"b","description":"","quantity":0,"tags":["own"]}`)
+	if widget.Description != "" || widget.Quantity != 0 || len(widget.Tags) != 1 || widget.Tags[0] != "own" {
+		t.Errorf("got %+v, want the client's values kept", widget)
+	}
+
+	// Defaults are only for creates.
+	changed := do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"b"}`)
+	var resp struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, changed, &resp)
+	if resp.Widget.Description != "" || resp.Widget.Quantity != 0 {
+		t.Errorf("got %+v after an update, want no defaults", resp.Widget)
+	}
+}
+
+func TestCreateDefaultsAreValidatedAtStartup(t *testing.T) {
+	for _, v := range []string{`{"colour":"red"}`, `{"quantity":"one"}`, `[]`} {
+		if _, err := loadConfig(nil, lookupIn(map[string]string{"API_WIDGET_DEFAULTS": v})); err == nil {
+			t.Errorf("%s: got no error", v)
+		}
+	}
+}
+
+func TestBulkUpdateAtomicRollsBackOnStoreFailure(t *testing.T) {
+	store := faultyStore{Store: newMemoryStore()}
+	h := newTestHandler(t, &store, nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+	b := createWidget(t, h, `{"name":"b"}`)
+	store.failPut = func(widget Widget) error {
+		if widget.ID == b.ID && widget.Name == "b2" {
+			return ErrUnavailable
+		}
+		return nil
+	}
+
+	w := do(h, http.MethodPatch, "/widgets/?atomic=true", `[{"id":"`+a.ID+`","changes":{"name":"a2"}},{"id":"`+b.ID+`","changes":{"name":"b2"}}]`)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503: %s", w.Code, w.Body.String())
+	}
+	var resp bulkResponse
+	decodeBody(t, w, &resp)
+	if resp.Failed != 2 {
+		t.Errorf("got %d failed, want 2", resp.Failed)
+	}
+	if r := resp.Results[0]; r.Success || r.Code != codeNotApplied || r.Widget != nil {
+		t.Errorf("first result %+v, want not applied", r)
+	}
+	if r := resp.Results[1]; r.Success || r.Code != codeUnavailable {
+		t.Errorf("second result %+v, want unavailable", r)
+	}
+
+	got, err := store.Get(context.Background(), a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "a" {
+		t.Errorf("first widget named %q after rollback, want a", got.Name)
+	}
+}
+
+func TestBulkUpdateWithoutAtomicKeepsStoredEntries(t *testing.T) {
+	store := faultyStore{Store: newMemoryStore()}
+	h := newTestHandler(t, &store, nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+	b := createWidget(t, h, `{"name":"b"}`)
+	store.failPut = func(widget Widget) error {
+		if widget.ID == b.ID {
+			return ErrUnavailable
+		}
+		return nil
+	}
+
+	w := do(h, http.MethodPatch, "/widgets/", `[{"id":"`+a.ID+`","changes":{"name":"a2"}},{"id":"`+b.ID+`","changes":{"name":"b2"}}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var resp bulkResponse
+	decodeBody(t, w, &resp)
+	if resp.Failed != 1 || !resp.Results[0].Success || resp.Results[1].Success {
+		t.Errorf("got results %+v, want only the second to fail", resp.Results)
+	}
+	if got, _ := store.Get(context.Background(), a.ID); got.Name != "a2" {
+		t.Errorf("first widget named %q, want a2", got.Name)
+	}
+}
+
+// erroringStore is a Store whose reads and writes all fail with err.
+type erroringStore struct {
+	Store
+	err error
+}
+
+func (s erroringStore) List(ctx context.Context) ([]Widget, error) { return nil, s.err }
+func (s erroringStore) Get(ctx context.Context, id string) (Widget, error) {
+	return Widget{}, s.err
+}
+func (s erroringStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	return Widget{}, false, s.err
+}
+func (s erroringStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	return Widget{}, s.err
+}
+func (s erroringStore) Delete(ctx context.Context, id string) (Widget, error) {
+	return Widget{}, s.err
+}
+
+func TestStoreErrorsMapToStatuses(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrNotFound, http.StatusNotFound, codeNotFound},
+		{ErrConflict, http.StatusConflict, codeConflict},
+		{ErrUnavailable, http.StatusServiceUnavailable, codeUnavailable},
+		{fmt.Errorf("dial tcp: %w", ErrUnavailable), http.StatusServiceUnavailable, codeUnavailable},
+		{errors.New("disk on fire"), http.StatusInternalServerError, codeInternal},
+	} {
+		h := newTestHandler(t, erroringStore{newMemoryStore(), tc.err}, nil)
+		for _, req := range []struct{ method, target, body string }{
+			{http.MethodGet, "/widgets/", ""},
+			{http.MethodGet, "/widgets/1", ""},
+			{http.MethodPost, "/widgets/", `{"name":"a"}`},
+			{http.MethodDelete, "/widgets/1", ""},
+		} {
+			w := do(h, req.method, req.target, req.body)
+			if w.Code != tc.status {
+				t.Errorf("%v: %s %s got status %d, want %d", tc.err, req.method, req.target, w.Code, tc.status)
+				continue
+			}
+			var e apiError
+			decodeBody(t, w, &e)
+			if e.Code != tc.code {
+				t.Errorf("%v: %s %s got code %q, want %q", tc.err, req.method, req.target, e.Code, tc.code)
+			}
+			if strings.Contains(e.Error, "disk on fire") {
+				t.Errorf("%v: got the store's error in the response", tc.err)
+			}
+		}
+	}
+}
+
+func TestCloneWidget(t *testing.T) {
+	store := newMemoryStore()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() Time { return Time{now} }
+	h := newTestHandler(t, store, nil)
+	source := createWidget(t, h, `{"name":"a","description":"d","quantity":3,"tags":["x"],"status":"active","client_token":"tok"}`)
+
+	now = now.Add(time.Hour)
+	for _, tc := range []struct {
+		body, want string
+	}{
+		{"", "a"},
+		{`{}`, "a"},
+		{`{"name":"b"}`, "b"},
+	} {
+		w := do(h, http.MethodPost, "/widgets/"+source.ID+"/clone", tc.body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%q: clone answered %d: %s", tc.body, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Widget Widget `json:"widget"`
+		}
+		decodeBody(t, w, &resp)
+		clone := resp.Widget
+		if clone.ID == source.ID || clone.Name != tc.want {
+			t.Errorf("%q: got id %s and name %q", tc.body, clone.ID, clone.Name)
+		}
+		if clone.Description != "d" || clone.Quantity != 3 || len(clone.Tags) != 1 || clone.Status != statusDraft || clone.Revision != 1 || clone.ClientToken != "" {
+			t.Errorf("%q: got %+v, want the source's fields as a new draft without its client token", tc.body, clone)
+		}
+		if !clone.CreatedAt.Equal(now) || !clone.UpdatedAt.Equal(now) {
+			t.Errorf("%q: got created %s, updated %s, want fresh timestamps", tc.body, clone.CreatedAt, clone.UpdatedAt)
+		}
+	}
+
+	expectError(t, do(h, http.MethodPost, "/widgets/missing/clone", ""), http.StatusNotFound, codeNotFound)
+	expectError(t, do(h, http.MethodPost, "/widgets/"+source.ID+"/clone", `{"name":"`+strings.Repeat("n", 101)+`"}`), http.StatusUnprocessableEntity, codeValidationFailed)
+}
+
+func TestAdjustQuantity(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a","quantity":5}`)
+	target := "/widgets/" + widget.ID + "/quantity"
+
+	for _, tc := range []struct {
+		delta string
+		want  int
+	}{
+		{"3", 8},
+		{"-8", 0},
+	} {
+		w := do(h, http.MethodPost, target, `{"delta":`+tc.delta+`}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("delta %s answered %d: %s", tc.delta, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Widget Widget `json:"widget"`
+		}
+		decodeBody(t, w, &resp)
+		if resp.Widget.Quantity != tc.want {
+			t.Errorf("delta %s: got quantity %d, want %d", tc.delta, resp.Widget.Quantity, tc.want)
+		}
+	}
+
+	expectError(t, do(h, http.MethodPost, target, `{"delta":-1}`), http.StatusConflict, codeNegativeQuantity)
+	expectError(t, do(h, http.MethodPost, target, `{}`), http.StatusUnprocessableEntity, codeValidationFailed)
+	expectError(t, do(h, http.MethodPost, "/widgets/missing/quantity", `{"delta":1}`), http.StatusNotFound, codeNotFound)
+}
+
+func TestAdjustQuantityIsAtomic(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a","quantity":0}`)
+	target := "/widgets/" + widget.ID + "/quantity"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do(h, http.MethodPost, target, `{"delta":2}`)
+		}()
+	}
+	wg.Wait()
+
+	var resp struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, do(h, http.MethodGet, "/widgets/"+widget.ID, ""), &resp)
+	if resp.Widget.Quantity != 100 {
+		t.Errorf("got quantity %d after 50 concurrent increments of 2, want 100", resp.Widget.Quantity)
+	}
+}
+
+func TestPprofIsOnlyMountedWhenEnabled(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", root)
+		mountPprof(mux, testConfig(t, map[string]string{"API_ENABLE_PPROF": strconv.FormatBool(enabled)}).EnablePprof)
+
+		for _, target := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+			w := do(mux, http.MethodGet, target, "")
+			if enabled && w.Code != http.StatusOK {
+				t.Errorf("%s: got status %d with pprof enabled", target, w.Code)
+			}
+			if !enabled {
+				expectError(t, w, http.StatusNotFound, codeNotFound)
+			}
+		}
+	}
+	if testConfig(t, nil).EnablePprof {
+		t.Error("got pprof enabled by default")
+	}
+}
+
+func TestLargeQuantitiesRoundTripExactly(t *testing.T) {
+	const big = "9007199254740993"
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_QUANTITY": "9223372036854775807", "API_WIDGET_DEFAULTS": `{"quantity":1}`})
+
+	w := do(h, http.MethodPost, "/widgets/", `{"name":"a","quantity":`+big+`}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"quantity":`+big+`,`) {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, w, &created)
+
+	for _, tc := range []struct{ method, target, body string }{
+		{http.MethodGet, "/widgets/" + created.Widget.ID, ""},
+		{http.MethodPut, "/widgets/" + created.Widget.ID, `{"name":"a","quantity":` + big + `}`},
+		{http.MethodPatch, "/widgets/", `[{"id":"` + created.Widget.ID + `","changes":{"quantity":` + big + `}}]`},
+		{http.MethodGet, "/widgets/", ""},
+	} {
+		w := do(h, tc.method, tc.target, tc.body)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"quantity":`+big+`,`) {
+			t.Errorf("%s %s answered %d: %s", tc.method, tc.target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequestCharsets(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+
+	for _, contentType := range []string{"application/json", "application/json; charset=utf-8", "application/json; charset=UTF-8", "application/json;charset=us-ascii"} {
+		if w := do(h, http.MethodPost, "/widgets/", `{"name":"café"}`, "Content-Type", contentType); w.Code != http.StatusCreated {
+			t.Errorf("%s: create answered %d: %s", contentType, w.Code, w.Body.String())
+		}
+	}
+
+	for _, contentType := range []string{"application/json; charset=iso-8859-1", "application/json; charset=utf-16"} {
+		e := expectError(t, do(h, http.MethodPost, "/widgets/", "{\"name\":\"caf\xe9\"}", "Content-Type", contentType), http.StatusUnsupportedMediaType, codeUnsupportedMediaType)
+		if e.Error != "The request body must be encoded as UTF-8." {
+			t.Errorf("%s: got %q", contentType, e.Error)
+		}
+	}
+	expectError(t, do(h, http.MethodPost, "/widgets/", `{"name":"a"}`, "Content-Type", "application/json; charset"), http.StatusUnsupportedMediaType, codeUnsupportedMediaType)
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	store := newMemoryStore()
+	h := newTestHandler(t, store, nil)
+
+	w := do(h, http.MethodPost, "/widgets/validate", `{"name":"a","quantity":3}`)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"valid":true}` {
+		t.Errorf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	w = do(h, http.MethodPost, "/widgets/validate", `{"name":"a","quantity":-1,"status":"gone"}`)
+	var result struct {
+		Valid      bool     `json:"valid"`
+		Violations []string `json:"violations"`
+	}
+	decodeBody(t, w, &result)
+	if w.Code != http.StatusUnprocessableEntity || result.Valid || len(result.Violations) != 2 {
+		t.Errorf("got status %d and %+v, want 422 with both violations", w.Code, result)
+	}
+
+	expectError(t, do(h, http.MethodPost, "/widgets/validate", `{"name":`), http.StatusBadRequest, codeBadRequest)
+
+	if widgets, _ := store.List(context.Background()); len(widgets) != 0 {
+		t.Errorf("got %d stored widgets, want validation never to store", len(widgets))
+	}
+}
+
+func TestReadOnlyBlocksMutations(t *testing.T) {
+	store := newMemoryStore()
+	writable := newTestHandler(t, store, nil)
+	widget := createWidget(t, writable, `{"name":"a"}`)
+	readOnly := newTestHandler(t, store, map[string]string{"API_READ_ONLY": "true"})
+
+	mutations := []struct{ method, target, body string }{
+		{http.MethodPost, "/widgets/", `{"name":"b"}`},
+		{http.MethodPut, "/widgets/" + widget.ID, `{"name":"b"}`},
+		{http.MethodPatch, "/widgets/", `[{"id":"` + widget.ID + `","changes":{"name":"b"}}]`},
+		{http.MethodPost, "/widgets/" + widget.ID + "/quantity", `{"delta":1}`},
+		{http.MethodDelete, "/widgets/" + widget.ID, ""},
+	}
+	for _, m := range mutations {
+		w := do(readOnly, m.method, m.target, m.body)
+		expectError(t, w, http.StatusMethodNotAllowed, codeReadOnly)
+		if got := w.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+			t.Errorf("%s %s: got Allow %q", m.method, m.target, got)
+		}
+	}
+	if w := do(readOnly, http.MethodGet, "/widgets/"+widget.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("read-only get answered %d", w.Code)
+	}
+	if w := do(readOnly, http.MethodPost, graphQLPath, `{"query":"mutation { deleteWidget(id: \"`+widget.ID+`\") { id } }"}`); !strings.Contains(w.Body.String(), "read-only") {
+		t.Errorf("got %s for a GraphQL mutation, want it refused as read-only", w.Body.String())
+	}
+
+	for _, m := range mutations {
+		if w := do(writable, m.method, m.target, m.body); w.Code >= http.StatusBadRequest {
+			t.Errorf("%s %s: got status %d without read-only", m.method, m.target, w.Code)
+		}
+	}
+}
+
+func TestIDMismatchStatus(t *testing.T) {
+	for _, tt := range []struct {
+		status string
+		want   int
+		code   string
+	}{
+		{"", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"404", http.StatusNotFound, codeNotFound},
+		{"400", http.StatusBadRequest, codeBadRequest},
+	} {
+		var env map[string]string
+		if len(tt.status) > 0 {
+			env = map[string]string{"API_ID_MISMATCH_STATUS": tt.status}
+		}
+		h := newTestHandler(t, nil, env)
+
+		w := do(h, http.MethodPost, "/widgets/1", `{"name":"a"}`)
+		if e := expectError(t, w, tt.want, tt.code); !strings.Contains(e.Error, "POST to /widgets/ instead") {
+			t.Errorf("POST with an id answered %q", e.Error)
+		}
+		if allow := w.Header().Get("Allow"); (tt.want == http.StatusMethodNotAllowed) != (len(allow) > 0) {
+			t.Errorf("POST with an id answered %d with Allow %q", tt.want, allow)
+		}
+
+		w = do(h, http.MethodDelete, "/widgets/", "")
+		if e := expectError(t, w, tt.want, tt.code); !strings.Contains(e.Error, "/widgets/{id}") {
+			t.Errorf("DELETE without an id answered %q", e.Error)
+		}
+	}
+}
+
+func TestBatchGetReportsMissingIDs(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_BATCH_IDS": "3"})
+	a := createWidget(t, h, `{"name":"a"}`)
+	b := createWidget(t, h, `{"name":"b"}`)
+	hidden := do(h, http.MethodPost, "/widgets/", `{"name":"c"}`, "X-User", "alice")
+	var c struct{ Widget Widget }
+	decodeBody(t, hidden, &c)
+
+	w := do(h, http.MethodGet, "/widgets/?ids="+b.ID+",nope,"+a.ID+","+b.ID+","+c.Widget.ID, "")
+	expectError(t, w, http.StatusBadRequest, codeBadRequest)
+
+	w = do(h, http.MethodGet, "/widgets/?ids="+b.ID+",%20nope%20,"+c.Widget.ID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var got struct {
+		Results []batchGetResult
+		Missing int
+	}
+	decodeBody(t, w, &got)
+	if len(got.Results) != 3 || got.Missing != 2 {
+		t.Fatalf("got %d results with %d missing: %s", len(got.Results), got.Missing, w.Body)
+	}
+	for i, want := range []struct {
+		id    string
+		found bool
+		name  string
+	}{
+		{b.ID, true, "b"},
+		{"nope", false, ""},
+		{c.Widget.ID, false, ""},
+	} {
+		r := got.Results[i]
+		if r.ID != want.id || r.Found != want.found || (r.Widget != nil) != want.found || (r.Widget != nil && r.Widget.Name != want.name) {
+			t.Errorf("result %d is %+v, want %+v", i, r, want)
+		}
+	}
+
+	expectError(t, do(h, http.MethodGet, "/widgets/?ids=,", ""), http.StatusBadRequest, codeBadRequest)
+	expectError(t, do(h, http.MethodGet, "/widgets/?ids=a&ids=b", ""), http.StatusBadRequest, codeBadRequest)
+}
+
+// BenchmarkIndex compares the JSON index, written directly, with one encoded
+// by a negotiated Formatter.
+func BenchmarkIndex(b *testing.B) {
+	for _, bb := range []struct {
+		name   string
+		accept string
+	}{
+		{"json", mimeJSON},
+		{"negotiated", "application/yaml"},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", bb.accept)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				root(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("got status %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONDepth(t *testing.T) {
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`"a"`, 0},
+		{`{}`, 1},
+		{`{"a":[1,{"b":[]}]}`, 4},
+		{`[[],[[]],[]]`, 3},
+		{`{"a":"[[[{{{"}`, 1},
+		{`{"a":"\"[[["}`, 1},
+		{`{"a":"\\"}`, 1},
+	} {
+		if got := jsonDepth([]byte(tt.body)); got != tt.want {
+			t.Errorf("%s: got depth %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestDeeplyNestedBodiesAreRejected(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_JSON_DEPTH": "4"})
+	nested := func(depth int) string {
+		return `{"name":"a","extra":` + strings.Repeat("[", depth-1) + strings.Repeat("]", depth-1) + `}`
+	}
+
+	e := expectError(t, do(h, http.MethodPost, "/widgets/", nested(5)), http.StatusBadRequest, codeBadRequest)
+	if e.Error != "The request body must be nested at most 4 levels deep." {
+		t.Errorf("got %q", e.Error)
+	}
+	widget := createWidget(t, h, `{"name":"a"}`)
+	expectError(t, do(h, http.MethodPut, "/widgets/"+widget.ID, nested(10)), http.StatusBadRequest, codeBadRequest)
+
+	// Brackets in strings do not count.
+	createWidget(t, h, `{"name":"[[[[[[","description":"{{{{{{"}`)
+}
+
+func TestTouchBumpsOnlyTheUpdateTime(t *testing.T) {
+	store := newMemoryStore()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() Time { return Time{now} }
+	h := newTestHandler(t, store, nil)
+	before := createWidget(t, h, `{"name":"a","description":"d","quantity":3,"tags":["x"],"status":"active"}`)
+	etag := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag")
+
+	now = now.Add(time.Hour)
+	w := do(h, http.MethodPost, "/widgets/"+before.ID+"/touch", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var touched struct{ Widget Widget }
+	decodeBody(t, w, &touched)
+	after := touched.Widget
+	if !after.UpdatedAt.Equal(now) || !after.CreatedAt.Equal(before.CreatedAt.Time) {
+		t.Errorf("got created %s and updated %s, want only updated moved to %s", after.CreatedAt, after.UpdatedAt, now)
+	}
+	if after.Revision != before.Revision+1 {
+		t.Errorf("got revision %d, want %d", after.Revision, before.Revision+1)
+	}
+	if after.Name != before.Name || after.Description != before.Description || after.Quantity != before.Quantity ||
+		after.Status != before.Status || strings.Join(after.Tags, ",") != strings.Join(before.Tags, ",") {
+		t.Errorf("got %+v, want the fields of %+v", after, before)
+	}
+	if got := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag"); got == etag {
+		t.Errorf("the list ETag stayed %s after a touch", got)
+	}
+
+	expectError(t, do(h, http.MethodPost, "/widgets/nope/touch", ""), http.StatusNotFound, codeNotFound)
+	expectError(t, do(h, http.MethodPost, "/widgets/"+before.ID+"/touch", "", "X-User", "alice"), http.StatusNotFound, codeNotFound)
+}
+
+func TestStaleUpdates(t *testing.T) {
+	for _, tt := range []struct {
+		mode    string
+		status  int
+		warning bool
+	}{
+		{staleIgnore, http.StatusOK, false},
+		{staleWarn, http.StatusOK, true},
+		{staleReject, http.StatusConflict, false},
+	} {
+		h := newTestHandler(t, nil, map[string]string{"API_STALE_UPDATES": tt.mode})
+		widget := createWidget(t, h, `{"name":"a"}`)
+
+		// Two clients read revision 1, and the first to write wins.
+		if w := do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"first","revision":1}`); w.Code != http.StatusOK {
+			t.Fatalf("%s: the first update answered %d: %s", tt.mode, w.Code, w.Body)
+		}
+		w := do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"second","revision":1}`)
+		if w.Code != tt.status {
+			t.Fatalf("%s: the second update answered %d, want %d: %s", tt.mode, w.Code, tt.status, w.Body)
+		}
+		if got := len(w.Header().Get("Warning")) > 0; got != tt.warning {
+			t.Errorf("%s: got Warning %q", tt.mode, w.Header().Get("Warning"))
+		}
+
+		want := "second"
+		if tt.status == http.StatusConflict {
+			e := expectError(t, w, http.StatusConflict, codeStaleRevision)
+			if e.Error != "The widget is at revision 2, not 1. Get it again before updating." {
+				t.Errorf("%s: got %q", tt.mode, e.Error)
+			}
+			want = "first"
+		}
+		var got struct{ Widget Widget }
+		decodeBody(t, do(h, http.MethodGet, "/widgets/"+widget.ID, ""), &got)
+		if got.Widget.Name != want {
+			t.Errorf("%s: the widget is named %s, want %s", tt.mode, got.Widget.Name, want)
+		}
+
+		// Updates without a revision are never checked.
+		if w := do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"third"}`); w.Code != http.StatusOK || len(w.Header().Get("Warning")) > 0 {
+			t.Errorf("%s: an update without a revision answered %d with Warning %q", tt.mode, w.Code, w.Header().Get("Warning"))
+		}
+	}
+}
+
+// interferingStore is a Store that updates a widget behind the caller's back
+// right after the first get returns it, as a concurrent client would.
+type interferingStore struct {
+	Store
+	once sync.Once
+}
+
+func (s *interferingStore) Get(ctx context.Context, id string) (Widget, error) {
+	widget, err := s.Store.Get(ctx, id)
+	if err == nil {
+		s.once.Do(func() {
+			s.Store.Update(ctx, id, func(w Widget) (Widget, error) {
+				w.Name = "concurrent"
+				return w, nil
+			})
+		})
+	}
+	return widget, err
+}
+
+func TestStaleUpdatesAreRejectedWhenAnotherUpdateGetsIn(t *testing.T) {
+	memory := newMemoryStore()
+	widget, _, err := memory.Create(context.Background(), Widget{ID: "1", Name: "a", Status: statusDraft, Revision: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, &interferingStore{Store: memory}, map[string]string{"API_STALE_UPDATES": staleReject})
+
+	w := do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"mine","revision":1}`)
+	expectError(t, w, http.StatusConflict, codeStaleRevision)
+	if got, _ := memory.Get(context.Background(), widget.ID); got.Name != "concurrent" {
+		t.Errorf("the widget is named %s, want the concurrent update kept", got.Name)
+	}
+}
+
+// newRenameTestStore returns a memoryStore behind the decorators that act on
+// renames, archiving deletes to path.
+func newRenameTestStore(t *testing.T, path string) Store {
+	t.Helper()
+	archive, err := openArchiveFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capacity, err := newCapacityStore(context.Background(), newCachingStore(newArchivingStore(newMemoryStore(), archive, true), time.Minute), 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTimingStore(newCoalescingStore(capacity))
+}
+
+func TestRenameMovesTheWidgetInOneStep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	h := newTestHandler(t, newRenameTestStore(t, path), nil)
+	first := createWidget(t, h, `{"name":"a","client_token":"tok"}`)
+	second := createWidget(t, h, `{"name":"b"}`)
+
+	w := do(h, http.MethodPost, "/widgets/"+first.ID+"/rename", `{"id":"gear-a"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Location"); got != "/widgets/gear-a" {
+		t.Errorf("got Location %q", got)
+	}
+	var resp struct{ Widget Widget }
+	decodeBody(t, w, &resp)
+	renamed := resp.Widget
+	if renamed.ID != "gear-a" || renamed.Revision != 2 || !renamed.CreatedAt.Equal(first.CreatedAt.Time) {
+		t.Errorf("got %+v, want revision 2 created at %s", renamed, first.CreatedAt)
+	}
+
+	if w := do(h, http.MethodGet, "/widgets/"+first.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for the old id, want 404", w.Code)
+	}
+	if got := widgetNames(listWidgets(t, h, "/widgets/").Widgets); got != "a,b" {
+		t.Errorf("got list %s, want the renamed widget to keep its place", got)
+	}
+	if w := do(h, http.MethodGet, "/widgets/gear-a/diff?from=1", ""); w.Code != http.StatusOK {
+		t.Errorf("got status %d for the history of the renamed widget: %s", w.Code, w.Body.String())
+	}
+
+	// The client token now leads to the renamed widget.
+	if w := do(h, http.MethodPost, "/widgets/", `{"name":"a","client_token":"tok"}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"gear-a"`) {
+		t.Errorf("got status %d, %s for a repeated client token", w.Code, w.Body.String())
+	}
+
+	// Sequence ids are still free for new widgets.
+	if third := createWidget(t, h, `{"name":"c"}`); third.ID == second.ID || third.ID == "gear-a" {
+		t.Errorf("got id %s for a new widget", third.ID)
+	}
+
+	if b, err := ioutil.ReadFile(path); err != nil || len(b) > 0 {
+		t.Errorf("got archive %q, %v, want nothing archived", b, err)
+	}
+}
+
+func TestRenameToATakenIDConflicts(t *testing.T) {
+	h := newTestHandler(t, newRenameTestStore(t, filepath.Join(t.TempDir(), "archive.jsonl")), nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+	b := createWidget(t, h, `{"name":"b"}`)
+	if w := do(h, http.MethodPost, "/widgets/"+b.ID+"/rename", `{"id":"gear-b"}`); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	w := do(h, http.MethodPost, "/widgets/"+a.ID+"/rename", `{"id":"gear-b"}`)
+	expectError(t, w, http.StatusConflict, codeIDTaken)
+
+	if w := do(h, http.MethodGet, "/widgets/"+a.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("got status %d, want the widget left at its id", w.Code)
+	}
+	if got := widgetNames(listWidgets(t, h, "/widgets/").Widgets); got != "a,b" {
+		t.Errorf("got list %s", got)
+	}
+}
+
+func TestRenameRejectsInvalidIDs(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+	for _, body := range []string{`{}`, `{"id":"42"}`, `{"id":"a/b"}`, `{"id":".."}`, `{"id":"stats"}`} {
+		w := do(h, http.MethodPost, "/widgets/"+a.ID+"/rename", body)
+		expectError(t, w, http.StatusUnprocessableEntity, codeValidationFailed)
+	}
+}
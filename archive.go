@@ -0,0 +1,109 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// archiveFile appends widgets to a file as JSON, one per line.
+type archiveFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openArchiveFile will open the archive at path for appending, creating it if
+// needed.
+func openArchiveFile(path string) (*archiveFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{file: file}, nil
+}
+
+func (a *archiveFile) append(widget Widget) error {
+	b, err := json.Marshal(widget)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(b)
+	return err
+}
+
+// archivingStore is a Store decorator that appends every widget deleted
+// through it to an archive before removing it. When required is set a widget
+// that cannot be archived is not deleted; otherwise the failure is logged and
+// the delete goes ahead.
+type archivingStore struct {
+	Store
+
+	archive  *archiveFile
+	required bool
+}
+
+// newArchivingStore will construct a new archivingStore around the given
+// Store.
+func newArchivingStore(store Store, archive *archiveFile, required bool) archivingStore {
+	return archivingStore{Store: store, archive: archive, required: required}
+}
+
+func (s archivingStore) Delete(ctx context.Context, id string) (Widget, error) {
+	widget, err := s.Store.Get(ctx, id)
+	if err != nil {
+		return widget, err
+	}
+
+	if err := s.archive.append(widget); err != nil {
+		if s.required {
+			return Widget{}, fmt.Errorf("unable to archive widget %s: %w", id, err)
+		}
+		log.Printf("unable to archive widget %s, deleting anyway %s", id, err)
+	}
+	return s.Store.Delete(ctx, id)
+}
+
+// Rename passes through to the wrapped store when it can rename. The widget
+// still exists, so nothing is archived.
+func (s archivingStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	if renamer, ok := s.Store.(Renamer); ok {
+		return renamer.Rename(ctx, id, newID)
+	}
+	return Widget{}, ErrNoRename
+}
+
+// History passes through to the wrapped store when it keeps history.
+func (s archivingStore) History(ctx context.Context, id string) ([]Widget, error) {
+	if historian, ok := s.Store.(Historian); ok {
+		return historian.History(ctx, id)
+	}
+	return nil, ErrNoHistory
+}
+
+// Purge passes through to the wrapped store when it can purge.
+func (s archivingStore) Purge(id string) {
+	if purger, ok := s.Store.(Purger); ok {
+		purger.Purge(id)
+	}
+}
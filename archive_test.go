@@ -0,0 +1,96 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readArchive returns the widgets in the archive at path, in order.
+func readArchive(t *testing.T, path string) []Widget {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var widgets []Widget
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var widget Widget
+		if err := json.Unmarshal(scanner.Bytes(), &widget); err != nil {
+			t.Fatalf("bad archive line %q: %s", scanner.Text(), err)
+		}
+		widgets = append(widgets, widget)
+	}
+	return widgets
+}
+
+func TestDeletedWidgetsAreArchived(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	archive, err := openArchiveFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, newArchivingStore(newMemoryStore(), archive, true), nil)
+	a := createWidget(t, h, `{"name":"a","quantity":2}`)
+	b := createWidget(t, h, `{"name":"b"}`)
+
+	for _, id := range []string{b.ID, a.ID} {
+		if w := do(h, http.MethodDelete, "/widgets/"+id, ""); w.Code != http.StatusOK {
+			t.Fatalf("delete answered %d", w.Code)
+		}
+	}
+	expectError(t, do(h, http.MethodDelete, "/widgets/"+a.ID, ""), http.StatusNotFound, codeNotFound)
+
+	archived := readArchive(t, path)
+	if widgetNames(archived) != "b,a" {
+		t.Fatalf("got archive %s, want each deleted widget once", widgetNames(archived))
+	}
+	if got := archived[1]; got.ID != a.ID || got.Quantity != 2 || !got.CreatedAt.Equal(a.CreatedAt.Time) {
+		t.Errorf("got archived widget %+v, want it as stored", got)
+	}
+}
+
+func TestArchiveFailures(t *testing.T) {
+	ctx := context.Background()
+	for _, required := range []bool{true, false} {
+		archive, err := openArchiveFile(filepath.Join(t.TempDir(), "archive.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive.file.Close()
+
+		store := newArchivingStore(newMemoryStore(), archive, required)
+		store.Put(ctx, Widget{ID: "1", Name: "a"})
+
+		_, err = store.Delete(ctx, "1")
+		_, getErr := store.Get(ctx, "1")
+		if required && (err == nil || getErr != nil) {
+			t.Errorf("required: got delete error %v and get error %v, want the widget kept", err, getErr)
+		}
+		if !required && (err != nil || !errors.Is(getErr, ErrNotFound)) {
+			t.Errorf("not required: got delete error %v and get error %v, want the widget deleted", err, getErr)
+		}
+	}
+}
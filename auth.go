@@ -0,0 +1,52 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requester identifies who made a request. Users are named by the X-User
+// header; admins present the configured admin token as a bearer token.
+type requester struct {
+	user  string
+	admin bool
+}
+
+// requesterFor returns the requester of r given the configured admin token.
+// When no admin token is configured nobody is an admin.
+func requesterFor(r *http.Request, adminToken string) requester {
+	return requester{
+		user:  strings.TrimSpace(r.Header.Get("X-User")),
+		admin: len(adminToken) > 0 && hasBearerToken(r, adminToken),
+	}
+}
+
+// canAccess reports whether the requester may see the given widget. Users
+// only see widgets they own; requests without X-User only see unowned ones.
+func (q requester) canAccess(widget Widget) bool {
+	return q.admin || widget.OwnerID == q.user
+}
+
+func hasBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
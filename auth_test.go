@@ -0,0 +1,79 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOwnershipLimitsAccess(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_ADMIN_TOKEN": "secret"})
+
+	w := do(h, http.MethodPost, "/widgets/", `{"name":"a"}`, "X-User", "alice")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create answered %d", w.Code)
+	}
+	var resp struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, w, &resp)
+	widget := resp.Widget
+	if widget.OwnerID != "alice" {
+		t.Fatalf("got owner %q, want alice", widget.OwnerID)
+	}
+	target := "/widgets/" + widget.ID
+
+	if w := do(h, http.MethodGet, target, "", "X-User", "alice"); w.Code != http.StatusOK {
+		t.Errorf("owner get answered %d", w.Code)
+	}
+	for _, headers := range [][]string{
+		{"X-User", "bob"},
+		{},
+		{"X-User", "bob", "Authorization", "Bearer wrong"},
+	} {
+		expectError(t, do(h, http.MethodGet, target, "", headers...), http.StatusNotFound, codeNotFound)
+		expectError(t, do(h, http.MethodPut, target, `{"name":"b"}`, headers...), http.StatusNotFound, codeNotFound)
+		expectError(t, do(h, http.MethodDelete, target, "", headers...), http.StatusNotFound, codeNotFound)
+
+		var page listPage
+		decodeBody(t, do(h, http.MethodGet, "/widgets/", "", headers...), &page)
+		if len(page.Widgets) != 0 {
+			t.Errorf("%v: got %d widgets in the list, want none of alice's", headers, len(page.Widgets))
+		}
+	}
+
+	admin := []string{"X-User", "bob", "Authorization", "Bearer secret"}
+	if w := do(h, http.MethodGet, target, "", admin...); w.Code != http.StatusOK {
+		t.Errorf("admin get answered %d", w.Code)
+	}
+	var page listPage
+	decodeBody(t, do(h, http.MethodGet, "/widgets/", "", admin...), &page)
+	if len(page.Widgets) != 1 {
+		t.Errorf("got %d widgets in the admin list, want 1", len(page.Widgets))
+	}
+}
+
+func TestNoAdminWithoutAToken(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/widgets/", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if requesterFor(r, "").admin {
+		t.Error("got an admin with no admin token configured")
+	}
+	r.Header.Set("Authorization", "bearer secret")
+	if !requesterFor(r, "secret").admin {
+		t.Error("got no admin for a lower-case bearer scheme")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// cachingStore is a Store decorator that caches widgets read through Get for
+// a fixed TTL. Any change to a widget through the store evicts its entry.
+type cachingStore struct {
+	Store
+
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	purges  uint64 // bumped on every eviction
+}
+
+type cacheEntry struct {
+	widget  Widget
+	expires time.Time
+}
+
+// newCachingStore will construct a new cachingStore in front of the given Store.
+func newCachingStore(store Store, ttl time.Duration) *cachingStore {
+	return &cachingStore{
+		Store:   store,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (s *cachingStore) Get(ctx context.Context, id string) (Widget, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[id]
+	purges := s.purges
+	s.mu.Unlock()
+	if ok && s.now().Before(entry.expires) {
+		return entry.widget, nil
+	}
+
+	widget, err := s.Store.Get(ctx, id)
+	if err != nil {
+		s.Purge(id)
+		return widget, err
+	}
+
+	// Skip caching if anything was evicted during the lookup, since the
+	// widget read may already be stale.
+	s.mu.Lock()
+	if s.purges == purges {
+		s.entries[id] = cacheEntry{widget: widget, expires: s.now().Add(s.ttl)}
+	}
+	s.mu.Unlock()
+	return widget, nil
+}
+
+func (s *cachingStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	stored, created, err := s.Store.Create(ctx, widget)
+	s.Purge(widget.ID)
+	return stored, created, err
+}
+
+func (s *cachingStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	stored, err := s.Store.Update(ctx, id, change)
+	s.Purge(id)
+	return stored, err
+}
+
+func (s *cachingStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	stored, err := s.Store.Put(ctx, widget)
+	s.Purge(widget.ID)
+	return stored, err
+}
+
+func (s *cachingStore) Delete(ctx context.Context, id string) (Widget, error) {
+	widget, err := s.Store.Delete(ctx, id)
+	s.Purge(id)
+	return widget, err
+}
+
+// Rename passes through to the wrapped store when it can rename, evicting
+// both ids.
+func (s *cachingStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	renamer, ok := s.Store.(Renamer)
+	if !ok {
+		return Widget{}, ErrNoRename
+	}
+	widget, err := renamer.Rename(ctx, id, newID)
+	s.Purge(id)
+	s.Purge(newID)
+	return widget, err
+}
+
+func (s *cachingStore) Reset(ctx context.Context) error {
+	err := s.Store.Reset(ctx)
+
+	s.mu.Lock()
+	s.entries = make(map[string]cacheEntry)
+	s.purges++
+	s.mu.Unlock()
+	return err
+}
+
+// History passes through to the wrapped store when it keeps history.
+func (s *cachingStore) History(ctx context.Context, id string) ([]Widget, error) {
+	if historian, ok := s.Store.(Historian); ok {
+		return historian.History(ctx, id)
+	}
+	return nil, ErrNoHistory
+}
+
+// Purge evicts the cached entry for the given id.
+func (s *cachingStore) Purge(id string) {
+	s.mu.Lock()
+	delete(s.entries, id)
+	s.purges++
+	s.mu.Unlock()
+}
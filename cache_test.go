@@ -0,0 +1,116 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPurgeEvictsTheCachedWidget(t *testing.T) {
+	counting := &countingStore{Store: newMemoryStore()}
+	env := map[string]string{"API_ADMIN_TOKEN": "secret"}
+	h := newTestHandler(t, newCachingStore(counting, time.Hour), env)
+	widget := createWidget(t, h, `{"name":"a"}`)
+	target := "/widgets/" + widget.ID
+
+	do(h, http.MethodGet, target, "")
+	do(h, http.MethodGet, target, "")
+	if got := counting.getCount(); got != 1 {
+		t.Fatalf("got %d store reads for two gets, want 1", got)
+	}
+
+	w := do(h, "PURGE", target, "")
+	expectError(t, w, http.StatusUnauthorized, codeUnauthorized)
+	if w := do(h, "PURGE", target, "", "Authorization", "Bearer secret"); w.Code != http.StatusOK {
+		t.Fatalf("purge answered %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := do(h, http.MethodGet, target, ""); w.Code != http.StatusOK {
+		t.Fatalf("get after purge answered %d, want the widget kept", w.Code)
+	}
+	if got := counting.getCount(); got != 2 {
+		t.Errorf("got %d store reads, want the get after purge to miss the cache", got)
+	}
+}
+
+func TestPurgeWithoutACacheIsANoOp(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_ADMIN_TOKEN": "secret"})
+	widget := createWidget(t, h, `{"name":"a"}`)
+
+	if w := do(h, "PURGE", "/widgets/"+widget.ID, "", "Authorization", "Bearer secret"); w.Code != http.StatusOK {
+		t.Errorf("purge answered %d", w.Code)
+	}
+	if w := do(h, http.MethodGet, "/widgets/"+widget.ID, ""); w.Code != http.StatusOK {
+		t.Errorf("get after purge answered %d", w.Code)
+	}
+}
+
+func TestCachingStoreServesRepeatedGets(t *testing.T) {
+	ctx := context.Background()
+	counting := &countingStore{Store: newMemoryStore()}
+	cache := newCachingStore(counting, time.Minute)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	if _, _, err := cache.Create(ctx, Widget{ID: "1", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if widget, err := cache.Get(ctx, "1"); err != nil || widget.Name != "a" {
+			t.Fatalf("got %+v, %v", widget, err)
+		}
+	}
+	if got := counting.getCount(); got != 1 {
+		t.Errorf("got %d store reads within the TTL, want 1", got)
+	}
+
+	now = now.Add(time.Minute)
+	cache.Get(ctx, "1")
+	if got := counting.getCount(); got != 2 {
+		t.Errorf("got %d store reads, want the expired entry read again", got)
+	}
+}
+
+func TestCachingStoreEvictsChangedWidgets(t *testing.T) {
+	ctx := context.Background()
+	counting := &countingStore{Store: newMemoryStore()}
+	cache := newCachingStore(counting, time.Hour)
+	cache.Create(ctx, Widget{ID: "1", Name: "a"})
+	cache.Get(ctx, "1")
+
+	if _, err := cache.Update(ctx, "1", func(widget Widget) (Widget, error) {
+		widget.Name = "b"
+		return widget, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if widget, _ := cache.Get(ctx, "1"); widget.Name != "b" {
+		t.Errorf("got %q after update, want the new name", widget.Name)
+	}
+
+	cache.Put(ctx, Widget{ID: "1", Name: "c"})
+	if widget, _ := cache.Get(ctx, "1"); widget.Name != "c" {
+		t.Errorf("got %q after put, want the new name", widget.Name)
+	}
+
+	cache.Delete(ctx, "1")
+	if _, err := cache.Get(ctx, "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v after delete, want ErrNotFound", err)
+	}
+}
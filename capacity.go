@@ -0,0 +1,236 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// capacityStore is a Store decorator that holds at most max widgets. When it
+// is full a create either fails with ErrFull or, when evict is set, deletes
+// the least recently used widget to make room. Creating, replacing, updating
+// or getting a widget counts as using it.
+type capacityStore struct {
+	Store
+
+	max   int
+	evict bool
+
+	// mu is held across a full create, so that two creates cannot both take
+	// the last free place.
+	mu     sync.Mutex
+	recent *list.List // widget ids, most recently used first
+	ids    map[string]*list.Element
+}
+
+// newCapacityStore will construct a new capacityStore around the given Store.
+// The widgets already stored are counted, oldest first as least recently used.
+func newCapacityStore(ctx context.Context, store Store, max int, evict bool) (*capacityStore, error) {
+	widgets, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &capacityStore{Store: store, max: max, evict: evict, recent: list.New(), ids: make(map[string]*list.Element)}
+	for _, widget := range widgets {
+		s.ids[widget.ID] = s.recent.PushFront(widget.ID)
+	}
+	return s, nil
+}
+
+// touch marks the widget as the most recently used.
+func (s *capacityStore) touch(id string) {
+	if e, ok := s.ids[id]; ok {
+		s.recent.MoveToFront(e)
+		return
+	}
+	s.ids[id] = s.recent.PushFront(id)
+}
+
+func (s *capacityStore) forget(id string) {
+	if e, ok := s.ids[id]; ok {
+		s.recent.Remove(e)
+		delete(s.ids, id)
+	}
+}
+
+// makeRoom ensures there is room for one more widget, evicting if allowed.
+// It must be called with mu held.
+func (s *capacityStore) makeRoom(ctx context.Context) error {
+	for s.recent.Len() >= s.max {
+		if !s.evict {
+			return ErrFull
+		}
+		if err := s.evictOldest(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictOldest deletes the least recently used widget. It must be called with
+// mu held.
+func (s *capacityStore) evictOldest(ctx context.Context) error {
+	id := s.recent.Back().Value.(string)
+	if _, err := s.Store.Delete(ctx, id); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	log.Printf("evicted least recently used widget %s", id)
+	s.forget(id)
+	recordEviction()
+	return nil
+}
+
+func (s *capacityStore) Get(ctx context.Context, id string) (Widget, error) {
+	widget, err := s.Store.Get(ctx, id)
+	if err == nil {
+		s.mu.Lock()
+		s.touch(id)
+		s.mu.Unlock()
+	}
+	return widget, err
+}
+
+// Create creates the widget before making room for it, so that a create
+// answered with the widget already stored for its client token, or one that
+// fails, neither fails for want of room nor evicts anything. Once the new
+// widget is stored either the least recently used other widget is evicted or
+// the new one is deleted again and ErrFull returned.
+func (s *capacityStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, created, err := s.Store.Create(ctx, widget)
+	if err != nil {
+		return stored, created, err
+	}
+	s.touch(stored.ID)
+	if !created {
+		return stored, false, nil
+	}
+
+	for s.recent.Len() > s.max {
+		if !s.evict || s.recent.Back().Value.(string) == stored.ID {
+			return Widget{}, false, s.undoCreate(ctx, stored.ID, ErrFull)
+		}
+		if err := s.evictOldest(ctx); err != nil {
+			return Widget{}, false, s.undoCreate(ctx, stored.ID, err)
+		}
+	}
+	return stored, true, nil
+}
+
+// undoCreate deletes a widget Create has just stored, returning err, or the
+// error deleting it when that fails. It must be called with mu held.
+func (s *capacityStore) undoCreate(ctx context.Context, id string, err error) error {
+	if _, deleteErr := s.Store.Delete(ctx, id); deleteErr != nil && !errors.Is(deleteErr, ErrNotFound) {
+		return deleteErr
+	}
+	s.forget(id)
+	return err
+}
+
+func (s *capacityStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	widget, err := s.Store.Update(ctx, id, change)
+	if err == nil {
+		s.mu.Lock()
+		s.touch(id)
+		s.mu.Unlock()
+	}
+	return widget, err
+}
+
+func (s *capacityStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ids[widget.ID]; !ok {
+		if err := s.makeRoom(ctx); err != nil {
+			return Widget{}, err
+		}
+	}
+	stored, err := s.Store.Put(ctx, widget)
+	if err == nil {
+		s.touch(stored.ID)
+	}
+	return stored, err
+}
+
+func (s *capacityStore) Delete(ctx context.Context, id string) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	widget, err := s.Store.Delete(ctx, id)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		s.forget(id)
+	}
+	return widget, err
+}
+
+// Rename passes through to the wrapped store when it can rename. The widget
+// keeps its place in the use order under its new id.
+func (s *capacityStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	renamer, ok := s.Store.(Renamer)
+	if !ok {
+		return Widget{}, ErrNoRename
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	widget, err := renamer.Rename(ctx, id, newID)
+	if err != nil {
+		return widget, err
+	}
+	if e, ok := s.ids[id]; ok {
+		e.Value = newID
+		s.ids[newID] = e
+		delete(s.ids, id)
+	} else {
+		s.touch(newID)
+	}
+	return widget, nil
+}
+
+func (s *capacityStore) Reset(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.Store.Reset(ctx); err != nil {
+		return err
+	}
+	s.recent.Init()
+	s.ids = make(map[string]*list.Element)
+	return nil
+}
+
+// History passes through to the wrapped store when it keeps history.
+func (s *capacityStore) History(ctx context.Context, id string) ([]Widget, error) {
+	if historian, ok := s.Store.(Historian); ok {
+		return historian.History(ctx, id)
+	}
+	return nil, ErrNoHistory
+}
+
+// Purge passes through to the wrapped store when it can purge.
+func (s *capacityStore) Purge(id string) {
+	if purger, ok := s.Store.(Purger); ok {
+		purger.Purge(id)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// storedIDs lists the ids in store, sorted.
+func storedIDs(t *testing.T, store Store) string {
+	t.Helper()
+	widgets, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(widgets))
+	for i, w := range widgets {
+		ids[i] = w.ID
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestCapacityStoreRejectsCreatesWhenFull(t *testing.T) {
+	ctx := context.Background()
+	store, err := newCapacityStore(ctx, newMemoryStore(), 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, _, err := store.Create(ctx, Widget{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.Create(ctx, Widget{ID: "c"}); !errors.Is(err, ErrFull) {
+		t.Errorf("got %v, want %v", err, ErrFull)
+	}
+	if _, err := store.Put(ctx, Widget{ID: "a", Name: "replaced"}); err != nil {
+		t.Errorf("replacing a widget in a full store failed %s", err)
+	}
+
+	if _, err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Create(ctx, Widget{ID: "c"}); err != nil {
+		t.Errorf("got %v after a delete made room", err)
+	}
+}
+
+func TestCapacityStoreEvictsTheLeastRecentlyUsedWidget(t *testing.T) {
+	ctx := context.Background()
+	memory := newMemoryStore()
+	if _, _, err := memory.Create(ctx, Widget{ID: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newCapacityStore(ctx, memory, 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, _, err := store.Create(ctx, Widget{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := scrapeStats(t)
+
+	// The widget stored before start up is the least recently used.
+	if _, _, err := store.Create(ctx, Widget{ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedIDs(t, store); got != "a,b,c" {
+		t.Fatalf("stored %s, want old evicted", got)
+	}
+
+	// Getting a widget makes it the most recently used.
+	if _, err := store.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Create(ctx, Widget{ID: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedIDs(t, store); got != "a,c,d" {
+		t.Errorf("stored %s, want b evicted", got)
+	}
+
+	// A renamed widget keeps its place in the use order.
+	if _, err := store.Rename(ctx, "c", "e"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Create(ctx, Widget{ID: "f"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedIDs(t, store); got != "a,d,f" {
+		t.Errorf("stored %s, want the renamed widget evicted", got)
+	}
+	if got := scrapeStats(t).WidgetEvictions - before.WidgetEvictions; got != 3 {
+		t.Errorf("evictions moved by %d, want 3", got)
+	}
+}
+
+func TestFullStoreAnswersInsufficientStorage(t *testing.T) {
+	store, err := newCapacityStore(context.Background(), newMemoryStore(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, store, nil)
+	createWidget(t, h, `{"name":"a"}`)
+	expectError(t, do(h, http.MethodPost, "/widgets/", `{"name":"b"}`), http.StatusInsufficientStorage, "insufficient_storage")
+}
+
+func TestCapacityStoreRetriesAndConflictsNeedNoRoom(t *testing.T) {
+	ctx := context.Background()
+	for _, evict := range []bool{false, true} {
+		store, err := newCapacityStore(ctx, newMemoryStore(), 2, evict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := store.Create(ctx, Widget{ID: "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := store.Create(ctx, Widget{ID: "b", ClientToken: "token"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Retrying a create with its client token answers the stored widget.
+		stored, created, err := store.Create(ctx, Widget{ID: "c", ClientToken: "token"})
+		if err != nil || created || stored.ID != "b" {
+			t.Errorf("evict %t: retry got %s, %t, %v, want b", evict, stored.ID, created, err)
+		}
+		if _, _, err := store.Create(ctx, Widget{ID: "a"}); !errors.Is(err, ErrConflict) {
+			t.Errorf("evict %t: got %v, want %v", evict, err, ErrConflict)
+		}
+		if got := storedIDs(t, store); got != "a,b" {
+			t.Errorf("evict %t: stored %s, want nothing evicted", evict, got)
+		}
+	}
+}
+
+func TestCapacityStoreNeverEvictsTheNewWidget(t *testing.T) {
+	ctx := context.Background()
+	store, err := newCapacityStore(ctx, newMemoryStore(), 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, _, err := store.Create(ctx, Widget{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.Create(ctx, Widget{ID: "c"}); !errors.Is(err, ErrFull) {
+		t.Fatalf("got %v, want %v", err, ErrFull)
+	}
+	if got := storedIDs(t, store); got != "a,b" {
+		t.Errorf("stored %s after a rejected create", got)
+	}
+	if _, err := store.Get(ctx, "c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v for the rejected widget, want %v", err, ErrNotFound)
+	}
+}
+
+func TestCapacityStoreCountsUpdatesAsUses(t *testing.T) {
+	ctx := context.Background()
+	store, err := newCapacityStore(ctx, newMemoryStore(), 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if _, _, err := store.Create(ctx, Widget{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Update(ctx, "a", func(w Widget) (Widget, error) {
+		w.Name = "updated"
+		return w, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Create(ctx, Widget{ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedIDs(t, store); got != "a,c" {
+		t.Errorf("stored %s, want b evicted", got)
+	}
+}
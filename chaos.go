@@ -0,0 +1,65 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// ChaosPolicy describes the faults injected into responses to test how
+// clients cope with a slow or failing server. Faults are only injected when
+// Enabled is set.
+type ChaosPolicy struct {
+	Enabled bool
+
+	// DelayRate is the fraction of requests delayed, each by a random time
+	// up to MaxDelay.
+	DelayRate float64
+	MaxDelay  time.Duration
+
+	// ErrorRate is the fraction of requests answered with a 500 instead of
+	// reaching the handler.
+	ErrorRate float64
+}
+
+// chaos injects the faults described by policy into requests to next. When
+// the policy is not enabled next is returned unchanged.
+func chaos(next http.Handler, policy ChaosPolicy) http.Handler {
+	if !policy.Enabled {
+		return next
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy.MaxDelay > 0 && rand.Float64() < policy.DelayRate {
+			delay := time.Duration(rand.Int63n(int64(policy.MaxDelay)))
+			log.Printf("chaos: delaying request by %s", delay)
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if rand.Float64() < policy.ErrorRate {
+			log.Printf("chaos: failing request")
+			writeJSONError(w, r, http.StatusInternalServerError, internalErrorMessage)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chaosRequests is how many requests the chaos tests send to measure rates.
+const chaosRequests = 2000
+
+func TestChaosInjectsFaultsAtTheConfiguredRates(t *testing.T) {
+	buf := captureLog(t)
+	h := chaos(okHandler, ChaosPolicy{Enabled: true, DelayRate: 0.5, MaxDelay: time.Microsecond, ErrorRate: 0.2})
+
+	failed := 0
+	for i := 0; i < chaosRequests; i++ {
+		switch w := do(h, http.MethodGet, "/widgets/", ""); w.Code {
+		case http.StatusOK:
+		case http.StatusInternalServerError:
+			failed++
+		default:
+			t.Fatalf("got status %d", w.Code)
+		}
+	}
+	delayed := strings.Count(buf.String(), "chaos: delaying request")
+
+	for _, tt := range []struct {
+		name string
+		got  int
+		rate float64
+	}{
+		{"delayed", delayed, 0.5},
+		{"failed", failed, 0.2},
+	} {
+		if got := float64(tt.got) / chaosRequests; math.Abs(got-tt.rate) > 0.05 {
+			t.Errorf("%s %.2f of requests, want about %.2f", tt.name, got, tt.rate)
+		}
+	}
+}
+
+func TestChaosIsOffUnlessEnabled(t *testing.T) {
+	buf := captureLog(t)
+	h := chaos(okHandler, ChaosPolicy{DelayRate: 1, MaxDelay: time.Second, ErrorRate: 1})
+	for i := 0; i < 100; i++ {
+		if w := do(h, http.MethodGet, "/widgets/", ""); w.Code != http.StatusOK {
+			t.Fatalf("got status %d with chaos disabled", w.Code)
+		}
+	}
+	if strings.Contains(buf.String(), "chaos") {
+		t.Errorf("got log %q with chaos disabled", buf.String())
+	}
+
+	cfg, err := loadConfig(nil, lookupIn(map[string]string{"API_CHAOS_ERROR_RATE": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Chaos.Enabled {
+		t.Error("chaos is enabled by default")
+	}
+	if _, err := loadConfig(nil, lookupIn(map[string]string{"API_CHAOS_ERROR_RATE": "1.5"})); err == nil {
+		t.Error("got no error for an error rate above 1")
+	}
+}
+
+func TestChaosFailuresAreInternalErrors(t *testing.T) {
+	h := chaos(okHandler, ChaosPolicy{Enabled: true, ErrorRate: 1})
+	expectError(t, do(h, http.MethodGet, "/widgets/", ""), http.StatusInternalServerError, codeInternal)
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIPResolver determines the address of the client that made a request.
+// Forwarding headers are only honored when the immediate peer is a trusted
+// proxy, since any client can send them.
+type clientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+// newClientIPResolver will construct a clientIPResolver that trusts the given
+// proxies. Each proxy is a CIDR block or a single IP address.
+func newClientIPResolver(proxies []string) (clientIPResolver, error) {
+	var c clientIPResolver
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if len(proxy) == 0 {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return c, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			c.trusted = append(c.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return c, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		c.trusted = append(c.trusted, network)
+	}
+	return c, nil
+}
+
+// clientIP returns the address of the client that made the request. When the
+// peer is a trusted proxy, X-Forwarded-For is read from right to left and the
+// first untrusted address is used, falling back to X-Real-IP.
+func (c clientIPResolver) clientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !c.isTrusted(peer) {
+		return peer
+	}
+
+	// A proxy may add its own header line rather than appending to the
+	// last one, so every line is read, in order.
+	if forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ","); len(forwarded) > 0 {
+		hops := strings.Split(forwarded, ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			client = hop
+			if !c.isTrusted(hop) {
+				break
+			}
+		}
+		if len(client) > 0 {
+			return client
+		}
+	}
+
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+
+	return peer
+}
+
+func (c clientIPResolver) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	resolver, err := newClientIPResolver([]string{"10.0.0.0/8", " 192.0.2.1 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		peer      string
+		forwarded []string
+		real      string
+		want      string
+	}{
+		{name: "untrusted peer without headers", peer: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer spoofing X-Forwarded-For", peer: "203.0.113.5:1234", forwarded: []string{"198.51.100.7"}, want: "203.0.113.5"},
+		{name: "untrusted peer spoofing X-Real-IP", peer: "203.0.113.5:1234", real: "198.51.100.7", want: "203.0.113.5"},
+		{name: "trusted peer", peer: "10.1.2.3:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted single address", peer: "192.0.2.1:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted chain", peer: "10.1.2.3:1234", forwarded: []string{"198.51.100.7, 10.0.0.9"}, want: "198.51.100.7"},
+		{name: "spoofed hop before the client", peer: "10.1.2.3:1234", forwarded: []string{"1.2.3.4, 198.51.100.7, 10.0.0.9"}, want: "198.51.100.7"},
+		{name: "garbage hop", peer: "10.1.2.3:1234", forwarded: []string{"nonsense, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "client line before the proxy's line", peer: "10.1.2.3:1234", forwarded: []string{"1.2.3.4", "198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted peer with X-Real-IP", peer: "10.1.2.3:1234", real: "198.51.100.7", want: "198.51.100.7"},
+		{name: "trusted peer without headers", peer: "10.1.2.3:1234", want: "10.1.2.3"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.peer
+		for _, line := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", line)
+		}
+		if len(tc.real) > 0 {
+			r.Header.Set("X-Real-IP", tc.real)
+		}
+		if got := resolver.clientIP(r); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewClientIPResolverRejectsInvalidProxies(t *testing.T) {
+	for _, proxy := range []string{"10.0.0.0/33", "proxy.example.com"} {
+		if _, err := newClientIPResolver([]string{proxy}); err == nil {
+			t.Errorf("got no error for %q", proxy)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// coalescingStore is a Store decorator that shares one lookup among
+// concurrent gets for the same id, so that a burst of reads for a popular
+// widget reaches the wrapped store once.
+//
+// A write forgets the lookup in flight for its widget, so gets that start
+// after the write never share a lookup that may have read the old widget.
+type coalescingStore struct {
+	Store
+
+	mu    sync.Mutex
+	calls map[string]*getCall
+}
+
+// getCall is a get in flight and, once done is closed, its result.
+type getCall struct {
+	done   chan struct{}
+	widget Widget
+	err    error
+}
+
+// newCoalescingStore will construct a new coalescingStore around the given
+// Store.
+func newCoalescingStore(store Store) *coalescingStore {
+	return &coalescingStore{Store: store, calls: make(map[string]*getCall)}
+}
+
+func (s *coalescingStore) Get(ctx context.Context, id string) (Widget, error) {
+	s.mu.Lock()
+	if c, ok := s.calls[id]; ok {
+		s.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return Widget{}, ctx.Err()
+		}
+		// The lookup ran with the context of the get that started it. If
+		// that get gave up, this one looks for itself.
+		if c.err == context.Canceled || c.err == context.DeadlineExceeded {
+			return s.Store.Get(ctx, id)
+		}
+		return c.widget, c.err
+	}
+	c := &getCall{done: make(chan struct{})}
+	s.calls[id] = c
+	s.mu.Unlock()
+
+	c.widget, c.err = s.Store.Get(ctx, id)
+
+	s.mu.Lock()
+	if s.calls[id] == c {
+		delete(s.calls, id)
+	}
+	s.mu.Unlock()
+	close(c.done)
+	return c.widget, c.err
+}
+
+// forget stops later gets for id sharing the lookup in flight.
+func (s *coalescingStore) forget(id string) {
+	s.mu.Lock()
+	delete(s.calls, id)
+	s.mu.Unlock()
+}
+
+func (s *coalescingStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	stored, created, err := s.Store.Create(ctx, widget)
+	s.forget(stored.ID)
+	return stored, created, err
+}
+
+func (s *coalescingStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	stored, err := s.Store.Put(ctx, widget)
+	s.forget(widget.ID)
+	return stored, err
+}
+
+func (s *coalescingStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	stored, err := s.Store.Update(ctx, id, change)
+	s.forget(id)
+	return stored, err
+}
+
+func (s *coalescingStore) Delete(ctx context.Context, id string) (Widget, error) {
+	widget, err := s.Store.Delete(ctx, id)
+	s.forget(id)
+	return widget, err
+}
+
+// Rename passes through to the wrapped store when it can rename.
+func (s *coalescingStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	renamer, ok := s.Store.(Renamer)
+	if !ok {
+		return Widget{}, ErrNoRename
+	}
+	widget, err := renamer.Rename(ctx, id, newID)
+	s.forget(id)
+	s.forget(newID)
+	return widget, err
+}
+
+func (s *coalescingStore) Reset(ctx context.Context) error {
+	err := s.Store.Reset(ctx)
+	s.mu.Lock()
+	s.calls = make(map[string]*getCall)
+	s.mu.Unlock()
+	return err
+}
+
+// History passes through to the wrapped store when it keeps history.
+func (s *coalescingStore) History(ctx context.Context, id string) ([]Widget, error) {
+	if historian, ok := s.Store.(Historian); ok {
+		return historian.History(ctx, id)
+	}
+	return nil, ErrNoHistory
+}
+
+// Purge passes through to the wrapped store when it can purge.
+func (s *coalescingStore) Purge(id string) {
+	if purger, ok := s.Store.(Purger); ok {
+		purger.Purge(id)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedStore is a Store whose gets wait until release is closed, signalling
+// entered as each one starts.
+type gatedStore struct {
+	Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newGatedStore(store Store) *gatedStore {
+	return &gatedStore{Store: store, entered: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (s *gatedStore) Get(ctx context.Context, id string) (Widget, error) {
+	s.entered <- struct{}{}
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return Widget{}, ctx.Err()
+	}
+	return s.Store.Get(ctx, id)
+}
+
+// waitEntered waits for a get to reach the gate.
+func (s *gatedStore) waitEntered(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.entered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no get reached the store")
+	}
+}
+
+// coalescingTestStore returns a coalescingStore over a gated store holding
+// widget 1, and the counter of gets reaching the gated store.
+func coalescingTestStore(t *testing.T) (*coalescingStore, *gatedStore, *countingStore) {
+	t.Helper()
+	memory := newMemoryStore()
+	if _, _, err := memory.Create(context.Background(), Widget{ID: "1", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	gated := newGatedStore(memory)
+	counting := &countingStore{Store: gated}
+	return newCoalescingStore(counting), gated, counting
+}
+
+func TestCoalescingStoreSharesConcurrentGets(t *testing.T) {
+	store, gated, counting := coalescingTestStore(t)
+	ctx := context.Background()
+
+	const gets = 20
+	var wg sync.WaitGroup
+	results := make(chan Widget, gets)
+	get := func() {
+		defer wg.Done()
+		widget, err := store.Get(ctx, "1")
+		if err != nil {
+			t.Error(err)
+		}
+		results <- widget
+	}
+	wg.Add(gets)
+	go get()
+	gated.waitEntered(t)
+	for i := 1; i < gets; i++ {
+		go get()
+	}
+	// Give the other gets time to join the lookup in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(gated.release)
+	wg.Wait()
+	close(results)
+
+	if n := counting.getCount(); n != 1 {
+		t.Errorf("the store got %d gets, want 1", n)
+	}
+	for widget := range results {
+		if widget.Name != "a" {
+			t.Errorf("got %+v", widget)
+		}
+	}
+
+	// Later gets look again.
+	if _, err := store.Get(ctx, "1"); err != nil || counting.getCount() != 2 {
+		t.Errorf("got %v after %d gets, want a second lookup", err, counting.getCount())
+	}
+}
+
+func TestCoalescingStoreDoesNotShareLookupsAcrossWrites(t *testing.T) {
+	store, gated, counting := coalescingTestStore(t)
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		store.Get(ctx, "1")
+		close(done)
+	}()
+	gated.waitEntered(t)
+
+	if _, err := store.Put(ctx, Widget{ID: "1", Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	after := make(chan Widget, 1)
+	go func() {
+		widget, _ := store.Get(ctx, "1")
+		after <- widget
+	}()
+	gated.waitEntered(t)
+	close(gated.release)
+	<-done
+
+	if widget := <-after; widget.Name != "b" {
+		t.Errorf("a get after a write returned %+v, want the new widget", widget)
+	}
+	if n := counting.getCount(); n != 2 {
+		t.Errorf("the store got %d gets, want 2", n)
+	}
+}
+
+func TestCoalescingStoreRetriesWhenTheSharedLookupIsCanceled(t *testing.T) {
+	store, gated, counting := coalescingTestStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := store.Get(ctx, "1")
+		first <- err
+	}()
+	gated.waitEntered(t)
+
+	joined := make(chan Widget, 1)
+	go func() {
+		widget, err := store.Get(context.Background(), "1")
+		if err != nil {
+			t.Error(err)
+		}
+		joined <- widget
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("the canceled get returned %v", err)
+	}
+	gated.waitEntered(t)
+	close(gated.release)
+
+	if widget := <-joined; widget.Name != "a" {
+		t.Errorf("the joined get returned %+v", widget)
+	}
+	if n := counting.getCount(); n != 2 {
+		t.Errorf("the store got %d gets, want 2", n)
+	}
+}
@@ -0,0 +1,695 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings for the server. Settings are read from
+// API_* environment variables, or the command line flags named after them,
+// in loadConfig and nowhere else.
+type Config struct {
+	// ListenNetwork is tcp, tcp4, tcp6 or unix, and ListenAddress the host
+	// and port, or socket path for unix, to listen on.
+	ListenNetwork string
+	ListenAddress string
+
+	// GRPCListenAddress is the host and port to serve WidgetService on over
+	// gRPC, from the same store, or empty to serve REST alone.
+	GRPCListenAddress string
+
+	// Environment is production or development. Development adds debug
+	// detail to internal error responses.
+	Environment string
+
+	// LogFile is the file logs are written to, rotated once it reaches
+	// LogMaxBytes and keeping LogMaxFiles rotated files. Logs go to stderr
+	// when it is empty, or also to stderr when LogToStderr is set.
+	LogFile     string
+	LogMaxBytes int
+	LogMaxFiles int
+	LogToStderr bool
+
+	// TimeZone is the zone timestamps are written in.
+	TimeZone *time.Location
+
+	// JSONNaming selects the style of JSON field names in responses.
+	JSONNaming string
+
+	// TrustedProxies lists the CIDR blocks or addresses of proxies whose
+	// forwarding headers are believed when resolving the client IP.
+	TrustedProxies []string
+
+	// RequestIDHeaders are the request headers a request ID is read from, in
+	// order of preference. RequestIDResponseHeader is the header it is echoed
+	// in.
+	RequestIDHeaders        []string
+	RequestIDResponseHeader string
+
+	// AdminToken is the bearer token that grants access to every widget
+	// regardless of owner. Admin access is disabled when it is empty.
+	AdminToken string
+
+	// CacheTTL is how long widgets read by id are cached. Zero disables the
+	// cache.
+	CacheTTL time.Duration
+
+	// DedupWindow is how long an identical create by the same owner returns
+	// the widget created first instead of a new one. Zero disables it.
+	DedupWindow time.Duration
+
+	// DefaultSort is the sort key used for lists that do not ask for one.
+	DefaultSort string
+
+	// TruncateDescription shortens descriptions longer than the limit instead
+	// of rejecting them.
+	TruncateDescription bool
+
+	// Limits bounds the values a widget may hold.
+	Limits Limits
+
+	// SlowRequest is the duration after which a request is logged as a
+	// warning. Zero disables the warning.
+	SlowRequest time.Duration
+
+	// OTLPEndpoint is the OpenTelemetry collector that spans are exported
+	// to, such as http://localhost:4318. Tracing is disabled when it is
+	// empty.
+	OTLPEndpoint string
+
+	// WebhookURL receives a POST for every widget created, updated or
+	// deleted, signed with WebhookSecret. Webhooks are disabled when it is
+	// empty.
+	WebhookURL    string
+	WebhookSecret string
+
+	// WebhookWorkers is how many webhooks are delivered at once, and
+	// WebhookQueueSize how many events may wait for delivery. When the queue
+	// is full new events are dropped, or wait if WebhookBlockWhenFull is
+	// set.
+	WebhookWorkers       int
+	WebhookQueueSize     int
+	WebhookBlockWhenFull bool
+
+	// StoreFile is the JSON file widgets are saved to and loaded from. They
+	// are kept in memory only when it is empty.
+	StoreFile string
+
+	// MaxWidgets is the most widgets the store may hold, or zero for no
+	// limit. When it is full creates are refused with 507, or, when
+	// EvictWhenFull is set, the least recently used widget is deleted to
+	// make room.
+	MaxWidgets    int
+	EvictWhenFull bool
+
+	// ArchiveFile receives every deleted widget as a line of JSON. When
+	// ArchiveRequired is set a widget that cannot be archived is not
+	// deleted. Archiving is disabled when it is empty.
+	ArchiveFile     string
+	ArchiveRequired bool
+
+	// EncryptionKey is a base64 encoded AES key used to encrypt
+	// EncryptedFields, such as description, before widgets are stored.
+	// Encryption is disabled when it is empty.
+	EncryptionKey   string
+	EncryptedFields []string
+
+	// IDScheme selects how widget ids are generated: uuid, ulid or sequence.
+	IDScheme string
+
+	// IDSequenceFile keeps the sequence scheme's high-water mark across
+	// restarts. It defaults to StoreFile with a .seq suffix, and when both
+	// are empty the sequence restarts at 1.
+	IDSequenceFile string
+
+	// ReadMaxAge is how long clients and proxies may reuse widget get and
+	// list responses. Zero requires them to revalidate every time.
+	ReadMaxAge time.Duration
+
+	// IDMismatchStatus is the status for a POST to a widget id or a PUT or
+	// DELETE without one: 400, 404 or 405.
+	IDMismatchStatus int
+
+	// ReadOnly rejects every request that could change widgets.
+	ReadOnly bool
+
+	// StaleUpdates is what happens to a PUT whose body gives a revision
+	// other than the stored one: ignore replaces the widget anyway, warn
+	// does too but adds a warning, and reject answers 409.
+	StaleUpdates string
+
+	// EnableTestEndpoints turns on endpoints meant only for integration
+	// tests, such as resetting the store. They must never be on in
+	// production.
+	EnableTestEndpoints bool
+
+	// Chaos injects delays and errors into widget requests. It must never be
+	// enabled in production.
+	Chaos ChaosPolicy
+
+	// EnablePprof mounts the net/http/pprof handlers under /debug/pprof/.
+	// They expose internals and must stay off unless needed.
+	EnablePprof bool
+
+	// RecentRequests is how many of the latest requests are kept in memory
+	// and listed at /debug/requests. The endpoint exposes request paths, so
+	// it is only mounted when EnableRecentRequests is set.
+	EnableRecentRequests bool
+	RecentRequests       int
+
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// once shutdown begins. Zero closes connections immediately.
+	ShutdownTimeout time.Duration
+
+	// PreShutdownDelay is how long the server keeps serving after a signal,
+	// with /readyz failing, so load balancers stop routing to it before
+	// shutdown begins.
+	PreShutdownDelay time.Duration
+
+	// MaxPathLen is the longest escaped request path accepted, in bytes.
+	MaxPathLen int
+
+	// StrictAccept answers 406 to requests whose Accept header names no
+	// format the server can produce. Otherwise they get JSON.
+	StrictAccept bool
+
+	// MaxQueryLen is the longest raw query string accepted, in bytes.
+	MaxQueryLen int
+
+	// MaxBodyBytes is the longest request body accepted. Longer bodies are
+	// refused with 413 before any of the body is read.
+	MaxBodyBytes int
+
+	// MaxJSONDepth is how deeply objects and arrays in a request body, and
+	// selections and values in a GraphQL query, may nest.
+	MaxJSONDepth int
+
+	// DefaultPageSize is how many widgets a list page holds when the request
+	// gives no limit, and MaxPageSize the most any page may hold.
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// MaxListFilters is the most filter parameters one list request may
+	// combine.
+	MaxListFilters int
+
+	// MaxListWaiters is the most list requests that may be held open at once
+	// waiting for a change.
+	MaxListWaiters int
+
+	// MaxInFlight is the most widget requests served at once before others
+	// are turned away with 503, or 0 for no limit.
+	MaxInFlight int
+
+	// MaxBatchIDs is the most ids a single batch get may ask for.
+	MaxBatchIDs int
+
+	// Defaults holds JSON values, keyed by field name, that are applied to
+	// fields missing from a create request.
+	Defaults map[string]json.RawMessage
+
+	// CORS controls which cross-origin requests are allowed.
+	CORS CORSPolicy
+
+	// GzipLevel is the compression level for gzip encoded responses.
+	GzipLevel int
+
+	// Security holds the security headers set on every response. Setting
+	// API_FRAME_OPTIONS or API_CONTENT_SECURITY_POLICY to off leaves that
+	// header out.
+	Security SecurityHeaders
+
+	// ServerTiming adds a Server-Timing header with the time spent in the
+	// store to every response.
+	ServerTiming bool
+}
+
+// loadConfig will construct a Config from the command line flags and the
+// environment, using defaults for any unset values.
+func loadConfig(args []string, getenv func(string) (string, bool)) (Config, error) {
+	src, err := newConfigSource(args, getenv)
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		ListenNetwork:           src.envString("API_LISTEN_NETWORK", "tcp"),
+		ListenAddress:           src.envString("API_LISTEN_ADDRESS", listenAddress),
+		GRPCListenAddress:       src.get("API_GRPC_LISTEN_ADDRESS"),
+		Environment:             src.envString("API_ENV", envProduction),
+		LogFile:                 src.get("API_LOG_FILE"),
+		DefaultSort:             src.envString("API_DEFAULT_SORT", sortCreated),
+		JSONNaming:              src.envString("API_JSON_NAMING", namingSnakeCase),
+		TrustedProxies:          src.envList("API_TRUSTED_PROXIES"),
+		RequestIDHeaders:        src.envList("API_REQUEST_ID_HEADERS"),
+		RequestIDResponseHeader: src.envString("API_REQUEST_ID_RESPONSE_HEADER", defaultRequestIDHeader),
+		AdminToken:              src.get("API_ADMIN_TOKEN"),
+		OTLPEndpoint:            src.get("API_OTLP_ENDPOINT"),
+		IDScheme:                src.envString("API_ID_SCHEME", idSchemeUUID),
+		IDSequenceFile:          src.get("API_ID_SEQUENCE_FILE"),
+		StoreFile:               src.get("API_STORE_FILE"),
+		ArchiveFile:             src.get("API_ARCHIVE_FILE"),
+		EncryptionKey:           src.get("API_ENCRYPTION_KEY"),
+		WebhookURL:              src.get("API_WEBHOOK_URL"),
+		WebhookSecret:           src.get("API_WEBHOOK_SECRET"),
+	}
+
+	if len(cfg.RequestIDHeaders) == 0 {
+		cfg.RequestIDHeaders = []string{defaultRequestIDHeader}
+	}
+
+	cfg.CORS = CORSPolicy{
+		AllowedOrigins: src.envList("API_CORS_ORIGINS"),
+		AllowedHeaders: append([]string{"Authorization", "Content-Type", "X-User", "traceparent"}, cfg.RequestIDHeaders...),
+		ExposedHeaders: []string{"X-Total-Count", "Content-Range", truncatedHeader, "Warning", cfg.RequestIDResponseHeader},
+	}
+
+	if err := checkOriginPatterns(cfg.CORS.AllowedOrigins); err != nil {
+		return cfg, fmt.Errorf("API_CORS_ORIGINS: %s", err)
+	}
+	if path := src.get("API_CORS_ORIGINS_FILE"); len(path) > 0 {
+		if cfg.CORS.OriginsFile, err = loadOriginsFile(path); err != nil {
+			return cfg, fmt.Errorf("API_CORS_ORIGINS_FILE: %s", err)
+		}
+	}
+	if cfg.CORS.Routes, err = parseCORSRoutes(src.envList("API_CORS_ROUTES")); err != nil {
+		return cfg, fmt.Errorf("API_CORS_ROUTES: %s", err)
+	}
+	if cfg.CORS.MaxAge, err = src.envDuration("API_CORS_MAX_AGE", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.CacheTTL, err = src.envDuration("API_CACHE_TTL", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.LogMaxBytes, err = src.envPositiveInt("API_LOG_MAX_BYTES", defaultLogMaxBytes); err != nil {
+		return cfg, err
+	}
+	if cfg.LogMaxFiles, err = src.envNonNegativeInt("API_LOG_MAX_FILES", defaultLogMaxFiles); err != nil {
+		return cfg, err
+	}
+	if cfg.LogToStderr, err = src.envBool("API_LOG_TO_STDERR", false); err != nil {
+		return cfg, err
+	}
+	if cfg.DedupWindow, err = src.envDuration("API_DEDUP_WINDOW", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.EnableTestEndpoints, err = src.envBool("API_ENABLE_TEST_ENDPOINTS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.ShutdownTimeout, err = src.envDuration("API_SHUTDOWN_TIMEOUT", defaultShutdownTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.PreShutdownDelay, err = src.envDuration("API_PRE_SHUTDOWN_DELAY", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.ArchiveRequired, err = src.envBool("API_ARCHIVE_REQUIRED", false); err != nil {
+		return cfg, err
+	}
+	if cfg.TruncateDescription, err = src.envBool("API_TRUNCATE_DESCRIPTION", false); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookWorkers, err = src.envPositiveInt("API_WEBHOOK_WORKERS", defaultWebhookWorkers); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookQueueSize, err = src.envPositiveInt("API_WEBHOOK_QUEUE_SIZE", defaultWebhookQueueSize); err != nil {
+		return cfg, err
+	}
+	if cfg.WebhookBlockWhenFull, err = src.envBool("API_WEBHOOK_BLOCK_WHEN_FULL", false); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxWidgets, err = src.envNonNegativeInt("API_MAX_WIDGETS", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.EvictWhenFull, err = src.envBool("API_EVICT_WHEN_FULL", false); err != nil {
+		return cfg, err
+	}
+	if cfg.IDMismatchStatus, err = src.envInt("API_ID_MISMATCH_STATUS", http.StatusMethodNotAllowed); err != nil {
+		return cfg, err
+	}
+	switch cfg.IDMismatchStatus {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusMethodNotAllowed:
+	default:
+		return cfg, fmt.Errorf("API_ID_MISMATCH_STATUS must be 400, 404 or 405")
+	}
+	if cfg.ReadOnly, err = src.envBool("API_READ_ONLY", false); err != nil {
+		return cfg, err
+	}
+	switch cfg.StaleUpdates = src.envString("API_STALE_UPDATES", staleIgnore); cfg.StaleUpdates {
+	case staleIgnore, staleWarn, staleReject:
+	default:
+		return cfg, fmt.Errorf("API_STALE_UPDATES must be %s, %s or %s", staleIgnore, staleWarn, staleReject)
+	}
+	if cfg.EnablePprof, err = src.envBool("API_ENABLE_PPROF", false); err != nil {
+		return cfg, err
+	}
+	if cfg.EnableRecentRequests, err = src.envBool("API_ENABLE_RECENT_REQUESTS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.RecentRequests, err = src.envPositiveInt("API_RECENT_REQUESTS", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.ReadMaxAge, err = src.envDuration("API_READ_MAX_AGE", 0); err != nil {
+		return cfg, err
+	}
+	slowMS, err := src.envNonNegativeInt("API_SLOW_REQUEST_MS", 1000)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SlowRequest = time.Duration(slowMS) * time.Millisecond
+	if cfg.MaxPathLen, err = src.envPositiveInt("API_MAX_PATH_LEN", 1024); err != nil {
+		return cfg, err
+	}
+	if cfg.Chaos.Enabled, err = src.envBool("API_CHAOS", false); err != nil {
+		return cfg, err
+	}
+	if cfg.Chaos.DelayRate, err = src.envFraction("API_CHAOS_DELAY_RATE", 0.1); err != nil {
+		return cfg, err
+	}
+	if cfg.Chaos.MaxDelay, err = src.envDuration("API_CHAOS_MAX_DELAY", time.Second); err != nil {
+		return cfg, err
+	}
+	if cfg.Chaos.ErrorRate, err = src.envFraction("API_CHAOS_ERROR_RATE", 0.01); err != nil {
+		return cfg, err
+	}
+	if cfg.StrictAccept, err = src.envBool("API_STRICT_ACCEPT", false); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxQueryLen, err = src.envPositiveInt("API_MAX_QUERY_LEN", 2048); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBodyBytes, err = src.envPositiveInt("API_MAX_BODY_BYTES", 1<<20); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxJSONDepth, err = src.envPositiveInt("API_MAX_JSON_DEPTH", 32); err != nil {
+		return cfg, err
+	}
+	if cfg.DefaultPageSize, err = src.envPositiveInt("API_DEFAULT_PAGE_SIZE", defaultPageSize); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxPageSize, err = src.envPositiveInt("API_MAX_PAGE_SIZE", defaultMaxPage); err != nil {
+		return cfg, err
+	}
+	if cfg.DefaultPageSize > cfg.MaxPageSize {
+		return cfg, fmt.Errorf("API_DEFAULT_PAGE_SIZE must not exceed API_MAX_PAGE_SIZE")
+	}
+	if cfg.MaxListFilters, err = src.envNonNegativeInt("API_MAX_LIST_FILTERS", 10); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxListWaiters, err = src.envNonNegativeInt("API_MAX_LIST_WAITERS", 100); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxInFlight, err = src.envNonNegativeInt("API_MAX_IN_FLIGHT", 0); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxBatchIDs, err = src.envPositiveInt("API_MAX_BATCH_IDS", 100); err != nil {
+		return cfg, err
+	}
+	cfg.Security = SecurityHeaders{
+		FrameOptions:          offAsEmpty(src.envString("API_FRAME_OPTIONS", "DENY")),
+		ContentSecurityPolicy: offAsEmpty(src.envString("API_CONTENT_SECURITY_POLICY", "default-src 'none'; frame-ancestors 'none'")),
+	}
+	if cfg.ServerTiming, err = src.envBool("API_SERVER_TIMING", true); err != nil {
+		return cfg, err
+	}
+	if cfg.GzipLevel, err = src.envInt("API_GZIP_LEVEL", gzip.DefaultCompression); err != nil {
+		return cfg, err
+	}
+	if err := validGzipLevel(cfg.GzipLevel); err != nil {
+		return cfg, fmt.Errorf("API_GZIP_LEVEL: %s", err)
+	}
+	if cfg.Limits.MaxNameLen, err = src.envPositiveInt("API_MAX_NAME_LEN", defaultMaxNameLen); err != nil {
+		return cfg, err
+	}
+	if cfg.Limits.MaxDescriptionLen, err = src.envPositiveInt("API_MAX_DESC_LEN", defaultMaxDescriptionLen); err != nil {
+		return cfg, err
+	}
+	if cfg.Limits.MaxQuantity, err = src.envNonNegativeInt("API_MAX_QUANTITY", defaultMaxQuantity); err != nil {
+		return cfg, err
+	}
+	if path := src.get("API_FIELDS_FILE"); len(path) > 0 {
+		if cfg.Limits.Fields, err = loadFieldDefinitions(path); err != nil {
+			return cfg, fmt.Errorf("API_FIELDS_FILE: %s", err)
+		}
+	}
+	if cfg.Limits.MaxAttributes, err = src.envNonNegativeInt("API_MAX_ATTRIBUTES", defaultMaxAttributes); err != nil {
+		return cfg, err
+	}
+	if cfg.Limits.MaxAttributeNameLen, err = src.envPositiveInt("API_MAX_ATTRIBUTE_NAME_LEN", defaultMaxAttributeNameLen); err != nil {
+		return cfg, err
+	}
+	if cfg.Limits.MaxAttributeValueLen, err = src.envPositiveInt("API_MAX_ATTRIBUTE_VALUE_LEN", defaultMaxAttributeValueLen); err != nil {
+		return cfg, err
+	}
+	if cfg.Limits.MaxTags, err = src.envNonNegativeInt("API_MAX_TAGS", defaultMaxTags); err != nil {
+		return cfg, err
+	}
+	if cfg.Limits.MaxTagLen, err = src.envPositiveInt("API_MAX_TAG_LEN", defaultMaxTagLen); err != nil {
+		return cfg, err
+	}
+
+	if len(cfg.WebhookURL) > 0 && len(cfg.WebhookSecret) == 0 {
+		return cfg, fmt.Errorf("API_WEBHOOK_SECRET must be set when API_WEBHOOK_URL is")
+	}
+
+	if cfg.TimeZone, err = time.LoadLocation(src.envString("API_TIMEZONE", "UTC")); err != nil {
+		return cfg, fmt.Errorf("API_TIMEZONE must be a time zone name such as UTC or Europe/Paris: %s", err)
+	}
+
+	cfg.EncryptedFields = src.envList("API_ENCRYPTED_FIELDS")
+	if len(cfg.EncryptedFields) == 0 {
+		cfg.EncryptedFields = []string{"description"}
+	}
+
+	switch cfg.ListenNetwork {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		if _, ok := src.lookup("API_LISTEN_ADDRESS"); !ok {
+			return cfg, fmt.Errorf("API_LISTEN_ADDRESS must be set to a socket path when API_LISTEN_NETWORK is unix")
+		}
+	default:
+		return cfg, fmt.Errorf("API_LISTEN_NETWORK must be tcp, tcp4, tcp6 or unix")
+	}
+
+	if !validSort(cfg.DefaultSort) {
+		return cfg, fmt.Errorf("API_DEFAULT_SORT must be %s, %s, %s, %s, %s or %s", sortCreated, sortCreatedDesc, sortQuantity, sortQuantityDesc, sortUpdated, sortUpdatedDesc)
+	}
+
+	if cfg.Environment != envProduction && cfg.Environment != envDevelopment {
+		return cfg, fmt.Errorf("API_ENV must be %s or %s", envProduction, envDevelopment)
+	}
+
+	if cfg.JSONNaming != namingSnakeCase && cfg.JSONNaming != namingCamelCase {
+		return cfg, fmt.Errorf("API_JSON_NAMING must be %s or %s", namingSnakeCase, namingCamelCase)
+	}
+
+	if v := src.get("API_WIDGET_DEFAULTS"); len(v) > 0 {
+		decoder := json.NewDecoder(strings.NewReader(v))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&Widget{}); err != nil {
+			return cfg, fmt.Errorf("API_WIDGET_DEFAULTS must be a JSON object of widget fields: %s", err)
+		}
+		if err := json.Unmarshal([]byte(v), &cfg.Defaults); err != nil {
+			return cfg, fmt.Errorf("API_WIDGET_DEFAULTS must be a JSON object of widget fields: %s", err)
+		}
+	}
+
+	if _, err := newIDGenerator(cfg.IDScheme, ""); err != nil {
+		return cfg, fmt.Errorf("API_ID_SCHEME: %s", err)
+	}
+	if cfg.IDScheme == idSchemeSequence && len(cfg.IDSequenceFile) == 0 && len(cfg.StoreFile) > 0 {
+		cfg.IDSequenceFile = cfg.StoreFile + ".seq"
+	}
+
+	if _, err := newClientIPResolver(cfg.TrustedProxies); err != nil {
+		return cfg, fmt.Errorf("API_TRUSTED_PROXIES: %s", err)
+	}
+
+	if err := src.unusedFlag(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// configSource looks up settings by their environment variable name. A
+// command line flag overrides the variable it is named after: the name in
+// lowercase without the API_ prefix and with dashes for underscores, so
+// -max-widgets=10 sets API_MAX_WIDGETS. A flag without a value, such as
+// -read-only, is set to true.
+type configSource struct {
+	getenv func(string) (string, bool)
+	flags  map[string]string
+	used   map[string]bool
+}
+
+// newConfigSource will construct a configSource from command line arguments
+// written as -name=value.
+func newConfigSource(args []string, getenv func(string) (string, bool)) (*configSource, error) {
+	s := &configSource{getenv: getenv, flags: make(map[string]string), used: make(map[string]bool)}
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if len(name) == len(arg) || len(name) == 0 {
+			return nil, fmt.Errorf("unexpected argument %q, settings are given as -name=value", arg)
+		}
+		value := "true"
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		s.flags["API_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = value
+	}
+	return s, nil
+}
+
+// lookup returns the flag or, failing that, the environment variable for key.
+func (s *configSource) lookup(key string) (string, bool) {
+	s.used[key] = true
+	if v, ok := s.flags[key]; ok {
+		return v, true
+	}
+	return s.getenv(key)
+}
+
+func (s *configSource) get(key string) string {
+	v, _ := s.lookup(key)
+	return v
+}
+
+// unusedFlag reports a flag that names no setting.
+func (s *configSource) unusedFlag() error {
+	var unknown []string
+	for key := range s.flags {
+		if !s.used[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	name := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(unknown[0], "API_"), "_", "-"))
+	return fmt.Errorf("unknown flag -%s", name)
+}
+
+func (s *configSource) envString(key string, def string) string {
+	if v, ok := s.lookup(key); ok && len(v) > 0 {
+		return v
+	}
+	return def
+}
+
+// envBool reads a boolean such as true or false.
+func (s *configSource) envBool(key string, def bool) (bool, error) {
+	v := s.get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("%s must be true or false", key)
+	}
+	return b, nil
+}
+
+// envDuration reads a non-negative duration such as 30s.
+func (s *configSource) envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := s.get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def, fmt.Errorf("%s must be a non-negative duration", key)
+	}
+	return d, nil
+}
+
+// envInt reads an integer.
+func (s *configSource) envInt(key string, def int) (int, error) {
+	v := s.get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("%s must be an integer", key)
+	}
+	return n, nil
+}
+
+// envNonNegativeInt reads an integer of zero or more.
+func (s *configSource) envNonNegativeInt(key string, def int) (int, error) {
+	v := s.get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return def, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return n, nil
+}
+
+// envPositiveInt reads an integer greater than zero.
+func (s *configSource) envPositiveInt(key string, def int) (int, error) {
+	v := s.get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return def, fmt.Errorf("%s must be a positive integer", key)
+	}
+	return n, nil
+}
+
+// envFraction reads a number between 0 and 1.
+func (s *configSource) envFraction(key string, def float64) (float64, error) {
+	v := s.get(key)
+	if len(v) == 0 {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		return def, fmt.Errorf("%s must be a number between 0 and 1", key)
+	}
+	return f, nil
+}
+
+// offAsEmpty returns v, or the empty string when v is off.
+func offAsEmpty(v string) string {
+	if strings.EqualFold(v, "off") {
+		return ""
+	}
+	return v
+}
+
+// envList reads a comma separated list, dropping empty entries.
+func (s *configSource) envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(s.get(key), ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
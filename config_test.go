@@ -0,0 +1,152 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(nil, lookupIn(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Environment != envProduction || cfg.JSONNaming != namingSnakeCase || cfg.TimeZone.String() != "UTC" {
+		t.Errorf("got environment %s, naming %s, zone %s", cfg.Environment, cfg.JSONNaming, cfg.TimeZone)
+	}
+	if cfg.MaxWidgets != 0 || cfg.ReadOnly || cfg.MaxInFlight != 0 {
+		t.Errorf("got max widgets %d, read only %t, max in flight %d", cfg.MaxWidgets, cfg.ReadOnly, cfg.MaxInFlight)
+	}
+	if cfg.IDScheme != idSchemeUUID || cfg.DefaultSort != sortCreated {
+		t.Errorf("got id scheme %s, default sort %s", cfg.IDScheme, cfg.DefaultSort)
+	}
+	if cfg.GRPCListenAddress != "" {
+		t.Errorf("got gRPC listen address %q, want gRPC off by default", cfg.GRPCListenAddress)
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	env := map[string]string{
+		"API_ENV":                 envDevelopment,
+		"API_JSON_NAMING":         namingCamelCase,
+		"API_TIMEZONE":            "Europe/Paris",
+		"API_MAX_WIDGETS":         "10",
+		"API_READ_ONLY":           "true",
+		"API_GRPC_LISTEN_ADDRESS": "localhost:9090",
+	}
+	cfg, err := loadConfig([]string{"-max-widgets=20", "-max-in-flight=3"}, lookupIn(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Environment != envDevelopment || cfg.JSONNaming != namingCamelCase || cfg.TimeZone.String() != "Europe/Paris" {
+		t.Errorf("got environment %s, naming %s, zone %s", cfg.Environment, cfg.JSONNaming, cfg.TimeZone)
+	}
+	if cfg.MaxWidgets != 20 {
+		t.Errorf("got max widgets %d, want the flag to win over the environment", cfg.MaxWidgets)
+	}
+	if !cfg.ReadOnly || cfg.MaxInFlight != 3 {
+		t.Errorf("got read only %t, max in flight %d", cfg.ReadOnly, cfg.MaxInFlight)
+	}
+	if cfg.GRPCListenAddress != "localhost:9090" {
+		t.Errorf("got gRPC listen address %q", cfg.GRPCListenAddress)
+	}
+}
+
+func TestSequenceFileDefaultsFromTheStoreFile(t *testing.T) {
+	env := map[string]string{"API_ID_SCHEME": idSchemeSequence, "API_STORE_FILE": "/data/widgets.json"}
+	cfg, err := loadConfig(nil, lookupIn(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IDSequenceFile != "/data/widgets.json.seq" {
+		t.Errorf("got sequence file %q", cfg.IDSequenceFile)
+	}
+
+	env["API_ID_SEQUENCE_FILE"] = "/data/ids"
+	if cfg, err = loadConfig(nil, lookupIn(env)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IDSequenceFile != "/data/ids" {
+		t.Errorf("got sequence file %q, want the configured one", cfg.IDSequenceFile)
+	}
+}
+
+func TestLoadConfigRejectsInvalidSettings(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{env: map[string]string{"API_ENV": "staging"}, want: "API_ENV"},
+		{env: map[string]string{"API_JSON_NAMING": "kebab"}, want: "API_JSON_NAMING"},
+		{env: map[string]string{"API_READ_ONLY": "maybe"}, want: "API_READ_ONLY"},
+		{env: map[string]string{"API_ID_MISMATCH_STATUS": "409"}, want: "API_ID_MISMATCH_STATUS"},
+		{env: map[string]string{"API_LISTEN_NETWORK": "udp"}, want: "API_LISTEN_NETWORK"},
+		{env: map[string]string{"API_LISTEN_NETWORK": "unix"}, want: "API_LISTEN_ADDRESS"},
+		{args: []string{"-no-such-setting=1"}, want: "unknown flag -no-such-setting"},
+		{args: []string{"stray"}, want: "unexpected argument"},
+	} {
+		_, err := loadConfig(tc.args, lookupIn(tc.env))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("args %v env %v: got error %v, want one mentioning %s", tc.args, tc.env, err, tc.want)
+		}
+	}
+}
+
+func TestOutputOptionsShapeResponses(t *testing.T) {
+	env := map[string]string{"API_JSON_NAMING": namingCamelCase, "API_TIMEZONE": "Asia/Tokyo"}
+	h := newTestHandler(t, nil, env)
+	handler := withOutput(h, newOutputOptions(h.cfg))
+	created := createWidget(t, handler, `{"name":"a","quantity":1}`)
+
+	w := do(handler, http.MethodGet, "/widgets/"+created.ID, "")
+	body := w.Body.String()
+	if !strings.Contains(body, `"createdAt":"`) || strings.Contains(body, "created_at") {
+		t.Errorf("got %s, want camelCase field names", body)
+	}
+	if !strings.Contains(body, "+09:00") {
+		t.Errorf("got %s, want timestamps in Asia/Tokyo", body)
+	}
+
+	// Without the options responses keep the defaults.
+	w = do(h, http.MethodGet, "/widgets/"+created.ID, "")
+	if body := w.Body.String(); !strings.Contains(body, `"created_at":"`) || !strings.Contains(body, `Z"`) {
+		t.Errorf("got %s, want snake_case names and UTC timestamps", body)
+	}
+}
+
+func TestOutputOptionsDevelopmentErrorDetail(t *testing.T) {
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	for _, tc := range []struct {
+		env       string
+		wantDebug bool
+	}{
+		{env: envProduction, wantDebug: false},
+		{env: envDevelopment, wantDebug: true},
+	} {
+		output := newOutputOptions(testConfig(t, map[string]string{"API_ENV": tc.env}))
+		w := do(withOutput(recoverPanics(panicking), output), http.MethodGet, "/widgets/", "")
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("%s: got status %d", tc.env, w.Code)
+		}
+		if got := strings.Contains(w.Body.String(), `"debug"`); got != tc.wantDebug {
+			t.Errorf("%s: got %s, want debug detail %t", tc.env, w.Body.String(), tc.wantDebug)
+		}
+	}
+}
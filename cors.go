@@ -0,0 +1,226 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy decides which cross-origin requests are allowed and which
+// headers they receive.
+type CORSPolicy struct {
+	// AllowedOrigins lists the origins allowed to make cross-origin
+	// requests, matched as described at originMatches. "*" allows any
+	// origin. CORS is off when it is empty and there is no OriginsFile.
+	AllowedOrigins []string
+
+	// OriginsFile, when set, allows the origins it lists as well. It is
+	// reloaded on SIGHUP.
+	OriginsFile *originsFile
+
+	// Routes limits CORS to requests matching one of these routes. Every
+	// route is allowed when it is empty.
+	Routes []CORSRoute
+
+	// AllowedHeaders are the request headers browsers may send.
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers browsers may read.
+	ExposedHeaders []string
+
+	// MaxAge is how long browsers may cache a preflight response. Zero leaves
+	// it to the browser's default.
+	MaxAge time.Duration
+}
+
+// CORSRoute matches requests by method and path pattern. The pattern uses
+// the same {param} syntax as the router and the method "*" matches any.
+type CORSRoute struct {
+	Method  string
+	Pattern string
+}
+
+// parseCORSRoutes reads routes written as "METHOD /path", such as
+// "GET /widgets/{id}".
+func parseCORSRoutes(specs []string) ([]CORSRoute, error) {
+	var routes []CORSRoute
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "/") {
+			return nil, fmt.Errorf("invalid CORS route %q, expected METHOD /path", spec)
+		}
+		routes = append(routes, CORSRoute{Method: strings.ToUpper(fields[0]), Pattern: fields[1]})
+	}
+	return routes, nil
+}
+
+// checkOriginPatterns reports the first allowed origin that is neither "*",
+// an exact origin, nor a pattern with a single leading wildcard label.
+func checkOriginPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "*" || !strings.Contains(pattern, "*") {
+			continue
+		}
+		host := pattern
+		if i := strings.Index(host, "://"); i >= 0 {
+			host = host[i+3:]
+		}
+		if !strings.HasPrefix(host, "*.") || strings.Contains(host[1:], "*") || len(host) == 2 {
+			return fmt.Errorf("invalid CORS origin %q, a wildcard must be the whole first label, as in https://*.example.com", pattern)
+		}
+	}
+	return nil
+}
+
+// allowsOrigin reports whether the origin may make cross-origin requests.
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if originMatches(allowed, origin) {
+			return true
+		}
+	}
+	for _, allowed := range p.OriginsFile.list() {
+		if originMatches(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches reports whether origin fits the allowed pattern. "*" matches
+// any origin and a pattern without a wildcard only that exact origin.
+//
+// A pattern such as https://*.example.com matches origins on any subdomain of
+// example.com, at any depth, but not example.com itself. The label boundary
+// is part of the match, so evil-example.com and example.com.evil.net are not
+// subdomains of example.com. The scheme and port must be the same as the
+// pattern's, so a pattern without a port matches only origins without one. A
+// pattern without a scheme, such as *.example.com, matches any scheme.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	i := strings.Index(pattern, "*.")
+	if i < 0 {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	scheme, suffix := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+
+	rest := origin
+	if len(scheme) > 0 {
+		if !strings.HasPrefix(origin, scheme) {
+			return false
+		}
+		rest = origin[len(scheme):]
+	} else if j := strings.Index(origin, "://"); j >= 0 {
+		rest = origin[j+3:]
+	}
+	if !strings.HasSuffix(rest, suffix) {
+		return false
+	}
+	return validSubdomain(rest[:len(rest)-len(suffix)])
+}
+
+// validSubdomain reports whether s is one or more dot-separated host labels,
+// so that nothing but a subdomain can stand in for a wildcard.
+func validSubdomain(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if len(label) == 0 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// methodsFor returns the methods CORS is allowed for on the given path, or
+// nil when none are.
+func (p CORSPolicy) methodsFor(path string) []string {
+	if len(p.Routes) == 0 {
+		return []string{"*"}
+	}
+
+	segments := splitPath(path)
+	var methods []string
+	for _, r := range p.Routes {
+		if _, ok := (route{segments: splitPath(r.Pattern)}).match(segments); ok {
+			methods = append(methods, r.Method)
+		}
+	}
+	return methods
+}
+
+// allows reports whether CORS applies to the method on the given path.
+func (p CORSPolicy) allows(method string, path string) bool {
+	for _, m := range p.methodsFor(path) {
+		if m == "*" || m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// cors adds CORS headers, as allowed by the policy, to responses from next.
+// Preflight requests are always answered here with 204 and never reach next;
+// those the policy does not allow simply get no CORS headers.
+func cors(next http.Handler, policy CORSPolicy) http.Handler {
+	if len(policy.AllowedOrigins) == 0 && policy.OriginsFile == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		path := r.URL.EscapedPath()
+		requested := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && len(requested) > 0 {
+			if policy.allowsOrigin(origin) && policy.allows(requested, path) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", requested)
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+				if policy.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if policy.allowsOrigin(origin) && policy.allows(r.Method, path) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if len(policy.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// okHandler answers every request with 200.
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestCORSRoutesLimitWhereHeadersAppear(t *testing.T) {
+	routes, err := parseCORSRoutes([]string{"GET /widgets", "get /widgets/{id}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := cors(okHandler, CORSPolicy{
+		AllowedOrigins: []string{"https://app.example.com"},
+		Routes:         routes,
+		ExposedHeaders: []string{"X-Total-Count"},
+	})
+	origin := []string{"Origin", "https://app.example.com"}
+
+	for _, tc := range []struct {
+		method, target string
+		want           bool
+	}{
+		{http.MethodGet, "/widgets/", true},
+		{http.MethodGet, "/widgets/1", true},
+		{http.MethodDelete, "/widgets/1", false},
+		{http.MethodPost, "/widgets/", false},
+		{http.MethodGet, "/widgets/1/history", false},
+	} {
+		w := do(h, tc.method, tc.target, "", origin...)
+		got := w.Header().Get("Access-Control-Allow-Origin") == "https://app.example.com"
+		if got != tc.want {
+			t.Errorf("%s %s: got CORS headers %t, want %t", tc.method, tc.target, got, tc.want)
+		}
+		if got && w.Header().Get("Access-Control-Expose-Headers") != "X-Total-Count" {
+			t.Errorf("%s %s: got Access-Control-Expose-Headers %q", tc.method, tc.target, w.Header().Get("Access-Control-Expose-Headers"))
+		}
+	}
+
+	// Preflights follow the same routes.
+	w := do(h, http.MethodOptions, "/widgets/1", "", "Origin", "https://app.example.com", "Access-Control-Request-Method", http.MethodDelete)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); len(got) > 0 {
+		t.Errorf("got Access-Control-Allow-Origin %q on a preflight for an excluded route", got)
+	}
+	w = do(h, http.MethodOptions, "/widgets/1", "", "Origin", "https://app.example.com", "Access-Control-Request-Method", http.MethodGet)
+	if got := w.Header().Get("Access-Control-Allow-Methods"); got != http.MethodGet {
+		t.Errorf("got Access-Control-Allow-Methods %q on a preflight for an allowed route", got)
+	}
+}
+
+func TestParseCORSRoutesRejectsMalformedRoutes(t *testing.T) {
+	for _, spec := range []string{"/widgets", "GET widgets", "GET /widgets extra"} {
+		if _, err := parseCORSRoutes([]string{spec}); err == nil {
+			t.Errorf("%q: got no error", spec)
+		}
+	}
+}
+
+func TestCORSPreflightNeverReachesTheHandler(t *testing.T) {
+	reached := false
+	h := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}), CORSPolicy{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedHeaders: []string{"Content-Type"},
+		MaxAge:         10 * time.Minute,
+	})
+
+	for _, origin := range []string{"https://app.example.com", "https://evil.example.com"} {
+		w := do(h, http.MethodOptions, "/widgets/1", "", "Origin", origin, "Access-Control-Request-Method", http.MethodPut)
+		if w.Code != http.StatusNoContent || reached {
+			t.Fatalf("%s: preflight answered %d, reached the handler %t", origin, w.Code, reached)
+		}
+		allowed := origin == "https://app.example.com"
+		if got := w.Header().Get("Access-Control-Allow-Origin"); (got == origin) != allowed {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q", origin, got)
+		}
+		if got := w.Header().Get("Access-Control-Max-Age"); allowed && got != "600" {
+			t.Errorf("%s: got Access-Control-Max-Age %q, want 600", origin, got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Headers"); allowed && got != "Content-Type" {
+			t.Errorf("%s: got Access-Control-Allow-Headers %q", origin, got)
+		}
+	}
+
+	// Plain OPTIONS requests are not preflights and reach the handler.
+	do(h, http.MethodOptions, "/widgets/1", "", "Origin", "https://app.example.com")
+	if !reached {
+		t.Error("an OPTIONS request without Access-Control-Request-Method did not reach the handler")
+	}
+}
+
+func TestOriginMatchesWildcardSubdomains(t *testing.T) {
+	const pattern = "https://*.example.com"
+	for _, tt := range []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://APP.Example.COM", true},
+		{"https://app-1.example.com", true},
+		{"https://example.com", false},
+		{"https://.example.com", false},
+		{"https://evil-example.com", false},
+		{"https://evilexample.com", false},
+		{"https://app.example.com.evil.net", false},
+		{"https://app.example.com:8443", false},
+		{"http://app.example.com", false},
+		{"https://evil.net/.example.com", false},
+		{"https://evil.net?.example.com", false},
+		{"https://user@app.example.com", false},
+		{"https://a..example.com", false},
+	} {
+		if got := originMatches(pattern, tt.origin); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"*.example.com", "http://app.example.com", true},
+		{"*.example.com", "https://app.example.com", true},
+		{"*.example.com", "https://example.com", false},
+		{"https://*.example.com:8443", "https://app.example.com:8443", true},
+		{"https://*.example.com:8443", "https://app.example.com", false},
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "https://other.example.com", false},
+		{"*", "https://anything.test", true},
+	} {
+		if got := originMatches(tt.pattern, tt.origin); got != tt.want {
+			t.Errorf("%s against %s: got %t, want %t", tt.origin, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOriginPatterns(t *testing.T) {
+	if err := checkOriginPatterns([]string{"*", "https://app.example.com", "https://*.example.com", "*.example.com"}); err != nil {
+		t.Errorf("got %s for valid patterns", err)
+	}
+	for _, pattern := range []string{"https://app.*.com", "https://*example.com", "https://*.*.example.com", "https://*."} {
+		if err := checkOriginPatterns([]string{pattern}); err == nil {
+			t.Errorf("%s: got no error", pattern)
+		}
+	}
+}
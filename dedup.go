@@ -0,0 +1,101 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// createDeduper remembers recent creates so that an identical create arriving
+// shortly after, such as from a double-click, returns the first widget rather
+// than making a second one.
+//
+// This is a heuristic. Two widgets with the same owner, name, description,
+// quantity, status, tags and attributes created within the window are
+// assumed to be accidental duplicates, and two identical creates racing each
+// other may both get through.
+type createDeduper struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu     sync.Mutex
+	recent map[string]recentCreate
+}
+
+type recentCreate struct {
+	id      string
+	expires time.Time
+}
+
+// newCreateDeduper will construct a new createDeduper with the given window,
+// or return nil when the window is zero.
+func newCreateDeduper(window time.Duration) *createDeduper {
+	if window <= 0 {
+		return nil
+	}
+	return &createDeduper{
+		window: window,
+		now:    time.Now,
+		recent: make(map[string]recentCreate),
+	}
+}
+
+// dedupKey identifies widgets that are considered duplicates of each other.
+// Tags and attributes are keyed by their JSON encoding, so that tags holding
+// commas cannot run together and, since map keys are sorted, the same
+// attributes sent in any order give the same key.
+func dedupKey(widget Widget) string {
+	tags, _ := json.Marshal(widget.Tags)
+	attributes, _ := json.Marshal(widget.Attributes)
+	return widget.OwnerID + "\x00" + widget.Name + "\x00" + widget.Description + "\x00" + strconv.Itoa(widget.Quantity) +
+		"\x00" + widget.Status + "\x00" + string(tags) + "\x00" + string(attributes)
+}
+
+// lookup returns the id of a widget created with the same key within the
+// window. A nil createDeduper never finds one.
+func (d *createDeduper) lookup(key string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.recent[key]
+	if !ok || !d.now().Before(entry.expires) {
+		return "", false
+	}
+	return entry.id, true
+}
+
+// remember records that the widget with the given id was just created, and
+// drops entries whose window has passed.
+func (d *createDeduper) remember(key, id string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	for k, entry := range d.recent {
+		if !now.Before(entry.expires) {
+			delete(d.recent, k)
+		}
+	}
+	d.recent[key] = recentCreate{id: id, expires: now.Add(d.window)}
+}
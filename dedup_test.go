@@ -0,0 +1,87 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDedupWindowReturnsTheFirstWidget(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_DEDUP_WINDOW": "5s"})
+	clock := time.Now()
+	h.dedup.now = func() time.Time { return clock }
+
+	first := createWidget(t, h, `{"name":"a","description":"d"}`)
+	w := do(h, http.MethodPost, "/widgets/", `{"name":"a","description":"d"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("duplicate within the window answered %d, want 200", w.Code)
+	}
+	var resp struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, w, &resp)
+	if resp.Widget.ID != first.ID {
+		t.Errorf("got widget %s, want the first widget %s", resp.Widget.ID, first.ID)
+	}
+
+	clock = clock.Add(6 * time.Second)
+	if second := createWidget(t, h, `{"name":"a","description":"d"}`); second.ID == first.ID {
+		t.Error("a create outside the window returned the first widget")
+	}
+}
+
+func TestDedupWindowTellsApartDifferentWidgets(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{
+		"API_DEDUP_WINDOW": "5s",
+		"API_FIELDS_FILE":  writeFieldsFile(t, `[{"name":"color","type":"string"},{"name":"size","type":"integer"}]`),
+	})
+
+	seen := make(map[string]bool)
+	for _, body := range []string{
+		`{"name":"a"}`,
+		`{"name":"a","description":"d"}`,
+		`{"name":"a","quantity":1}`,
+		`{"name":"a","status":"active"}`,
+		`{"name":"a","tags":["x"]}`,
+		`{"name":"a","tags":["x,y"]}`,
+		`{"name":"a","tags":["x","y"]}`,
+		`{"name":"a","attributes":{"color":"red"}}`,
+		`{"name":"a","attributes":{"color":"blue"}}`,
+	} {
+		widget := createWidget(t, h, body)
+		if seen[widget.ID] {
+			t.Errorf("%s was taken as a duplicate", body)
+		}
+		seen[widget.ID] = true
+	}
+}
+
+func TestDedupKeyIgnoresAttributeOrder(t *testing.T) {
+	a := Widget{Name: "a", Attributes: map[string]interface{}{"color": "red", "size": 1}}
+	b := Widget{Name: "a", Attributes: map[string]interface{}{"size": 1, "color": "red"}}
+	if dedupKey(a) != dedupKey(b) {
+		t.Error("the same attributes gave different keys")
+	}
+}
+
+func TestDedupSkipsCreatesWithClientTokens(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_DEDUP_WINDOW": "5s"})
+	first := createWidget(t, h, `{"name":"a","client_token":"one"}`)
+	if second := createWidget(t, h, `{"name":"a","client_token":"two"}`); second.ID == first.ID {
+		t.Error("creates with different client tokens were deduplicated")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// diffIgnoredFields are widget fields that change with every revision and so
+// are left out of diffs.
+var diffIgnoredFields = map[string]bool{
+	"id":         true,
+	"revision":   true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// fieldChange is the value of one widget field in two revisions.
+type fieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// diff returns the fields that differ between two kept revisions of the widget
+// with the given id, named by the from and to query parameters as in v1 or 1.
+// Without to, the latest revision is used.
+func (h WidgetHandler) diff(w http.ResponseWriter, r *http.Request, id string) {
+	current, err := h.find(r, id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	if err := checkSingleValues(query, "from", "to"); err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseRevision(query.Get("from"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	to := current.Revision
+	if v := query.Get("to"); len(v) > 0 {
+		if to, err = parseRevision(v); err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	historian, ok := h.store.(Historian)
+	if !ok {
+		writeJSONError(w, r, http.StatusNotFound, "The store keeps no widget history.")
+		return
+	}
+	history, err := historian.History(r.Context(), id)
+	if err == ErrNoHistory {
+		writeJSONError(w, r, http.StatusNotFound, "The store keeps no widget history.")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	older, ok := findRevision(history, from)
+	if !ok {
+		writeJSONError(w, r, http.StatusNotFound, "Revision "+strconv.Itoa(from)+" of the widget could not be found.")
+		return
+	}
+	newer, ok := findRevision(history, to)
+	if !ok {
+		writeJSONError(w, r, http.StatusNotFound, "Revision "+strconv.Itoa(to)+" of the widget could not be found.")
+		return
+	}
+
+	changes, err := diffWidgets(older, newer, outputFor(r))
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if err := writeResponse(w, r, http.StatusOK, map[string]interface{}{
+		"id":      id,
+		"from":    from,
+		"to":      to,
+		"changes": changes,
+	}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// parseRevision reads a revision written as v1 or 1.
+func parseRevision(v string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+	if err != nil || n < 1 {
+		return 0, errors.New("The from and to parameters must be revisions such as v1.")
+	}
+	return n, nil
+}
+
+// findRevision returns the given revision from a widget's history.
+func findRevision(history []Widget, revision int) (Widget, bool) {
+	for _, widget := range history {
+		if widget.Revision == revision {
+			return widget, true
+		}
+	}
+	return Widget{}, false
+}
+
+// diffWidgets returns the fields whose JSON values differ between two
+// revisions, keyed by field name in the style of output.
+func diffWidgets(older, newer Widget, output outputOptions) (map[string]fieldChange, error) {
+	a, err := widgetFields(older)
+	if err != nil {
+		return nil, err
+	}
+	b, err := widgetFields(newer)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]fieldChange)
+	for _, fields := range []map[string]interface{}{a, b} {
+		for name := range fields {
+			if diffIgnoredFields[name] || reflect.DeepEqual(a[name], b[name]) {
+				continue
+			}
+			changes[output.fieldName(name)] = fieldChange{From: a[name], To: b[name]}
+		}
+	}
+	return changes, nil
+}
+
+// widgetFields decodes the widget's JSON form into a map of field values.
+func widgetFields(widget Widget) (map[string]interface{}, error) {
+	b, err := json.Marshal(widget)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := unmarshalNumbers(b, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
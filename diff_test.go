@@ -0,0 +1,93 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// widgetDiff is the body of a diff response.
+type widgetDiff struct {
+	ID      string
+	From    int
+	To      int
+	Changes map[string]fieldChange
+}
+
+func TestDiffBetweenRecordedRevisions(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a","quantity":1}`)
+	for _, body := range []string{`{"name":"b","quantity":2}`, `{"name":"b","quantity":2,"description":"d"}`} {
+		if w := do(h, http.MethodPut, "/widgets/"+widget.ID, body); w.Code != http.StatusOK {
+			t.Fatalf("update answered %d: %s", w.Code, w.Body)
+		}
+	}
+
+	for _, tt := range []struct {
+		query    string
+		from, to int
+		changed  string
+	}{
+		{"from=v1&to=v2", 1, 2, "name,quantity"},
+		{"from=2&to=v3", 2, 3, "description"},
+		{"from=v1", 1, 3, "description,name,quantity"},
+		{"from=v3&to=v3", 3, 3, ""},
+	} {
+		w := do(h, http.MethodGet, "/widgets/"+widget.ID+"/diff?"+tt.query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", tt.query, w.Code, w.Body)
+		}
+		var diff widgetDiff
+		decodeBody(t, w, &diff)
+		if diff.ID != widget.ID || diff.From != tt.from || diff.To != tt.to {
+			t.Errorf("%s: got diff of %s from %d to %d", tt.query, diff.ID, diff.From, diff.To)
+		}
+		var changed []string
+		for name := range diff.Changes {
+			changed = append(changed, name)
+		}
+		sort.Strings(changed)
+		if got := strings.Join(changed, ","); got != tt.changed {
+			t.Errorf("%s: changed %s, want %s", tt.query, got, tt.changed)
+		}
+	}
+
+	w := do(h, http.MethodGet, "/widgets/"+widget.ID+"/diff?from=v1&to=v2", "")
+	var diff widgetDiff
+	decodeBody(t, w, &diff)
+	if c := diff.Changes["name"]; c.From != "a" || c.To != "b" {
+		t.Errorf("got name change %+v, want a to b", c)
+	}
+	if c := diff.Changes["quantity"]; c.From != 1.0 || c.To != 2.0 {
+		t.Errorf("got quantity change %+v, want 1 to 2", c)
+	}
+}
+
+func TestDiffRejectsUnknownRevisions(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a"}`)
+
+	e := expectError(t, do(h, http.MethodGet, "/widgets/"+widget.ID+"/diff?from=v1&to=v9", ""), http.StatusNotFound, codeNotFound)
+	if e.Error != "Revision 9 of the widget could not be found." {
+		t.Errorf("got %q", e.Error)
+	}
+	expectError(t, do(h, http.MethodGet, "/widgets/nope/diff?from=v1", ""), http.StatusNotFound, codeNotFound)
+	for _, query := range []string{"", "from=v0", "from=first", "from=v1&to=x", "from=1&from=2"} {
+		expectError(t, do(h, http.MethodGet, "/widgets/"+widget.ID+"/diff?"+query, ""), http.StatusBadRequest, codeBadRequest)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// encryptedPrefix marks a field value encrypted by a fieldCipher.
+const encryptedPrefix = "enc:v1:"
+
+// errDecrypt is returned when a stored field cannot be decrypted, such as
+// when the key has changed.
+var errDecrypt = errors.New("unable to decrypt widget field")
+
+// fieldCipher encrypts text fields with AES-GCM. Each value gets a fresh
+// random nonce, which is stored in front of the ciphertext, and is sealed
+// with the id of its widget and the name of its field as additional data, so
+// that a value moved to another field or widget fails to decrypt.
+type fieldCipher struct {
+	aead cipher.AEAD
+}
+
+// newFieldCipher will construct a new fieldCipher from a base64 encoded
+// AES-128, AES-192 or AES-256 key.
+func newFieldCipher(encodedKey string) (*fieldCipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.New("the key must be base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("the key must be 16, 24 or 32 bytes")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fieldCipher{aead: aead}, nil
+}
+
+// additionalData is what a value of the given widget field is sealed with.
+func additionalData(id string, field string) []byte {
+	return []byte(id + "\x00" + field)
+}
+
+func (c *fieldCipher) encrypt(plaintext string, data []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), data)
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt returns the plaintext of value. Values without the encrypted prefix
+// were stored before encryption was turned on and are returned as they are.
+func (c *fieldCipher) decrypt(value string, data []byte) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errDecrypt
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, data)
+	if err != nil {
+		return "", errDecrypt
+	}
+	return string(plaintext), nil
+}
+
+// encryptingStore is a Store decorator that encrypts the configured fields of
+// every widget before passing it to the wrapped store, and decrypts them on
+// the way back, so the wrapped store only ever holds ciphertext.
+type encryptingStore struct {
+	Store
+
+	cipher *fieldCipher
+	fields []string
+}
+
+// newEncryptingStore will construct a new encryptingStore around the given
+// Store that encrypts the named fields.
+func newEncryptingStore(store Store, c *fieldCipher, fields []string) (encryptingStore, error) {
+	for _, field := range fields {
+		if field != "name" && field != "description" {
+			return encryptingStore{}, fmt.Errorf("%s is not a field that can be encrypted", field)
+		}
+	}
+	return encryptingStore{Store: store, cipher: c, fields: fields}, nil
+}
+
+// transform applies fn to each configured field of widget, passing the
+// additional data for the field of the widget with the given id.
+func (s encryptingStore) transform(widget Widget, id string, fn func(string, []byte) (string, error)) (Widget, error) {
+	for _, field := range s.fields {
+		var value *string
+		switch field {
+		case "name":
+			value = &widget.Name
+		case "description":
+			value = &widget.Description
+		}
+		v, err := fn(*value, additionalData(id, field))
+		if err != nil {
+			return Widget{}, fmt.Errorf("widget %s %s: %w", widget.ID, field, err)
+		}
+		*value = v
+	}
+	return widget, nil
+}
+
+func (s encryptingStore) seal(widget Widget) (Widget, error) {
+	return s.transform(widget, widget.ID, s.cipher.encrypt)
+}
+
+func (s encryptingStore) open(widget Widget, err error) (Widget, error) {
+	if err != nil {
+		return widget, err
+	}
+	return s.transform(widget, widget.ID, s.cipher.decrypt)
+}
+
+// openAs decrypts a widget whose fields were sealed under the given id, as
+// the revision a rename stores is.
+func (s encryptingStore) openAs(widget Widget, id string) (Widget, error) {
+	return s.transform(widget, id, s.cipher.decrypt)
+}
+
+func (s encryptingStore) List(ctx context.Context) ([]Widget, error) {
+	widgets, err := s.Store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range widgets {
+		if widgets[i], err = s.open(widgets[i], nil); err != nil {
+			return nil, err
+		}
+	}
+	return widgets, nil
+}
+
+func (s encryptingStore) Get(ctx context.Context, id string) (Widget, error) {
+	return s.open(s.Store.Get(ctx, id))
+}
+
+func (s encryptingStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	sealed, err := s.seal(widget)
+	if err != nil {
+		return Widget{}, false, err
+	}
+	stored, created, err := s.Store.Create(ctx, sealed)
+	stored, err = s.open(stored, err)
+	return stored, created, err
+}
+
+func (s encryptingStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	sealed, err := s.seal(widget)
+	if err != nil {
+		return Widget{}, err
+	}
+	return s.open(s.Store.Put(ctx, sealed))
+}
+
+func (s encryptingStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	return s.open(s.Store.Update(ctx, id, func(widget Widget) (Widget, error) {
+		widget, err := s.open(widget, nil)
+		if err != nil {
+			return widget, err
+		}
+		if widget, err = change(widget); err != nil {
+			return widget, err
+		}
+		widget.ID = id
+		return s.seal(widget)
+	}))
+}
+
+func (s encryptingStore) Delete(ctx context.Context, id string) (Widget, error) {
+	return s.open(s.Store.Delete(ctx, id))
+}
+
+// Rename passes through to the wrapped store when it can rename. The wrapped
+// store moves the fields as they were sealed, under the old id, so they are
+// sealed again under the new one as a further revision.
+func (s encryptingStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	renamer, ok := s.Store.(Renamer)
+	if !ok {
+		return Widget{}, ErrNoRename
+	}
+	if _, err := renamer.Rename(ctx, id, newID); err != nil {
+		return Widget{}, err
+	}
+	return s.open(s.Store.Update(ctx, newID, func(widget Widget) (Widget, error) {
+		widget, err := s.openAs(widget, id)
+		if err != nil {
+			return widget, err
+		}
+		return s.seal(widget)
+	}))
+}
+
+// History passes through to the wrapped store when it keeps history,
+// decrypting every revision. A revision stored by a rename is still sealed
+// under the id of the revision before it.
+func (s encryptingStore) History(ctx context.Context, id string) ([]Widget, error) {
+	historian, ok := s.Store.(Historian)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	history, err := historian.History(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range history {
+		revision := history[i]
+		if history[i], err = s.open(revision, nil); err != nil && i > 0 && history[i-1].ID != revision.ID {
+			history[i], err = s.openAs(revision, history[i-1].ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// Purge passes through to the wrapped store when it can purge.
+func (s encryptingStore) Purge(id string) {
+	if purger, ok := s.Store.(Purger); ok {
+		purger.Purge(id)
+	}
+}
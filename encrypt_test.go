@@ -0,0 +1,189 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestCipher returns a fieldCipher for a key made of repeated b.
+func newTestCipher(t *testing.T, b byte) *fieldCipher {
+	t.Helper()
+	c, err := newFieldCipher(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEncryptingStoreStoresCiphertext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "widgets.json")
+	file, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newEncryptingStore(file, newTestCipher(t, 1), []string{"description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	created, _, err := store.Create(ctx, Widget{ID: "1", Name: "gear", Description: "top secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Description != "top secret" {
+		t.Errorf("create returned description %q", created.Description)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("top secret")) || !bytes.Contains(data, []byte(encryptedPrefix)) {
+		t.Errorf("the file holds %s, want an encrypted description", data)
+	}
+	if !bytes.Contains(data, []byte("gear")) {
+		t.Errorf("the file holds %s, want a plaintext name", data)
+	}
+
+	got, err := store.Get(ctx, "1")
+	if err != nil || got.Description != "top secret" {
+		t.Errorf("got %q, %v, want the plaintext description", got.Description, err)
+	}
+	if _, err := store.Update(ctx, "1", func(w Widget) (Widget, error) {
+		w.Description += "!"
+		return w, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	widgets, err := store.List(ctx)
+	if err != nil || len(widgets) != 1 || widgets[0].Description != "top secret!" {
+		t.Errorf("listed %+v, %v", widgets, err)
+	}
+}
+
+func TestEncryptingStoreFailsCleanlyWithTheWrongKey(t *testing.T) {
+	memory := newMemoryStore()
+	store, _ := newEncryptingStore(memory, newTestCipher(t, 1), []string{"description"})
+	ctx := context.Background()
+	if _, _, err := store.Create(ctx, Widget{ID: "1", Description: "top secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong, _ := newEncryptingStore(memory, newTestCipher(t, 2), []string{"description"})
+	if _, err := wrong.Get(ctx, "1"); !errors.Is(err, errDecrypt) {
+		t.Errorf("got %v, want %v", err, errDecrypt)
+	}
+	if _, err := wrong.List(ctx); !errors.Is(err, errDecrypt) {
+		t.Errorf("got %v, want %v", err, errDecrypt)
+	}
+}
+
+func TestEncryptingStoreReadsPlaintextWrittenBeforeEncryption(t *testing.T) {
+	memory := newMemoryStore()
+	ctx := context.Background()
+	if _, _, err := memory.Create(ctx, Widget{ID: "1", Description: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := newEncryptingStore(memory, newTestCipher(t, 1), []string{"description"})
+	if got, err := store.Get(ctx, "1"); err != nil || got.Description != "old" {
+		t.Errorf("got %q, %v", got.Description, err)
+	}
+}
+
+func TestNewFieldCipherAndStoreValidateConfiguration(t *testing.T) {
+	for _, key := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := newFieldCipher(key); err == nil {
+			t.Errorf("key %q was accepted", key)
+		}
+	}
+	if _, err := newEncryptingStore(newMemoryStore(), newTestCipher(t, 1), []string{"quantity"}); err == nil || !strings.Contains(err.Error(), "quantity") {
+		t.Errorf("got %v, want an error about quantity", err)
+	}
+}
+
+func TestEncryptedFieldsCannotBeMovedBetweenFieldsOrWidgets(t *testing.T) {
+	memory := newMemoryStore()
+	store, _ := newEncryptingStore(memory, newTestCipher(t, 1), []string{"name", "description"})
+	ctx := context.Background()
+	for _, id := range []string{"1", "2"} {
+		if _, _, err := store.Create(ctx, Widget{ID: id, Name: "gear " + id, Description: "secret " + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	one, _ := memory.Get(ctx, "1")
+	two, _ := memory.Get(ctx, "2")
+
+	swapped := one
+	swapped.Name, swapped.Description = one.Description, one.Name
+	moved := two
+	moved.Description = one.Description
+	for _, w := range []Widget{swapped, moved} {
+		if _, err := memory.Put(ctx, w); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get(ctx, w.ID); !errors.Is(err, errDecrypt) {
+			t.Errorf("widget %s: got %v, want %v", w.ID, err, errDecrypt)
+		}
+	}
+}
+
+func TestResponsesLogNoPayload(t *testing.T) {
+	buf := captureLog(t)
+	store, _ := newEncryptingStore(newMemoryStore(), newTestCipher(t, 1), []string{"description"})
+	h := newTestHandler(t, store, nil)
+	widget := createWidget(t, h, `{"name":"gear","description":"top secret"}`)
+	if w := do(h, http.MethodGet, "/widgets/"+widget.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if strings.Contains(buf.String(), "top secret") {
+		t.Errorf("the log holds a decrypted field:\n%s", buf)
+	}
+	if !strings.Contains(buf.String(), "wrote application/json response code 200 with") {
+		t.Errorf("the log does not record the response:\n%s", buf)
+	}
+}
+
+func TestEncryptingStoreRenamesUnderTheNewID(t *testing.T) {
+	store, _ := newEncryptingStore(newMemoryStore(), newTestCipher(t, 1), []string{"description"})
+	ctx := context.Background()
+	if _, _, err := store.Create(ctx, Widget{ID: "1", Description: "top secret"}); err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := store.Rename(ctx, "1", "2")
+	if err != nil || renamed.ID != "2" || renamed.Description != "top secret" {
+		t.Fatalf("renamed to %+v, %v", renamed, err)
+	}
+	if got, err := store.Get(ctx, "2"); err != nil || got.Description != "top secret" {
+		t.Errorf("got %q, %v", got.Description, err)
+	}
+	history, err := store.History(ctx, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, revision := range history {
+		if revision.Description != "top secret" {
+			t.Errorf("revision %d has description %q", revision.Revision, revision.Description)
+		}
+	}
+}
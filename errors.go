@@ -0,0 +1,186 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+const (
+	envProduction  = "production"
+	envDevelopment = "development"
+)
+
+// maxStackLen bounds the stack trace included in development error responses.
+const maxStackLen = 4096
+
+const internalErrorMessage = "An unexpected error occurred."
+
+// Machine-readable error codes returned alongside error messages. Unlike the
+// messages they never change with the client's language.
+const (
+	codeBadRequest           = "bad_request"
+	codeUnauthorized         = "unauthorized"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codePathTooLong          = "path_too_long"
+	codeQueryTooLong         = "query_too_long"
+	codeBodyTooLarge         = "body_too_large"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeValidationFailed     = "validation_failed"
+	codeInternal             = "internal_error"
+	codeUnavailable          = "unavailable"
+	codeNotApplied           = "not_applied"
+	codeNegativeQuantity     = "negative_quantity"
+	codeReadOnly             = "read_only"
+	codeInvalidTransition    = "invalid_transition"
+	codeStaleRevision        = "stale_revision"
+	codeIDTaken              = "id_taken"
+)
+
+// errorCode returns the default error code for an HTTP status.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeBadRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusRequestURITooLong:
+		return codePathTooLong
+	case http.StatusRequestEntityTooLarge:
+		return codeBodyTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codeUnsupportedMediaType
+	case http.StatusUnprocessableEntity:
+		return codeValidationFailed
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	case http.StatusInternalServerError:
+		return codeInternal
+	}
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// statusError is an error meant for the client, carrying the status it would
+// be reported with and, optionally, a more specific code than the status's.
+type statusError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e statusError) Error() string {
+	return e.message
+}
+
+// clientErrorCode returns the error code for an error reported to the client
+// outside of a response status, such as in a bulk update result.
+func clientErrorCode(err error) string {
+	var serr statusError
+	var verr ValidationError
+	switch {
+	case errors.As(err, &serr) && len(serr.code) > 0:
+		return serr.code
+	case errors.As(err, &serr):
+		return errorCode(serr.status)
+	case errors.As(err, &verr):
+		return codeValidationFailed
+	}
+	return codeBadRequest
+}
+
+// writeInternalError logs err and writes a 500 response for it, unless err
+// came from writing a response that was already under way.
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	// Once a response is under way another cannot be written.
+	var werr responseWriteError
+	if errors.As(err, &werr) {
+		if clientGone(err) {
+			log.Printf("client closed the connection before the response was written %s", err)
+		} else {
+			log.Printf("%s", err)
+		}
+		return
+	}
+
+	log.Printf("internal error %s", err)
+	writeErrorDetail(w, r, http.StatusInternalServerError, internalErrorMessage, map[string]interface{}{
+		"errors": errorChain(err),
+	})
+}
+
+// writeErrorDetail writes an error response with message. The given debug
+// detail is only included in development; in production the response only
+// says that something went wrong and the detail is logged.
+func writeErrorDetail(w http.ResponseWriter, r *http.Request, status int, message string, detail map[string]interface{}) error {
+	if !outputFor(r).development {
+		return writeJSONError(w, r, status, message)
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	return writeJSON(w, r, status, map[string]interface{}{
+		"code":  errorCode(status),
+		"error": translate(r, message),
+		"debug": detail,
+	})
+}
+
+// errorChain returns the message of err and of every error it wraps, from the
+// outermost in.
+func errorChain(err error) []string {
+	var chain []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		chain = append(chain, err.Error())
+	}
+	return chain
+}
+
+// recoverPanics turns a panic in next into a 500 response. The stack is
+// logged, and returned truncated in development.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			stack := debug.Stack()
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rec, stack)
+			if len(stack) > maxStackLen {
+				stack = stack[:maxStackLen]
+			}
+			writeErrorDetail(w, r, http.StatusInternalServerError, internalErrorMessage, map[string]interface{}{
+				"panic": fmt.Sprint(rec),
+				"stack": strings.Split(strings.TrimSpace(string(stack)), "\n"),
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
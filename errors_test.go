@@ -0,0 +1,182 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// debugError is the body of an error response with development detail.
+type debugError struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	Debug struct {
+		Errors []string `json:"errors"`
+		Panic  string   `json:"panic"`
+		Stack  []string `json:"stack"`
+	} `json:"debug"`
+}
+
+func TestInternalErrorDetailOnlyInDevelopment(t *testing.T) {
+	err := fmt.Errorf("reading widgets: %w", errors.New("disk on fire"))
+	for _, env := range []string{envProduction, envDevelopment} {
+		vars := map[string]string{"API_ENV": env}
+		api := newTestHandler(t, erroringStore{newMemoryStore(), err}, vars)
+		h := withOutput(api, newOutputOptions(api.cfg))
+
+		w := do(h, http.MethodGet, "/widgets/", "")
+		var e debugError
+		decodeBody(t, w, &e)
+		if w.Code != http.StatusInternalServerError || e.Code != codeInternal || e.Error != internalErrorMessage {
+			t.Fatalf("%s: got status %d and %+v", env, w.Code, e)
+		}
+		if env == envProduction {
+			if strings.Contains(w.Body.String(), "disk on fire") || len(e.Debug.Errors) > 0 {
+				t.Errorf("%s: got %s, want no detail", env, w.Body.String())
+			}
+			continue
+		}
+		want := []string{"reading widgets: disk on fire", "disk on fire"}
+		if strings.Join(e.Debug.Errors, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: got error chain %q, want %q", env, e.Debug.Errors, want)
+		}
+	}
+}
+
+func TestPanicDetailOnlyInDevelopment(t *testing.T) {
+	panicking := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	for _, env := range []string{envProduction, envDevelopment} {
+		output := newOutputOptions(testConfig(t, map[string]string{"API_ENV": env}))
+		w := do(withOutput(panicking, output), http.MethodGet, "/widgets/", "")
+		var e debugError
+		decodeBody(t, w, &e)
+		if env == envProduction {
+			if strings.Contains(w.Body.String(), "boom") || len(e.Debug.Stack) > 0 {
+				t.Errorf("%s: got %s, want no detail", env, w.Body.String())
+			}
+			continue
+		}
+		if e.Debug.Panic != "boom" || len(e.Debug.Stack) == 0 {
+			t.Errorf("%s: got %+v, want the panic and its stack", env, e.Debug)
+		}
+		if n := len(strings.Join(e.Debug.Stack, "\n")); n > maxStackLen {
+			t.Errorf("%s: got a stack of %d bytes, want at most %d", env, n, maxStackLen)
+		}
+	}
+}
+
+func TestErrorCodesForTheMainPaths(t *testing.T) {
+	api := newTestHandler(t, nil, map[string]string{"API_MAX_NAME_LEN": "5"})
+	h := limitBody(api, 64)
+	widget := createWidget(t, h, `{"name":"a"}`)
+	retired := createWidget(t, h, `{"name":"b","status":"retired"}`)
+
+	for _, tc := range []struct {
+		name                 string
+		method, target, body string
+		headers              []string
+		status               int
+		code                 string
+	}{
+		{name: "malformed body", method: http.MethodPost, target: "/widgets/", body: `{"name":`, status: http.StatusBadRequest, code: codeBadRequest},
+		{name: "missing widget", method: http.MethodGet, target: "/widgets/missing", status: http.StatusNotFound, code: codeNotFound},
+		{name: "wrong method", method: http.MethodPost, target: "/widgets/" + widget.ID, status: http.StatusMethodNotAllowed, code: codeMethodNotAllowed},
+		{name: "invalid widget", method: http.MethodPost, target: "/widgets/", body: `{"name":"too long"}`, status: http.StatusUnprocessableEntity, code: codeValidationFailed},
+		{name: "body too large", method: http.MethodPost, target: "/widgets/", body: `{"name":"` + strings.Repeat("a", 64) + `"}`, status: http.StatusRequestEntityTooLarge, code: codeBodyTooLarge},
+		{name: "unsupported charset", method: http.MethodPost, target: "/widgets/", body: `{"name":"a"}`, headers: []string{"Content-Type", "application/json; charset=latin1"}, status: http.StatusUnsupportedMediaType, code: codeUnsupportedMediaType},
+		{name: "illegal transition", method: http.MethodPut, target: "/widgets/" + retired.ID, body: `{"name":"b","status":"active"}`, status: http.StatusConflict, code: codeInvalidTransition},
+		{name: "negative quantity", method: http.MethodPost, target: "/widgets/" + widget.ID + "/quantity", body: `{"delta":-1}`, status: http.StatusConflict, code: codeNegativeQuantity},
+	} {
+		w := do(h, tc.method, tc.target, tc.body, tc.headers...)
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d: %s", tc.name, w.Code, tc.status, w.Body.String())
+			continue
+		}
+		var e apiError
+		decodeBody(t, w, &e)
+		if e.Code != tc.code || len(e.Error) == 0 {
+			t.Errorf("%s: got %+v, want code %s with a message", tc.name, e, tc.code)
+		}
+	}
+}
+
+func TestErrorCodeDefaults(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusNotFound:            codeNotFound,
+		http.StatusTooManyRequests:     "too_many_requests",
+		http.StatusInsufficientStorage: "insufficient_storage",
+		http.StatusNotAcceptable:       "not_acceptable",
+	} {
+		if got := errorCode(status); got != want {
+			t.Errorf("errorCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+// closedWriter is a ResponseWriter whose writes fail with err, as when the
+// client has gone away.
+type closedWriter struct {
+	header  http.Header
+	err     error
+	headers int
+	writes  int
+}
+
+func (w *closedWriter) Header() http.Header { return w.header }
+
+func (w *closedWriter) WriteHeader(status int) { w.headers++ }
+
+func (w *closedWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return 0, w.err
+}
+
+func TestWritesToAClosedConnectionAreOnlyLogged(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a"}`)
+
+	for _, tt := range []struct {
+		err  error
+		gone bool
+	}{
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{errors.New("disk on fire"), false},
+	} {
+		buf := captureLog(t)
+		w := &closedWriter{header: http.Header{}, err: tt.err}
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/widgets/"+widget.ID, nil))
+
+		if w.headers != 1 || w.writes != 1 {
+			t.Errorf("%s: wrote the header %d times and the body %d times, want once each", tt.err, w.headers, w.writes)
+		}
+		if got := strings.Contains(buf.String(), "client closed the connection"); got != tt.gone {
+			t.Errorf("%s: got log %q", tt.err, buf.String())
+		}
+		if strings.Contains(buf.String(), "internal error") {
+			t.Errorf("%s: reported an internal error after the response started: %s", tt.err, buf.String())
+		}
+	}
+}
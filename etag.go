@@ -0,0 +1,135 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxListWait bounds how long a long-polling list request may be held open.
+const maxListWait = 60 * time.Second
+
+// listPollInterval is how often a held list request checks the store version.
+const listPollInterval = 100 * time.Millisecond
+
+// listETag returns the ETag of a widget list. It changes with the store
+// version and with anything else that shapes the response: the requester,
+// the query, the negotiated format and the output options. The wait parameter
+// only affects how the request is served, so it is left out.
+func listETag(version uint64, q requester, query url.Values, mime string, output outputOptions) string {
+	shaping := url.Values{}
+	for key, values := range query {
+		if key != "wait" {
+			shaping[key] = values
+		}
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00%t\x00%s\x00%s\x00%s\x00%s", version, q.user, q.admin, shaping.Encode(), mime, output.naming, output.zone)
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. Weak
+// comparison is used, as it is for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWait reads the wait query parameter, the longest a conditional list
+// request may be held open waiting for a change.
+func parseWait(query url.Values) (time.Duration, error) {
+	if err := checkSingleValues(query, "wait"); err != nil {
+		return 0, err
+	}
+	v := query.Get("wait")
+	if len(v) == 0 {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(v)
+	if err != nil || wait < 0 || wait > maxListWait {
+		return 0, fmt.Errorf("The wait parameter must be a duration of at most %ds.", int(maxListWait.Seconds()))
+	}
+	return wait, nil
+}
+
+// waitLimit caps how many list requests may wait for a change at once, since
+// each holds a connection open.
+type waitLimit struct {
+	max     int64
+	waiting int64
+}
+
+// newWaitLimit will construct a waitLimit admitting up to max waiters.
+func newWaitLimit(max int) *waitLimit {
+	return &waitLimit{max: int64(max)}
+}
+
+// acquire admits a waiter, reporting false when the limit is reached. Each
+// admitted waiter must be released.
+func (l *waitLimit) acquire() bool {
+	if atomic.AddInt64(&l.waiting, 1) > l.max {
+		atomic.AddInt64(&l.waiting, -1)
+		return false
+	}
+	listWaiters.Add(1)
+	return true
+}
+
+func (l *waitLimit) release() {
+	atomic.AddInt64(&l.waiting, -1)
+	listWaiters.Add(-1)
+}
+
+// errWaitTimeout reports that the awaited change did not happen in time.
+var errWaitTimeout = errors.New("timed out waiting for a change")
+
+// waitForChange polls the store version until changed reports true for it,
+// returning errWaitTimeout once wait has passed.
+func waitForChange(ctx context.Context, store Store, wait time.Duration, changed func(version uint64) bool) error {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	ticker := time.NewTicker(listPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return errWaitTimeout
+		case <-ticker.C:
+		}
+		version, err := store.Version(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return errWaitTimeout
+			}
+			return err
+		}
+		if changed(version) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListETagAnswersNotModifiedUntilAChange(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a"}`)
+
+	w := do(h, http.MethodGet, "/widgets/", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || len(etag) == 0 {
+		t.Fatalf("got status %d and ETag %q", w.Code, etag)
+	}
+
+	w = do(h, http.MethodGet, "/widgets/", "", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got status %d with %d bytes for an unchanged list, want 304 and no body", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("got ETag %q on the 304, want %q", got, etag)
+	}
+
+	do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"b"}`)
+	w = do(h, http.MethodGet, "/widgets/", "", "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("got status %d and ETag %q after a change, want 200 and a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+	if got := widgetNames(listWidgets(t, h, "/widgets/").Widgets); got != "b" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestListETagDependsOnWhatShapesTheResponse(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	createWidget(t, h, `{"name":"a"}`)
+	etag := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag")
+
+	for _, tc := range []struct {
+		target  string
+		headers []string
+	}{
+		{"/widgets/?limit=1", nil},
+		{"/widgets/", []string{"X-User", "alice"}},
+		{"/widgets/", []string{"Accept", "application/yaml"}},
+	} {
+		headers := append([]string{"If-None-Match", etag}, tc.headers...)
+		if w := do(h, http.MethodGet, tc.target, "", headers...); w.Code != http.StatusOK {
+			t.Errorf("%s %v: got status %d, want a different list to have its own ETag", tc.target, tc.headers, w.Code)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"x", "abc"`, true},
+		{`*`, true},
+		{`"abd"`, false},
+		{``, false},
+	} {
+		if got := etagMatches(tc.header, `"abc"`); got != tc.want {
+			t.Errorf("etagMatches(%q) = %t, want %t", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestListLongPollReturnsAChange(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	etag := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- do(h, http.MethodGet, "/widgets/?wait=5s", "", "If-None-Match", etag)
+	}()
+	waitUntil(t, func() bool { return atomic.LoadInt64(&h.waits.waiting) == 1 })
+	createWidget(t, h, `{"name":"a"}`)
+
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+			t.Fatalf("got status %d with ETag %q after a change", w.Code, w.Header().Get("ETag"))
+		}
+		var page listPage
+		decodeBody(t, w, &page)
+		if got := widgetNames(page.Widgets); got != "a" {
+			t.Errorf("listed %s, want the new widget", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the long poll did not return after a change")
+	}
+}
+
+func TestListLongPollTimesOut(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	etag := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag")
+
+	start := time.Now()
+	w := do(h, http.MethodGet, "/widgets/?wait=200ms", "", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag {
+		t.Errorf("got status %d with ETag %q, want 304 with %q", w.Code, w.Header().Get("ETag"), etag)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("answered after %s, want the request held for the wait", elapsed)
+	}
+
+	start = time.Now()
+	if w := do(h, http.MethodGet, "/widgets/?wait=5s", "", "If-None-Match", `"stale"`); w.Code != http.StatusOK || time.Since(start) > time.Second {
+		t.Errorf("a stale ETag answered %d after %s, want 200 at once", w.Code, time.Since(start))
+	}
+	expectError(t, do(h, http.MethodGet, "/widgets/?wait=2m", ""), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestListLongPollLimitsWaiters(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_LIST_WAITERS": "1"})
+	etag := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag")
+
+	done := make(chan int)
+	go func() {
+		done <- do(h, http.MethodGet, "/widgets/?wait=5s", "", "If-None-Match", etag).Code
+	}()
+	waitUntil(t, func() bool { return atomic.LoadInt64(&h.waits.waiting) == 1 })
+
+	w := do(h, http.MethodGet, "/widgets/?wait=5s", "", "If-None-Match", etag)
+	expectError(t, w, http.StatusServiceUnavailable, codeUnavailable)
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got Retry-After %q", w.Header().Get("Retry-After"))
+	}
+	createWidget(t, h, `{"name":"a"}`)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("the waiting poll answered %d", code)
+	}
+}
+
+func TestWaitLimit(t *testing.T) {
+	l := newWaitLimit(2)
+	if !l.acquire() || !l.acquire() {
+		t.Fatal("a waiter under the limit was turned away")
+	}
+	if l.acquire() {
+		t.Error("a waiter over the limit was admitted")
+	}
+	l.release()
+	if !l.acquire() {
+		t.Error("a released slot was not reused")
+	}
+	l.release()
+	l.release()
+	if none := newWaitLimit(0); none.acquire() {
+		t.Error("a limit of zero admitted a waiter")
+	}
+}
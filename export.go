@@ -0,0 +1,124 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const mimeNDJSON = "application/x-ndjson"
+
+// export streams every widget the requester can access as newline delimited
+// JSON in insertion order. A Range header such as items=10-19 selects a slice
+// of that order by zero-based position, so an interrupted backup can resume
+// where it stopped.
+//
+// Unlike list, export is deliberately unpaginated and ignores limit, offset
+// and cursor; it is meant for taking everything at once.
+func (h WidgetHandler) export(w http.ResponseWriter, r *http.Request) {
+	stored, err := h.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	q := requesterFor(r, h.cfg.AdminToken)
+	widgets := make([]Widget, 0, len(stored))
+	for _, widget := range stored {
+		if q.canAccess(widget) {
+			widgets = append(widgets, widget)
+		}
+	}
+
+	setSurrogateKeys(w, surrogateCollectionKey)
+	w.Header().Set("Accept-Ranges", "items")
+	status := http.StatusOK
+	if v := r.Header.Get("Range"); len(v) > 0 {
+		start, end, err := parseItemsRange(v, len(widgets))
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("items */%d", len(widgets)))
+			writeJSONError(w, r, http.StatusRequestedRangeNotSatisfiable, err.Error())
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("items %d-%d/%d", start, end, len(widgets)))
+		widgets = widgets[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", mimeNDJSON)
+	w.WriteHeader(status)
+
+	output := outputFor(r)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for _, widget := range widgets {
+		if err := encoder.Encode(output.apply(widget)); err != nil {
+			log.Printf("unable to export widgets %s", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// parseItemsRange reads a Range header of the form items=start-end,
+// items=start- or items=-count against a list of total items. It returns the
+// inclusive positions of the first and last items selected.
+func parseItemsRange(header string, total int) (int, int, error) {
+	invalid := errors.New("The requested range is not satisfiable.")
+
+	spec := strings.TrimSpace(header)
+	if !strings.HasPrefix(spec, "items=") || strings.Contains(spec, ",") {
+		return 0, 0, invalid
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(spec, "items="), "-", 2)
+	if len(bounds) != 2 || total == 0 {
+		return 0, 0, invalid
+	}
+
+	first, last := strings.TrimSpace(bounds[0]), strings.TrimSpace(bounds[1])
+	if len(first) == 0 {
+		count, err := strconv.Atoi(last)
+		if err != nil || count <= 0 {
+			return 0, 0, invalid
+		}
+		if count > total {
+			count = total
+		}
+		return total - count, total - 1, nil
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 || start >= total {
+		return 0, 0, invalid
+	}
+	end := total - 1
+	if len(last) > 0 {
+		if end, err = strconv.Atoi(last); err != nil || end < start {
+			return 0, 0, invalid
+		}
+		if end >= total {
+			end = total - 1
+		}
+	}
+	return start, end, nil
+}
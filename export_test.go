@@ -0,0 +1,104 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// exportedNames returns the names of the widgets in an NDJSON export.
+func exportedNames(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var widgets []Widget
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var widget Widget
+		if err := json.Unmarshal(scanner.Bytes(), &widget); err != nil {
+			t.Fatalf("bad export line %q: %s", scanner.Text(), err)
+		}
+		widgets = append(widgets, widget)
+	}
+	return widgetNames(widgets)
+}
+
+func TestExportRanges(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	for _, name := range strings.Split("a,b,c,d,e", ",") {
+		createWidget(t, h, `{"name":"`+name+`"}`)
+	}
+
+	w := do(h, http.MethodGet, "/widgets/export", "")
+	if w.Code != http.StatusOK || exportedNames(t, w) != "a,b,c,d,e" {
+		t.Fatalf("got status %d exporting everything", w.Code)
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "items" {
+		t.Errorf("got Accept-Ranges %q", got)
+	}
+
+	for _, tc := range []struct {
+		header       string
+		names        string
+		contentRange string
+	}{
+		{"items=1-3", "b,c,d", "items 1-3/5"},
+		{"items=3-", "d,e", "items 3-4/5"},
+		{"items=-2", "d,e", "items 3-4/5"},
+		{"items=2-100", "c,d,e", "items 2-4/5"},
+	} {
+		w := do(h, http.MethodGet, "/widgets/export", "", "Range", tc.header)
+		if w.Code != http.StatusPartialContent {
+			t.Errorf("%s: got status %d, want 206", tc.header, w.Code)
+			continue
+		}
+		if got := exportedNames(t, w); got != tc.names {
+			t.Errorf("%s: got %s, want %s", tc.header, got, tc.names)
+		}
+		if got := w.Header().Get("Content-Range"); got != tc.contentRange {
+			t.Errorf("%s: got Content-Range %q, want %q", tc.header, got, tc.contentRange)
+		}
+	}
+
+	for _, header := range []string{"items=5-6", "items=3-1", "bytes=0-10", "items=0-1,3-4", "items=-0"} {
+		w := do(h, http.MethodGet, "/widgets/export", "", "Range", header)
+		if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "items */5" {
+			t.Errorf("%s: got status %d and Content-Range %q", header, w.Code, w.Header().Get("Content-Range"))
+		}
+	}
+}
+
+func TestListIsPaginatedWhileExportReturnsEverything(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_DEFAULT_PAGE_SIZE": "2", "API_MAX_PAGE_SIZE": "3"})
+	for _, name := range strings.Split("a,b,c,d,e", ",") {
+		createWidget(t, h, `{"name":"`+name+`"}`)
+	}
+
+	page := listWidgets(t, h, "/widgets/")
+	if got := widgetNames(page.Widgets); got != "a,b" || len(page.NextCursor) == 0 {
+		t.Errorf("the default page listed %s with cursor %q, want a,b and more", got, page.NextCursor)
+	}
+	page = listWidgets(t, h, "/widgets/?limit=100")
+	if got := widgetNames(page.Widgets); got != "a,b,c" {
+		t.Errorf("a page past the limit listed %s, want it capped at a,b,c", got)
+	}
+
+	if got := exportedNames(t, do(h, http.MethodGet, "/widgets/export", "")); got != "a,b,c,d,e" {
+		t.Errorf("exported %s, want every widget", got)
+	}
+}
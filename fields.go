@@ -0,0 +1,214 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Types a custom field may have.
+const (
+	fieldString  = "string"
+	fieldNumber  = "number"
+	fieldInteger = "integer"
+	fieldBoolean = "boolean"
+)
+
+// FieldDefinition describes a custom widget field, held in the widget's
+// attributes under Name. The constraints that apply depend on the type.
+type FieldDefinition struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+
+	// MaxLength is the most characters a string may have, and Enum the
+	// values it is limited to. Both are unchecked when empty.
+	MaxLength int      `json:"max_length"`
+	Enum      []string `json:"enum"`
+
+	// Min and Max bound numbers and integers.
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// loadFieldDefinitions reads a JSON array of field definitions from path.
+func loadFieldDefinitions(path string) ([]FieldDefinition, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields []FieldDefinition
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if len(f.Name) == 0 {
+			return nil, fmt.Errorf("every field needs a name")
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("field %s is defined twice", f.Name)
+		}
+		seen[f.Name] = true
+		switch f.Type {
+		case fieldString, fieldNumber, fieldInteger, fieldBoolean:
+		default:
+			return nil, fmt.Errorf("field %s has unknown type %q", f.Name, f.Type)
+		}
+	}
+	return fields, nil
+}
+
+// checkAttributeLimits returns the ways the attributes exceed the limits on
+// their number and size. Names are checked in sorted order so that the same
+// widget always reports the same violation.
+func checkAttributeLimits(attributes map[string]interface{}, limits Limits) []string {
+	var violations []string
+	if len(attributes) > limits.MaxAttributes {
+		violations = append(violations, fmt.Sprintf("A widget may have at most %d attributes.", limits.MaxAttributes))
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if utf8.RuneCountInString(name) > limits.MaxAttributeNameLen {
+			violations = append(violations, fmt.Sprintf("Each attribute name must be at most %d characters.", limits.MaxAttributeNameLen))
+			return violations
+		}
+	}
+	for _, name := range names {
+		if attributeLen(attributes[name]) > limits.MaxAttributeValueLen {
+			violations = append(violations, fmt.Sprintf("The %s attribute must be at most %d characters.", name, limits.MaxAttributeValueLen))
+		}
+	}
+	return violations
+}
+
+// attributeLen is the length of an attribute value in characters: a string
+// is measured as itself, anything else as its JSON encoding.
+func attributeLen(value interface{}) int {
+	if s, ok := value.(string); ok {
+		return utf8.RuneCountInString(s)
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	return utf8.RuneCount(b)
+}
+
+// checkAttributes returns the ways the attributes break the field
+// definitions. Attributes without a definition are not allowed.
+func checkAttributes(attributes map[string]interface{}, fields []FieldDefinition) []string {
+	var violations []string
+
+	defined := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		defined[f.Name] = true
+		value, ok := attributes[f.Name]
+		if !ok || value == nil {
+			if f.Required {
+				violations = append(violations, fmt.Sprintf("The %s attribute is required.", f.Name))
+			}
+			continue
+		}
+		violations = append(violations, f.check(value)...)
+	}
+
+	var unknown []string
+	for name := range attributes {
+		if !defined[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		violations = append(violations, fmt.Sprintf("The %s attribute is not defined.", name))
+	}
+	return violations
+}
+
+// check returns the ways value breaks the definition.
+func (f FieldDefinition) check(value interface{}) []string {
+	switch f.Type {
+	case fieldString:
+		s, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("The %s attribute must be a string.", f.Name)}
+		}
+		if f.MaxLength > 0 && utf8.RuneCountInString(s) > f.MaxLength {
+			return []string{fmt.Sprintf("The %s attribute must be at most %d characters.", f.Name, f.MaxLength)}
+		}
+		if len(f.Enum) > 0 && !containsString(f.Enum, s) {
+			return []string{fmt.Sprintf("The %s attribute must be one of %s.", f.Name, strings.Join(f.Enum, ","))}
+		}
+	case fieldBoolean:
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("The %s attribute must be a boolean.", f.Name)}
+		}
+	case fieldNumber, fieldInteger:
+		n, ok := attributeNumber(value)
+		if !ok {
+			return []string{fmt.Sprintf("The %s attribute must be a number.", f.Name)}
+		}
+		if f.Type == fieldInteger && n != math.Trunc(n) {
+			return []string{fmt.Sprintf("The %s attribute must be an integer.", f.Name)}
+		}
+		if f.Min != nil && n < *f.Min {
+			return []string{fmt.Sprintf("The %s attribute must be at least %s.", f.Name, formatNumber(*f.Min))}
+		}
+		if f.Max != nil && n > *f.Max {
+			return []string{fmt.Sprintf("The %s attribute must be at most %s.", f.Name, formatNumber(*f.Max))}
+		}
+	}
+	return nil
+}
+
+// attributeNumber returns a decoded JSON number as a float64. Depending on
+// how the body was decoded it may be a json.Number or a float64.
+func attributeNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		n, err := v.Float64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFieldsFile writes field definitions to a temporary file and returns
+// its path.
+func writeFieldsFile(t *testing.T, definitions string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fields.json")
+	if err := ioutil.WriteFile(path, []byte(definitions), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRequiredCustomFieldIsEnforced(t *testing.T) {
+	path := writeFieldsFile(t, `[{"name":"color","type":"string","required":true,"enum":["red","blue"]}]`)
+	h := newTestHandler(t, nil, map[string]string{"API_FIELDS_FILE": path})
+
+	w := do(h, http.MethodPost, "/widgets/", `{"name":"a"}`)
+	e := expectError(t, w, http.StatusUnprocessableEntity, codeValidationFailed)
+	if e.Error != "The color attribute is required." {
+		t.Errorf("got error %q", e.Error)
+	}
+
+	w = do(h, http.MethodPost, "/widgets/", `{"name":"a","attributes":{"color":"green"}}`)
+	expectError(t, w, http.StatusUnprocessableEntity, codeValidationFailed)
+
+	widget := createWidget(t, h, `{"name":"a","attributes":{"color":"red"}}`)
+	if widget.Attributes["color"] != "red" {
+		t.Errorf("got attributes %v", widget.Attributes)
+	}
+}
+
+func TestCheckAttributes(t *testing.T) {
+	min, max := 1.0, 10.0
+	fields := []FieldDefinition{
+		{Name: "label", Type: fieldString, MaxLength: 3},
+		{Name: "weight", Type: fieldNumber, Min: &min, Max: &max},
+		{Name: "count", Type: fieldInteger},
+		{Name: "fragile", Type: fieldBoolean},
+	}
+	for _, tt := range []struct {
+		attributes string
+		want       string
+	}{
+		{`{"label":"abc","weight":2.5,"count":3,"fragile":true}`, ""},
+		{`{"label":"abcd"}`, "The label attribute must be at most 3 characters."},
+		{`{"label":1}`, "The label attribute must be a string."},
+		{`{"weight":11}`, "The weight attribute must be at most 10."},
+		{`{"weight":0.5}`, "The weight attribute must be at least 1."},
+		{`{"count":1.5}`, "The count attribute must be an integer."},
+		{`{"fragile":"yes"}`, "The fragile attribute must be a boolean."},
+		{`{"other":1}`, "The other attribute is not defined."},
+	} {
+		var attributes map[string]interface{}
+		if err := unmarshalNumbers([]byte(tt.attributes), &attributes); err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(checkAttributes(attributes, fields), " ")
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.attributes, got, tt.want)
+		}
+	}
+}
+
+func TestLoadFieldDefinitionsRejectsUnknownTypes(t *testing.T) {
+	if _, err := loadFieldDefinitions(writeFieldsFile(t, `[{"name":"a","type":"date"}]`)); err == nil {
+		t.Error("a field of unknown type was accepted")
+	}
+}
+
+func TestLargeIntegerAttributesAreNotRounded(t *testing.T) {
+	const big = "9007199254740993"
+	h := newTestHandler(t, nil, map[string]string{
+		"API_FIELDS_FILE":     writeFieldsFile(t, `[{"name":"big","type":"integer"}]`),
+		"API_WIDGET_DEFAULTS": `{"description":"default"}`,
+	})
+
+	w := do(h, http.MethodPost, "/widgets/", `{"name":"a","attributes":{"big":`+big+`}}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"big":`+big) {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, w, &created)
+
+	w = do(h, http.MethodPatch, "/widgets/", `[{"id":"`+created.Widget.ID+`","changes":{"attributes":{"big":`+big+`1}}}]`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"big":`+big+`1`) {
+		t.Errorf("bulk update answered %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFileStoreKeepsLargeIntegerAttributes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "widgets.json")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	widget := Widget{ID: "1", Name: "a", Status: statusDraft, Attributes: map[string]interface{}{"big": json.Number("9007199254740993")}}
+	if _, _, err := store.Create(context.Background(), widget); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := reopened.Get(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := got.Attributes["big"].(json.Number); !ok || n.String() != "9007199254740993" {
+		t.Errorf("got attribute %v (%T)", got.Attributes["big"], got.Attributes["big"])
+	}
+}
+
+func TestAttributeLimits(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{
+		"API_FIELDS_FILE":             writeFieldsFile(t, `[{"name":"a","type":"string"},{"name":"b","type":"string"},{"name":"c","type":"string"},{"name":"weight","type":"number"}]`),
+		"API_MAX_ATTRIBUTES":          "2",
+		"API_MAX_ATTRIBUTE_NAME_LEN":  "8",
+		"API_MAX_ATTRIBUTE_VALUE_LEN": "5",
+	})
+
+	for _, tt := range []struct {
+		body string
+		want string
+	}{
+		{`{"name":"w","attributes":{"a":"1","b":"2","c":"3"}}`, "A widget may have at most 2 attributes."},
+		{`{"name":"w","attributes":{"a":"toolong"}}`, "The a attribute must be at most 5 characters."},
+		{`{"name":"w","attributes":{"weight":1234.5678}}`, "The weight attribute must be at most 5 characters."},
+		{`{"name":"w","attributes":{"muchtoolong":"1"}}`, "Each attribute name must be at most 8 characters."},
+	} {
+		e := expectError(t, do(h, http.MethodPost, "/widgets/", tt.body), http.StatusUnprocessableEntity, codeValidationFailed)
+		if !strings.Contains(e.Error, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.body, e.Error, tt.want)
+		}
+	}
+
+	// Values are measured in characters, not bytes.
+	widget := createWidget(t, h, `{"name":"w","attributes":{"a":"ééééé","b":"12345"}}`)
+	if len(widget.Attributes) != 2 {
+		t.Errorf("got attributes %v", widget.Attributes)
+	}
+}
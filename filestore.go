@@ -0,0 +1,220 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// fileSchemaVersion is the version of the store file format written by this
+// build.
+//
+// Version 1 held widgets from before lifecycle states and revisions, so they
+// have no status or revision. Version 2 adds both.
+const fileSchemaVersion = 2
+
+// fileMigrations upgrade the widgets of a store file from the version they
+// are keyed by to the next one. Widgets are handled as decoded JSON objects
+// so that migrations do not depend on the current Widget type.
+var fileMigrations = map[int]func(widgets []map[string]interface{}) error{
+	1: func(widgets []map[string]interface{}) error {
+		for _, widget := range widgets {
+			if _, ok := widget["status"]; !ok {
+				widget["status"] = statusDraft
+			}
+			if _, ok := widget["revision"]; !ok {
+				widget["revision"] = 1
+			}
+		}
+		return nil
+	},
+}
+
+// storeFile is the on-disk form of a fileStore.
+type storeFile struct {
+	SchemaVersion int `json:"schema_version"`
+
+	Widgets json.RawMessage `json:"widgets"`
+}
+
+// fileStore is a memoryStore that saves every widget to a JSON file after each
+// change and loads them again on start. Revision history is kept in memory
+// only.
+type fileStore struct {
+	*memoryStore
+
+	path string
+
+	// mu serializes changes so that each save sees the store as the change
+	// left it.
+	mu sync.Mutex
+}
+
+// openFileStore will construct a fileStore from the file at path, which is
+// created on the first change if it does not exist. Files written in an older
+// format are upgraded and saved again.
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	widgets, upgraded, err := decodeStoreFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load store file %s: %w", path, err)
+	}
+	s.memoryStore.load(widgets)
+	if upgraded {
+		log.Printf("upgraded store file %s to schema version %d", path, fileSchemaVersion)
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// decodeStoreFile reads the widgets in a store file of any known version,
+// reporting whether they had to be upgraded.
+func decodeStoreFile(b []byte) ([]Widget, bool, error) {
+	var file storeFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, false, err
+	}
+	if file.SchemaVersion < 1 {
+		return nil, false, fmt.Errorf("missing schema_version")
+	}
+	if file.SchemaVersion > fileSchemaVersion {
+		return nil, false, fmt.Errorf("schema version %d is newer than the supported version %d", file.SchemaVersion, fileSchemaVersion)
+	}
+
+	if file.SchemaVersion < fileSchemaVersion {
+		var objects []map[string]interface{}
+		if err := unmarshalNumbers(file.Widgets, &objects); err != nil {
+			return nil, false, err
+		}
+		for version := file.SchemaVersion; version < fileSchemaVersion; version++ {
+			if err := fileMigrations[version](objects); err != nil {
+				return nil, false, fmt.Errorf("unable to upgrade from schema version %d: %w", version, err)
+			}
+		}
+		var err error
+		if file.Widgets, err = json.Marshal(objects); err != nil {
+			return nil, false, err
+		}
+	}
+
+	var widgets []Widget
+	if err := unmarshalNumbers(file.Widgets, &widgets); err != nil {
+		return nil, false, err
+	}
+	return widgets, file.SchemaVersion < fileSchemaVersion, nil
+}
+
+// save writes every widget to the file. The file is replaced by rename so that
+// a crash never leaves it half written.
+func (s *fileStore) save() error {
+	widgets, err := s.memoryStore.List(context.Background())
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(widgets)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(storeFile{SchemaVersion: fileSchemaVersion, Widgets: raw})
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// saved saves the store after a change that returned err, unless the change
+// failed.
+func (s *fileStore) saved(err error) error {
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		log.Printf("unable to save store file %s %s", s.path, err)
+		return fmt.Errorf("unable to save store file: %w", err)
+	}
+	return nil
+}
+
+func (s *fileStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, created, err := s.memoryStore.Create(ctx, widget)
+	if err != nil || !created {
+		return stored, created, err
+	}
+	return stored, created, s.saved(nil)
+}
+
+func (s *fileStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.memoryStore.Put(ctx, widget)
+	return stored, s.saved(err)
+}
+
+func (s *fileStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.memoryStore.Update(ctx, id, change)
+	return stored, s.saved(err)
+}
+
+func (s *fileStore) Delete(ctx context.Context, id string) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	widget, err := s.memoryStore.Delete(ctx, id)
+	return widget, s.saved(err)
+}
+
+func (s *fileStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	widget, err := s.memoryStore.Rename(ctx, id, newID)
+	return widget, s.saved(err)
+}
+
+func (s *fileStore) Reset(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.saved(s.memoryStore.Reset(ctx))
+}
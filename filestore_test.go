@@ -0,0 +1,120 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copyFixture copies a file from testdata into a temporary directory, so that
+// tests may change it, and returns the copy's path.
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFileStoreUpgradesOlderFiles(t *testing.T) {
+	path := copyFixture(t, "store_v1.json")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	widgets, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(widgets) != 2 {
+		t.Fatalf("loaded %d widgets, want 2", len(widgets))
+	}
+	for _, w := range widgets {
+		if w.Status != statusDraft || w.Revision != 1 {
+			t.Errorf("widget %s has status %q and revision %d, want a draft at revision 1", w.ID, w.Status, w.Revision)
+		}
+	}
+	if widgets[0].Name != "sprocket" || widgets[0].Description != "A small gear." || widgets[0].Quantity != 3 {
+		t.Errorf("got %+v, want the fields kept", widgets[0])
+	}
+	if widgets[1].Quantity != 9007199254740993 {
+		t.Errorf("got quantity %d, want it kept exactly", widgets[1].Quantity)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file storeFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.SchemaVersion != fileSchemaVersion {
+		t.Errorf("the file was saved at schema version %d, want %d", file.SchemaVersion, fileSchemaVersion)
+	}
+	if _, err := openFileStore(path); err != nil {
+		t.Errorf("unable to reopen the upgraded file %s", err)
+	}
+}
+
+func TestFileStoreRejectsUnknownVersions(t *testing.T) {
+	for _, tt := range []struct {
+		file string
+		want string
+	}{
+		{`{"schema_version":99,"widgets":[]}`, "schema version 99 is newer"},
+		{`{"widgets":[]}`, "missing schema_version"},
+		{`not json`, "invalid character"},
+	} {
+		path := filepath.Join(t.TempDir(), "widgets.json")
+		if err := ioutil.WriteFile(path, []byte(tt.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := openFileStore(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestFileStoreKeepsWidgetsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "widgets.json")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Create(context.Background(), Widget{ID: "1", Name: "a", Status: statusActive, Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := reopened.Get(context.Background(), "1"); err != nil || got.Name != "a" || got.Status != statusActive {
+		t.Errorf("got %+v, %v after reopening", got, err)
+	}
+}
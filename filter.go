@@ -0,0 +1,161 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Keys accepted by the sort parameter. Created is insertion order, and
+// -created newest first.
+const (
+	sortCreated      = "created"
+	sortCreatedDesc  = "-created"
+	sortQuantity     = "quantity"
+	sortQuantityDesc = "-quantity"
+	sortUpdated      = "updated"
+	sortUpdatedDesc  = "-updated"
+)
+
+// validSort reports whether key is an accepted sort key.
+func validSort(key string) bool {
+	switch key {
+	case sortCreated, sortCreatedDesc, sortQuantity, sortQuantityDesc, sortUpdated, sortUpdatedDesc:
+		return true
+	}
+	return false
+}
+
+// filterParams are the query parameters that narrow a widget list.
+var filterParams = []string{"min_quantity", "max_quantity", "status"}
+
+// widgetFilter narrows and orders a widget list.
+type widgetFilter struct {
+	minQuantity *int
+	maxQuantity *int
+	status      string
+
+	// sort is empty for insertion order, or one of the other sort keys.
+	sort string
+}
+
+// parseFilter reads the min_quantity, max_quantity, status and sort query
+// parameters, allowing at most maxFilters of the filtering parameters at once.
+// Without a sort parameter the list is sorted by defaultSort, unless a cursor
+// is given. Sorting cannot be combined with a cursor, since cursors follow
+// insertion order.
+func parseFilter(query url.Values, defaultSort string, maxFilters int) (widgetFilter, error) {
+	var f widgetFilter
+
+	if err := checkSingleValues(query, append(filterParams, "sort")...); err != nil {
+		return f, err
+	}
+	filters := 0
+	for _, name := range filterParams {
+		if _, ok := query[name]; ok {
+			filters++
+		}
+	}
+	if filters > maxFilters {
+		return f, fmt.Errorf("A list may combine at most %d filters.", maxFilters)
+	}
+
+	if f.status = query.Get("status"); len(f.status) > 0 && !validStatus(f.status) {
+		return f, errors.New("The status parameter must be draft, active or retired.")
+	}
+
+	for _, param := range []struct {
+		name   string
+		target **int
+	}{
+		{"min_quantity", &f.minQuantity},
+		{"max_quantity", &f.maxQuantity},
+	} {
+		if v := query.Get(param.name); len(v) > 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return f, errors.New("The " + param.name + " parameter must be a non-negative integer.")
+			}
+			*param.target = &n
+		}
+	}
+
+	key := query.Get("sort")
+	if len(key) == 0 && len(query.Get("cursor")) == 0 {
+		key = defaultSort
+	}
+	if len(key) == 0 {
+		key = sortCreated
+	}
+	if !validSort(key) {
+		return f, errors.New("The sort parameter must be created, quantity or updated, with a - to reverse.")
+	}
+	if key != sortCreated {
+		f.sort = key
+	}
+	if len(f.sort) > 0 && len(query.Get("cursor")) > 0 {
+		return f, errors.New("The cursor parameter cannot be combined with sort.")
+	}
+
+	return f, nil
+}
+
+// match reports whether the widget passes the filter.
+func (f widgetFilter) match(widget Widget) bool {
+	if f.minQuantity != nil && widget.Quantity < *f.minQuantity {
+		return false
+	}
+	if f.maxQuantity != nil && widget.Quantity > *f.maxQuantity {
+		return false
+	}
+	if len(f.status) > 0 && widget.Status != f.status {
+		return false
+	}
+	return true
+}
+
+// order sorts widgets in place. Widgets with equal quantities keep their
+// insertion order. Timestamps often tie, since widgets can be written within
+// the same clock tick, so widgets updated at the same time are ordered by id
+// to keep the order the same from one request to the next.
+func (f widgetFilter) order(widgets []Widget) {
+	switch f.sort {
+	case sortCreatedDesc:
+		for i, j := 0, len(widgets)-1; i < j; i, j = i+1, j-1 {
+			widgets[i], widgets[j] = widgets[j], widgets[i]
+		}
+	case sortQuantity:
+		sort.SliceStable(widgets, func(i, j int) bool {
+			return widgets[i].Quantity < widgets[j].Quantity
+		})
+	case sortQuantityDesc:
+		sort.SliceStable(widgets, func(i, j int) bool {
+			return widgets[i].Quantity > widgets[j].Quantity
+		})
+	case sortUpdated, sortUpdatedDesc:
+		desc := f.sort == sortUpdatedDesc
+		sort.Slice(widgets, func(i, j int) bool {
+			a, b := widgets[i].UpdatedAt.Time, widgets[j].UpdatedAt.Time
+			if a.Equal(b) {
+				return widgets[i].ID < widgets[j].ID
+			}
+			return a.Before(b) != desc
+		})
+	}
+}
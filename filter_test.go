@@ -0,0 +1,216 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultSortAppliesUnlessTheRequestSorts(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_DEFAULT_SORT": "-created"})
+	createWidget(t, h, `{"name":"a","quantity":2}`)
+	createWidget(t, h, `{"name":"b","quantity":3}`)
+	createWidget(t, h, `{"name":"c","quantity":1}`)
+
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{"/widgets/", "c,b,a"},
+		{"/widgets/?sort=created", "a,b,c"},
+		{"/widgets/?sort=quantity", "c,a,b"},
+		{"/widgets/?sort=-quantity", "b,a,c"},
+	} {
+		if got := widgetNames(listWidgets(t, h, tt.target).Widgets); got != tt.want {
+			t.Errorf("%s listed %s, want %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultSortIsValidatedAtStartup(t *testing.T) {
+	_, err := loadConfig(nil, func(key string) (string, bool) {
+		if key == "API_DEFAULT_SORT" {
+			return "-created_at", true
+		}
+		return "", false
+	})
+	if err == nil {
+		t.Fatal("an unknown default sort was accepted")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, tt := range []struct {
+		query   string
+		wantErr bool
+		sort    string
+	}{
+		{query: "", sort: ""},
+		{query: "sort=-created", sort: sortCreatedDesc},
+		{query: "sort=quantity", sort: sortQuantity},
+		{query: "sort=-quantity", sort: sortQuantityDesc},
+		{query: "sort=updated", sort: sortUpdated},
+		{query: "sort=name", wantErr: true},
+		{query: "sort=quantity&cursor=abc", wantErr: true},
+		{query: "status=unknown", wantErr: true},
+		{query: "min_quantity=-1", wantErr: true},
+		{query: "max_quantity=x", wantErr: true},
+		{query: "min_quantity=1&max_quantity=2&status=draft", wantErr: true},
+	} {
+		query, _ := url.ParseQuery(tt.query)
+		f, err := parseFilter(query, "", 2)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %t", tt.query, err, tt.wantErr)
+			continue
+		}
+		if err == nil && f.sort != tt.sort {
+			t.Errorf("%q: got sort %q, want %q", tt.query, f.sort, tt.sort)
+		}
+	}
+}
+
+func TestFilterMatchesQuantityAndStatus(t *testing.T) {
+	low, high := 2, 5
+	f := widgetFilter{minQuantity: &low, maxQuantity: &high, status: statusActive}
+	for _, tt := range []struct {
+		widget Widget
+		want   bool
+	}{
+		{Widget{Quantity: 3, Status: statusActive}, true},
+		{Widget{Quantity: 1, Status: statusActive}, false},
+		{Widget{Quantity: 6, Status: statusActive}, false},
+		{Widget{Quantity: 3, Status: statusDraft}, false},
+	} {
+		if got := f.match(tt.widget); got != tt.want {
+			t.Errorf("match(%+v) = %t, want %t", tt.widget, got, tt.want)
+		}
+	}
+}
+
+func TestListFiltersByQuantity(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	for i, name := range []string{"a", "b", "c", "d"} {
+		createWidget(t, h, fmt.Sprintf(`{"name":%q,"quantity":%d}`, name, i*10))
+	}
+
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{"/widgets/?min_quantity=10", "b,c,d"},
+		{"/widgets/?max_quantity=10", "a,b"},
+		{"/widgets/?min_quantity=10&max_quantity=20", "b,c"},
+		{"/widgets/?min_quantity=25&sort=-quantity", "d"},
+		{"/widgets/?sort=-quantity", "d,c,b,a"},
+		{"/widgets/?min_quantity=100", ""},
+	} {
+		if got := widgetNames(listWidgets(t, h, tt.target).Widgets); got != tt.want {
+			t.Errorf("%s listed %s, want %s", tt.target, got, tt.want)
+		}
+	}
+	expectError(t, do(h, http.MethodGet, "/widgets/?min_quantity=many", ""), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestListFiltersByStatus(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	createWidget(t, h, `{"name":"a"}`)
+	createWidget(t, h, `{"name":"b","status":"active"}`)
+	createWidget(t, h, `{"name":"c","status":"retired"}`)
+	createWidget(t, h, `{"name":"d","status":"active"}`)
+
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{"/widgets/?status=draft", "a"},
+		{"/widgets/?status=active", "b,d"},
+		{"/widgets/?status=retired", "c"},
+		{"/widgets/", "a,b,c,d"},
+	} {
+		if got := widgetNames(listWidgets(t, h, tt.target).Widgets); got != tt.want {
+			t.Errorf("%s listed %s, want %s", tt.target, got, tt.want)
+		}
+	}
+	expectError(t, do(h, http.MethodGet, "/widgets/?status=gone", ""), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestTimestampSortsBreakTiesByID(t *testing.T) {
+	tick := Time{time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)}
+	later := Time{tick.Add(time.Second)}
+	for _, tt := range []struct {
+		sort string
+		want string
+	}{
+		{sortUpdated, "a,c,d,b"},
+		{sortUpdatedDesc, "b,a,c,d"},
+	} {
+		widgets := []Widget{
+			{ID: "d", UpdatedAt: tick},
+			{ID: "b", UpdatedAt: later},
+			{ID: "a", UpdatedAt: tick},
+			{ID: "c", UpdatedAt: tick},
+		}
+		widgetFilter{sort: tt.sort}.order(widgets)
+		var ids []string
+		for _, w := range widgets {
+			ids = append(ids, w.ID)
+		}
+		if got := fmt.Sprint(ids); got != fmt.Sprint(strings.Split(tt.want, ",")) {
+			t.Errorf("%s ordered %s, want %s", tt.sort, got, tt.want)
+		}
+	}
+}
+
+func TestListSortedByTimestampIsStableAcrossPages(t *testing.T) {
+	store := newMemoryStore()
+	store.now = func() Time { return Time{time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)} }
+	h := newTestHandler(t, store, nil)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		createWidget(t, h, `{"name":"`+name+`"}`)
+	}
+
+	want := widgetNames(listWidgets(t, h, "/widgets/?sort=-updated").Widgets)
+	var paged []string
+	for offset := 0; offset < 5; offset += 2 {
+		page := listWidgets(t, h, fmt.Sprintf("/widgets/?sort=-updated&limit=2&offset=%d", offset))
+		paged = append(paged, widgetNames(page.Widgets))
+	}
+	if got := strings.Join(paged, ","); got != want {
+		t.Errorf("pages listed %s, want %s", got, want)
+	}
+	for i := 0; i < 3; i++ {
+		if got := widgetNames(listWidgets(t, h, "/widgets/?sort=-updated").Widgets); got != want {
+			t.Errorf("listed %s, then %s", want, got)
+		}
+	}
+}
+
+func TestListRejectsTooManyFilters(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_LIST_FILTERS": "2"})
+	createWidget(t, h, `{"name":"a","quantity":5}`)
+
+	if got := widgetNames(listWidgets(t, h, "/widgets/?min_quantity=1&max_quantity=9&sort=quantity").Widgets); got != "a" {
+		t.Errorf("two filters and a sort listed %s, want a", got)
+	}
+	e := expectError(t, do(h, http.MethodGet, "/widgets/?min_quantity=1&max_quantity=9&status=draft", ""), http.StatusBadRequest, codeBadRequest)
+	if e.Error != "A list may combine at most 2 filters." {
+		t.Errorf("got %q", e.Error)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const mimeJSON = "application/json"
+
+// Formatter encodes response payloads in one media type.
+type Formatter interface {
+	Encode(w io.Writer, payload interface{}) error
+}
+
+// formatters holds the registered Formatters keyed by MIME type.
+var formatters = map[string]Formatter{}
+
+// registerFormatter makes f available to clients that accept mime.
+func registerFormatter(mime string, f Formatter) {
+	formatters[mime] = f
+}
+
+func init() {
+	registerFormatter(mimeJSON, jsonFormatter{})
+	registerFormatter("application/yaml", yamlFormatter{})
+	registerFormatter("application/x-yaml", yamlFormatter{})
+}
+
+// negotiateFormat picks the registered Formatter that best matches the given
+// Accept header. JSON is used when the header is empty or nothing matches.
+func negotiateFormat(accept string) (string, Formatter) {
+	if mime, f, ok := matchFormat(accept); ok {
+		return mime, f
+	}
+	return mimeJSON, formatters[mimeJSON]
+}
+
+// matchFormat returns the registered Formatter that best matches the given
+// Accept header, reporting false when none does. An empty header matches
+// JSON.
+func matchFormat(accept string) (string, Formatter, bool) {
+	if len(strings.TrimSpace(accept)) == 0 {
+		return mimeJSON, formatters[mimeJSON], true
+	}
+
+	type mediaRange struct {
+		mime string
+		q    float64
+	}
+
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mime := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(mime) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mime: mime, q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, r := range ranges {
+		if r.mime == "*/*" {
+			return mimeJSON, formatters[mimeJSON], true
+		}
+		if f, ok := formatters[r.mime]; ok {
+			return r.mime, f, true
+		}
+		if strings.HasSuffix(r.mime, "/*") {
+			prefix := strings.TrimSuffix(r.mime, "*")
+			if strings.HasPrefix(mimeJSON, prefix) {
+				return mimeJSON, formatters[mimeJSON], true
+			}
+			mimes := make([]string, 0, len(formatters))
+			for mime := range formatters {
+				mimes = append(mimes, mime)
+			}
+			sort.Strings(mimes)
+			for _, mime := range mimes {
+				if strings.HasPrefix(mime, prefix) {
+					return mime, formatters[mime], true
+				}
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// requireAcceptable answers 406 to requests whose Accept header matches no
+// registered format, nor the given other media types, before they reach
+// next. With strict unset every request is passed on, and unmatched ones get
+// JSON.
+func requireAcceptable(next http.Handler, strict bool, others ...string) http.Handler {
+	if !strict {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		if _, _, ok := matchFormat(accept); !ok && !acceptsAnyOf(accept, others) {
+			writeJSONError(w, r, http.StatusNotAcceptable, "None of the media types in the Accept header can be produced.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptsAnyOf reports whether the Accept header names one of the given
+// media types with a non-zero quality.
+func acceptsAnyOf(accept string, mimes []string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mime := strings.ToLower(strings.TrimSpace(params[0]))
+		zero := false
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				v, err := strconv.ParseFloat(q[2:], 64)
+				zero = err == nil && v == 0
+			}
+		}
+		for _, m := range mimes {
+			if mime == m && !zero {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonFormatter encodes payloads as JSON.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Encode(w io.Writer, payload interface{}) error {
+	return json.NewEncoder(w).Encode(payload)
+}
+
+// yamlFormatter encodes payloads as YAML. The payload is first converted to
+// JSON so that it honours the same field names and marshalers.
+type yamlFormatter struct{}
+
+func (yamlFormatter) Encode(w io.Writer, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writeYAML(&buf, v, 0)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// writeYAML writes v as a block style YAML node at the given indent. It only
+// needs to handle the values produced by decoding JSON.
+func writeYAML(buf *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			buf.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buf.WriteString(pad + yamlKey(key) + ":")
+			writeYAMLChild(buf, v[key], indent)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			// Mappings start on the dash line, as in "- id: ...".
+			if m, ok := item.(map[string]interface{}); ok && len(m) > 0 {
+				var sub bytes.Buffer
+				writeYAML(&sub, m, indent+1)
+				buf.WriteString(pad + "- ")
+				buf.Write(sub.Bytes()[len(pad)+2:])
+				continue
+			}
+			buf.WriteString(pad + "-")
+			writeYAMLChild(buf, item, indent)
+		}
+	default:
+		buf.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLChild writes the value of a mapping entry or sequence item whose
+// key or dash has already been written.
+func writeYAMLChild(buf *bytes.Buffer, v interface{}, indent int) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		if len(c) > 0 {
+			buf.WriteString("\n")
+			writeYAML(buf, c, indent+1)
+			return
+		}
+		buf.WriteString(" {}\n")
+	case []interface{}:
+		if len(c) > 0 {
+			buf.WriteString("\n")
+			writeYAML(buf, c, indent+1)
+			return
+		}
+		buf.WriteString(" []\n")
+	default:
+		buf.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+// yamlKey formats a mapping key, leaving simple names unquoted.
+func yamlKey(key string) string {
+	plain := len(key) > 0
+	for i, c := range key {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			plain = false
+			break
+		}
+	}
+	switch strings.ToLower(key) {
+	case "true", "false", "null", "yes", "no", "on", "off", "y", "n":
+		plain = false
+	}
+	if plain {
+		return key
+	}
+	return yamlScalar(key)
+}
+
+// yamlScalar formats a JSON scalar. Strings are double quoted, which YAML
+// reads with the same escapes as JSON.
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return ""
+}
+
+// writeResponse writes payload in the format negotiated from the request's
+// Accept header.
+func writeResponse(w http.ResponseWriter, r *http.Request, status int, payload interface{}) error {
+	mime, f := negotiateFormat(r.Header.Get("Accept"))
+	w.Header().Add("Vary", "Accept")
+	return writeFormatted(w, r, status, mime, f, payload)
+}
+
+// writeFormatted writes payload with the given Formatter, using the output
+// options of r. Encoding errors are returned as a responseWriteError, since
+// the status has already been sent. Only the size of the payload is logged,
+// since it may hold decrypted fields.
+func writeFormatted(w http.ResponseWriter, r *http.Request, status int, mime string, f Formatter, payload interface{}) error {
+	w.Header().Set("Content-Type", mime)
+	w.WriteHeader(status)
+	body := &countingWriter{w: w}
+	err := f.Encode(body, outputFor(r).apply(payload))
+	log.Printf("wrote %s response code %d with %d byte payload", mime, status, body.n)
+	if err != nil {
+		return responseWriteError{err: err}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// responseWriteError is an error writing a response body after the status and
+// headers were sent, so no error response can follow it.
+type responseWriteError struct {
+	err error
+}
+
+func (e responseWriteError) Error() string {
+	return "unable to write response: " + e.err.Error()
+}
+
+func (e responseWriteError) Unwrap() error {
+	return e.err
+}
+
+// clientGone reports whether err means the client closed the connection.
+func clientGone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
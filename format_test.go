@@ -0,0 +1,125 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                  mimeJSON,
+		"*/*":                               mimeJSON,
+		"application/json":                  mimeJSON,
+		"application/yaml":                  "application/yaml",
+		"application/x-yaml":                "application/x-yaml",
+		"text/html, application/yaml;q=0.5": "application/yaml",
+		"application/yaml;q=0.4, application/json;q=0.9": mimeJSON,
+		"application/json;q=0, application/yaml":         "application/yaml",
+		"application/*":                                  mimeJSON,
+		"text/html":                                      mimeJSON,
+	} {
+		if got, _ := negotiateFormat(accept); got != want {
+			t.Errorf("negotiateFormat(%q) = %s, want %s", accept, got, want)
+		}
+	}
+
+	if _, _, ok := matchFormat("text/html"); ok {
+		t.Error("got a match for a type with no formatter")
+	}
+}
+
+func TestYAMLFormatter(t *testing.T) {
+	payload := map[string]interface{}{
+		"widget": map[string]interface{}{
+			"name":  "a: b",
+			"tags":  []string{"x", "y"},
+			"empty": []string{},
+			"items": []map[string]int{{"id": 1}},
+			"yes":   true,
+			"count": 12345678901234567,
+		},
+	}
+	var buf bytes.Buffer
+	if err := (yamlFormatter{}).Encode(&buf, payload); err != nil {
+		t.Fatal(err)
+	}
+	want := `widget:
+  count: 12345678901234567
+  empty: []
+  items:
+    - id: 1
+  name: "a: b"
+  tags:
+    - "x"
+    - "y"
+  "yes": true
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestResponsesUseTheNegotiatedFormat(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a"}`)
+
+	w := do(h, http.MethodGet, "/widgets/"+widget.ID, "", "Accept", "application/yaml")
+	if got := w.Header().Get("Content-Type"); got != "application/yaml" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "widget:\n") || !strings.Contains(body, `  name: "a"`) {
+		t.Errorf("got body %q, want YAML", body)
+	}
+	if got := strings.Join(w.Header()["Vary"], ", "); !strings.Contains(got, "Accept") {
+		t.Errorf("got Vary %q, want it to name Accept", got)
+	}
+
+	if got := do(h, http.MethodGet, "/widgets/"+widget.ID, "").Header().Get("Content-Type"); got != mimeJSON {
+		t.Errorf("got Content-Type %q without an Accept header", got)
+	}
+}
+
+func TestUnsupportedAcceptTypes(t *testing.T) {
+	api := newTestHandler(t, nil, nil)
+	widget := createWidget(t, api, `{"name":"a"}`)
+	target := "/widgets/" + widget.ID
+
+	lenient := requireAcceptable(api, false, mimeNDJSON)
+	w := do(lenient, http.MethodGet, target, "", "Accept", "application/xml")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != mimeJSON {
+		t.Errorf("lenient mode answered %d with Content-Type %q, want JSON", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	strict := requireAcceptable(api, true, mimeNDJSON)
+	expectError(t, do(strict, http.MethodGet, target, "", "Accept", "application/xml"), http.StatusNotAcceptable, "not_acceptable")
+	expectError(t, do(strict, http.MethodGet, target, "", "Accept", "application/json;q=0"), http.StatusNotAcceptable, "not_acceptable")
+	for _, accept := range []string{"", "*/*", "application/xml, application/json;q=0.5", "application/yaml", mimeNDJSON} {
+		if w := do(strict, http.MethodGet, target, "", "Accept", accept); w.Code != http.StatusOK {
+			t.Errorf("strict mode answered %d to Accept %q", w.Code, accept)
+		}
+	}
+
+	cfg, err := loadConfig(nil, lookupIn(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.StrictAccept {
+		t.Error("strict Accept handling is on by default")
+	}
+}
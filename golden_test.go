@@ -0,0 +1,96 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenTime is the time of every change in a golden test, so that timestamps
+// in the responses do not vary between runs.
+var goldenTime = time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// newGoldenHandler returns a widget handler over a store whose clock is
+// stopped at goldenTime, holding two widgets with sequence ids 1 and 2.
+func newGoldenHandler(t *testing.T) WidgetHandler {
+	t.Helper()
+	store := newMemoryStore()
+	store.now = func() Time { return Time{goldenTime} }
+	h := newTestHandler(t, store, nil)
+	createWidget(t, h, `{"name":"sprocket","description":"A small gear.","quantity":3,"tags":["metal"]}`)
+	createWidget(t, h, `{"name":"flange","quantity":1,"status":"active"}`)
+	return h
+}
+
+// goldenResponse renders the status, content type and indented JSON body of
+// w, the parts of a response the golden files pin down.
+func goldenResponse(t *testing.T, w *httptest.ResponseRecorder) []byte {
+	t.Helper()
+	var body bytes.Buffer
+	if err := json.Indent(&body, w.Body.Bytes(), "", "  "); err != nil {
+		t.Fatalf("response is not JSON: %s\n%s", err, w.Body.String())
+	}
+	return []byte(fmt.Sprintf("%d %s\nContent-Type: %s\n\n%s\n", w.Code, http.StatusText(w.Code), w.Header().Get("Content-Type"), body.String()))
+}
+
+// checkGolden compares got with testdata/name.golden, or rewrites the file
+// when the -update flag is set.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read golden file, run go test -update to create it: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("response differs from %s, run go test -update if the change is intended\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestGoldenResponses(t *testing.T) {
+	h := newGoldenHandler(t)
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{name: "get", method: http.MethodGet, target: "/widgets/1"},
+		{name: "list", method: http.MethodGet, target: "/widgets/?limit=1"},
+		{name: "error_not_found", method: http.MethodGet, target: "/widgets/404"},
+		{name: "error_validation", method: http.MethodPost, target: "/widgets/", body: `{"name":"","quantity":-1}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checkGolden(t, tc.name, goldenResponse(t, do(h, tc.method, tc.target, tc.body)))
+		})
+	}
+}
@@ -0,0 +1,936 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// graphQLPath is where the GraphQL endpoint is mounted.
+const graphQLPath = "/graphql"
+
+// The GraphQL endpoint supports a small subset of the language, enough to
+// select widget fields and run the CRUD mutations:
+//
+//	type Query {
+//	  widget(id: ID!): Widget
+//	  widgets(filter: WidgetFilter, limit: Int): [Widget!]!
+//	}
+//	type Mutation {
+//	  createWidget(input: WidgetInput!): Widget
+//	  updateWidget(id: ID!, input: WidgetInput!): Widget
+//	  deleteWidget(id: ID!): Widget
+//	}
+//	input WidgetFilter { status: String, minQuantity: Int, maxQuantity: Int }
+//	input WidgetInput {
+//	  name: String, description: String, quantity: Int, status: String,
+//	  tags: [String!], attributes: JSON, clientToken: String, revision: Int
+//	}
+//
+// Widget has the fields of the REST representation in camelCase. Operations
+// may be named and declare variables, and fields may be aliased. Fragments,
+// directives and introspection are not supported.
+//
+// The mutations store widgets the way the REST endpoints do, so a
+// clientToken is only taken by createWidget and a revision, checked like the
+// one in a PUT body, only by updateWidget. Warnings about stored widgets are
+// listed under extensions.
+
+// graphQLRequest is the body of a GraphQL request.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLError is an error in a GraphQL response. Path leads to the field
+// that failed, when there is one.
+type graphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// graphQLObject is a selected object, encoded with its fields in the order
+// they were selected.
+type graphQLObject []graphQLValue
+
+type graphQLValue struct {
+	key   string
+	value interface{}
+}
+
+func (o graphQLObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.key)
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// graphql executes a GraphQL query or mutation, sent as a JSON body or, for
+// queries, as the query, variables and operationName parameters of a GET.
+func (h WidgetHandler) graphql(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query, req.OperationName = query.Get("query"), query.Get("operationName")
+		if v := query.Get("variables"); len(v) > 0 {
+			if err := unmarshalNumbers([]byte(v), &req.Variables); err != nil {
+				writeGraphQLErrors(w, r, http.StatusBadRequest, "The variables parameter must be a JSON object.")
+				return
+			}
+		}
+	} else if err := decodeJSON(r.Body, &req, h.cfg.MaxJSONDepth); err != nil {
+		writeGraphQLErrors(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	doc, err := parseGraphQL(req.Query, h.cfg.MaxJSONDepth)
+	if err != nil {
+		writeGraphQLErrors(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		writeGraphQLErrors(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if op.kind == "mutation" && r.Method == http.MethodGet {
+		writeGraphQLErrors(w, r, http.StatusMethodNotAllowed, "Mutations must be sent with POST.")
+		return
+	}
+	if op.kind == "mutation" && h.cfg.ReadOnly {
+		writeGraphQLErrors(w, r, http.StatusMethodNotAllowed, "The service is read-only, so widgets cannot be changed.")
+		return
+	}
+
+	vars := make(map[string]interface{}, len(op.defaults)+len(req.Variables))
+	for name, value := range op.defaults {
+		vars[name] = value
+	}
+	for name, value := range req.Variables {
+		vars[name] = value
+	}
+
+	exec := graphQLExecution{h: h, w: w, r: r, vars: vars}
+	data := make(graphQLObject, 0, len(op.selections))
+	for _, field := range op.selections {
+		var value interface{}
+		var err error
+		if op.kind == "mutation" {
+			value, err = exec.mutation(field)
+		} else {
+			value, err = exec.query(field)
+		}
+		if err != nil {
+			exec.errors = append(exec.errors, graphQLError{Message: translate(r, err.Error()), Path: []interface{}{field.key()}})
+			value = nil
+		}
+		data = append(data, graphQLValue{key: field.key(), value: value})
+	}
+
+	payload := map[string]interface{}{"data": data}
+	if len(exec.errors) > 0 {
+		payload["errors"] = exec.errors
+	}
+	if len(exec.warnings) > 0 {
+		payload["extensions"] = map[string][]string{"warnings": exec.warnings}
+	}
+	if err := writeJSON(w, r, http.StatusOK, payload); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// writeGraphQLErrors writes a GraphQL response for a request that could not
+// be executed at all.
+func writeGraphQLErrors(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", "POST")
+	}
+	if err := writeJSON(w, r, status, map[string][]graphQLError{"errors": {{Message: translate(r, message)}}}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// graphQLExecution holds the state of one executing operation.
+type graphQLExecution struct {
+	h        WidgetHandler
+	w        http.ResponseWriter
+	r        *http.Request
+	vars     map[string]interface{}
+	errors   []graphQLError
+	warnings []string
+}
+
+func (e *graphQLExecution) query(field graphQLField) (interface{}, error) {
+	switch field.name {
+	case "__typename":
+		return "Query", nil
+	case "widget":
+		id, err := e.stringArg(field, "id", true)
+		if err != nil {
+			return nil, err
+		}
+		widget, err := e.h.find(e.r, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, storeError(err)
+		}
+		return e.selectWidget(widget, field)
+	case "widgets":
+		return e.widgets(field)
+	}
+	return nil, fmt.Errorf("Query has no field %s.", field.name)
+}
+
+func (e *graphQLExecution) widgets(field graphQLField) (interface{}, error) {
+	var f widgetFilter
+	if filter, ok := e.value(field.args["filter"]).(map[string]interface{}); ok {
+		for key, value := range filter {
+			switch key {
+			case "status":
+				status, ok := value.(string)
+				if !ok || !validStatus(status) {
+					return nil, errors.New("The status parameter must be draft, active or retired.")
+				}
+				f.status = status
+			case "minQuantity", "maxQuantity":
+				n, ok := graphQLInt(value)
+				if !ok || n < 0 {
+					return nil, fmt.Errorf("The %s filter must be a non-negative integer.", key)
+				}
+				if key == "minQuantity" {
+					f.minQuantity = &n
+				} else {
+					f.maxQuantity = &n
+				}
+			default:
+				return nil, fmt.Errorf("WidgetFilter has no field %s.", key)
+			}
+		}
+	} else if field.args["filter"] != nil && e.value(field.args["filter"]) != nil {
+		return nil, errors.New("The filter argument must be an object.")
+	}
+
+	limit := e.h.cfg.DefaultPageSize
+	if v, ok := field.args["limit"]; ok {
+		n, ok := graphQLInt(e.value(v))
+		if !ok || n < 1 || n > e.h.cfg.MaxPageSize {
+			return nil, fmt.Errorf("The limit argument must be between 1 and %d.", e.h.cfg.MaxPageSize)
+		}
+		limit = n
+	}
+
+	stored, err := e.h.store.List(e.r.Context())
+	if err != nil {
+		return nil, storeError(err)
+	}
+	q := requesterFor(e.r, e.h.cfg.AdminToken)
+	widgets := make([]interface{}, 0)
+	for _, widget := range stored {
+		if len(widgets) == limit {
+			break
+		}
+		if !q.canAccess(widget) || !f.match(widget) {
+			continue
+		}
+		selected, err := e.selectWidget(widget, field)
+		if err != nil {
+			return nil, err
+		}
+		widgets = append(widgets, selected)
+	}
+	return widgets, nil
+}
+
+func (e *graphQLExecution) mutation(field graphQLField) (interface{}, error) {
+	switch field.name {
+	case "__typename":
+		return "Mutation", nil
+	case "createWidget":
+		return e.createWidget(field)
+	case "updateWidget":
+		return e.updateWidget(field)
+	case "deleteWidget":
+		id, err := e.stringArg(field, "id", true)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := e.h.find(e.r, id); err != nil {
+			return nil, storeError(err)
+		}
+		widget, err := e.h.store.Delete(e.r.Context(), id)
+		if err != nil {
+			return nil, storeError(err)
+		}
+		recordDelete()
+		return e.selectWidget(widget, field)
+	}
+	return nil, fmt.Errorf("Mutation has no field %s.", field.name)
+}
+
+// widgetInputFields maps the fields of WidgetInput to their JSON names.
+var widgetInputFields = map[string]string{
+	"name":        "name",
+	"description": "description",
+	"quantity":    "quantity",
+	"status":      "status",
+	"tags":        "tags",
+	"attributes":  "attributes",
+	"clientToken": "client_token",
+	"revision":    "revision",
+}
+
+// widgetInputOnly are the WidgetInput fields taken by a single mutation.
+var widgetInputOnly = map[string]string{
+	"clientToken": "createWidget",
+	"revision":    "updateWidget",
+}
+
+// input returns the input argument as a JSON object with the REST field names.
+func (e *graphQLExecution) input(field graphQLField) ([]byte, error) {
+	input, ok := e.value(field.args["input"]).(map[string]interface{})
+	if !ok {
+		return nil, errors.New("The input argument must be an object.")
+	}
+	fields := make(map[string]interface{}, len(input))
+	for key, value := range input {
+		name, ok := widgetInputFields[key]
+		if only, ok2 := widgetInputOnly[key]; !ok || (ok2 && only != field.name) {
+			return nil, fmt.Errorf("WidgetInput has no field %s.", key)
+		}
+		fields[name] = value
+	}
+	return json.Marshal(fields)
+}
+
+func (e *graphQLExecution) createWidget(field graphQLField) (interface{}, error) {
+	b, err := e.input(field)
+	if err != nil {
+		return nil, err
+	}
+	widget, err := decodeWidgetWithDefaults(bytes.NewReader(b), e.h.cfg.Defaults, e.h.cfg.MaxJSONDepth)
+	if err != nil {
+		return nil, err
+	}
+	widget, _, err = e.h.saveNew(e.w, e.r, widget)
+	if err != nil {
+		return nil, saveError(err)
+	}
+	e.warn(widget)
+	return e.selectWidget(widget, field)
+}
+
+func (e *graphQLExecution) updateWidget(field graphQLField) (interface{}, error) {
+	id, err := e.stringArg(field, "id", true)
+	if err != nil {
+		return nil, err
+	}
+	b, err := e.input(field)
+	if err != nil {
+		return nil, err
+	}
+	var input struct {
+		widgetChanges
+		Revision int `json:"revision"`
+	}
+	if err := unmarshalNumbers(b, &input); err != nil {
+		return nil, err
+	}
+
+	widget, warnings, err := e.h.saveChanges(e.w, e.r, id, input.Revision, input.widgetChanges.apply)
+	if err != nil {
+		return nil, saveError(err)
+	}
+	e.warn(widget, warnings...)
+	return e.selectWidget(widget, field)
+}
+
+// warn adds the warnings about a stored widget, after the given ones, to the
+// response, as withWarnings does for REST responses.
+func (e *graphQLExecution) warn(widget Widget, warnings ...string) {
+	payload := e.h.withWarnings(e.w, e.r, widget, warnings...)
+	if translated, ok := payload["warnings"].([]string); ok {
+		e.warnings = append(e.warnings, translated...)
+	}
+}
+
+// saveError returns the client message for an error from saveNew or
+// saveChanges.
+func saveError(err error) error {
+	var serr statusError
+	if errors.As(err, &serr) {
+		return serr
+	}
+	return storeError(err)
+}
+
+// storeError returns the client message for an error from the store, logging
+// internal errors rather than passing them on.
+func storeError(err error) error {
+	status, message := storeErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("internal error %s", err)
+	}
+	return errors.New(message)
+}
+
+// selectWidget returns the fields of widget selected by field.
+func (e *graphQLExecution) selectWidget(widget Widget, field graphQLField) (interface{}, error) {
+	if len(field.selections) == 0 {
+		return nil, fmt.Errorf("The %s field needs a selection of Widget fields.", field.name)
+	}
+
+	obj := make(graphQLObject, 0, len(field.selections))
+	for _, sel := range field.selections {
+		if len(sel.selections) > 0 {
+			return nil, fmt.Errorf("The Widget field %s has no fields to select.", sel.name)
+		}
+		var value interface{}
+		switch sel.name {
+		case "__typename":
+			value = "Widget"
+		case "id":
+			value = widget.ID
+		case "name":
+			value = widget.Name
+		case "description":
+			value = widget.Description
+		case "quantity":
+			value = widget.Quantity
+		case "status":
+			value = widget.Status
+		case "tags":
+			value = widget.Tags
+			if widget.Tags == nil {
+				value = []string{}
+			}
+		case "attributes":
+			value = widget.Attributes
+		case "revision":
+			value = widget.Revision
+		case "createdAt":
+			value = widget.CreatedAt
+		case "updatedAt":
+			value = widget.UpdatedAt
+		case "clientToken":
+			value = widget.ClientToken
+		case "ownerId":
+			value = widget.OwnerID
+		default:
+			return nil, fmt.Errorf("Widget has no field %s.", sel.name)
+		}
+		obj = append(obj, graphQLValue{key: sel.key(), value: value})
+	}
+	return obj, nil
+}
+
+// stringArg returns the named string argument of field.
+func (e *graphQLExecution) stringArg(field graphQLField, name string, required bool) (string, error) {
+	value := e.value(field.args[name])
+	s, ok := value.(string)
+	if !ok && (value != nil || required) {
+		return "", fmt.Errorf("The %s argument must be a string.", name)
+	}
+	return s, nil
+}
+
+// value resolves variables in an argument value.
+func (e *graphQLExecution) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case graphQLVariable:
+		return e.vars[string(v)]
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = e.value(item)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			out[key] = e.value(item)
+		}
+		return out
+	}
+	return v
+}
+
+// graphQLInt returns a whole number argument, which may have come from the
+// query as an int or from JSON variables as a float64.
+func graphQLInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		if n == float64(int(n)) {
+			return int(n), true
+		}
+	case json.Number:
+		i, err := strconv.Atoi(n.String())
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// graphQLDocument is a parsed GraphQL document.
+type graphQLDocument struct {
+	operations []graphQLOperation
+}
+
+type graphQLOperation struct {
+	kind       string // query or mutation
+	name       string
+	defaults   map[string]interface{}
+	selections []graphQLField
+}
+
+type graphQLField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []graphQLField
+}
+
+// key returns the name the field's value is reported under.
+func (f graphQLField) key() string {
+	if len(f.alias) > 0 {
+		return f.alias
+	}
+	return f.name
+}
+
+// graphQLVariable is a reference to a variable, resolved at execution.
+type graphQLVariable string
+
+// operation returns the named operation, or the only one when name is empty.
+func (d graphQLDocument) operation(name string) (graphQLOperation, error) {
+	if len(name) == 0 {
+		if len(d.operations) != 1 {
+			return graphQLOperation{}, errors.New("The operationName must be given when the document has several operations.")
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return graphQLOperation{}, fmt.Errorf("The document has no operation %s.", name)
+}
+
+// graphQLToken is a lexical token. Kind is 'n' for a name, 'i' for an int,
+// 'f' for a float, 's' for a string and 'p' for punctuation.
+type graphQLToken struct {
+	kind byte
+	text string
+}
+
+// lexGraphQL splits a document into tokens, dropping whitespace, commas and
+// comments.
+func lexGraphQL(src string) ([]graphQLToken, error) {
+	var tokens []graphQLToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, graphQLToken{kind: 'p', text: "..."})
+			i += 3
+		case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+			tokens = append(tokens, graphQLToken{kind: 'p', text: string(c)})
+			i++
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, graphQLToken{kind: 'n', text: src[i:j]})
+			i = j
+		case c == '-' || c >= '0' && c <= '9':
+			j, kind := i+1, byte('i')
+			for j < len(src) && strings.IndexByte("0123456789.eE+-", src[j]) >= 0 {
+				if strings.IndexByte(".eE", src[j]) >= 0 {
+					kind = 'f'
+				}
+				j++
+			}
+			tokens = append(tokens, graphQLToken{kind: kind, text: src[i:j]})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, errors.New("The query has an unterminated string.")
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, errors.New("The query has an invalid string.")
+			}
+			tokens = append(tokens, graphQLToken{kind: 's', text: s})
+			i = j + 1
+		default:
+			return nil, fmt.Errorf("The query has an unexpected character %s.", string(c))
+		}
+	}
+	return tokens, nil
+}
+
+// graphQLParser builds a document from tokens. Selection sets, lists and
+// objects may nest at most maxDepth levels deep.
+type graphQLParser struct {
+	tokens   []graphQLToken
+	pos      int
+	depth    int
+	maxDepth int
+}
+
+// parseGraphQL parses a document of query and mutation operations whose
+// selections and values nest at most maxDepth levels deep.
+func parseGraphQL(src string, maxDepth int) (graphQLDocument, error) {
+	var doc graphQLDocument
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return doc, err
+	}
+	p := &graphQLParser{tokens: tokens, maxDepth: maxDepth}
+	if len(tokens) == 0 {
+		return doc, errors.New("The query must not be empty.")
+	}
+	for !p.done() {
+		op, err := p.operation()
+		if err != nil {
+			return doc, err
+		}
+		doc.operations = append(doc.operations, op)
+	}
+	return doc, nil
+}
+
+func (p *graphQLParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *graphQLParser) peek() graphQLToken {
+	if p.done() {
+		return graphQLToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// is reports whether the next token is the given punctuation or name.
+func (p *graphQLParser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == 'p' || t.kind == 'n') && t.text == text
+}
+
+func (p *graphQLParser) expect(text string) error {
+	if !p.is(text) {
+		return p.unexpected()
+	}
+	p.pos++
+	return nil
+}
+
+func (p *graphQLParser) name() (string, error) {
+	t := p.peek()
+	if t.kind != 'n' {
+		return "", p.unexpected()
+	}
+	p.pos++
+	return t.text, nil
+}
+
+// nest enters a selection set, list, object or list type, which leave undoes.
+func (p *graphQLParser) nest() error {
+	if p.depth++; p.depth > p.maxDepth {
+		return fmt.Errorf("The query must be nested at most %d levels deep.", p.maxDepth)
+	}
+	return nil
+}
+
+func (p *graphQLParser) leave() {
+	p.depth--
+}
+
+func (p *graphQLParser) unexpected() error {
+	if p.done() {
+		return errors.New("The query ends unexpectedly.")
+	}
+	return fmt.Errorf("The query has an unexpected %s.", p.peek().text)
+}
+
+func (p *graphQLParser) operation() (graphQLOperation, error) {
+	op := graphQLOperation{kind: "query"}
+	if p.is("{") {
+		sels, err := p.selectionSet()
+		op.selections = sels
+		return op, err
+	}
+
+	kind, err := p.name()
+	if err != nil {
+		return op, err
+	}
+	switch kind {
+	case "query", "mutation":
+		op.kind = kind
+	case "fragment":
+		return op, errors.New("Fragments are not supported.")
+	default:
+		return op, fmt.Errorf("The %s operation is not supported.", kind)
+	}
+	if p.peek().kind == 'n' {
+		op.name, _ = p.name()
+	}
+	if p.is("(") {
+		if op.defaults, err = p.variableDefinitions(); err != nil {
+			return op, err
+		}
+	}
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+// variableDefinitions parses ($name: Type = default, ...), returning the
+// defaults. Types are not checked.
+func (p *graphQLParser) variableDefinitions() (map[string]interface{}, error) {
+	defaults := make(map[string]interface{})
+	p.pos++
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if err := p.skipType(); err != nil {
+			return nil, err
+		}
+		if p.is("=") {
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			defaults[name] = value
+		}
+	}
+	p.pos++
+	return defaults, nil
+}
+
+func (p *graphQLParser) skipType() error {
+	if p.is("[") {
+		p.pos++
+		if err := p.nest(); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+		p.leave()
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.is("!") {
+		p.pos++
+	}
+	return nil
+}
+
+func (p *graphQLParser) selectionSet() ([]graphQLField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if err := p.nest(); err != nil {
+		return nil, err
+	}
+	var fields []graphQLField
+	for !p.is("}") {
+		if p.is("...") {
+			return nil, errors.New("Fragments are not supported.")
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	p.pos++
+	p.leave()
+	if len(fields) == 0 {
+		return nil, errors.New("A selection set must select at least one field.")
+	}
+	return fields, nil
+}
+
+func (p *graphQLParser) field() (graphQLField, error) {
+	var f graphQLField
+	name, err := p.name()
+	if err != nil {
+		return f, err
+	}
+	if p.is(":") {
+		p.pos++
+		f.alias = name
+		if name, err = p.name(); err != nil {
+			return f, err
+		}
+	}
+	f.name = name
+
+	if p.is("(") {
+		p.pos++
+		f.args = make(map[string]interface{})
+		for !p.is(")") {
+			arg, err := p.name()
+			if err != nil {
+				return f, err
+			}
+			if err := p.expect(":"); err != nil {
+				return f, err
+			}
+			if f.args[arg], err = p.value(); err != nil {
+				return f, err
+			}
+		}
+		p.pos++
+	}
+	if p.is("@") {
+		return f, errors.New("Directives are not supported.")
+	}
+	if p.is("{") {
+		f.selections, err = p.selectionSet()
+	}
+	return f, err
+}
+
+func (p *graphQLParser) value() (interface{}, error) {
+	t := p.peek()
+	switch {
+	case t.kind == 'p' && t.text == "$":
+		p.pos++
+		name, err := p.name()
+		return graphQLVariable(name), err
+	case t.kind == 'i':
+		p.pos++
+		n, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("The query has an invalid number %s.", t.text)
+		}
+		return n, nil
+	case t.kind == 'f':
+		p.pos++
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("The query has an invalid number %s.", t.text)
+		}
+		return f, nil
+	case t.kind == 's':
+		p.pos++
+		return t.text, nil
+	case t.kind == 'n':
+		p.pos++
+		switch t.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.text, nil // an enum value
+	case t.kind == 'p' && t.text == "[":
+		p.pos++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, 0)
+		for !p.is("]") {
+			if p.done() {
+				return nil, p.unexpected()
+			}
+			item, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		p.pos++
+		p.leave()
+		return list, nil
+	case t.kind == 'p' && t.text == "{":
+		p.pos++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		obj := make(map[string]interface{})
+		for !p.is("}") {
+			key, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[key], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.pos++
+		p.leave()
+		return obj, nil
+	}
+	return nil, p.unexpected()
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type graphQLResponse struct {
+	Data       map[string]json.RawMessage `json:"data"`
+	Errors     []graphQLError             `json:"errors"`
+	Extensions struct {
+		Warnings []string `json:"warnings"`
+	} `json:"extensions"`
+}
+
+// postGraphQL sends query with vars to h and decodes the response.
+func postGraphQL(t *testing.T, h http.Handler, query string, vars map[string]interface{}) (int, graphQLResponse) {
+	t.Helper()
+	b, err := json.Marshal(graphQLRequest{Query: query, Variables: vars})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := do(h, http.MethodPost, graphQLPath, string(b))
+	var resp graphQLResponse
+	decodeBody(t, w, &resp)
+	return w.Code, resp
+}
+
+// graphQLWidget is a widget selected by a GraphQL query.
+type graphQLWidget struct {
+	ID          string
+	Name        string
+	Description string
+	Quantity    int
+	Revision    int
+}
+
+func decodeGraphQLData(t *testing.T, resp graphQLResponse, name string, v interface{}) {
+	t.Helper()
+	if len(resp.Errors) > 0 {
+		t.Fatalf("got errors %+v", resp.Errors)
+	}
+	if err := json.Unmarshal(resp.Data[name], v); err != nil {
+		t.Fatalf("unable to decode %s from %s: %s", name, resp.Data[name], err)
+	}
+}
+
+func TestGraphQLSelectsOnlyTheRequestedFields(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	created := createWidget(t, h, `{"name":"sprocket","description":"shiny","quantity":3}`)
+
+	_, resp := postGraphQL(t, h, `query Get($id: ID!) { widget(id: $id) { id label: name } }`, map[string]interface{}{"id": created.ID})
+	var got map[string]interface{}
+	decodeGraphQLData(t, resp, "widget", &got)
+	if len(got) != 2 || got["id"] != created.ID || got["label"] != "sprocket" {
+		t.Errorf("got %v, want only the id and the aliased name", got)
+	}
+}
+
+func TestGraphQLGetVariables(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	createWidget(t, h, `{"name":"a","quantity":1}`)
+	createWidget(t, h, `{"name":"b","quantity":2}`)
+
+	query := url.Values{
+		"query":     {`query List($n: Int) { widgets(limit: $n) { name } }`},
+		"variables": {`{"n": 1}`},
+	}
+	w := do(h, http.MethodGet, graphQLPath+"?"+query.Encode(), "")
+	var resp graphQLResponse
+	decodeBody(t, w, &resp)
+	var widgets []map[string]interface{}
+	decodeGraphQLData(t, resp, "widgets", &widgets)
+	if len(widgets) != 1 {
+		t.Errorf("got %v, want a single widget", widgets)
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+
+	_, resp := postGraphQL(t, h, `mutation { createWidget(input: {name: "gear", quantity: 5}) { id name quantity revision } }`, nil)
+	var created graphQLWidget
+	decodeGraphQLData(t, resp, "createWidget", &created)
+	if created.Name != "gear" || created.Quantity != 5 || created.Revision != 1 {
+		t.Fatalf("got %+v", created)
+	}
+
+	_, resp = postGraphQL(t, h, `mutation Up($id: ID!) { updateWidget(id: $id, input: {quantity: 7}) { name quantity revision } }`, map[string]interface{}{"id": created.ID})
+	var updated graphQLWidget
+	decodeGraphQLData(t, resp, "updateWidget", &updated)
+	if updated.Name != "gear" || updated.Quantity != 7 || updated.Revision != 2 {
+		t.Errorf("got %+v, want the quantity changed and the name kept", updated)
+	}
+
+	_, resp = postGraphQL(t, h, `mutation Del($id: ID!) { deleteWidget(id: $id) { id } }`, map[string]interface{}{"id": created.ID})
+	var deleted graphQLWidget
+	decodeGraphQLData(t, resp, "deleteWidget", &deleted)
+	if w := do(h, http.MethodGet, "/widgets/"+created.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d after deleteWidget, want 404", w.Code)
+	}
+}
+
+func TestGraphQLMutationsShareTheRESTRules(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{
+		"API_DEDUP_WINDOW":         "1m",
+		"API_TRUNCATE_DESCRIPTION": "true",
+		"API_MAX_DESC_LEN":         "10",
+		"API_STALE_UPDATES":        staleReject,
+	})
+	h.dedup.now = func() time.Time { return time.Unix(0, 0) }
+
+	create := `mutation { createWidget(input: {name: "gear", description: "far too long", quantity: 1}) { id description } }`
+	_, resp := postGraphQL(t, h, create, nil)
+	var first graphQLWidget
+	decodeGraphQLData(t, resp, "createWidget", &first)
+	if first.Description != "far too l…" {
+		t.Errorf("got description %q, want it truncated", first.Description)
+	}
+
+	_, resp = postGraphQL(t, h, create, nil)
+	var second graphQLWidget
+	decodeGraphQLData(t, resp, "createWidget", &second)
+	if second.ID != first.ID {
+		t.Errorf("got id %s, want the duplicate create to return %s", second.ID, first.ID)
+	}
+
+	update := `mutation Up($id: ID!, $rev: Int) { updateWidget(id: $id, input: {quantity: 2, revision: $rev}) { revision } }`
+	_, resp = postGraphQL(t, h, update, map[string]interface{}{"id": first.ID, "rev": 1})
+	var updated graphQLWidget
+	decodeGraphQLData(t, resp, "updateWidget", &updated)
+	if updated.Revision != 2 {
+		t.Fatalf("got revision %d", updated.Revision)
+	}
+	_, resp = postGraphQL(t, h, update, map[string]interface{}{"id": first.ID, "rev": 1})
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "revision 2, not 1") {
+		t.Errorf("got errors %+v, want a stale revision", resp.Errors)
+	}
+
+	_, resp = postGraphQL(t, h, `mutation Up($id: ID!) { updateWidget(id: $id, input: {description: "123456789"}) { id } }`, map[string]interface{}{"id": first.ID})
+	if len(resp.Errors) > 0 || len(resp.Extensions.Warnings) != 1 {
+		t.Errorf("got errors %+v, warnings %v, want a warning for a description near the limit", resp.Errors, resp.Extensions.Warnings)
+	}
+
+	_, resp = postGraphQL(t, h, `mutation { createWidget(input: {name: "x", revision: 3}) { id } }`, nil)
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "no field revision") {
+		t.Errorf("got errors %+v, want revision refused on create", resp.Errors)
+	}
+}
+
+func TestGraphQLRejectsDeepQueries(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_JSON_DEPTH": "4"})
+	for _, query := range []string{
+		`{ widgets(filter: {status: [[[["x"]]]]}) { id } }`,
+		`{ a { b { c { d { e } } } } }`,
+		`query Q($v: [[[[[Int]]]]]) { widgets { id } }`,
+	} {
+		code, resp := postGraphQL(t, h, query, nil)
+		if code != http.StatusBadRequest || len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "at most 4 levels") {
+			t.Errorf("%s: got status %d, errors %+v", query, code, resp.Errors)
+		}
+	}
+
+	if code, resp := postGraphQL(t, h, `{ widgets(filter: {status: "draft"}) { id } }`, nil); code != http.StatusOK || len(resp.Errors) > 0 {
+		t.Errorf("got status %d, errors %+v for a shallow query", code, resp.Errors)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmckind/go-api-demo/widgetspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcMetadata is the call metadata passed on to the REST code as the
+// request headers of the same name.
+var grpcMetadata = []string{"x-user", "authorization", "accept-language"}
+
+// widgetService serves WidgetService over gRPC from the same WidgetHandler,
+// and so the same Store, as the REST API. Each call is handed to the REST
+// code as a request carrying its context and metadata, so widgets are
+// validated, deduplicated and checked for stale revisions the same way.
+// Headers the REST code sets, such as Warning, are sent as response metadata.
+type widgetService struct {
+	widgetspb.UnimplementedWidgetServiceServer
+
+	h WidgetHandler
+}
+
+// newGRPCServer will construct a gRPC server for WidgetService backed by h.
+func newGRPCServer(h WidgetHandler) *grpc.Server {
+	srv := grpc.NewServer()
+	widgetspb.RegisterWidgetServiceServer(srv, widgetService{h: h})
+	return srv
+}
+
+// stopGRPC stops srv once its calls finish, or cuts them off after timeout.
+func stopGRPC(srv *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("gRPC calls still running after %s, stopping anyway", timeout)
+		srv.Stop()
+	}
+}
+
+// grpcRequest returns the request the REST code reads a call's context and
+// metadata from.
+func grpcRequest(ctx context.Context, method string) *http.Request {
+	r, err := http.NewRequest(method, "/widgets/", nil)
+	if err != nil {
+		panic(err)
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, name := range grpcMetadata {
+			if values := md.Get(name); len(values) > 0 {
+				r.Header.Set(name, values[0])
+			}
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// callHeaders collects the headers the REST code sets during a call. The
+// body it would write is discarded, since calls answer with messages.
+type callHeaders http.Header
+
+func (h callHeaders) Header() http.Header {
+	return http.Header(h)
+}
+
+func (h callHeaders) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (h callHeaders) WriteHeader(status int) {}
+
+// send sends the collected headers as the call's response metadata.
+func (h callHeaders) send(ctx context.Context) {
+	if len(h) == 0 {
+		return
+	}
+	md := metadata.MD{}
+	for name, values := range h {
+		md.Append(strings.ToLower(name), values...)
+	}
+	if err := grpc.SetHeader(ctx, md); err != nil {
+		log.Printf("unable to set gRPC response metadata %s", err)
+	}
+}
+
+func (s widgetService) ListWidgets(ctx context.Context, req *widgetspb.ListWidgetsRequest) (*widgetspb.ListWidgetsResponse, error) {
+	r := grpcRequest(ctx, http.MethodGet)
+	query := url.Values{"limit": {strconv.Itoa(int(req.Limit))}}
+	if len(req.Cursor) > 0 {
+		query.Set("cursor", req.Cursor)
+	}
+	p, err := parsePage(query, s.h.cfg.DefaultPageSize, s.h.cfg.MaxPageSize)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, translate(r, err.Error()))
+	}
+
+	stored, err := s.h.store.List(ctx)
+	if err != nil {
+		return nil, grpcError(r, err)
+	}
+	q := requesterFor(r, s.h.cfg.AdminToken)
+	all := make([]Widget, 0, len(stored))
+	for _, widget := range stored {
+		if q.canAccess(widget) {
+			all = append(all, widget)
+		}
+	}
+	widgets, next := p.apply(all)
+
+	resp := &widgetspb.ListWidgetsResponse{NextCursor: next}
+	for _, widget := range widgets {
+		pb, err := widgetProto(widget)
+		if err != nil {
+			return nil, grpcError(r, err)
+		}
+		resp.Widgets = append(resp.Widgets, pb)
+	}
+	return resp, nil
+}
+
+func (s widgetService) GetWidget(ctx context.Context, req *widgetspb.GetWidgetRequest) (*widgetspb.Widget, error) {
+	r := grpcRequest(ctx, http.MethodGet)
+	widget, err := s.h.find(r, req.Id)
+	if err != nil {
+		return nil, grpcError(r, err)
+	}
+	return s.reply(r, widget)
+}
+
+func (s widgetService) CreateWidget(ctx context.Context, req *widgetspb.CreateWidgetRequest) (*widgetspb.Widget, error) {
+	r := grpcRequest(ctx, http.MethodPost)
+	if err := s.checkWritable(r); err != nil {
+		return nil, err
+	}
+	b, err := widgetInput(req.Widget)
+	if err != nil {
+		return nil, grpcError(r, err)
+	}
+	widget, err := decodeWidgetWithDefaults(bytes.NewReader(b), s.h.cfg.Defaults, s.h.cfg.MaxJSONDepth)
+	if err != nil {
+		return nil, grpcDecodeError(r, err)
+	}
+
+	w := callHeaders{}
+	if widget, _, err = s.h.saveNew(w, r, widget); err != nil {
+		return nil, grpcError(r, err)
+	}
+	s.h.withWarnings(w, r, widget)
+	w.send(ctx)
+	return s.reply(r, widget)
+}
+
+// UpdateWidget replaces the widget as a PUT does. A revision other than zero
+// is the one the client read.
+func (s widgetService) UpdateWidget(ctx context.Context, req *widgetspb.UpdateWidgetRequest) (*widgetspb.Widget, error) {
+	r := grpcRequest(ctx, http.MethodPut)
+	if err := s.checkWritable(r); err != nil {
+		return nil, err
+	}
+	b, err := widgetInput(req.Widget)
+	if err != nil {
+		return nil, grpcError(r, err)
+	}
+	var replacement Widget
+	if err := decodeJSON(bytes.NewReader(b), &replacement, s.h.cfg.MaxJSONDepth); err != nil {
+		return nil, grpcDecodeError(r, err)
+	}
+
+	w := callHeaders{}
+	widget, warnings, err := s.h.saveChanges(w, r, req.Widget.GetId(), int(req.Widget.GetRevision()), replacing(replacement))
+	if err != nil {
+		return nil, grpcError(r, err)
+	}
+	s.h.withWarnings(w, r, widget, warnings...)
+	w.send(ctx)
+	return s.reply(r, widget)
+}
+
+func (s widgetService) DeleteWidget(ctx context.Context, req *widgetspb.DeleteWidgetRequest) (*widgetspb.Widget, error) {
+	r := grpcRequest(ctx, http.MethodDelete)
+	if err := s.checkWritable(r); err != nil {
+		return nil, err
+	}
+	if _, err := s.h.find(r, req.Id); err != nil {
+		return nil, grpcError(r, err)
+	}
+	widget, err := s.h.store.Delete(ctx, req.Id)
+	if err != nil {
+		return nil, grpcError(r, err)
+	}
+	recordDelete()
+	return s.reply(r, widget)
+}
+
+// checkWritable refuses changes when the service is read-only.
+func (s widgetService) checkWritable(r *http.Request) error {
+	if s.h.cfg.ReadOnly {
+		return status.Error(codes.FailedPrecondition, translate(r, "The service is read-only, so widgets cannot be changed."))
+	}
+	return nil
+}
+
+func (s widgetService) reply(r *http.Request, widget Widget) (*widgetspb.Widget, error) {
+	pb, err := widgetProto(widget)
+	if err != nil {
+		return nil, grpcError(r, err)
+	}
+	return pb, nil
+}
+
+// widgetProto returns widget as a message.
+func widgetProto(widget Widget) (*widgetspb.Widget, error) {
+	pb := &widgetspb.Widget{
+		Id:          widget.ID,
+		Name:        widget.Name,
+		Description: widget.Description,
+		Quantity:    int64(widget.Quantity),
+		Status:      widget.Status,
+		Tags:        widget.Tags,
+		Revision:    int64(widget.Revision),
+		CreatedAt:   timestamppb.New(widget.CreatedAt.Time),
+		UpdatedAt:   timestamppb.New(widget.UpdatedAt.Time),
+		ClientToken: widget.ClientToken,
+		OwnerId:     widget.OwnerID,
+	}
+	if len(widget.Attributes) > 0 {
+		b, err := json.Marshal(widget.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		pb.Attributes = &structpb.Struct{}
+		if err := pb.Attributes.UnmarshalJSON(b); err != nil {
+			return nil, err
+		}
+	}
+	return pb, nil
+}
+
+// widgetInput returns the fields a client may set on a widget message as a
+// JSON request body, leaving out those at their zero value so that the
+// configured defaults apply to them.
+func widgetInput(pb *widgetspb.Widget) ([]byte, error) {
+	if pb == nil {
+		return nil, statusError{status: http.StatusBadRequest, message: "The widget field is required."}
+	}
+	fields := map[string]interface{}{}
+	if len(pb.Name) > 0 {
+		fields["name"] = pb.Name
+	}
+	if len(pb.Description) > 0 {
+		fields["description"] = pb.Description
+	}
+	if pb.Quantity != 0 {
+		fields["quantity"] = pb.Quantity
+	}
+	if len(pb.Status) > 0 {
+		fields["status"] = pb.Status
+	}
+	if len(pb.Tags) > 0 {
+		fields["tags"] = pb.Tags
+	}
+	if len(pb.ClientToken) > 0 {
+		fields["client_token"] = pb.ClientToken
+	}
+	if pb.Attributes != nil {
+		b, err := pb.Attributes.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		fields["attributes"] = json.RawMessage(b)
+	}
+	return json.Marshal(fields)
+}
+
+// grpcDecodeError returns the status for a widget message that could not be
+// decoded, as writeDecodeError would write it.
+func grpcDecodeError(r *http.Request, err error) error {
+	var serr statusError
+	if errors.As(err, &serr) {
+		return grpcError(r, err)
+	}
+	return status.Error(codes.InvalidArgument, translate(r, err.Error()))
+}
+
+// grpcError returns the status for an error from the REST code or the store,
+// logging internal errors rather than passing them on.
+func grpcError(r *http.Request, err error) error {
+	httpStatus, message := storeErrorStatus(err)
+	var serr statusError
+	if errors.As(err, &serr) {
+		httpStatus, message = serr.status, serr.message
+	} else if httpStatus == http.StatusInternalServerError {
+		log.Printf("internal error %s", err)
+	}
+	return status.Error(grpcCode(httpStatus), translate(r, message))
+}
+
+// grpcCode maps an HTTP status to the gRPC code closest to it.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
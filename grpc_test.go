@@ -0,0 +1,132 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/jmckind/go-api-demo/widgetspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCTestClient serves WidgetService from h over an in-memory connection
+// and returns a client for it.
+func newGRPCTestClient(t *testing.T, h WidgetHandler) widgetspb.WidgetServiceClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	srv := newGRPCServer(h)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return ln.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return widgetspb.NewWidgetServiceClient(conn)
+}
+
+func TestGRPCCreateAndGetWidget(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	client := newGRPCTestClient(t, h)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user", "alice")
+
+	var header metadata.MD
+	created, err := client.CreateWidget(ctx, &widgetspb.CreateWidgetRequest{Widget: &widgetspb.Widget{Name: "sprocket", Quantity: 3, Tags: []string{" Metal "}}}, grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == "" || created.Status != statusDraft || created.Revision != 1 || created.OwnerId != "alice" || created.Tags[0] != "metal" {
+		t.Errorf("got %+v", created)
+	}
+
+	got, err := client.GetWidget(ctx, &widgetspb.GetWidgetRequest{Id: created.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "sprocket" || got.Quantity != 3 || !got.CreatedAt.AsTime().Equal(created.CreatedAt.AsTime()) {
+		t.Errorf("got %+v, want the created widget", got)
+	}
+
+	// Both front ends see the same store.
+	if w := do(h, http.MethodGet, "/widgets/"+created.Id, "", "X-User", "alice"); w.Code != http.StatusOK {
+		t.Errorf("got REST status %d for the widget created over gRPC", w.Code)
+	}
+	if _, err := client.GetWidget(context.Background(), &widgetspb.GetWidgetRequest{Id: created.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v for another user's widget, want NotFound", err)
+	}
+}
+
+func TestGRPCUpdateChecksStaleRevisions(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_STALE_UPDATES": staleReject})
+	client := newGRPCTestClient(t, h)
+	ctx := context.Background()
+	created := createWidget(t, h, `{"name":"a","quantity":1}`)
+
+	updated, err := client.UpdateWidget(ctx, &widgetspb.UpdateWidgetRequest{Widget: &widgetspb.Widget{Id: created.ID, Name: "b", Quantity: 2, Revision: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "b" || updated.Revision != 2 {
+		t.Errorf("got %+v", updated)
+	}
+
+	_, err = client.UpdateWidget(ctx, &widgetspb.UpdateWidgetRequest{Widget: &widgetspb.Widget{Id: created.ID, Name: "c", Revision: 1}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v for a stale revision, want FailedPrecondition", err)
+	}
+	if _, err := client.CreateWidget(ctx, &widgetspb.CreateWidgetRequest{Widget: &widgetspb.Widget{Quantity: -1}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for an invalid widget, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCListAndDelete(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	client := newGRPCTestClient(t, h)
+	ctx := context.Background()
+	a := createWidget(t, h, `{"name":"a"}`)
+	createWidget(t, h, `{"name":"b"}`)
+
+	page, err := client.ListWidgets(ctx, &widgetspb.ListWidgetsRequest{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Widgets) != 1 || page.Widgets[0].Name != "a" {
+		t.Fatalf("got %+v", page)
+	}
+	page, err = client.ListWidgets(ctx, &widgetspb.ListWidgetsRequest{Limit: 1, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Widgets) != 1 || page.Widgets[0].Name != "b" || page.NextCursor != "" {
+		t.Errorf("got %+v for the second page", page)
+	}
+
+	if _, err := client.DeleteWidget(ctx, &widgetspb.DeleteWidgetRequest{Id: a.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetWidget(ctx, &widgetspb.GetWidgetRequest{Id: a.ID}); status.Code(err) != codes.NotFound {
+		t.Errorf("got %v after delete, want NotFound", err)
+	}
+}
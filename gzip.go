@@ -0,0 +1,129 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// validGzipLevel reports whether level is accepted by compress/gzip, from
+// gzip.HuffmanOnly through gzip.BestCompression.
+func validGzipLevel(level int) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("gzip level must be between %d and %d", gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+// gzipResponses compresses responses from next at the given level when the
+// client accepts gzip.
+func gzipResponses(next http.Handler, level int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w, level: level}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header lists gzip without
+// refusing it with a zero quality value.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter compresses the body written to it. The compressor is only
+// created once there is a body, so responses such as 204 stay empty.
+type gzipWriter struct {
+	http.ResponseWriter
+	level    int
+	gz       *gzip.Writer
+	wrote    bool
+	compress bool
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.wrote {
+		return
+	}
+	g.wrote = true
+	g.compress = status != http.StatusNoContent && status != http.StatusNotModified &&
+		len(g.Header().Get("Content-Encoding")) == 0
+	if g.compress {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.wrote {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.compress {
+		return g.ResponseWriter.Write(b)
+	}
+	if g.gz == nil {
+		gz, err := gzip.NewWriterLevel(g.ResponseWriter, g.level)
+		if err != nil {
+			return 0, err
+		}
+		g.gz = gz
+	}
+	return g.gz.Write(b)
+}
+
+// Flush sends whatever has been compressed so far, so streamed responses
+// still reach the client promptly.
+func (g *gzipWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the compressed stream.
+func (g *gzipWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
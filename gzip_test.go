@@ -0,0 +1,69 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGzipLevelsDecompress(t *testing.T) {
+	body := strings.Repeat(`{"name":"widget"}`, 100)
+	payload := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+
+	for _, level := range []int{gzip.HuffmanOnly, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		w := do(gzipResponses(payload, level), http.MethodGet, "/", "", "Accept-Encoding", "gzip")
+		if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Fatalf("level %d: got Content-Encoding %q", level, got)
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		if string(got) != body {
+			t.Errorf("level %d: got %d bytes back, want the original %d", level, len(got), len(body))
+		}
+	}
+
+	// Clients that refuse gzip get the body as is.
+	w := do(gzipResponses(payload, gzip.BestSpeed), http.MethodGet, "/", "", "Accept-Encoding", "gzip;q=0")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+		t.Errorf("got an encoded response for a client refusing gzip")
+	}
+}
+
+func TestGzipLevelIsValidatedAtStartup(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"API_GZIP_LEVEL": "9"})
+	if cfg.GzipLevel != gzip.BestCompression {
+		t.Errorf("got level %d", cfg.GzipLevel)
+	}
+	if cfg := testConfig(t, nil); cfg.GzipLevel != gzip.DefaultCompression {
+		t.Errorf("got default level %d", cfg.GzipLevel)
+	}
+	for _, level := range []string{"10", "-3", "fast"} {
+		if _, err := loadConfig(nil, lookupIn(map[string]string{"API_GZIP_LEVEL": level})); err == nil {
+			t.Errorf("%s: got no error", level)
+		}
+	}
+}
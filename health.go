@@ -0,0 +1,73 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// livez reports that the process is up. It never checks dependencies.
+func livez(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "Method not allowed for this resource.")
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyHandler reports whether the server's dependencies are reachable and
+// it is not draining for shutdown.
+type ReadyHandler struct {
+	store    Store
+	draining *drainFlag
+}
+
+// NewReadyHandler will construct a new ReadyHandler that checks the given
+// Store and fails once draining is set.
+func NewReadyHandler(store Store, draining *drainFlag) ReadyHandler {
+	return ReadyHandler{
+		store:    store,
+		draining: draining,
+	}
+}
+
+func (h ReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "Method not allowed for this resource.")
+		return
+	}
+
+	if h.draining.isSet() {
+		writeJSONError(w, r, http.StatusServiceUnavailable, "The service is shutting down.")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := h.store.Ping(ctx); err != nil {
+		log.Printf("store is not ready %s", err)
+		writeJSONError(w, r, http.StatusServiceUnavailable, "The service is not ready.")
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
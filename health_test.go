@@ -0,0 +1,55 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// unreadyStore is a Store that cannot be reached.
+type unreadyStore struct {
+	Store
+}
+
+func (unreadyStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestReadyzFailsWhileLivezSucceeds(t *testing.T) {
+	ready := NewReadyHandler(unreadyStore{newMemoryStore()}, &drainFlag{})
+	expectError(t, do(ready, http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable, codeUnavailable)
+
+	if w := do(http.HandlerFunc(livez), http.MethodGet, "/livez", ""); w.Code != http.StatusOK {
+		t.Errorf("got /livez status %d with an unready store, want 200", w.Code)
+	}
+}
+
+func TestReadyzSucceedsWithAReachableStore(t *testing.T) {
+	ready := NewReadyHandler(newMemoryStore(), &drainFlag{})
+	if w := do(ready, http.MethodGet, "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("got status %d: %s", w.Code, w.Body.String())
+	}
+	expectError(t, do(ready, http.MethodPost, "/readyz", ""), http.StatusMethodNotAllowed, codeMethodNotAllowed)
+}
+
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	draining := &drainFlag{}
+	ready := NewReadyHandler(newMemoryStore(), draining)
+	draining.start()
+	expectError(t, do(ready, http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable, codeUnavailable)
+}
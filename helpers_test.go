@@ -0,0 +1,183 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testConfig loads the configuration from env alone, as if no other
+// environment variables were set.
+func testConfig(t *testing.T, env map[string]string) Config {
+	t.Helper()
+	cfg, err := loadConfig(nil, lookupIn(env))
+	if err != nil {
+		t.Fatalf("invalid test configuration: %s", err)
+	}
+	return cfg
+}
+
+// lookupIn returns a getenv function reading from env.
+func lookupIn(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+// newTestHandler returns a widget handler configured from env over store,
+// handing out sequence ids. A nil store is an empty memoryStore.
+func newTestHandler(t *testing.T, store Store, env map[string]string) WidgetHandler {
+	t.Helper()
+	if store == nil {
+		store = newMemoryStore()
+	}
+	ids, err := newSequenceGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWidgetHandler(store, ids, testConfig(t, env))
+}
+
+// do sends a request to h, with headers given as name and value pairs, and
+// returns the recorded response.
+func do(h http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if len(body) > 0 {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decodeBody decodes the JSON response body into v.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("unable to decode response %q: %s", w.Body.String(), err)
+	}
+}
+
+// createWidget creates a widget from body, failing the test unless it is
+// created.
+func createWidget(t *testing.T, h http.Handler, body string) Widget {
+	t.Helper()
+	w := do(h, http.MethodPost, "/widgets/", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, w, &resp)
+	return resp.Widget
+}
+
+// apiError is the body of an error response.
+type apiError struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// expectError fails the test unless w is an error response with the given
+// status and code.
+func expectError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) apiError {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("got status %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+	var e apiError
+	decodeBody(t, w, &e)
+	if e.Code != code {
+		t.Fatalf("got code %q, want %q: %s", e.Code, code, e.Error)
+	}
+	return e
+}
+
+// faultyStore is a Store whose Put fails for the widgets failPut picks.
+type faultyStore struct {
+	Store
+	failPut func(Widget) error
+}
+
+func (s faultyStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	if s.failPut != nil {
+		if err := s.failPut(widget); err != nil {
+			return Widget{}, err
+		}
+	}
+	return s.Store.Put(ctx, widget)
+}
+
+// listPage is the body of a list response.
+type listPage struct {
+	Widgets    []Widget `json:"widgets"`
+	NextCursor string   `json:"next_cursor"`
+}
+
+// listWidgets gets the list at target, failing the test unless it answers
+// 200.
+func listWidgets(t *testing.T, h http.Handler, target string) listPage {
+	t.Helper()
+	w := do(h, http.MethodGet, target, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list answered %d: %s", w.Code, w.Body.String())
+	}
+	var page listPage
+	decodeBody(t, w, &page)
+	return page
+}
+
+// widgetNames returns the names of widgets, in order.
+func widgetNames(widgets []Widget) string {
+	names := make([]string, len(widgets))
+	for i, widget := range widgets {
+		names[i] = widget.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// countingStore is a Store that counts the calls to Get.
+type countingStore struct {
+	Store
+	gets int32
+}
+
+func (s *countingStore) Get(ctx context.Context, id string) (Widget, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.Store.Get(ctx, id)
+}
+
+func (s *countingStore) getCount() int {
+	return int(atomic.LoadInt32(&s.gets))
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultLanguage = "en"
+
+// translations maps a language to translations of the English client
+// messages. Keys are the English messages as written in the code, with %d or
+// %s standing for values filled in at runtime. Messages without a
+// translation are sent in English.
+var translations = map[string]map[string]string{
+	"es": {
+		"A list may combine at most %d filters.":                                        "Una lista puede combinar como máximo %d filtros.",
+		"A widget id is required in the path, as in /widgets/{id}.":                     "Se requiere un id de widget en la ruta, como en /widgets/{id}.",
+		"A widget may have at most %d tags.":                                            "Un widget puede tener como máximo %d etiquetas.",
+		"A selection set must select at least one field.":                               "Un conjunto de selección debe seleccionar al menos un campo.",
+		"Directives are not supported.":                                                 "Las directivas no son compatibles.",
+		"Fragments are not supported.":                                                  "Los fragmentos no son compatibles.",
+		"Mutation has no field %s.":                                                     "Mutation no tiene el campo %s.",
+		"Mutations must be sent with POST.":                                             "Las mutaciones deben enviarse con POST.",
+		"Query has no field %s.":                                                        "Query no tiene el campo %s.",
+		"The %s argument must be a string.":                                             "El argumento %s debe ser una cadena.",
+		"The %s field needs a selection of Widget fields.":                              "El campo %s necesita una selección de campos de Widget.",
+		"The %s filter must be a non-negative integer.":                                 "El filtro %s debe ser un entero no negativo.",
+		"The %s operation is not supported.":                                            "La operación %s no es compatible.",
+		"The Widget field %s has no fields to select.":                                  "El campo %s de Widget no tiene campos que seleccionar.",
+		"The document has no operation %s.":                                             "El documento no tiene la operación %s.",
+		"The filter argument must be an object.":                                        "El argumento filter debe ser un objeto.",
+		"The input argument must be an object.":                                         "El argumento input debe ser un objeto.",
+		"The limit argument must be between 1 and %d.":                                  "El argumento limit debe estar entre 1 y %d.",
+		"The operationName must be given when the document has several operations.":     "Se debe indicar operationName cuando el documento tiene varias operaciones.",
+		"The query ends unexpectedly.":                                                  "La consulta termina de forma inesperada.",
+		"The query has an invalid number %s.":                                           "La consulta tiene un número no válido %s.",
+		"The query has an invalid string.":                                              "La consulta tiene una cadena no válida.",
+		"The query has an unexpected character %s.":                                     "La consulta tiene un carácter inesperado %s.",
+		"The query has an unexpected %s.":                                               "La consulta tiene un %s inesperado.",
+		"The query has an unterminated string.":                                         "La consulta tiene una cadena sin terminar.",
+		"The query must not be empty.":                                                  "La consulta no debe estar vacía.",
+		"The variables parameter must be a JSON object.":                                "El parámetro variables debe ser un objeto JSON.",
+		"Widget has no field %s.":                                                       "Widget no tiene el campo %s.",
+		"WidgetFilter has no field %s.":                                                 "WidgetFilter no tiene el campo %s.",
+		"WidgetInput has no field %s.":                                                  "WidgetInput no tiene el campo %s.",
+		"An unexpected error occurred.":                                                 "Se produjo un error inesperado.",
+		"Each tag must be at most %d characters.":                                       "Cada etiqueta debe tener como máximo %d caracteres.",
+		"Method not allowed for this resource.":                                         "Método no permitido para este recurso.",
+		"No more widgets can be stored.":                                                "No se pueden almacenar más widgets.",
+		"None of the media types in the Accept header can be produced.":                 "No se puede producir ninguno de los tipos de medio de la cabecera Accept.",
+		"Not applied because another update in the batch failed.":                       "No se aplicó porque falló otra actualización del lote.",
+		"A widget may have at most %d attributes.":                                      "Un widget puede tener como máximo %d atributos.",
+		"Each attribute name must be at most %d characters.":                            "Cada nombre de atributo debe tener como máximo %d caracteres.",
+		"The id must be at most %d characters.":                                         "El id debe tener como máximo %d caracteres.",
+		"The id may only use letters, digits, hyphens, underscores, dots and tildes.":   "El id solo puede usar letras, dígitos, guiones, guiones bajos, puntos y virgulillas.",
+		"The id %s is reserved.":                                                        "El id %s está reservado.",
+		"The id may not be made only of digits.":                                        "El id no puede estar formado solo por dígitos.",
+		"The store cannot rename widgets.":                                              "El almacén no puede renombrar widgets.",
+		"The id %s is already taken.":                                                   "El id %s ya está en uso.",
+		"The server is handling too many requests.":                                     "El servidor está atendiendo demasiadas solicitudes.",
+		"Try again shortly.":                                                            "Inténtelo de nuevo en breve.",
+		"The %s attribute is required.":                                                 "El atributo %s es obligatorio.",
+		"The %s attribute is not defined.":                                              "El atributo %s no está definido.",
+		"The %s attribute must be a string.":                                            "El atributo %s debe ser una cadena.",
+		"The %s attribute must be a boolean.":                                           "El atributo %s debe ser un booleano.",
+		"The %s attribute must be a number.":                                            "El atributo %s debe ser un número.",
+		"The %s attribute must be an integer.":                                          "El atributo %s debe ser un entero.",
+		"The %s attribute must be at most %d characters.":                               "El atributo %s debe tener como máximo %d caracteres.",
+		"The %s attribute must be one of %s.":                                           "El atributo %s debe ser uno de %s.",
+		"The %s attribute must be at least %s.":                                         "El atributo %s debe ser como mínimo %s.",
+		"The %s attribute must be at most %s.":                                          "El atributo %s debe ser como máximo %s.",
+		"The %s must be valid UTF-8.":                                                   "El campo %s debe ser UTF-8 válido.",
+		"The %s must not contain control characters.":                                   "El campo %s no debe contener caracteres de control.",
+		"The %s parameter must not be repeated.":                                        "El parámetro %s no debe repetirse.",
+		"The %s parameter must be a non-negative integer.":                              "El parámetro %s debe ser un entero no negativo.",
+		"The from and to parameters must be revisions such as v1.":                      "Los parámetros from y to deben ser revisiones como v1.",
+		"The store keeps no widget history.":                                            "El almacén no guarda el historial de los widgets.",
+		"Revision %d of the widget could not be found.":                                 "No se pudo encontrar la revisión %d del widget.",
+		"The Content-Type header is not valid.":                                         "La cabecera Content-Type no es válida.",
+		"The atomic parameter must be a boolean.":                                       "El parámetro atomic debe ser un booleano.",
+		"The changes field is required.":                                                "El campo changes es obligatorio.",
+		"The cursor parameter cannot be combined with sort.":                            "El parámetro cursor no se puede combinar con sort.",
+		"The cursor parameter is not valid.":                                            "El parámetro cursor no es válido.",
+		"The delta field is required.":                                                  "El campo delta es obligatorio.",
+		"The description is close to the limit of %d characters.":                       "La descripción está cerca del límite de %d caracteres.",
+		"The description must be at most %d characters.":                                "La descripción debe tener como máximo %d caracteres.",
+		"The ids parameter must list at least one id.":                                  "El parámetro ids debe incluir al menos un id.",
+		"The ids parameter must list at most %d ids.":                                   "El parámetro ids debe incluir como máximo %d ids.",
+		"The id field is required.":                                                     "El campo id es obligatorio.",
+		"The name is close to the limit of %d characters.":                              "El nombre está cerca del límite de %d caracteres.",
+		"The name must be at most %d characters.":                                       "El nombre debe tener como máximo %d caracteres.",
+		"The quantity cannot go below zero.":                                            "La cantidad no puede ser menor que cero.",
+		"The quantity must be between 0 and %d.":                                        "La cantidad debe estar entre 0 y %d.",
+		"The query string must be at most %d bytes.":                                    "La cadena de consulta debe tener como máximo %d bytes.",
+		"The query must be nested at most %d levels deep.":                              "La consulta debe anidarse como máximo %d niveles.",
+		"The request body must be nested at most %d levels deep.":                       "El cuerpo de la solicitud debe anidarse como máximo %d niveles.",
+		"The request body must be at most %d bytes.":                                    "El cuerpo de la solicitud debe tener como máximo %d bytes.",
+		"The request body must be a JSON array, not an object.":                         "El cuerpo de la solicitud debe ser un arreglo JSON, no un objeto.",
+		"The request body must be a JSON object, not an array.":                         "El cuerpo de la solicitud debe ser un objeto JSON, no un arreglo.",
+		"The request body must be encoded as UTF-8.":                                    "El cuerpo de la solicitud debe estar codificado en UTF-8.",
+		"The request body must be valid UTF-8.":                                         "El cuerpo de la solicitud debe ser UTF-8 válido.",
+		"The request conflicts with the current state of the resource.":                 "La solicitud entra en conflicto con el estado actual del recurso.",
+		"The request path is not validly percent-encoded.":                              "La ruta de la solicitud no tiene una codificación porcentual válida.",
+		"The request path must be at most %d bytes.":                                    "La ruta de la solicitud debe tener como máximo %d bytes.",
+		"The requested range is not satisfiable.":                                       "El rango solicitado no se puede satisfacer.",
+		"The requested resource could not be located.":                                  "No se pudo encontrar el recurso solicitado.",
+		"The service is shutting down.":                                                 "El servicio se está apagando.",
+		"The wait parameter must be a duration of at most %ds.":                         "El parámetro wait debe ser una duración de como máximo %ds.",
+		"The service is read-only, so widgets cannot be changed.":                       "El servicio es de solo lectura, por lo que no se pueden modificar los widgets.",
+		"The status cannot change from %s to %s.":                                       "El estado no puede cambiar de %s a %s.",
+		"The status must be draft, active or retired.":                                  "El estado debe ser draft, active o retired.",
+		"The status parameter must be draft, active or retired.":                        "El parámetro status debe ser draft, active o retired.",
+		"The service is not ready.":                                                     "El servicio no está listo.",
+		"The service is temporarily unavailable.":                                       "El servicio no está disponible temporalmente.",
+		"Too many requests are waiting for changes.":                                    "Hay demasiadas solicitudes esperando cambios.",
+		"Try again without wait.":                                                       "Inténtelo de nuevo sin wait.",
+		"The widget is at revision %d, not %d.":                                         "El widget está en la revisión %d, no en la %d.",
+		"Get it again before updating.":                                                 "Vuelva a obtenerlo antes de actualizarlo.",
+		"The widget was changed after revision %d was read.":                            "El widget cambió después de leer la revisión %d.",
+		"The sort parameter must be created, quantity or updated, with a - to reverse.": "El parámetro sort debe ser created, quantity o updated, con un - para invertir.",
+		"Widgets cannot be created at a chosen id.":                                     "No se pueden crear widgets con un id elegido.",
+		"POST to /widgets/ instead.":                                                    "Use POST en /widgets/.",
+		"Valid credentials are required for this resource.":                             "Se requieren credenciales válidas para este recurso.",
+	},
+}
+
+// translation is a compiled entry of translations.
+type translation struct {
+	pattern *regexp.Regexp
+	text    string
+}
+
+var (
+	compileTranslations sync.Once
+	compiledExact       map[string]map[string]string
+	compiledPatterns    map[string][]translation
+)
+
+var formatVerb = regexp.MustCompile(`%[ds]`)
+
+// compile splits translations into exact matches and patterns for messages
+// with verbs. A %d matches digits and a %s matches a single word.
+func compile() {
+	compiledExact = make(map[string]map[string]string)
+	compiledPatterns = make(map[string][]translation)
+	for lang, table := range translations {
+		compiledExact[lang] = make(map[string]string)
+		for english, text := range table {
+			if !formatVerb.MatchString(english) {
+				compiledExact[lang][english] = text
+				continue
+			}
+			var expr strings.Builder
+			expr.WriteString("^")
+			last := 0
+			for _, loc := range formatVerb.FindAllStringIndex(english, -1) {
+				expr.WriteString(regexp.QuoteMeta(english[last:loc[0]]))
+				if english[loc[0]+1] == 'd' {
+					expr.WriteString(`(-?\d+)`)
+				} else {
+					expr.WriteString(`([^\s]+)`)
+				}
+				last = loc[1]
+			}
+			expr.WriteString(regexp.QuoteMeta(english[last:]) + "$")
+			compiledPatterns[lang] = append(compiledPatterns[lang], translation{
+				pattern: regexp.MustCompile(expr.String()),
+				text:    text,
+			})
+		}
+	}
+}
+
+// translate returns message in the language preferred by the request's
+// Accept-Language header. Messages made of several sentences, such as a list
+// of validation failures, are translated a sentence at a time.
+func translate(r *http.Request, message string) string {
+	lang := preferredLanguage(r.Header.Get("Accept-Language"))
+	if lang == defaultLanguage {
+		return message
+	}
+	compileTranslations.Do(compile)
+
+	sentences := strings.SplitAfter(message, ". ")
+	for i, sentence := range sentences {
+		trailing := strings.HasSuffix(sentence, " ")
+		sentences[i] = translateSentence(lang, strings.TrimSuffix(sentence, " "))
+		if trailing {
+			sentences[i] += " "
+		}
+	}
+	return strings.Join(sentences, "")
+}
+
+func translateSentence(lang, sentence string) string {
+	if text, ok := compiledExact[lang][sentence]; ok {
+		return text
+	}
+	for _, t := range compiledPatterns[lang] {
+		match := t.pattern.FindStringSubmatch(sentence)
+		if match == nil {
+			continue
+		}
+		args := match[1:]
+		return formatVerb.ReplaceAllStringFunc(t.text, func(string) string {
+			arg := args[0]
+			args = args[1:]
+			return arg
+		})
+	}
+	return sentence
+}
+
+// preferredLanguage returns the language with a translation, or English, that
+// the given Accept-Language header ranks highest.
+func preferredLanguage(accept string) string {
+	type languageRange struct {
+		lang string
+		q    float64
+	}
+
+	var ranges []languageRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if len(tag) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, languageRange{lang: strings.SplitN(tag, "-", 2)[0], q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, r := range ranges {
+		if r.lang == defaultLanguage {
+			return defaultLanguage
+		}
+		if _, ok := translations[r.lang]; ok {
+			return r.lang
+		}
+	}
+	return defaultLanguage
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestErrorMessagesFollowAcceptLanguage(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"", "The requested resource could not be located."},
+		{"en-GB", "The requested resource could not be located."},
+		{"fr", "The requested resource could not be located."},
+		{"es", "No se pudo encontrar el recurso solicitado."},
+		{"es-MX, en;q=0.5", "No se pudo encontrar el recurso solicitado."},
+		{"en, es;q=0.5", "The requested resource could not be located."},
+		{"es;q=0", "The requested resource could not be located."},
+	} {
+		w := do(h, http.MethodGet, "/widgets/missing", "", "Accept-Language", tc.accept)
+		e := expectError(t, w, http.StatusNotFound, codeNotFound)
+		if e.Error != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.accept, e.Error, tc.want)
+		}
+		if got := strings.Join(w.Header()["Vary"], ", "); !strings.Contains(got, "Accept-Language") {
+			t.Errorf("%q: got Vary %q, want it to name Accept-Language", tc.accept, got)
+		}
+	}
+}
+
+func TestTranslationsFillInValues(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_NAME_LEN": "3", "API_MAX_QUANTITY": "7"})
+
+	w := do(h, http.MethodPost, "/widgets/", `{"name":"long","quantity":8}`, "Accept-Language", "es")
+	e := expectError(t, w, http.StatusUnprocessableEntity, codeValidationFailed)
+	want := "El nombre debe tener como máximo 3 caracteres. La cantidad debe estar entre 0 y 7."
+	if e.Error != want {
+		t.Errorf("got %q, want %q", e.Error, want)
+	}
+}
+
+func TestTranslationsKeepTheirVerbs(t *testing.T) {
+	verbs := regexp.MustCompile(`%[ds]`)
+	for lang, table := range translations {
+		for message, text := range table {
+			if strings.Join(verbs.FindAllString(message, -1), "") != strings.Join(verbs.FindAllString(text, -1), "") {
+				t.Errorf("%s: %q is translated as %q with different verbs", lang, message, text)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	idSchemeUUID     = "uuid"
+	idSchemeULID     = "ulid"
+	idSchemeSequence = "sequence"
+)
+
+// IDGenerator creates identifiers for new widgets.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// newIDGenerator will construct the IDGenerator for the named scheme. The
+// sequence scheme keeps its high-water mark in sequenceFile, when given, so
+// that ids are not reused after a restart.
+func newIDGenerator(scheme string, sequenceFile string) (IDGenerator, error) {
+	switch scheme {
+	case idSchemeUUID:
+		return uuidGenerator{}, nil
+	case idSchemeULID:
+		return &ulidGenerator{now: time.Now}, nil
+	case idSchemeSequence:
+		return newSequenceGenerator(sequenceFile)
+	}
+	return nil, fmt.Errorf("unknown id scheme %q", scheme)
+}
+
+// uuidGenerator creates random version 4 UUIDs.
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ulidGenerator creates ULIDs, which sort in creation order. IDs made within
+// the same millisecond increment the random part so they still sort.
+type ulidGenerator struct {
+	now func() time.Time
+
+	mu   sync.Mutex
+	last uint64
+	rand [10]byte
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ulidGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(g.now().UnixNano() / int64(time.Millisecond))
+	if ms > g.last {
+		if _, err := rand.Read(g.rand[:]); err != nil {
+			return "", err
+		}
+		g.last = ms
+	} else if !increment(g.rand[:]) {
+		return "", fmt.Errorf("ulid entropy exhausted for millisecond %d", g.last)
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], g.last<<16)
+	copy(b[6:], g.rand[:])
+	return encodeULID(b), nil
+}
+
+// increment adds one to the big-endian number in b, reporting false on
+// overflow.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID writes the 128 bits of b as 26 Crockford base32 characters.
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// resetter is implemented by generators whose state can be restarted.
+type resetter interface {
+	Reset()
+}
+
+// sequenceBlock is how many sequence ids are reserved in the sequence file at
+// a time. Ids reserved but not handed out before a restart are skipped.
+const sequenceBlock = 100
+
+// sequenceGenerator creates increasing integer IDs starting at 1. It is safe
+// for concurrent use.
+//
+// When it has a file, the file holds the highest id reserved. Marks are
+// written a block at a time, ahead of the ids handed out, so most ids cost no
+// write and a restart resumes above every id already used.
+type sequenceGenerator struct {
+	last uint64
+
+	file     string
+	mu       sync.Mutex
+	reserved uint64
+}
+
+// newSequenceGenerator will construct a sequenceGenerator that resumes from
+// the mark in file, if there is one. An empty file name keeps the sequence
+// in memory only.
+func newSequenceGenerator(file string) (*sequenceGenerator, error) {
+	g := &sequenceGenerator{file: file}
+	if len(file) == 0 {
+		return g, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mark, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sequence file %s: %s", file, err)
+	}
+	g.last, g.reserved = mark, mark
+	return g, nil
+}
+
+func (g *sequenceGenerator) NewID() (string, error) {
+	id := atomic.AddUint64(&g.last, 1)
+	if len(g.file) > 0 && id > atomic.LoadUint64(&g.reserved) {
+		if err := g.reserve(id); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatUint(id, 10), nil
+}
+
+// reserve records a block of ids starting at id as reserved. The file is
+// replaced by rename so that a crash never leaves it half written.
+func (g *sequenceGenerator) reserve(id uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if id <= g.reserved {
+		return nil
+	}
+
+	mark := id + sequenceBlock - 1
+	tmp := g.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(mark, 10)+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, g.file); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&g.reserved, mark)
+	return nil
+}
+
+// skip makes the sequence resume above id, when id is a sequence id, so that
+// widgets stored before a sequence file was kept are not given again.
+func (g *sequenceGenerator) skip(id string) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		last := atomic.LoadUint64(&g.last)
+		if n <= last || atomic.CompareAndSwapUint64(&g.last, last, n) {
+			return
+		}
+	}
+}
+
+// Reset restarts the sequence so the next id is 1.
+func (g *sequenceGenerator) Reset() {
+	atomic.StoreUint64(&g.last, 0)
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIDSchemes(t *testing.T) {
+	for _, tc := range []struct {
+		scheme string
+		format *regexp.Regexp
+	}{
+		{idSchemeUUID, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)},
+		{idSchemeULID, regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)},
+		{idSchemeSequence, regexp.MustCompile(`^[1-9][0-9]*$`)},
+	} {
+		ids, err := newIDGenerator(tc.scheme, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			id, err := ids.NewID()
+			if err != nil {
+				t.Fatalf("%s: %s", tc.scheme, err)
+			}
+			if !tc.format.MatchString(id) {
+				t.Fatalf("%s: got badly formed id %q", tc.scheme, id)
+			}
+			if seen[id] {
+				t.Fatalf("%s: got %q twice", tc.scheme, id)
+			}
+			seen[id] = true
+		}
+	}
+
+	if _, err := newIDGenerator("snowflake", ""); err == nil {
+		t.Error("got no error for an unknown scheme")
+	}
+}
+
+func TestULIDsSortInCreationOrder(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := &ulidGenerator{now: func() time.Time { return now }}
+
+	var ids []string
+	for i := 0; i < 100; i++ {
+		// Several ids share each millisecond.
+		if i%10 == 0 {
+			now = now.Add(time.Millisecond)
+		}
+		id, err := g.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Errorf("got ids out of creation order: %v", ids)
+	}
+}
+
+func TestSequenceStartsAtOne(t *testing.T) {
+	g, err := newSequenceGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if id, _ := g.NewID(); id != want {
+			t.Errorf("got %s, want %s", id, want)
+		}
+	}
+}
+
+func TestSequenceIsUniqueAndIncreasingUnderConcurrency(t *testing.T) {
+	g, err := newSequenceGenerator(filepath.Join(t.TempDir(), "sequence"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, each = 8, 250
+	ids := make([][]uint64, workers)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				id, err := g.NewID()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.ParseUint(id, 10, 64)
+				ids[i] = append(ids[i], n)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	for i, got := range ids {
+		for j, n := range got {
+			if j > 0 && n <= got[j-1] {
+				t.Errorf("worker %d got %d after %d", i, n, got[j-1])
+			}
+			if seen[n] {
+				t.Errorf("id %d was handed out twice", n)
+			}
+			seen[n] = true
+		}
+	}
+	for n := uint64(1); n <= workers*each; n++ {
+		if !seen[n] {
+			t.Errorf("id %d was skipped", n)
+		}
+	}
+}
+
+func TestSequenceResumesAboveUsedIDsAfterARestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sequence")
+	g, err := newSequenceGenerator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	for i := 0; i < sequenceBlock+10; i++ {
+		if last, err = g.NewID(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted, err := newSequenceGenerator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, _ := restarted.NewID()
+	if n, _ := strconv.Atoi(next); n <= sequenceBlock+10 {
+		t.Errorf("got %s after a restart, last id was %s", next, last)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("many"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSequenceGenerator(file); err == nil {
+		t.Error("got no error for a corrupt sequence file")
+	}
+}
+
+func TestConcurrentCreatesGetUniqueSequenceIDs(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	const creates = 50
+	ids := make(chan string, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := do(h, http.MethodPost, "/widgets/", fmt.Sprintf(`{"name":"w%d"}`, i))
+			var created struct{ Widget Widget }
+			if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+				t.Errorf("got status %d: %s", w.Code, w.Body)
+			}
+			ids <- created.Widget.ID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("id %s was given to two widgets", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != creates {
+		t.Errorf("got %d distinct ids for %d creates", len(seen), creates)
+	}
+}
+
+func TestSequenceSkipsStoredIDs(t *testing.T) {
+	g, err := newSequenceGenerator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"7", "3", "01ARZ3NDEKTSV4RRFFQ69G5FAV"} {
+		g.skip(id)
+	}
+	if id, _ := g.NewID(); id != "8" {
+		t.Errorf("got %s, want 8", id)
+	}
+}
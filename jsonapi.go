@@ -0,0 +1,95 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+)
+
+const mimeJSONAPI = "application/vnd.api+json"
+
+func init() {
+	registerFormatter(mimeJSONAPI, jsonAPIFormatter{})
+}
+
+// jsonAPIFormatter encodes payloads as JSON:API documents. A widget envelope
+// becomes a single resource and a widget list a collection; any other payload
+// is sent as top-level meta.
+type jsonAPIFormatter struct{}
+
+func (jsonAPIFormatter) Encode(w io.Writer, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+
+	doc := map[string]interface{}{}
+	if widget, ok := fields["widget"].(map[string]interface{}); ok {
+		resource := jsonAPIResource(widget)
+		doc["data"] = resource
+		doc["links"] = resource["links"]
+		if warnings, ok := fields["warnings"]; ok {
+			doc["meta"] = map[string]interface{}{"warnings": warnings}
+		}
+	} else if widgets, ok := fields["widgets"].([]interface{}); ok {
+		data := make([]interface{}, 0, len(widgets))
+		for _, item := range widgets {
+			if widget, ok := item.(map[string]interface{}); ok {
+				data = append(data, jsonAPIResource(widget))
+			}
+		}
+		links := map[string]string{"self": "/widgets/"}
+		next, ok := fields["next_cursor"].(string)
+		if !ok {
+			next, ok = fields["nextCursor"].(string)
+		}
+		if ok {
+			links["next"] = "/widgets/?cursor=" + url.QueryEscape(next)
+		}
+		doc["data"] = data
+		doc["links"] = links
+		doc["meta"] = map[string]interface{}{"count": len(data)}
+	} else {
+		doc["meta"] = fields
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// jsonAPIResource turns a decoded widget into a resource object, moving its
+// id out of the attributes.
+func jsonAPIResource(widget map[string]interface{}) map[string]interface{} {
+	id, _ := widget["id"].(string)
+	attributes := make(map[string]interface{}, len(widget))
+	for key, value := range widget {
+		if key != "id" {
+			attributes[key] = value
+		}
+	}
+	return map[string]interface{}{
+		"type":       "widgets",
+		"id":         id,
+		"attributes": attributes,
+		"links":      map[string]string{"self": "/widgets/" + url.PathEscape(id)},
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// jsonAPIResourceObject is a resource object in a JSON:API document.
+type jsonAPIResourceObject struct {
+	Type       string
+	ID         string
+	Attributes map[string]interface{}
+	Links      map[string]string
+}
+
+func TestJSONAPIRendersASingleWidget(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"gear","quantity":2}`)
+
+	w := do(h, http.MethodGet, "/widgets/"+widget.ID, "", "Accept", mimeJSONAPI)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), mimeJSONAPI) {
+		t.Fatalf("got status %d with Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var doc struct {
+		Data  jsonAPIResourceObject
+		Links map[string]string
+	}
+	decodeBody(t, w, &doc)
+	if doc.Data.Type != "widgets" || doc.Data.ID != widget.ID {
+		t.Errorf("got resource %s %s, want widgets %s", doc.Data.Type, doc.Data.ID, widget.ID)
+	}
+	if doc.Data.Attributes["name"] != "gear" || doc.Data.Attributes["quantity"] != 2.0 {
+		t.Errorf("got attributes %v", doc.Data.Attributes)
+	}
+	if _, ok := doc.Data.Attributes["id"]; ok {
+		t.Errorf("the id is repeated in the attributes %v", doc.Data.Attributes)
+	}
+	if self := "/widgets/" + widget.ID; doc.Data.Links["self"] != self || doc.Links["self"] != self {
+		t.Errorf("got links %v and %v, want self %s", doc.Data.Links, doc.Links, self)
+	}
+}
+
+func TestJSONAPIRendersACollection(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		createWidget(t, h, `{"name":"`+name+`"}`)
+	}
+
+	w := do(h, http.MethodGet, "/widgets/?limit=2", "", "Accept", mimeJSONAPI)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var doc struct {
+		Data  []jsonAPIResourceObject
+		Links map[string]string
+		Meta  struct{ Count int }
+	}
+	decodeBody(t, w, &doc)
+	if len(doc.Data) != 2 || doc.Meta.Count != 2 {
+		t.Fatalf("got %d resources with count %d, want 2", len(doc.Data), doc.Meta.Count)
+	}
+	for i, want := range []string{"a", "b"} {
+		if doc.Data[i].Type != "widgets" || doc.Data[i].Attributes["name"] != want {
+			t.Errorf("resource %d is %+v, want widget %s", i, doc.Data[i], want)
+		}
+	}
+	if doc.Links["self"] != "/widgets/" || !strings.HasPrefix(doc.Links["next"], "/widgets/?cursor=") {
+		t.Errorf("got links %v, want self and next", doc.Links)
+	}
+
+	if w := do(h, http.MethodGet, "/widgets/", ""); strings.Contains(w.Body.String(), `"data"`) {
+		t.Errorf("the default response is %s, want plain JSON", w.Body)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingWriterRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	w, err := newRotatingWriter(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	logger := log.New(w, "", 0)
+	for i := 0; i < 20; i++ {
+		logger.Printf("line %02d %s", i, strings.Repeat("x", 20))
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("got %s", err)
+		}
+		if info.Size() > 100 {
+			t.Errorf("%s holds %d bytes, want at most 100", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("got %v for a third rotated file, want only two kept", err)
+	}
+
+	// The newest lines are in the current file and whole lines are never
+	// split across files.
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(b), fmt.Sprintf("line 19 %s\n", strings.Repeat("x", 20))) {
+		t.Errorf("got current file %q, want it to end with the last line", b)
+	}
+	rotated, _ := ioutil.ReadFile(path + ".1")
+	if !strings.HasPrefix(string(rotated), "line ") {
+		t.Errorf("got rotated file %q, want it to start with a whole line", rotated)
+	}
+}
+
+func TestRotatingWriterAppendsToAnExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("x", 90)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newRotatingWriter(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// The file's existing size counts towards the limit.
+	w.Write([]byte("twenty bytes of log\n"))
+	if b, _ := ioutil.ReadFile(path + ".1"); len(b) != 90 {
+		t.Errorf("got %d bytes in the rotated file, want the 90 already there", len(b))
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxLoggedPathLen keeps over-long request paths from flooding the logs.
+const maxLoggedPathLen = 256
+
+// statusRecorder is an http.ResponseWriter that records the response status.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses pass through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logRequests logs the request ID, client, method, path, status and duration
+// of every request handled by next. Requests taking longer than slow are
+// logged as a warning instead; a zero slow threshold never warns.
+func logRequests(next http.Handler, ips clientIPResolver, slow time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		elapsed := time.Since(start)
+		level := "info"
+		if slow > 0 && elapsed > slow {
+			level = "warning"
+		}
+		log.Printf("%s: request: %s client: %s method: %s path: %s status: %d duration: %s",
+			level, requestID(r.Context()), ips.clientIP(r), r.Method, truncate(r.URL.EscapedPath(), maxLoggedPathLen), rec.status, elapsed)
+	})
+}
+
+// cacheControl sets a Cache-Control header on responses from next that do
+// not already have one. Successful GET and HEAD responses use readPolicy;
+// all other methods and every error response use no-store.
+func cacheControl(next http.Handler, readPolicy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, read: read, readPolicy: readPolicy}, r)
+	})
+}
+
+// readCachePolicy returns the Cache-Control value for reads given a max age.
+// Without a max age responses must be revalidated before they are reused.
+func readCachePolicy(maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+}
+
+type cacheControlWriter struct {
+	http.ResponseWriter
+	read       bool
+	readPolicy string
+	wrote      bool
+}
+
+func (c *cacheControlWriter) WriteHeader(status int) {
+	if !c.wrote && len(c.Header().Get("Cache-Control")) == 0 {
+		if c.read && status < http.StatusBadRequest {
+			c.Header().Set("Cache-Control", c.readPolicy)
+		} else {
+			c.Header().Set("Cache-Control", "no-store")
+		}
+	}
+	c.wrote = true
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheControlWriter) Write(b []byte) (int, error) {
+	if !c.wrote {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses pass through the writer.
+func (c *cacheControlWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// SecurityHeaders are the headers set on every response to limit what
+// browsers do with it. Empty values are not sent.
+type SecurityHeaders struct {
+	FrameOptions          string
+	ContentSecurityPolicy string
+}
+
+// securityHeaders sets X-Content-Type-Options: nosniff and the configured
+// security headers on responses from next. They are set before next runs, so
+// a handler serving a page can replace them with its own.
+func securityHeaders(next http.Handler, headers SecurityHeaders) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if len(headers.FrameOptions) > 0 {
+			w.Header().Set("X-Frame-Options", headers.FrameOptions)
+		}
+		if len(headers.ContentSecurityPolicy) > 0 {
+			w.Header().Set("Content-Security-Policy", headers.ContentSecurityPolicy)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitInFlight answers 503 with a Retry-After when max requests are already
+// being served, rather than letting a burst queue up behind them. Unlike rate
+// limiting it bounds all clients together. It wraps the widget routes only, so
+// health probes still answer while the process is busy. A max of 0 admits
+// every request.
+func limitInFlight(next http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			log.Printf("rejecting request with %d already in flight", max)
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, r, http.StatusServiceUnavailable, "The server is handling too many requests. Try again shortly.")
+			return
+		}
+		var once sync.Once
+		release := func() {
+			once.Do(func() { <-slots })
+		}
+		defer release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), inFlightKey{}, release)))
+	})
+}
+
+type inFlightKey struct{}
+
+// releaseInFlight gives up the request's in-flight slot early, for requests
+// such as long polls that go on to wait rather than work.
+func releaseInFlight(r *http.Request) {
+	if release, ok := r.Context().Value(inFlightKey{}).(func()); ok {
+		release()
+	}
+}
+
+// limitPath rejects requests whose escaped path is longer than max with 414
+// before they reach next.
+func limitPath(next http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := len(r.URL.EscapedPath()); n > max {
+			log.Printf("rejecting request path of %d bytes", n)
+			writeJSONError(w, r, http.StatusRequestURITooLong, fmt.Sprintf("The request path must be at most %d bytes.", max))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitQuery rejects requests whose raw query string is longer than max with
+// 414 before anything parses it.
+func limitQuery(next http.Handler, max int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := len(r.URL.RawQuery); n > max {
+			log.Printf("rejecting query string of %d bytes", n)
+			writeAPIError(w, r, http.StatusRequestURITooLong, codeQueryTooLong, fmt.Sprintf("The query string must be at most %d bytes.", max))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody rejects requests whose declared body is longer than max bytes
+// with 413 before anything reads it. Since a client sending Expect:
+// 100-continue is only told to continue when the body is first read, a
+// rejected client never uploads the body at all. Bodies of unknown length are
+// cut off once they pass max.
+func limitBody(next http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			log.Printf("rejecting request body of %d bytes", r.ContentLength)
+			writeAPIError(w, r, http.StatusRequestEntityTooLarge, codeBodyTooLarge, bodyTooLargeMessage(max))
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &limitedBody{ReadCloser: r.Body, max: max, remaining: max}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bodyTooLargeMessage(max int64) string {
+	return fmt.Sprintf("The request body must be at most %d bytes.", max)
+}
+
+// limitedBody fails reads past max bytes with a statusError, so the decode
+// error is reported to the client as a 413.
+type limitedBody struct {
+	io.ReadCloser
+	max       int64
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.tooLarge()
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		return n, b.tooLarge()
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) tooLarge() error {
+	return statusError{status: http.StatusRequestEntityTooLarge, code: codeBodyTooLarge, message: bodyTooLargeMessage(b.max)}
+}
+
+// truncate shortens s to at most max bytes, marking where it was cut.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
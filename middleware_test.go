@@ -0,0 +1,295 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// captureLog returns a buffer receiving the log output until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(ioutil.Discard) })
+	return &buf
+}
+
+func TestLogRequestsWarnsAboutSlowRequests(t *testing.T) {
+	buf := captureLog(t)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	h := logRequests(slow, clientIPResolver{}, 10*time.Millisecond)
+
+	do(h, http.MethodGet, "/fast", "")
+	if got := buf.String(); !strings.Contains(got, " info: ") || !strings.Contains(got, "path: /fast") {
+		t.Errorf("got %q, want an info line for the fast request", got)
+	}
+
+	buf.Reset()
+	do(h, http.MethodGet, "/slow", "")
+	got := buf.String()
+	if !strings.Contains(got, " warning: ") || !strings.Contains(got, "path: /slow") || !strings.Contains(got, "duration: ") {
+		t.Errorf("got %q, want a warning with the path and duration", got)
+	}
+
+	buf.Reset()
+	do(logRequests(slow, clientIPResolver{}, 0), http.MethodGet, "/slow", "")
+	if got := buf.String(); !strings.Contains(got, " info: ") {
+		t.Errorf("got %q, want no warning without a threshold", got)
+	}
+}
+
+func TestCacheControlDiffersBetweenReadsAndWrites(t *testing.T) {
+	api := newTestHandler(t, nil, nil)
+	h := cacheControl(api, readCachePolicy(0))
+	widget := createWidget(t, h, `{"name":"a"}`)
+
+	if got := do(h, http.MethodPost, "/widgets/", `{"name":"b"}`).Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("got Cache-Control %q on a create, want no-store", got)
+	}
+	if got := do(h, http.MethodGet, "/widgets/"+widget.ID, "").Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("got Cache-Control %q on a get, want no-cache by default", got)
+	}
+	if got := do(h, http.MethodGet, "/widgets/missing", "").Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("got Cache-Control %q on a failed get, want no-store", got)
+	}
+
+	h = cacheControl(api, readCachePolicy(30*time.Second))
+	if got := do(h, http.MethodGet, "/widgets/", "").Header().Get("Cache-Control"); got != "max-age=30" {
+		t.Errorf("got Cache-Control %q on a list with a max age", got)
+	}
+}
+
+func TestLimitPathRejectsOverLongIDs(t *testing.T) {
+	buf := captureLog(t)
+	api := newTestHandler(t, nil, nil)
+	h := limitPath(api, 64)
+
+	id := strings.Repeat("x", 100)
+	e := expectError(t, do(h, http.MethodGet, "/widgets/"+id, ""), http.StatusRequestURITooLong, codePathTooLong)
+	if e.Error != "The request path must be at most 64 bytes." {
+		t.Errorf("got message %q", e.Error)
+	}
+	if strings.Contains(buf.String(), id) {
+		t.Errorf("got the over-long id in the log: %s", buf.String())
+	}
+
+	// The limit applies to the path as sent, percent-encoding included.
+	expectError(t, do(h, http.MethodGet, "/widgets/"+strings.Repeat("%20", 20), ""), http.StatusRequestURITooLong, codePathTooLong)
+	expectError(t, do(h, http.MethodGet, "/widgets/"+strings.Repeat("x", 54), ""), http.StatusNotFound, codeNotFound)
+}
+
+// waitUntil polls cond until it holds, failing the test after a second.
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimitInFlightRejectsPastTheLimit(t *testing.T) {
+	var serving int32
+	unblock := make(chan struct{})
+	h := limitInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&serving, 1)
+		<-unblock
+	}), 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do(h, http.MethodGet, "/widgets/", "")
+		}()
+	}
+	waitUntil(t, func() bool { return atomic.LoadInt32(&serving) == 2 })
+
+	w := do(h, http.MethodGet, "/widgets/", "")
+	expectError(t, w, http.StatusServiceUnavailable, codeUnavailable)
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want 1", got)
+	}
+
+	close(unblock)
+	wg.Wait()
+	if w := do(h, http.MethodGet, "/widgets/", ""); w.Code != http.StatusOK {
+		t.Errorf("got status %d once the limit cleared, want 200", w.Code)
+	}
+}
+
+func TestLimitInFlightZeroAdmitsEverything(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := limitInFlight(next, 0)
+	for i := 0; i < 3; i++ {
+		if w := do(h, http.MethodGet, "/", ""); w.Code != http.StatusOK {
+			t.Errorf("got status %d, want 200", w.Code)
+		}
+	}
+}
+
+func TestLimitQueryRejectsOverLongQueries(t *testing.T) {
+	buf := captureLog(t)
+	h := limitQuery(newTestHandler(t, nil, nil), 64)
+
+	query := "status=" + strings.Repeat("x", 100)
+	e := expectError(t, do(h, http.MethodGet, "/widgets/?"+query, ""), http.StatusRequestURITooLong, codeQueryTooLong)
+	if e.Error != "The query string must be at most 64 bytes." {
+		t.Errorf("got message %q", e.Error)
+	}
+	if log := buf.String(); strings.Contains(log, query) || !strings.Contains(log, "rejecting query string of 107 bytes") {
+		t.Errorf("got log %q, want the length without the query", log)
+	}
+
+	// A query at the limit is passed on to be parsed.
+	expectError(t, do(h, http.MethodGet, "/widgets/?status="+strings.Repeat("x", 57), ""), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestLimitInFlightFreesTheSlotOfALongPoll(t *testing.T) {
+	wh := newTestHandler(t, nil, nil)
+	h := limitInFlight(wh, 1)
+	etag := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag")
+
+	done := make(chan int)
+	go func() {
+		done <- do(h, http.MethodGet, "/widgets/?wait=5s", "", "If-None-Match", etag).Code
+	}()
+	waitUntil(t, func() bool { return atomic.LoadInt64(&wh.waits.waiting) == 1 })
+
+	if w := do(h, http.MethodGet, "/widgets/", ""); w.Code != http.StatusOK {
+		t.Fatalf("got status %d beside a long poll, want 200: %s", w.Code, w.Body.String())
+	}
+	createWidget(t, h, `{"name":"a"}`)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("long poll answered %d after a change, want 200", code)
+	}
+}
+
+// expectContinue sends a POST of body to /widgets/ on srv with Expect:
+// 100-continue, uploading the body only if the server asks for it. It returns
+// the final status and whether the body was sent.
+func expectContinue(t *testing.T, srv *httptest.Server, body string) (int, bool) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "POST /widgets/ HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", len(body))
+	reader := bufio.NewReader(conn)
+	req := httptest.NewRequest(http.MethodPost, "/widgets/", nil)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		resp.Body.Close()
+		return resp.StatusCode, false
+	}
+	if _, err := conn.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = http.ReadResponse(reader, req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, true
+}
+
+func TestExpectContinueSkipsTheUploadOfRejectedBodies(t *testing.T) {
+	srv := httptest.NewServer(limitBody(newTestHandler(t, nil, nil), 64))
+	defer srv.Close()
+
+	if status, sent := expectContinue(t, srv, `{"name":"a"}`); status != http.StatusCreated || !sent {
+		t.Errorf("a small body answered %d, sent %t; want 201 after 100 Continue", status, sent)
+	}
+	big := `{"name":"a","description":"` + strings.Repeat("x", 100) + `"}`
+	if status, sent := expectContinue(t, srv, big); status != http.StatusRequestEntityTooLarge || sent {
+		t.Errorf("a large body answered %d, sent %t; want 413 without the upload", status, sent)
+	}
+
+	readOnly := httptest.NewServer(limitBody(newTestHandler(t, nil, map[string]string{"API_READ_ONLY": "true"}), 64))
+	defer readOnly.Close()
+	if status, sent := expectContinue(t, readOnly, `{"name":"a"}`); status != http.StatusMethodNotAllowed || sent {
+		t.Errorf("a read-only create answered %d, sent %t; want 405 without the upload", status, sent)
+	}
+}
+
+func TestLimitBodyCutsOffBodiesOfUnknownLength(t *testing.T) {
+	h := limitBody(newTestHandler(t, nil, nil), 64)
+	r := httptest.NewRequest(http.MethodPost, "/widgets/", strings.NewReader(`{"name":"`+strings.Repeat("x", 100)+`"}`))
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	expectError(t, w, http.StatusRequestEntityTooLarge, codeBodyTooLarge)
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		env        map[string]string
+		frame, csp string
+	}{
+		{nil, "DENY", "default-src 'none'; frame-ancestors 'none'"},
+		{map[string]string{"API_FRAME_OPTIONS": "SAMEORIGIN", "API_CONTENT_SECURITY_POLICY": "default-src 'self'"}, "SAMEORIGIN", "default-src 'self'"},
+		{map[string]string{"API_FRAME_OPTIONS": "off", "API_CONTENT_SECURITY_POLICY": "OFF"}, "", ""},
+	} {
+		cfg, err := loadConfig(nil, lookupIn(tt.env))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := securityHeaders(newTestHandler(t, nil, tt.env), cfg.Security)
+		for _, target := range []string{"/widgets/", "/widgets/nope"} {
+			w := do(h, http.MethodGet, target, "")
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("%v %s: got X-Content-Type-Options %q", tt.env, target, got)
+			}
+			if got := w.Header().Get("X-Frame-Options"); got != tt.frame {
+				t.Errorf("%v %s: got X-Frame-Options %q, want %q", tt.env, target, got, tt.frame)
+			}
+			if got := w.Header().Get("Content-Security-Policy"); got != tt.csp {
+				t.Errorf("%v %s: got Content-Security-Policy %q, want %q", tt.env, target, got, tt.csp)
+			}
+		}
+	}
+
+	// The UI replaces the policy with one that lets its page run.
+	cfg, _ := loadConfig(nil, lookupIn(nil))
+	w := do(securityHeaders(http.HandlerFunc(ui), cfg.Security), http.MethodGet, "/ui", "")
+	if got := w.Header().Get("Content-Security-Policy"); !strings.Contains(got, "script-src 'unsafe-inline'") {
+		t.Errorf("got Content-Security-Policy %q on the UI", got)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	namingSnakeCase = "snake_case"
+	namingCamelCase = "camelCase"
+)
+
+var (
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	timeType      = reflect.TypeOf(Time{})
+)
+
+// apply returns payload with its field names in the configured style and its
+// timestamps in the configured zone.
+func (o outputOptions) apply(payload interface{}) interface{} {
+	if o.naming != namingCamelCase && o.zone == time.UTC {
+		return payload
+	}
+	return renameFields(payload, o.fieldName, o.zone)
+}
+
+// fieldName returns the given snake_case name in the configured style.
+func (o outputOptions) fieldName(name string) string {
+	if o.naming == namingCamelCase {
+		return snakeToCamel(name)
+	}
+	return name
+}
+
+// renameFields returns a copy of payload suitable for JSON encoding where every
+// struct field name, and every key of the outer envelope maps, has been passed
+// through rename and every Time is written in zone. Maps held in struct fields
+// are user data and keep their keys.
+func renameFields(payload interface{}, rename func(string) string, zone *time.Location) interface{} {
+	return renameValue(reflect.ValueOf(payload), rename, zone, true)
+}
+
+func renameValue(v reflect.Value, rename func(string) string, zone *time.Location, renameKeys bool) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	if v.Type() == timeType {
+		b, err := v.Interface().(Time).In(zone).MarshalJSON()
+		if err != nil {
+			return v.Interface()
+		}
+		return json.RawMessage(b)
+	}
+
+	if v.Type().Implements(marshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return nil
+		}
+		b, err := json.Marshal(v.Interface())
+		if err != nil {
+			return v.Interface()
+		}
+		return json.RawMessage(b)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return renameValue(v.Elem(), rename, zone, renameKeys)
+	case reflect.Struct:
+		out := make(map[string]interface{}, v.NumField())
+		renameStruct(v, rename, zone, out)
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(iter.Key().Interface())
+			if renameKeys {
+				key = rename(key)
+			}
+			out[key] = renameValue(iter.Value(), rename, zone, renameKeys)
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		out := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out[i] = renameValue(v.Index(i), rename, zone, renameKeys)
+		}
+		return out
+	default:
+		return v.Interface()
+	}
+}
+
+// renameStruct adds the exported fields of the struct v to out, honoring the
+// name, omitempty and "-" options of their json tags.
+func renameStruct(v reflect.Value, rename func(string) string, zone *time.Location, out map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if len(field.PkgPath) > 0 && !field.Anonymous {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+
+		fv := v.Field(i)
+		if field.Anonymous && len(name) == 0 && fv.Kind() == reflect.Struct {
+			renameStruct(fv, rename, zone, out)
+			continue
+		}
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		omitEmpty := false
+		for _, opt := range opts[1:] {
+			if opt == "omitempty" {
+				omitEmpty = true
+			}
+		}
+		if omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		out[rename(name)] = renameValue(fv, rename, zone, false)
+	}
+}
+
+// isEmptyValue reports whether v would be omitted by an omitempty json tag.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// snakeToCamel converts a snake_case name such as next_cursor to nextCursor.
+func snakeToCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) > 0 {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
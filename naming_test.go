@@ -0,0 +1,94 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOutputNamingStyles(t *testing.T) {
+	widget := Widget{
+		ID:         "1",
+		Name:       "a",
+		OwnerID:    "alice",
+		CreatedAt:  Time{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		Attributes: map[string]interface{}{"max_speed": 3},
+	}
+	payload := map[string]interface{}{"widget": widget, "next_cursor": "x"}
+
+	for _, tc := range []struct {
+		naming string
+		want   []string
+		absent []string
+	}{
+		{
+			naming: namingSnakeCase,
+			want:   []string{"owner_id", "created_at", "next_cursor"},
+			absent: []string{"ownerId", "createdAt", "nextCursor"},
+		},
+		{
+			naming: namingCamelCase,
+			want:   []string{"ownerId", "createdAt", "nextCursor"},
+			absent: []string{"owner_id", "created_at", "next_cursor"},
+		},
+	} {
+		output := outputOptions{naming: tc.naming, zone: time.UTC}
+		b, err := json.Marshal(output.apply(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		fields := got["widget"].(map[string]interface{})
+		for _, name := range tc.want {
+			if _, ok := fields[name]; !ok {
+				if _, ok := got[name]; !ok {
+					t.Errorf("%s: missing %s in %s", tc.naming, name, b)
+				}
+			}
+		}
+		for _, name := range tc.absent {
+			if _, ok := fields[name]; ok {
+				t.Errorf("%s: unexpected %s in %s", tc.naming, name, b)
+			}
+			if _, ok := got[name]; ok {
+				t.Errorf("%s: unexpected %s in %s", tc.naming, name, b)
+			}
+		}
+
+		// Attribute keys are user data and are never renamed.
+		attributes := fields["attributes"].(map[string]interface{})
+		if _, ok := attributes["max_speed"]; !ok {
+			t.Errorf("%s: got attributes %v, want the keys as given", tc.naming, attributes)
+		}
+	}
+}
+
+func TestSnakeToCamel(t *testing.T) {
+	for name, want := range map[string]string{
+		"name":          "name",
+		"owner_id":      "ownerId",
+		"max_json_size": "maxJsonSize",
+		"trailing_":     "trailing",
+	} {
+		if got := snakeToCamel(name); got != want {
+			t.Errorf("snakeToCamel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// originsFile holds CORS origins read from a file with one origin or pattern
+// per line. Blank lines and lines starting with # are ignored. The file is
+// read again on reload, so the allowed origins can change without a restart.
+type originsFile struct {
+	path    string
+	origins atomic.Value // []string
+}
+
+// loadOriginsFile will read the origins in the file at path.
+func loadOriginsFile(path string) (*originsFile, error) {
+	f := &originsFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the file again. If it cannot be read or lists an invalid
+// origin the origins already loaded are kept.
+func (f *originsFile) reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	origins := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		origins = append(origins, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := checkOriginPatterns(origins); err != nil {
+		return err
+	}
+
+	f.origins.Store(origins)
+	return nil
+}
+
+// list returns the origins last loaded. A nil originsFile has none.
+func (f *originsFile) list() []string {
+	if f == nil {
+		return nil
+	}
+	return f.origins.Load().([]string)
+}
+
+// reloadOnHangup reloads the file whenever the process receives SIGHUP.
+func (f *originsFile) reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := f.reload(); err != nil {
+				log.Printf("keeping previous CORS origins, unable to reload %s: %s", f.path, err)
+				continue
+			}
+			log.Printf("reloaded %d CORS origins from %s", len(f.list()), f.path)
+		}
+	}()
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// writeOrigins replaces the origins file at path with the given lines.
+func writeOrigins(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOriginsFileReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "origins")
+	writeOrigins(t, path, "# allowed origins", "https://app.example.com", "")
+	f, err := loadOriginsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := cors(okHandler, CORSPolicy{OriginsFile: f})
+	allowed := func(origin string) bool {
+		return do(h, http.MethodGet, "/widgets/", "", "Origin", origin).Header().Get("Access-Control-Allow-Origin") == origin
+	}
+	if !allowed("https://app.example.com") || allowed("https://admin.example.com") {
+		t.Fatalf("got origins %v before the reload", f.list())
+	}
+
+	writeOrigins(t, path, "https://*.example.com")
+	if err := f.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !allowed("https://admin.example.com") {
+		t.Errorf("got origins %v after the reload", f.list())
+	}
+
+	// An invalid file keeps the origins already loaded.
+	writeOrigins(t, path, "https://app.*.com")
+	if err := f.reload(); err == nil {
+		t.Error("got no error reloading an invalid pattern")
+	}
+	os.Remove(path)
+	if err := f.reload(); err == nil {
+		t.Error("got no error reloading a missing file")
+	}
+	if got := strings.Join(f.list(), ","); got != "https://*.example.com" || !allowed("https://admin.example.com") {
+		t.Errorf("got origins %s after failed reloads, want the last valid list", got)
+	}
+}
+
+func TestOriginsFileReloadsOnHangup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "origins")
+	writeOrigins(t, path, "https://app.example.com")
+	f, err := loadOriginsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.reloadOnHangup()
+
+	writeOrigins(t, path, "https://app.example.com", "https://admin.example.com")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return len(f.list()) == 2 })
+}
+
+func TestLoadOriginsFileRejectsInvalidFiles(t *testing.T) {
+	if _, err := loadOriginsFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("got no error for a missing file")
+	}
+	path := filepath.Join(t.TempDir(), "origins")
+	writeOrigins(t, path, "https://*example.com")
+	if _, err := loadOriginsFile(path); err == nil {
+		t.Error("got no error for an invalid pattern")
+	}
+}
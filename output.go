@@ -0,0 +1,66 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// outputOptions are the configured choices about how responses are written.
+type outputOptions struct {
+	// naming is the style of JSON field names.
+	naming string
+	// zone is the zone timestamps are written in.
+	zone *time.Location
+	// development adds debug detail to internal error responses.
+	development bool
+}
+
+// defaultOutput is used for requests that did not pass through withOutput.
+var defaultOutput = outputOptions{naming: namingSnakeCase, zone: time.UTC}
+
+// newOutputOptions returns the output options set in cfg.
+func newOutputOptions(cfg Config) outputOptions {
+	zone := cfg.TimeZone
+	if zone == nil {
+		zone = time.UTC
+	}
+	return outputOptions{
+		naming:      cfg.JSONNaming,
+		zone:        zone,
+		development: cfg.Environment == envDevelopment,
+	}
+}
+
+type outputKey struct{}
+
+// withOutput stores the output options in the request context for the
+// handlers and error writers below it.
+func withOutput(next http.Handler, output outputOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), outputKey{}, output)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// outputFor returns the output options for r.
+func outputFor(r *http.Request) outputOptions {
+	if output, ok := r.Context().Value(outputKey{}).(outputOptions); ok {
+		return output
+	}
+	return defaultOutput
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// page describes which slice of a widget list should be returned.
+//
+// A cursor is an opaque token identifying the last widget seen by the client.
+// Paging with a cursor is stable even when widgets are created or deleted
+// between requests. When no cursor is given the offset is used instead.
+type page struct {
+	limit  int
+	offset int
+	cursor uint64
+}
+
+// Page sizes used by the list endpoint when none are configured.
+const (
+	defaultPageSize = 50
+	defaultMaxPage  = 500
+)
+
+// parsePage reads the limit, offset and cursor query parameters. Lists are
+// always paginated: without a limit, or with a limit of zero, pages hold
+// defaultLimit widgets, and larger limits are capped at maxLimit.
+func parsePage(query url.Values, defaultLimit, maxLimit int) (page, error) {
+	p := page{limit: defaultLimit}
+
+	if err := checkSingleValues(query, "limit", "offset", "cursor"); err != nil {
+		return p, err
+	}
+
+	if v := query.Get("limit"); len(v) > 0 {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return p, errors.New("The limit parameter must be a non-negative integer.")
+		}
+		if limit > 0 {
+			p.limit = limit
+		}
+	}
+	if p.limit > maxLimit {
+		p.limit = maxLimit
+	}
+
+	if v := query.Get("offset"); len(v) > 0 {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return p, errors.New("The offset parameter must be a non-negative integer.")
+		}
+		p.offset = offset
+	}
+
+	if v := query.Get("cursor"); len(v) > 0 {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return p, errors.New("The cursor parameter is not valid.")
+		}
+		p.cursor = cursor
+	}
+
+	return p, nil
+}
+
+// apply returns the widgets in this page along with the cursor for the next
+// page, which is empty when there are no more widgets. The given widgets must
+// be ordered by sequence.
+func (p page) apply(widgets []Widget) ([]Widget, string) {
+	start := 0
+	if p.cursor > 0 {
+		for start < len(widgets) && widgets[start].seq <= p.cursor {
+			start++
+		}
+	} else if p.offset < len(widgets) {
+		start = p.offset
+	} else {
+		start = len(widgets)
+	}
+
+	end := len(widgets)
+	if p.limit > 0 && start+p.limit < end {
+		end = start + p.limit
+	}
+
+	next := ""
+	if end < len(widgets) && end > 0 {
+		next = encodeCursor(widgets[end-1].seq)
+	}
+	return widgets[start:end], next
+}
+
+// checkSingleValues rejects any of the named query parameters that is given
+// more than once, as in ?limit=10&limit=20. Picking one of the values would
+// silently ignore the others, so the request is refused instead.
+func checkSingleValues(query url.Values, names ...string) error {
+	for _, name := range names {
+		if len(query[name]) > 1 {
+			return fmt.Errorf("The %s parameter must not be repeated.", name)
+		}
+	}
+	return nil
+}
+
+func encodeCursor(seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(seq, 10)))
+}
+
+func decodeCursor(cursor string) (uint64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(b), 10, 64)
+}
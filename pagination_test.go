@@ -0,0 +1,108 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCursorPagingIsStableUnderInserts(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		createWidget(t, h, `{"name":"`+name+`"}`)
+	}
+
+	first := listWidgets(t, h, "/widgets/?limit=2")
+	if got := widgetNames(first.Widgets); got != "a,b" || first.NextCursor == "" {
+		t.Fatalf("got first page %s with cursor %q", got, first.NextCursor)
+	}
+
+	// Widgets created between pages come after the cursor rather than
+	// shifting the widgets already seen into the next page.
+	createWidget(t, h, `{"name":"d"}`)
+	second := listWidgets(t, h, "/widgets/?limit=2&cursor="+url.QueryEscape(first.NextCursor))
+	if got := widgetNames(second.Widgets); got != "c,d" || second.NextCursor != "" {
+		t.Fatalf("got second page %s with cursor %q", got, second.NextCursor)
+	}
+
+	createWidget(t, h, `{"name":"e"}`)
+	third := listWidgets(t, h, "/widgets/?limit=2&cursor="+url.QueryEscape(first.NextCursor))
+	if got := widgetNames(third.Widgets); got != "c,d" || third.NextCursor == "" {
+		t.Fatalf("got %s with cursor %q on re-reading the second page", got, third.NextCursor)
+	}
+	last := listWidgets(t, h, "/widgets/?limit=2&cursor="+url.QueryEscape(third.NextCursor))
+	if got := widgetNames(last.Widgets); got != "e" || last.NextCursor != "" {
+		t.Errorf("got last page %s with cursor %q", got, last.NextCursor)
+	}
+}
+
+func TestCursorPagingSkipsDeletedWidgets(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	var ids []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		ids = append(ids, createWidget(t, h, `{"name":"`+name+`"}`).ID)
+	}
+
+	first := listWidgets(t, h, "/widgets/?limit=2")
+	if w := do(h, http.MethodDelete, "/widgets/"+ids[1], ""); w.Code != http.StatusOK {
+		t.Fatalf("delete answered %d", w.Code)
+	}
+	if w := do(h, http.MethodDelete, "/widgets/"+ids[2], ""); w.Code != http.StatusOK {
+		t.Fatalf("delete answered %d", w.Code)
+	}
+	second := listWidgets(t, h, "/widgets/?limit=2&cursor="+url.QueryEscape(first.NextCursor))
+	if got := widgetNames(second.Widgets); got != "d" {
+		t.Errorf("got second page %s, want only the widget not yet seen", got)
+	}
+}
+
+func TestOffsetPagingWithoutACursor(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		createWidget(t, h, `{"name":"`+name+`"}`)
+	}
+	if got := widgetNames(listWidgets(t, h, "/widgets/?limit=2&offset=1").Widgets); got != "b,c" {
+		t.Errorf("got %s", got)
+	}
+	expectError(t, do(h, http.MethodGet, "/widgets/?cursor=not-a-cursor", ""), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestRepeatedListParametersAreRejected(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	createWidget(t, h, `{"name":"a"}`)
+
+	for _, query := range []string{
+		"limit=10&limit=20",
+		"offset=0&offset=1",
+		"cursor=MQ&cursor=Mg",
+		"min_quantity=1&min_quantity=2",
+		"status=draft&status=active",
+		"sort=created&sort=-created",
+		"wait=1s&wait=2s",
+	} {
+		e := expectError(t, do(h, http.MethodGet, "/widgets/?"+query, ""), http.StatusBadRequest, codeBadRequest)
+		if !strings.Contains(e.Error, "must not be repeated") {
+			t.Errorf("%s: got %q", query, e.Error)
+		}
+	}
+
+	// Different parameters may still be combined.
+	if got := widgetNames(listWidgets(t, h, "/widgets/?limit=10&offset=0&status=draft").Widgets); got != "a" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recentRequest is a request kept by a requestRing.
+type recentRequest struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+
+	// DurationMS is how long the request took, in milliseconds.
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// requestRing keeps the most recent requests, overwriting the oldest once it
+// is full.
+type requestRing struct {
+	mu       sync.Mutex
+	requests []recentRequest
+	next     int
+	full     bool
+}
+
+// newRequestRing will construct a new requestRing holding size requests.
+func newRequestRing(size int) *requestRing {
+	return &requestRing{requests: make([]recentRequest, size)}
+}
+
+func (rr *requestRing) add(req recentRequest) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	rr.requests[rr.next] = req
+	rr.next = (rr.next + 1) % len(rr.requests)
+	if rr.next == 0 {
+		rr.full = true
+	}
+}
+
+// recent returns the kept requests, newest first.
+func (rr *requestRing) recent() []recentRequest {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	n := rr.next
+	if rr.full {
+		n = len(rr.requests)
+	}
+	requests := make([]recentRequest, 0, n)
+	for i := 1; i <= n; i++ {
+		requests = append(requests, rr.requests[(rr.next-i+len(rr.requests))%len(rr.requests)])
+	}
+	return requests
+}
+
+// ServeHTTP writes the kept requests, newest first.
+func (rr *requestRing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, r, []string{http.MethodGet, http.MethodHead})
+		return
+	}
+	if err := writeJSON(w, r, http.StatusOK, map[string][]recentRequest{"requests": rr.recent()}); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
+
+// recordRequests adds every request handled by next to the ring. It must run
+// inside requestIDs so that the request ID is known.
+func recordRequests(next http.Handler, ring *requestRing) http.Handler {
+	if ring == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		ring.add(recentRequest{
+			Time:       start,
+			RequestID:  requestID(r.Context()),
+			Method:     r.Method,
+			Path:       truncate(r.URL.EscapedPath(), maxLoggedPathLen),
+			Status:     rec.status,
+			DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+		})
+	})
+}
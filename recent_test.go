@@ -0,0 +1,69 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRecordRequestsKeepsTheLatestInARing(t *testing.T) {
+	ring := newRequestRing(3)
+	api := newTestHandler(t, nil, nil)
+	h := requestIDs(recordRequests(api, ring), []string{defaultRequestIDHeader}, defaultRequestIDHeader)
+
+	do(h, http.MethodPost, "/widgets/", `{"name":"a"}`, defaultRequestIDHeader, "first")
+	do(h, http.MethodGet, "/widgets/1", "", defaultRequestIDHeader, "second")
+	do(h, http.MethodGet, "/widgets/nope", "", defaultRequestIDHeader, "third")
+	if got := len(ring.recent()); got != 3 {
+		t.Fatalf("kept %d requests, want 3", got)
+	}
+	do(h, http.MethodDelete, "/widgets/1", "", defaultRequestIDHeader, "fourth")
+
+	w := do(ring, http.MethodGet, "/debug/requests", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	var body struct{ Requests []recentRequest }
+	decodeBody(t, w, &body)
+	want := []recentRequest{
+		{RequestID: "fourth", Method: http.MethodDelete, Path: "/widgets/1", Status: http.StatusOK},
+		{RequestID: "third", Method: http.MethodGet, Path: "/widgets/nope", Status: http.StatusNotFound},
+		{RequestID: "second", Method: http.MethodGet, Path: "/widgets/1", Status: http.StatusOK},
+	}
+	if len(body.Requests) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(body.Requests), len(want))
+	}
+	for i, got := range body.Requests {
+		if got.RequestID != want[i].RequestID || got.Method != want[i].Method || got.Path != want[i].Path || got.Status != want[i].Status {
+			t.Errorf("request %d is %+v, want %+v", i, got, want[i])
+		}
+		if got.Time.IsZero() || got.DurationMS < 0 {
+			t.Errorf("request %d has time %s and duration %f", i, got.Time, got.DurationMS)
+		}
+	}
+
+	expectError(t, do(ring, http.MethodPost, "/debug/requests", ""), http.StatusMethodNotAllowed, codeMethodNotAllowed)
+}
+
+func TestRecentRequestsAreOffByDefault(t *testing.T) {
+	cfg, err := loadConfig(nil, lookupIn(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.EnableRecentRequests {
+		t.Error("recent requests are exposed by default")
+	}
+}
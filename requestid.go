@@ -0,0 +1,74 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+const defaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen bounds request IDs taken from clients, which end up in
+// logs and response headers.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// requestIDs gives every request an ID, taken from the first of the inbound
+// headers that holds a usable value or generated otherwise. The ID is stored
+// in the request context and echoed in the outbound header.
+func requestIDs(next http.Handler, inbound []string, outbound string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var id string
+		for _, name := range inbound {
+			if v := r.Header.Get(name); validRequestID(v) {
+				id = v
+				break
+			}
+		}
+		if len(id) == 0 {
+			var err error
+			if id, err = (uuidGenerator{}).NewID(); err != nil {
+				log.Printf("unable to generate request id %s", err)
+			}
+		}
+
+		w.Header().Set(outbound, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validRequestID reports whether a client supplied ID is short and made only
+// of printable ASCII, so it is safe to log and echo.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID given to the request, or an empty string.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
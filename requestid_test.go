@@ -0,0 +1,76 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDsReadAlternateInboundHeaders(t *testing.T) {
+	var seen string
+	h := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	}), []string{"X-Correlation-ID", "Request-Id"}, "Request-Id")
+
+	for _, tt := range []struct {
+		headers []string
+		want    string
+	}{
+		{[]string{"X-Correlation-ID", "abc"}, "abc"},
+		{[]string{"Request-Id", "def"}, "def"},
+		{[]string{"X-Correlation-ID", "abc", "Request-Id", "def"}, "abc"},
+		{[]string{"X-Correlation-ID", "bad id", "Request-Id", "def"}, "def"},
+		{[]string{"X-Request-ID", "ignored"}, ""},
+	} {
+		w := do(h, http.MethodGet, "/", "", tt.headers...)
+		got := w.Header().Get("Request-Id")
+		if len(tt.want) > 0 && got != tt.want {
+			t.Errorf("%v: echoed %q, want %q", tt.headers, got, tt.want)
+		}
+		if len(tt.want) == 0 && (len(got) == 0 || got == "ignored") {
+			t.Errorf("%v: echoed %q, want a generated id", tt.headers, got)
+		}
+		if seen != got {
+			t.Errorf("%v: the request context holds %q, but %q was echoed", tt.headers, seen, got)
+		}
+		if other := w.Header().Get(defaultRequestIDHeader); len(other) > 0 {
+			t.Errorf("%v: also echoed %s %q", tt.headers, defaultRequestIDHeader, other)
+		}
+	}
+}
+
+func TestRequestIDsRejectUnsafeValues(t *testing.T) {
+	h := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), []string{defaultRequestIDHeader}, defaultRequestIDHeader)
+	for _, id := range []string{"with space", "tab\there", strings.Repeat("x", maxRequestIDLen+1)} {
+		if got := do(h, http.MethodGet, "/", "", defaultRequestIDHeader, id).Header().Get(defaultRequestIDHeader); got == id || len(got) == 0 {
+			t.Errorf("%q was echoed as %q, want a generated id", id, got)
+		}
+	}
+}
+
+func TestRequestIDHeaderSettings(t *testing.T) {
+	cfg, err := loadConfig(nil, lookupIn(map[string]string{
+		"API_REQUEST_ID_HEADERS":         "X-Correlation-ID, Request-Id",
+		"API_REQUEST_ID_RESPONSE_HEADER": "Request-Id",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cfg.RequestIDHeaders, ","); got != "X-Correlation-ID,Request-Id" || cfg.RequestIDResponseHeader != "Request-Id" {
+		t.Errorf("got inbound %s, outbound %s", got, cfg.RequestIDResponseHeader)
+	}
+}
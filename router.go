@@ -0,0 +1,151 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+type paramsKey struct{}
+
+// router dispatches requests by method and path pattern. Pattern segments
+// written as {name} match any single non-empty path segment and capture it,
+// percent-decoded, as a path parameter. Trailing slashes are ignored when
+// matching.
+type router struct {
+	routes []route
+
+	// methodNotAllowed writes the response when the path matches but the
+	// method does not, given the methods the path supports. It defaults to a
+	// plain 405.
+	methodNotAllowed func(w http.ResponseWriter, r *http.Request, allowed []string)
+}
+
+type route struct {
+	method   string
+	segments []string
+	handler  http.Handler
+}
+
+// newRouter will construct a new router with no routes.
+func newRouter() *router {
+	return &router{}
+}
+
+// handle registers the handler for requests with the given method and path
+// pattern, such as /widgets/{id}.
+func (rt *router) handle(method string, pattern string, handler http.HandlerFunc) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  handler,
+	})
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.EscapedPath())
+
+	var allowed []string
+	for _, route := range rt.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if err := unescapeParams(params); err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "The request path is not validly percent-encoded.")
+			return
+		}
+		if route.method != r.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+
+		ctx := context.WithValue(r.Context(), paramsKey{}, params)
+		route.handler.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+
+	if len(allowed) == 0 {
+		notFound(w, r)
+		return
+	}
+
+	sort.Strings(allowed)
+	if rt.methodNotAllowed != nil {
+		rt.methodNotAllowed(w, r, allowed)
+		return
+	}
+	writeMethodNotAllowed(w, r, allowed)
+}
+
+// writeMethodNotAllowed writes a 405 response listing the allowed methods.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeJSONError(w, r, http.StatusMethodNotAllowed, "Method not allowed for this resource.")
+}
+
+// match reports whether the path segments fit the route, returning any
+// captured path parameters.
+func (rt route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, segment := range rt.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if len(segments[i]) == 0 {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// unescapeParams percent-decodes captured path parameters in place, so that
+// an id sent as a%20b reaches the handler as "a b" rather than as written.
+func unescapeParams(params map[string]string) error {
+	for name, value := range params {
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			return err
+		}
+		params[name] = unescaped
+	}
+	return nil
+}
+
+// pathParam returns the named path parameter captured by the router.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
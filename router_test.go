@@ -0,0 +1,120 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRouterExtractsPathParams(t *testing.T) {
+	var got string
+	capture := func(route string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			got = route + " " + pathParam(r, "id") + " " + pathParam(r, "version")
+		}
+	}
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/widgets", capture("list"))
+	rt.handle(http.MethodGet, "/widgets/{id}", capture("get"))
+	rt.handle(http.MethodDelete, "/widgets/{id}", capture("delete"))
+	rt.handle(http.MethodGet, "/widgets/{id}/versions/{version}", capture("version"))
+
+	for _, tc := range []struct {
+		method, target, want string
+	}{
+		{http.MethodGet, "/widgets", "list  "},
+		{http.MethodGet, "/widgets/", "list  "},
+		{http.MethodGet, "/widgets/abc", "get abc "},
+		{http.MethodGet, "/widgets/abc/", "get abc "},
+		{http.MethodDelete, "/widgets/abc", "delete abc "},
+		{http.MethodGet, "/widgets/a%20b", "get a b "},
+		{http.MethodGet, "/widgets/a%2Fb", "get a/b "},
+		{http.MethodGet, "/widgets/abc/versions/2", "version abc 2"},
+	} {
+		got = ""
+		if w := do(rt, tc.method, tc.target, ""); w.Code != http.StatusOK {
+			t.Errorf("%s %s: got status %d", tc.method, tc.target, w.Code)
+		}
+		if got != tc.want {
+			t.Errorf("%s %s: got %q, want %q", tc.method, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestRouterUnmatchedRequests(t *testing.T) {
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/widgets/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	rt.handle(http.MethodPut, "/widgets/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, target := range []string{"/widgets", "/widgets/abc/versions", "/other/abc"} {
+		expectError(t, do(rt, http.MethodGet, target, ""), http.StatusNotFound, codeNotFound)
+	}
+
+	w := do(rt, http.MethodPost, "/widgets/abc", "")
+	expectError(t, w, http.StatusMethodNotAllowed, codeMethodNotAllowed)
+	if got := w.Header().Get("Allow"); got != "GET, PUT" {
+		t.Errorf("got Allow %q", got)
+	}
+}
+
+func TestUnescapeParamsRejectsMalformedEncoding(t *testing.T) {
+	for _, value := range []string{"%zz", "a%2", "%"} {
+		if err := unescapeParams(map[string]string{"id": value}); err == nil {
+			t.Errorf("%q: got no error", value)
+		}
+	}
+	params := map[string]string{"id": "a%25zz"}
+	if err := unescapeParams(params); err != nil || params["id"] != "a%zz" {
+		t.Errorf("got %q, %v, want a%%zz", params["id"], err)
+	}
+}
+
+func TestMalformedPathsAreRejectedBeforeRouting(t *testing.T) {
+	reached := false
+	rt := newRouter()
+	rt.handle(http.MethodGet, "/widgets/{id}", func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})
+	srv := httptest.NewServer(rt)
+	defer srv.Close()
+
+	for _, path := range []string{"/widgets/%zz", "/widgets/a%2", "/widgets/%"} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", path)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest || reached {
+			t.Errorf("%s: got status %d, reached the handler %t", path, resp.StatusCode, reached)
+		}
+	}
+
+	// An escaped percent sign is a valid part of an id.
+	if w := do(rt, http.MethodGet, "/widgets/a%25zz", ""); w.Code != http.StatusOK || !reached {
+		t.Errorf("got status %d for an escaped percent sign", w.Code)
+	}
+}
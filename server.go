@@ -0,0 +1,127 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 15 * time.Second
+
+// drainFlag records that the server is about to shut down. A nil flag is
+// never set.
+type drainFlag struct {
+	set int32
+}
+
+func (f *drainFlag) start() {
+	atomic.StoreInt32(&f.set, 1)
+}
+
+func (f *drainFlag) isSet() bool {
+	return f != nil && atomic.LoadInt32(&f.set) == 1
+}
+
+// listen opens the listener for the given network, one of tcp, tcp4, tcp6 or
+// unix. For unix the address is a socket path; a stale socket left by an
+// earlier run is removed first, and the socket is removed again when the
+// listener closes.
+func listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return net.Listen(network, address)
+	case "unix":
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, err
+			}
+		}
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		ln.(*net.UnixListener).SetUnlinkOnClose(true)
+		return ln, nil
+	}
+	return nil, fmt.Errorf("unknown listen network %q", network)
+}
+
+// serve runs srv on ln until it fails or the process receives SIGINT or
+// SIGTERM. It then sets draining and keeps serving for delay, so that
+// readiness checks fail before connections are refused, and shuts down,
+// waiting up to timeout for in-flight requests.
+func serve(srv *http.Server, ln net.Listener, timeout, delay time.Duration, draining *drainFlag) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		log.Printf("received %s, shutting down", sig)
+	}
+
+	draining.start()
+	if delay > 0 {
+		log.Printf("failing readiness for %s before shutdown", delay)
+		select {
+		case err := <-errs:
+			return err
+		case <-time.After(delay):
+		}
+	}
+	return shutdown(srv, timeout)
+}
+
+// shutdown stops srv accepting connections and waits up to timeout for
+// in-flight requests to finish before closing whatever is left. A zero timeout
+// closes every connection immediately.
+func shutdown(srv *http.Server, timeout time.Duration) error {
+	start := time.Now()
+	if timeout == 0 {
+		log.Printf("closing connections immediately")
+		return srv.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("warning: draining timed out after %s, closing remaining connections", time.Since(start))
+		return srv.Close()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("drained connections in %s", time.Since(start))
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startSlowServer serves on a local port with a handler that holds every
+// request for a minute. It returns once a request is being held, with the
+// server and a channel receiving the outcome of that request.
+func startSlowServer(t *testing.T) (*http.Server, chan error) {
+	t.Helper()
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		select {
+		case <-release:
+		case <-time.After(time.Minute):
+		}
+	})}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow request never arrived")
+	}
+	return srv, done
+}
+
+func TestShutdownGivesUpAfterTheTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{100 * time.Millisecond, 0} {
+		srv, done := startSlowServer(t)
+
+		start := time.Now()
+		if err := shutdown(srv, timeout); err != nil {
+			t.Fatalf("%s: got %s", timeout, err)
+		}
+		if elapsed := time.Since(start); elapsed > timeout+time.Second {
+			t.Errorf("%s: shutdown took %s with a slow handler running", timeout, elapsed)
+		}
+		if err := <-done; err == nil {
+			t.Errorf("%s: got a response for the slow request, want its connection closed", timeout)
+		}
+	}
+}
+
+func TestShutdownTimeoutSetting(t *testing.T) {
+	if cfg := testConfig(t, nil); cfg.ShutdownTimeout != defaultShutdownTimeout {
+		t.Errorf("got default timeout %s", cfg.ShutdownTimeout)
+	}
+	if cfg := testConfig(t, map[string]string{"API_SHUTDOWN_TIMEOUT": "0"}); cfg.ShutdownTimeout != 0 {
+		t.Errorf("got timeout %s, want immediate shutdown", cfg.ShutdownTimeout)
+	}
+	for _, v := range []string{"-1s", "soon"} {
+		if _, err := loadConfig(nil, lookupIn(map[string]string{"API_SHUTDOWN_TIMEOUT": v})); err == nil {
+			t.Errorf("%s: got no error", v)
+		}
+	}
+}
+
+func TestServeFailsReadinessBeforeShuttingDown(t *testing.T) {
+	// Catch SIGTERM here too, so it cannot kill the test before serve
+	// starts listening for it.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	draining := &drainFlag{}
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", NewReadyHandler(newMemoryStore(), draining))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	ln, err := listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + ln.Addr().String()
+	get := func(path string) int {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	const delay = 300 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(&http.Server{Handler: mux}, ln, time.Second, delay, draining)
+	}()
+	waitUntil(t, func() bool { return get("/readyz") == http.StatusOK })
+
+	start := time.Now()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return get("/readyz") == http.StatusServiceUnavailable })
+	if code := get("/widgets/"); code != http.StatusOK {
+		t.Errorf("got status %d while draining, want requests still served", code)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve returned %s", err)
+		}
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Errorf("shut down after %s, want at least %s", elapsed, delay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not shut down")
+	}
+	if code := get("/readyz"); code != 0 {
+		t.Errorf("got status %d after shutdown", code)
+	}
+}
+
+func TestListenServesOverAUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+
+	// A socket left behind by an earlier run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: newTestHandler(t, nil, nil)}
+	go srv.Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/widgets/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d over the socket", resp.StatusCode)
+	}
+
+	if err := shutdown(srv, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket is still there after shutdown: %v", err)
+	}
+}
+
+func TestListenRejectsUnknownNetworks(t *testing.T) {
+	if _, err := listen("udp", "127.0.0.1:0"); err == nil {
+		t.Error("got no error listening on udp")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// Runtime stats published at /debug/vars alongside the expvar defaults. The
+// widget counters are kept up to date by the handlers.
+var (
+	startTime = time.Now()
+
+	widgetCount   = expvar.NewInt("widgets")
+	widgetCreates = expvar.NewInt("widget_creates")
+	widgetDeletes = expvar.NewInt("widget_deletes")
+
+	// widgetEvictions counts widgets deleted to make room in a full store.
+	widgetEvictions = expvar.NewInt("widget_evictions")
+
+	// listWaiters is how many list requests are being held open waiting for
+	// a change.
+	listWaiters = expvar.NewInt("list_waiters")
+)
+
+func init() {
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} {
+		return int64(time.Since(startTime).Seconds())
+	}))
+}
+
+// recordCreate counts a widget newly created.
+func recordCreate() {
+	widgetCreates.Add(1)
+	widgetCount.Add(1)
+}
+
+// recordDelete counts a widget deleted.
+func recordDelete() {
+	widgetDeletes.Add(1)
+	widgetCount.Add(-1)
+}
+
+// recordEviction counts a widget evicted from a full store.
+func recordEviction() {
+	widgetEvictions.Add(1)
+	widgetCount.Add(-1)
+}
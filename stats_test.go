@@ -0,0 +1,102 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// runtimeStats is the part of /debug/vars this package publishes.
+type runtimeStats struct {
+	Widgets         int64 `json:"widgets"`
+	WidgetCreates   int64 `json:"widget_creates"`
+	WidgetDeletes   int64 `json:"widget_deletes"`
+	ListWaiters     int64 `json:"list_waiters"`
+	WidgetEvictions int64 `json:"widget_evictions"`
+	Uptime          int64 `json:"uptime_seconds"`
+}
+
+func scrapeStats(t *testing.T) runtimeStats {
+	t.Helper()
+	w := do(expvar.Handler(), http.MethodGet, "/debug/vars", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	var stats runtimeStats
+	decodeBody(t, w, &stats)
+	return stats
+}
+
+func TestDebugVarsCountWidgets(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	before := scrapeStats(t)
+
+	a := createWidget(t, h, `{"name":"a"}`)
+	createWidget(t, h, `{"name":"b"}`)
+	createWidget(t, h, `{"name":"c","client_token":"t"}`)
+	do(h, http.MethodPost, "/widgets/", `{"name":"c","client_token":"t"}`)
+	do(h, http.MethodDelete, "/widgets/"+a.ID, "")
+	do(h, http.MethodDelete, "/widgets/"+a.ID, "")
+
+	after := scrapeStats(t)
+	if got := after.Widgets - before.Widgets; got != 2 {
+		t.Errorf("widget count moved by %d, want 2", got)
+	}
+	if got := after.WidgetCreates - before.WidgetCreates; got != 3 {
+		t.Errorf("creates moved by %d, want 3 since a retried create is not new", got)
+	}
+	if got := after.WidgetDeletes - before.WidgetDeletes; got != 1 {
+		t.Errorf("deletes moved by %d, want 1", got)
+	}
+	if after.Uptime < 0 {
+		t.Errorf("got uptime %d", after.Uptime)
+	}
+}
+
+func TestDebugVarsCountListWaiters(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_LIST_WAITERS": "2"})
+	etag := do(h, http.MethodGet, "/widgets/", "").Header().Get("ETag")
+	before := scrapeStats(t)
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- do(h, http.MethodGet, "/widgets/?wait=5s", "", "If-None-Match", etag).Code
+		}()
+	}
+	waitUntil(t, func() bool { return atomic.LoadInt64(&h.waits.waiting) == 2 })
+	if got := scrapeStats(t).ListWaiters - before.ListWaiters; got != 2 {
+		t.Errorf("list waiters moved by %d with two polls waiting, want 2", got)
+	}
+
+	// A subscriber over the limit is turned away and not counted.
+	expectError(t, do(h, http.MethodGet, "/widgets/?wait=5s", "", "If-None-Match", etag), http.StatusServiceUnavailable, codeUnavailable)
+	if got := scrapeStats(t).ListWaiters - before.ListWaiters; got != 2 {
+		t.Errorf("list waiters moved by %d after a rejected poll, want 2", got)
+	}
+
+	createWidget(t, h, `{"name":"a"}`)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("a waiting poll answered %d", code)
+		}
+	}
+	if got := scrapeStats(t).ListWaiters - before.ListWaiters; got != 0 {
+		t.Errorf("list waiters moved by %d once the polls returned, want 0", got)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Errors returned by a Store. Implementations may wrap them with more detail.
+var (
+	// ErrNotFound means the requested widget does not exist.
+	ErrNotFound = errors.New("widget not found")
+
+	// ErrConflict means the change conflicts with the stored state.
+	ErrConflict = errors.New("widget conflict")
+
+	// ErrUnavailable means the store cannot be reached right now.
+	ErrUnavailable = errors.New("store unavailable")
+
+	// ErrFull means the store holds as many widgets as it may.
+	ErrFull = errors.New("store full")
+
+	// ErrNoHistory means the store does not keep widget history.
+	ErrNoHistory = errors.New("store keeps no history")
+
+	// ErrNoRename means the store cannot rename widgets.
+	ErrNoRename = errors.New("store cannot rename widgets")
+)
+
+// Store persists Widgets. Every method takes the context of the request it
+// serves.
+type Store interface {
+	// List returns all widgets ordered by their insertion sequence.
+	List(ctx context.Context) ([]Widget, error)
+
+	// Get returns the widget with the given id, or ErrNotFound.
+	Get(ctx context.Context, id string) (Widget, error)
+
+	// Create stores a new widget. When the widget has a client token that is
+	// already held by a stored widget, that widget is returned instead and
+	// created is false.
+	Create(ctx context.Context, widget Widget) (stored Widget, created bool, err error)
+
+	// Put creates or replaces the given widget.
+	Put(ctx context.Context, widget Widget) (Widget, error)
+
+	// Update applies change to the widget with the given id and stores the
+	// result, or returns ErrNotFound. No other change to the widget can happen
+	// in between. If change returns an error nothing is stored and that error
+	// is returned.
+	Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error)
+
+	// Delete removes the widget with the given id, or returns ErrNotFound.
+	Delete(ctx context.Context, id string) (Widget, error)
+
+	// Version returns a number that changes whenever any widget is created,
+	// changed or deleted, so that clients can tell cheaply whether anything
+	// changed.
+	Version(ctx context.Context) (uint64, error)
+
+	// Ping reports whether the store is reachable.
+	Ping(ctx context.Context) error
+
+	// Reset removes every widget and restarts the insertion sequence.
+	Reset(ctx context.Context) error
+}
+
+// Purger is implemented by stores that cache widgets and can evict a single
+// cached widget without deleting it.
+type Purger interface {
+	Purge(id string)
+}
+
+// Historian is implemented by stores that keep earlier revisions of widgets.
+type Historian interface {
+	// History returns the kept revisions of the widget with the given id,
+	// oldest first, or ErrNotFound. Stores that wrap another store return
+	// ErrNoHistory when the wrapped store keeps none.
+	History(ctx context.Context, id string) ([]Widget, error)
+}
+
+// Renamer is implemented by stores that can move a widget to a new id.
+type Renamer interface {
+	// Rename moves the widget with the given id to newID in one step and
+	// stores it as a new revision, keeping its creation time, its place in
+	// the insertion sequence and its history. It returns ErrNotFound when
+	// there is no such widget and ErrConflict when newID is taken. Stores
+	// that wrap another store return ErrNoRename when the wrapped store
+	// cannot rename.
+	Rename(ctx context.Context, id string, newID string) (Widget, error)
+}
+
+// maxHistory is how many revisions of each widget a memoryStore keeps.
+const maxHistory = 50
+
+// memoryStore is a Store that keeps widgets, and their recent revisions, in
+// memory.
+type memoryStore struct {
+	mu      sync.RWMutex
+	now     func() Time
+	seq     uint64
+	version uint64
+	widgets map[string]Widget
+	history map[string][]Widget
+	tokens  map[string]string // client token key to widget id
+}
+
+// newMemoryStore will construct a new, empty memoryStore.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		now:     now,
+		widgets: make(map[string]Widget, 0),
+		history: make(map[string][]Widget, 0),
+		tokens:  make(map[string]string, 0),
+	}
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Widget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	widgets := make([]Widget, 0, len(s.widgets))
+	for _, widget := range s.widgets {
+		widgets = append(widgets, widget)
+	}
+	sort.Slice(widgets, func(i, j int) bool {
+		return widgets[i].seq < widgets[j].seq
+	})
+	return widgets, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Widget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	widget, ok := s.widgets[id]
+	if !ok {
+		return widget, ErrNotFound
+	}
+	return widget, nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(widget.ClientToken) > 0 {
+		if id, ok := s.tokens[tokenKey(widget)]; ok {
+			return s.widgets[id], false, nil
+		}
+	}
+	if _, ok := s.widgets[widget.ID]; ok {
+		return Widget{}, false, ErrConflict
+	}
+	return s.put(widget), true, nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(widget), nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	widget, ok := s.widgets[id]
+	if !ok {
+		return widget, ErrNotFound
+	}
+	widget, err := change(widget)
+	if err != nil {
+		return Widget{}, err
+	}
+	widget.ID = id
+	return s.put(widget), nil
+}
+
+func (s *memoryStore) put(widget Widget) Widget {
+	widget.UpdatedAt = s.now()
+	if existing, ok := s.widgets[widget.ID]; ok {
+		widget.seq = existing.seq
+		widget.CreatedAt = existing.CreatedAt
+		widget.Revision = existing.Revision + 1
+	} else {
+		s.seq++
+		widget.seq = s.seq
+		widget.CreatedAt = widget.UpdatedAt
+		widget.Revision = 1
+	}
+	s.widgets[widget.ID] = widget
+	history := append(s.history[widget.ID], widget)
+	if len(history) > maxHistory {
+		history = append([]Widget(nil), history[len(history)-maxHistory:]...)
+	}
+	s.history[widget.ID] = history
+	s.version++
+	if len(widget.ClientToken) > 0 {
+		s.tokens[tokenKey(widget)] = widget.ID
+	}
+	return widget
+}
+
+// load adds previously stored widgets, in insertion order, keeping their
+// timestamps and revisions.
+func (s *memoryStore) load(widgets []Widget) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, widget := range widgets {
+		s.seq++
+		widget.seq = s.seq
+		s.widgets[widget.ID] = widget
+		s.history[widget.ID] = []Widget{widget}
+		if len(widget.ClientToken) > 0 {
+			s.tokens[tokenKey(widget)] = widget.ID
+		}
+	}
+	s.version++
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	widget, ok := s.widgets[id]
+	if !ok {
+		return widget, ErrNotFound
+	}
+	delete(s.widgets, id)
+	delete(s.history, id)
+	delete(s.tokens, tokenKey(widget))
+	s.version++
+	return widget, nil
+}
+
+func (s *memoryStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	widget, ok := s.widgets[id]
+	if !ok {
+		return widget, ErrNotFound
+	}
+	if _, ok := s.widgets[newID]; ok {
+		return Widget{}, ErrConflict
+	}
+
+	// The widget is moved as it is, so that put stores the renamed copy as
+	// its next revision.
+	delete(s.widgets, id)
+	delete(s.tokens, tokenKey(widget))
+	s.widgets[newID] = widget
+	s.history[newID] = s.history[id]
+	delete(s.history, id)
+
+	widget.ID = newID
+	return s.put(widget), nil
+}
+
+func (s *memoryStore) History(ctx context.Context, id string) ([]Widget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	history, ok := s.history[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]Widget(nil), history...), nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq = 0
+	s.version++
+	s.widgets = make(map[string]Widget, 0)
+	s.history = make(map[string][]Widget, 0)
+	s.tokens = make(map[string]string, 0)
+	return nil
+}
+
+func (s *memoryStore) Version(ctx context.Context) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.version, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// tokenKey scopes a widget's client token to its owner so that users cannot
+// see each other's widgets by reusing a token.
+func tokenKey(widget Widget) string {
+	return widget.OwnerID + "\x00" + widget.ClientToken
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "net/http"
+
+// widgetSummary aggregates the widgets a requester can access.
+type widgetSummary struct {
+	Total int `json:"total"`
+
+	ByStatus map[string]int `json:"by_status"`
+
+	// ByTag counts the widgets carrying each tag, so a widget with several
+	// tags is counted under each of them.
+	ByTag map[string]int `json:"by_tag"`
+
+	// Quantity is nil when there are no widgets.
+	Quantity *quantitySummary `json:"quantity"`
+}
+
+type quantitySummary struct {
+	Min int     `json:"min"`
+	Max int     `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// summarize aggregates widgets in a single pass.
+func summarize(widgets []Widget, q requester) widgetSummary {
+	s := widgetSummary{ByStatus: make(map[string]int), ByTag: make(map[string]int)}
+
+	var sum int64
+	for _, widget := range widgets {
+		if !q.canAccess(widget) {
+			continue
+		}
+		s.Total++
+		s.ByStatus[widget.Status]++
+		for _, tag := range widget.Tags {
+			s.ByTag[tag]++
+		}
+
+		sum += int64(widget.Quantity)
+		if s.Quantity == nil {
+			s.Quantity = &quantitySummary{Min: widget.Quantity, Max: widget.Quantity}
+			continue
+		}
+		if widget.Quantity < s.Quantity.Min {
+			s.Quantity.Min = widget.Quantity
+		}
+		if widget.Quantity > s.Quantity.Max {
+			s.Quantity.Max = widget.Quantity
+		}
+	}
+	if s.Quantity != nil {
+		s.Quantity.Avg = float64(sum) / float64(s.Total)
+	}
+	return s
+}
+
+// stats writes aggregate counts and quantities over the widgets the requester
+// can access, for dashboards that have no use for the widgets themselves.
+func (h WidgetHandler) stats(w http.ResponseWriter, r *http.Request) {
+	widgets, err := h.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	setSurrogateKeys(w, surrogateCollectionKey)
+	if err := writeResponse(w, r, http.StatusOK, summarize(widgets, requesterFor(r, h.cfg.AdminToken))); err != nil {
+		writeInternalError(w, r, err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestStatsAggregateTheAccessibleWidgets(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	createWidget(t, h, `{"name":"a","quantity":2,"tags":["metal","blue"]}`)
+	createWidget(t, h, `{"name":"b","quantity":7,"tags":["metal"],"status":"active"}`)
+	createWidget(t, h, `{"name":"c","quantity":0,"status":"retired"}`)
+	do(h, http.MethodPost, "/widgets/", `{"name":"d","quantity":100,"tags":["hidden"]}`, "X-User", "alice")
+
+	w := do(h, http.MethodGet, "/widgets/stats", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var got widgetSummary
+	decodeBody(t, w, &got)
+	want := widgetSummary{
+		Total:    3,
+		ByStatus: map[string]int{statusDraft: 1, statusActive: 1, statusRetired: 1},
+		ByTag:    map[string]int{"metal": 2, "blue": 1},
+		Quantity: &quantitySummary{Min: 0, Max: 7, Avg: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		g, _ := json.Marshal(got)
+		e, _ := json.Marshal(want)
+		t.Errorf("got %s, want %s", g, e)
+	}
+
+	var alice widgetSummary
+	decodeBody(t, do(h, http.MethodGet, "/widgets/stats", "", "X-User", "alice"), &alice)
+	if alice.Total != 1 || alice.ByTag["hidden"] != 1 || alice.Quantity.Avg != 100 {
+		t.Errorf("got %+v for alice, want only her widget", alice)
+	}
+}
+
+func TestStatsWithoutWidgets(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	var got widgetSummary
+	decodeBody(t, do(h, http.MethodGet, "/widgets/stats", ""), &got)
+	if got.Total != 0 || got.Quantity != nil || len(got.ByStatus) != 0 || len(got.ByTag) != 0 {
+		t.Errorf("got %+v, want an empty summary", got)
+	}
+}
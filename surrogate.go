@@ -0,0 +1,40 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Surrogate keys let a CDN purge cached responses by what they contain rather
+// than by URL. Responses carry these keys in the Surrogate-Key header:
+//
+//	widgets          every list, batch get and export response
+//	widget/{id}      a widget read by id, and each widget in a batch get
+//
+// When a widget is created, purge widgets. When a widget is updated or
+// deleted, purge both widgets and widget/{id}.
+const surrogateCollectionKey = "widgets"
+
+// widgetSurrogateKey returns the surrogate key of a single widget.
+func widgetSurrogateKey(id string) string {
+	return "widget/" + id
+}
+
+// setSurrogateKeys sets the Surrogate-Key header to the given keys.
+func setSurrogateKeys(w http.ResponseWriter, keys ...string) {
+	w.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSurrogateKeys(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	a := createWidget(t, h, `{"name":"a"}`)
+	b := createWidget(t, h, `{"name":"b"}`)
+
+	for _, tt := range []struct {
+		target string
+		want   string
+	}{
+		{"/widgets/" + a.ID, "widget/" + a.ID},
+		{"/widgets/", "widgets"},
+		{"/widgets/?status=draft", "widgets"},
+		{"/widgets/?ids=" + a.ID + ",nope," + b.ID, "widgets widget/" + a.ID + " widget/" + b.ID},
+		{"/widgets/export", "widgets"},
+	} {
+		w := do(h, http.MethodGet, tt.target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", tt.target, w.Code)
+		}
+		if got := w.Header().Get("Surrogate-Key"); got != tt.want {
+			t.Errorf("%s: got Surrogate-Key %q, want %q", tt.target, got, tt.want)
+		}
+	}
+
+	if got := do(h, http.MethodGet, "/widgets/nope", "").Header().Get("Surrogate-Key"); len(got) > 0 {
+		t.Errorf("a missing widget got Surrogate-Key %q", got)
+	}
+}
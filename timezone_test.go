@@ -0,0 +1,61 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampsUseTheConfiguredZone(t *testing.T) {
+	store := newMemoryStore()
+	store.now = func() Time { return Time{time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)} }
+	api := newTestHandler(t, store, map[string]string{"API_TIMEZONE": "America/New_York"})
+	h := withOutput(api, newOutputOptions(api.cfg))
+	widget := createWidget(t, h, `{"name":"a"}`)
+
+	body := do(h, http.MethodGet, "/widgets/"+widget.ID, "").Body.String()
+	if !strings.Contains(body, `"created_at":"2020-06-01T08:00:00-04:00"`) {
+		t.Errorf("got %s, want timestamps at the New York offset", body)
+	}
+
+	index := do(withOutput(http.HandlerFunc(root), newOutputOptions(api.cfg)), http.MethodGet, "/", "").Body.String()
+	if !strings.Contains(index, " -0400 EDT") && !strings.Contains(index, " -0500 EST") {
+		t.Errorf("got index %s, want its timestamp in New York", index)
+	}
+}
+
+func TestTimeMarshalsInUTC(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	b, err := json.Marshal(Time{time.Date(2020, 1, 1, 9, 0, 0, 0, tokyo)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `"2020-01-01T00:00:00Z"` {
+		t.Errorf("got %s", b)
+	}
+}
+
+func TestTimeZoneIsValidatedAtStartup(t *testing.T) {
+	if _, err := loadConfig(nil, lookupIn(map[string]string{"API_TIMEZONE": "Mars/Olympus_Mons"})); err == nil {
+		t.Error("got no error for an unknown zone")
+	}
+}
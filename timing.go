@@ -0,0 +1,177 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type timingsKey struct{}
+
+// requestTimings accumulates how long a request spent in the store.
+type requestTimings struct {
+	mu    sync.Mutex
+	store time.Duration
+}
+
+// recordStoreTime adds the time since start to the timings in ctx, if any.
+func recordStoreTime(ctx context.Context, start time.Time) {
+	t, ok := ctx.Value(timingsKey{}).(*requestTimings)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	t.store += time.Since(start)
+	t.mu.Unlock()
+}
+
+// serverTiming adds a Server-Timing header to responses from next, giving
+// the time spent in store operations and the total as store and total in
+// milliseconds. Headers are sent before a streamed body, so for a streamed
+// response both cover only the time until the first write.
+func serverTiming(next http.Handler, enabled bool) http.Handler {
+	if !enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timings := &requestTimings{}
+		ctx := context.WithValue(r.Context(), timingsKey{}, timings)
+		next.ServeHTTP(&serverTimingWriter{ResponseWriter: w, start: time.Now(), timings: timings}, r.WithContext(ctx))
+	})
+}
+
+type serverTimingWriter struct {
+	http.ResponseWriter
+	start   time.Time
+	timings *requestTimings
+	wrote   bool
+}
+
+func (s *serverTimingWriter) WriteHeader(status int) {
+	if !s.wrote {
+		s.timings.mu.Lock()
+		store := s.timings.store
+		s.timings.mu.Unlock()
+		s.Header().Set("Server-Timing", fmt.Sprintf("store;dur=%.3f, total;dur=%.3f", milliseconds(store), milliseconds(time.Since(s.start))))
+	}
+	s.wrote = true
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *serverTimingWriter) Write(b []byte) (int, error) {
+	if !s.wrote {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses pass through the writer.
+func (s *serverTimingWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timingStore is a Store decorator that adds the duration of every store
+// operation to the request's Server-Timing.
+type timingStore struct {
+	Store
+}
+
+// newTimingStore will construct a new timingStore around the given Store.
+func newTimingStore(store Store) timingStore {
+	return timingStore{Store: store}
+}
+
+func (s timingStore) List(ctx context.Context) ([]Widget, error) {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.List(ctx)
+}
+
+func (s timingStore) Get(ctx context.Context, id string) (Widget, error) {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Get(ctx, id)
+}
+
+func (s timingStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Create(ctx, widget)
+}
+
+func (s timingStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Put(ctx, widget)
+}
+
+func (s timingStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Update(ctx, id, change)
+}
+
+func (s timingStore) Delete(ctx context.Context, id string) (Widget, error) {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Delete(ctx, id)
+}
+
+func (s timingStore) Reset(ctx context.Context) error {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Reset(ctx)
+}
+
+func (s timingStore) Version(ctx context.Context) (uint64, error) {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Version(ctx)
+}
+
+func (s timingStore) Ping(ctx context.Context) error {
+	defer recordStoreTime(ctx, time.Now())
+	return s.Store.Ping(ctx)
+}
+
+// Rename passes through to the wrapped store when it can rename.
+func (s timingStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	renamer, ok := s.Store.(Renamer)
+	if !ok {
+		return Widget{}, ErrNoRename
+	}
+	defer recordStoreTime(ctx, time.Now())
+	return renamer.Rename(ctx, id, newID)
+}
+
+// History passes through to the wrapped store when it keeps history.
+func (s timingStore) History(ctx context.Context, id string) ([]Widget, error) {
+	historian, ok := s.Store.(Historian)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	defer recordStoreTime(ctx, time.Now())
+	return historian.History(ctx, id)
+}
+
+// Purge passes through to the wrapped store when it can purge.
+func (s timingStore) Purge(id string) {
+	if purger, ok := s.Store.(Purger); ok {
+		purger.Purge(id)
+	}
+}
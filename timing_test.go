@@ -0,0 +1,70 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// slowStore is a Store whose gets take at least delay.
+type slowStore struct {
+	Store
+	delay time.Duration
+}
+
+func (s slowStore) Get(ctx context.Context, id string) (Widget, error) {
+	time.Sleep(s.delay)
+	return s.Store.Get(ctx, id)
+}
+
+var serverTimingPattern = regexp.MustCompile(`^store;dur=(\d+\.\d{3}), total;dur=(\d+\.\d{3})$`)
+
+func TestServerTimingReportsStoreAndTotalTimes(t *testing.T) {
+	api := newTestHandler(t, newTimingStore(slowStore{Store: newMemoryStore(), delay: 5 * time.Millisecond}), nil)
+	widget := createWidget(t, api, `{"name":"a"}`)
+	h := serverTiming(api, true)
+
+	w := do(h, http.MethodGet, "/widgets/"+widget.ID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	m := serverTimingPattern.FindStringSubmatch(w.Header().Get("Server-Timing"))
+	if m == nil {
+		t.Fatalf("got Server-Timing %q", w.Header().Get("Server-Timing"))
+	}
+	store, _ := strconv.ParseFloat(m[1], 64)
+	total, _ := strconv.ParseFloat(m[2], 64)
+	if store < 5 || total < store {
+		t.Errorf("got store %.3fms and total %.3fms, want at least 5ms in the store", store, total)
+	}
+
+	// Responses written without an explicit status get the header too, and
+	// requests that never reach the store spend no time there.
+	w = do(serverTiming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), true), http.MethodGet, "/", "")
+	if m := serverTimingPattern.FindStringSubmatch(w.Header().Get("Server-Timing")); m == nil || m[1] != "0.000" {
+		t.Errorf("got Server-Timing %q without a store", w.Header().Get("Server-Timing"))
+	}
+
+	if got := do(serverTiming(api, false), http.MethodGet, "/widgets/"+widget.ID, "").Header().Get("Server-Timing"); len(got) > 0 {
+		t.Errorf("got Server-Timing %q with timing off", got)
+	}
+}
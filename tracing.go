@@ -0,0 +1,219 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans this service records.
+const tracerName = "github.com/jmckind/go-api-demo"
+
+// newOTLPTracerProvider will construct a TracerProvider that exports spans in
+// batches to the OpenTelemetry collector at endpoint, such as
+// http://localhost:4318, over OTLP/HTTP. Spans are sampled as their parent
+// was, so a caller's traceparent decides whether a trace is recorded.
+func newOTLPTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	url := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(url))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("go-api-demo"),
+			semconv.ServiceVersion(version),
+		)),
+	), nil
+}
+
+// stopTracing exports the spans still buffered by provider, giving up after
+// timeout.
+func stopTracing(provider *sdktrace.TracerProvider, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := provider.Shutdown(ctx); err != nil {
+		log.Printf("unable to export remaining spans %s", err)
+	}
+}
+
+// traceRequests starts a server span for every request handled by next,
+// continuing the caller's trace when a valid traceparent header is present.
+// A nil Tracer records nothing.
+func traceRequests(next http.Handler, tracer trace.Tracer) http.Handler {
+	if tracer == nil {
+		return next
+	}
+
+	propagator := propagation.TraceContext{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.RequestURI()),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// tracingStore is a Store decorator that records a span around every store
+// operation.
+type tracingStore struct {
+	Store
+
+	tracer trace.Tracer
+}
+
+// newTracingStore will construct a new tracingStore around the given Store.
+func newTracingStore(store Store, tracer trace.Tracer) tracingStore {
+	return tracingStore{Store: store, tracer: tracer}
+}
+
+// start starts a span for the named store operation with the given
+// attributes.
+func (s tracingStore) start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindInternal), trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if there is one, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s tracingStore) List(ctx context.Context) ([]Widget, error) {
+	ctx, span := s.start(ctx, "store.List")
+	widgets, err := s.Store.List(ctx)
+	endSpan(span, err)
+	return widgets, err
+}
+
+func (s tracingStore) Get(ctx context.Context, id string) (Widget, error) {
+	ctx, span := s.start(ctx, "store.Get", attribute.String("widget.id", id))
+	widget, err := s.Store.Get(ctx, id)
+	endSpan(span, err)
+	return widget, err
+}
+
+func (s tracingStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	ctx, span := s.start(ctx, "store.Create", attribute.String("widget.id", widget.ID))
+	stored, created, err := s.Store.Create(ctx, widget)
+	endSpan(span, err)
+	return stored, created, err
+}
+
+func (s tracingStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	ctx, span := s.start(ctx, "store.Put", attribute.String("widget.id", widget.ID))
+	stored, err := s.Store.Put(ctx, widget)
+	endSpan(span, err)
+	return stored, err
+}
+
+func (s tracingStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	ctx, span := s.start(ctx, "store.Update", attribute.String("widget.id", id))
+	stored, err := s.Store.Update(ctx, id, change)
+	endSpan(span, err)
+	return stored, err
+}
+
+func (s tracingStore) Delete(ctx context.Context, id string) (Widget, error) {
+	ctx, span := s.start(ctx, "store.Delete", attribute.String("widget.id", id))
+	widget, err := s.Store.Delete(ctx, id)
+	endSpan(span, err)
+	return widget, err
+}
+
+func (s tracingStore) Reset(ctx context.Context) error {
+	ctx, span := s.start(ctx, "store.Reset")
+	err := s.Store.Reset(ctx)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracingStore) Version(ctx context.Context) (uint64, error) {
+	ctx, span := s.start(ctx, "store.Version")
+	version, err := s.Store.Version(ctx)
+	endSpan(span, err)
+	return version, err
+}
+
+func (s tracingStore) Ping(ctx context.Context) error {
+	ctx, span := s.start(ctx, "store.Ping")
+	err := s.Store.Ping(ctx)
+	endSpan(span, err)
+	return err
+}
+
+// Rename passes through to the wrapped store when it can rename.
+func (s tracingStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	renamer, ok := s.Store.(Renamer)
+	if !ok {
+		return Widget{}, ErrNoRename
+	}
+	ctx, span := s.start(ctx, "store.Rename", attribute.String("widget.id", id), attribute.String("widget.new_id", newID))
+	widget, err := renamer.Rename(ctx, id, newID)
+	endSpan(span, err)
+	return widget, err
+}
+
+// History passes through to the wrapped store when it keeps history.
+func (s tracingStore) History(ctx context.Context, id string) ([]Widget, error) {
+	historian, ok := s.Store.(Historian)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	ctx, span := s.start(ctx, "store.History", attribute.String("widget.id", id))
+	history, err := historian.History(ctx, id)
+	endSpan(span, err)
+	return history, err
+}
+
+// Purge passes through to the wrapped store when it can purge.
+func (s tracingStore) Purge(id string) {
+	if purger, ok := s.Store.(Purger); ok {
+		purger.Purge(id)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTestTracer returns a Tracer whose spans are exported, as soon as they
+// end, to the returned in-memory exporter.
+func newTestTracer(t *testing.T) (trace.Tracer, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return provider.Tracer(tracerName), exporter
+}
+
+// namedSpans returns the exported spans with the given name.
+func namedSpans(exporter *tracetest.InMemoryExporter, name string) []tracetest.SpanStub {
+	var spans []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// spanAttribute returns the value of the span's attribute with the given key.
+func spanAttribute(span tracetest.SpanStub, key string) string {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracingRecordsRequestAndStoreSpans(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	h := newTestHandler(t, newTracingStore(newMemoryStore(), tracer), nil)
+	widget := createWidget(t, h, `{"name":"a"}`)
+	traced := traceRequests(h, tracer)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	do(traced, http.MethodGet, "/widgets/"+widget.ID, "", "traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	servers := namedSpans(exporter, "HTTP GET")
+	if len(servers) != 1 {
+		t.Fatalf("got %d request spans, want 1", len(servers))
+	}
+	server := servers[0]
+	if got := server.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("got trace %s, want the caller's trace", got)
+	}
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" || !server.Parent.IsRemote() {
+		t.Errorf("got parent %s, want the caller's span", got)
+	}
+	if server.SpanKind != trace.SpanKindServer || spanAttribute(server, "http.status_code") != "200" || server.EndTime.Before(server.StartTime) {
+		t.Errorf("got request span %+v", server)
+	}
+
+	var get *tracetest.SpanStub
+	for _, span := range namedSpans(exporter, "store.Get") {
+		if span.SpanContext.TraceID() == server.SpanContext.TraceID() {
+			span := span
+			get = &span
+		}
+	}
+	if get == nil {
+		t.Fatal("got no store span in the request's trace")
+	}
+	if get.Parent.SpanID() != server.SpanContext.SpanID() || spanAttribute(*get, "widget.id") != widget.ID {
+		t.Errorf("got store span %+v, want a child of the request span", get)
+	}
+}
+
+func TestTracingStartsATraceWithoutTraceparent(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	traced := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}), tracer)
+
+	do(traced, http.MethodGet, "/", "", "traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	spans := namedSpans(exporter, "HTTP GET")
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if !spans[0].SpanContext.TraceID().IsValid() || spans[0].Parent.IsValid() || spans[0].Status.Code != codes.Error {
+		t.Errorf("got %+v, want a failed root span in a new trace", spans[0])
+	}
+}
+
+func TestTracingSkipsUnsampledTraces(t *testing.T) {
+	tracer, exporter := newTestTracer(t)
+	h := newTestHandler(t, newTracingStore(newMemoryStore(), tracer), nil)
+	traced := traceRequests(h, tracer)
+
+	do(traced, http.MethodGet, "/widgets/", "", "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("exported %d spans for a trace the caller did not sample", len(spans))
+	}
+}
+
+func TestTracingContinuesOnlyValidTraceparents(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	for header, ok := range map[string]bool{
+		"00-" + traceID + "-00f067aa0ba902b7-01":                true,
+		"01-" + traceID + "-00f067aa0ba902b7-01-extra":          true,
+		"00-" + traceID + "-00f067aa0ba902b7-01-extra":          false,
+		"ff-" + traceID + "-00f067aa0ba902b7-01":                false,
+		"00-" + traceID + "-0000000000000000-01":                false,
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01": false,
+		"garbage": false,
+	} {
+		tracer, exporter := newTestTracer(t)
+		do(traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), tracer), http.MethodGet, "/", "", "traceparent", header)
+		spans := exporter.GetSpans()
+		if len(spans) != 1 {
+			t.Errorf("%q: got %d spans, want 1", header, len(spans))
+			continue
+		}
+		if got := spans[0].SpanContext.TraceID().String() == traceID; got != ok {
+			t.Errorf("%q: continued the trace %t, want %t", header, got, ok)
+		}
+	}
+}
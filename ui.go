@@ -0,0 +1,47 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// uiFiles holds the widget admin page.
+//
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// ui serves a single page for listing, creating, editing and deleting widgets
+// through the API.
+func ui(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "Method not allowed for this resource.")
+		return
+	}
+
+	page, err := uiFiles.ReadFile("ui/index.html")
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(page)
+	}
+}
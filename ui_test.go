@@ -0,0 +1,42 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUIServesTheWidgetPage(t *testing.T) {
+	h := http.HandlerFunc(ui)
+
+	w := do(h, http.MethodGet, "/ui", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q", got)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "<!DOCTYPE html>") || !strings.Contains(body, "/widgets/") {
+		t.Errorf("got body %.80q, want the widget page", body)
+	}
+
+	if w := do(h, http.MethodHead, "/ui", ""); w.Code != http.StatusOK || w.Body.Len() > 0 {
+		t.Errorf("HEAD answered %d with %d bytes", w.Code, w.Body.Len())
+	}
+	expectError(t, do(h, http.MethodPost, "/ui", ""), http.StatusMethodNotAllowed, codeMethodNotAllowed)
+}
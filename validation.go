@@ -0,0 +1,236 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxNameLen        = 100
+	defaultMaxDescriptionLen = 1000
+	defaultMaxQuantity       = 1000000
+	defaultMaxTags           = 20
+	defaultMaxTagLen         = 32
+
+	defaultMaxAttributes        = 50
+	defaultMaxAttributeNameLen  = 64
+	defaultMaxAttributeValueLen = 1024
+)
+
+// Widget lifecycle states. New widgets start as drafts, and retired widgets
+// can no longer change state.
+const (
+	statusDraft   = "draft"
+	statusActive  = "active"
+	statusRetired = "retired"
+)
+
+// statusTransitions lists the states each state may move to.
+var statusTransitions = map[string][]string{
+	statusDraft:   {statusActive, statusRetired},
+	statusActive:  {statusRetired},
+	statusRetired: {},
+}
+
+// validStatus reports whether status is a known state.
+func validStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// checkTransition returns an error describing why a widget cannot move from
+// one state to another. Staying in the same state is always allowed.
+func checkTransition(from, to string) error {
+	if from == to {
+		return nil
+	}
+	for _, allowed := range statusTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return statusError{
+		status:  http.StatusConflict,
+		code:    codeInvalidTransition,
+		message: fmt.Sprintf("The status cannot change from %s to %s.", from, to),
+	}
+}
+
+// Limits bounds the values a Widget may hold.
+type Limits struct {
+	// MaxNameLen is the most characters allowed in a name.
+	MaxNameLen int
+
+	// MaxDescriptionLen is the most characters allowed in a description.
+	MaxDescriptionLen int
+
+	// MaxQuantity is the largest quantity allowed.
+	MaxQuantity int
+
+	// MaxTags is the most tags a widget may have, and MaxTagLen the most
+	// characters allowed in each.
+	MaxTags   int
+	MaxTagLen int
+
+	// Fields defines the custom attributes a widget may have.
+	Fields []FieldDefinition
+
+	// MaxAttributes is the most attributes a widget may have, whatever the
+	// field definitions allow. MaxAttributeNameLen and MaxAttributeValueLen
+	// bound the characters in each name and value; values other than
+	// strings are measured as JSON.
+	MaxAttributes        int
+	MaxAttributeNameLen  int
+	MaxAttributeValueLen int
+}
+
+// ValidationError lists the reasons a widget is not valid.
+type ValidationError struct {
+	Violations []string
+}
+
+func (e ValidationError) Error() string {
+	return strings.Join(e.Violations, " ")
+}
+
+// Validate checks the widget against the given limits, returning a
+// ValidationError describing every violation found.
+//
+// Text fields must be valid UTF-8 without control characters; descriptions
+// may also contain tabs and line breaks. Offending values are rejected rather
+// than stripped so that clients never have their input silently changed.
+func (w Widget) Validate(limits Limits) error {
+	var violations []string
+
+	if n := utf8.RuneCountInString(w.Name); n > limits.MaxNameLen {
+		violations = append(violations, fmt.Sprintf("The name must be at most %d characters.", limits.MaxNameLen))
+	}
+	if n := utf8.RuneCountInString(w.Description); n > limits.MaxDescriptionLen {
+		violations = append(violations, fmt.Sprintf("The description must be at most %d characters.", limits.MaxDescriptionLen))
+	}
+
+	if w.Quantity < 0 || w.Quantity > limits.MaxQuantity {
+		violations = append(violations, fmt.Sprintf("The quantity must be between 0 and %d.", limits.MaxQuantity))
+	}
+
+	if !validStatus(w.Status) {
+		violations = append(violations, "The status must be draft, active or retired.")
+	}
+
+	if len(w.Tags) > limits.MaxTags {
+		violations = append(violations, fmt.Sprintf("A widget may have at most %d tags.", limits.MaxTags))
+	}
+	for _, tag := range w.Tags {
+		if utf8.RuneCountInString(tag) > limits.MaxTagLen {
+			violations = append(violations, fmt.Sprintf("Each tag must be at most %d characters.", limits.MaxTagLen))
+			break
+		}
+	}
+
+	// Attributes past the size limits are not checked against their
+	// definitions, so oversized names are never echoed back.
+	if v := checkAttributeLimits(w.Attributes, limits); len(v) > 0 {
+		violations = append(violations, v...)
+	} else {
+		violations = append(violations, checkAttributes(w.Attributes, limits.Fields)...)
+	}
+
+	violations = append(violations, checkText("name", w.Name, false)...)
+	violations = append(violations, checkText("description", w.Description, true)...)
+	for _, tag := range w.Tags {
+		if v := checkText("tags", tag, false); len(v) > 0 {
+			violations = append(violations, v...)
+			break
+		}
+	}
+
+	if len(violations) > 0 {
+		return ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// warnFraction is how close to a length limit a value may come before it is
+// warned about.
+const warnFraction = 0.9
+
+// Warnings returns concerns about a valid widget that do not stop it being
+// stored, such as a name close to its length limit.
+func (w Widget) Warnings(limits Limits) []string {
+	var warnings []string
+	if n := utf8.RuneCountInString(w.Name); n < limits.MaxNameLen && float64(n) >= warnFraction*float64(limits.MaxNameLen) {
+		warnings = append(warnings, fmt.Sprintf("The name is close to the limit of %d characters.", limits.MaxNameLen))
+	}
+	if n := utf8.RuneCountInString(w.Description); n < limits.MaxDescriptionLen && float64(n) >= warnFraction*float64(limits.MaxDescriptionLen) {
+		warnings = append(warnings, fmt.Sprintf("The description is close to the limit of %d characters.", limits.MaxDescriptionLen))
+	}
+	return warnings
+}
+
+// normalizeTags trims and lowercases the widget's tags, dropping empty and
+// repeated ones.
+func (w Widget) normalizeTags() Widget {
+	if w.Tags == nil {
+		return w
+	}
+	tags := make([]string, 0, len(w.Tags))
+	seen := make(map[string]bool, len(w.Tags))
+	for _, tag := range w.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) == 0 || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	w.Tags = tags
+	return w
+}
+
+// ellipsis marks the end of a truncated description.
+const ellipsis = "…"
+
+// truncateDescription shortens the description to at most max characters,
+// ending it with an ellipsis, and reports whether it had to.
+func (w Widget) truncateDescription(max int) (Widget, bool) {
+	if utf8.RuneCountInString(w.Description) <= max {
+		return w, false
+	}
+	runes := []rune(w.Description)
+	w.Description = string(runes[:max-1]) + ellipsis
+	return w, true
+}
+
+// checkText reports whether value is valid UTF-8 free of control characters.
+// Tabs and line breaks are allowed when multiline is set.
+func checkText(field string, value string, multiline bool) []string {
+	if !utf8.ValidString(value) {
+		return []string{fmt.Sprintf("The %s must be valid UTF-8.", field)}
+	}
+	for _, r := range value {
+		if multiline && (r == '\t' || r == '\n' || r == '\r') {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return []string{fmt.Sprintf("The %s must not contain control characters.", field)}
+		}
+	}
+	return nil
+}
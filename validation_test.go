@@ -0,0 +1,264 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNameAndDescriptionLengthLimits(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_NAME_LEN": "5", "API_MAX_DESC_LEN": "8"})
+
+	// Limits count characters, not bytes.
+	createWidget(t, h, `{"name":"ééééé","description":"12345678"}`)
+
+	e := expectError(t, do(h, http.MethodPost, "/widgets/", `{"name":"éééééé"}`), http.StatusUnprocessableEntity, codeValidationFailed)
+	if !strings.Contains(e.Error, "The name must be at most 5 characters.") {
+		t.Errorf("got %q, want the name limit", e.Error)
+	}
+	e = expectError(t, do(h, http.MethodPost, "/widgets/", `{"name":"a","description":"123456789"}`), http.StatusUnprocessableEntity, codeValidationFailed)
+	if !strings.Contains(e.Error, "The description must be at most 8 characters.") {
+		t.Errorf("got %q, want the description limit", e.Error)
+	}
+}
+
+func TestLengthLimitsAreValidatedAtStartup(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"API_MAX_NAME_LEN": "0"},
+		{"API_MAX_NAME_LEN": "ten"},
+		{"API_MAX_DESC_LEN": "-1"},
+	} {
+		if _, err := loadConfig(nil, lookupIn(env)); err == nil {
+			t.Errorf("%v: got no error", env)
+		}
+	}
+
+	cfg := testConfig(t, nil)
+	if cfg.Limits.MaxNameLen != defaultMaxNameLen || cfg.Limits.MaxDescriptionLen != defaultMaxDescriptionLen {
+		t.Errorf("got limits %+v, want the defaults", cfg.Limits)
+	}
+}
+
+func TestTextFieldsRejectControlCharactersAndInvalidUTF8(t *testing.T) {
+	limits := testConfig(t, nil).Limits
+	for _, tc := range []struct {
+		widget Widget
+		want   string
+	}{
+		{Widget{Name: "a\x00b", Status: statusDraft}, "The name must not contain control characters."},
+		{Widget{Name: "a\x1bb", Status: statusDraft}, "The name must not contain control characters."},
+		{Widget{Name: "a\tb", Status: statusDraft}, "The name must not contain control characters."},
+		{Widget{Name: "a\xffb", Status: statusDraft}, "The name must be valid UTF-8."},
+		{Widget{Name: "a", Description: "x\x7fy", Status: statusDraft}, "The description must not contain control characters."},
+		{Widget{Name: "a", Description: "\xc3", Status: statusDraft}, "The description must be valid UTF-8."},
+		{Widget{Name: "a", Tags: []string{"ok", "b\x00d"}, Status: statusDraft}, "The tags must not contain control characters."},
+	} {
+		err := tc.widget.Validate(limits)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %v, want %q", tc.widget.Name+tc.widget.Description, err, tc.want)
+		}
+	}
+
+	// Descriptions may span lines.
+	if err := (Widget{Name: "a", Description: "one\n\ttwo\r\n", Status: statusDraft}).Validate(limits); err != nil {
+		t.Errorf("got %v for a multiline description", err)
+	}
+}
+
+func TestCreateRejectsUnsafeText(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	expectError(t, do(h, http.MethodPost, "/widgets/", `{"name":"a\u0000b"}`), http.StatusUnprocessableEntity, codeValidationFailed)
+	expectError(t, do(h, http.MethodPost, "/widgets/", "{\"name\":\"a\xffb\"}"), http.StatusUnprocessableEntity, codeValidationFailed)
+}
+
+func TestQuantityBounds(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_QUANTITY": "10"})
+	createWidget(t, h, `{"name":"a","quantity":0}`)
+	widget := createWidget(t, h, `{"name":"a","quantity":10}`)
+
+	for _, body := range []string{`{"name":"a","quantity":-1}`, `{"name":"a","quantity":11}`} {
+		e := expectError(t, do(h, http.MethodPost, "/widgets/", body), http.StatusUnprocessableEntity, codeValidationFailed)
+		if !strings.Contains(e.Error, "The quantity must be between 0 and 10.") {
+			t.Errorf("%s: got %q", body, e.Error)
+		}
+		expectError(t, do(h, http.MethodPut, "/widgets/"+widget.ID, body), http.StatusUnprocessableEntity, codeValidationFailed)
+	}
+
+	var resp bulkResponse
+	decodeBody(t, do(h, http.MethodPatch, "/widgets/", `[{"id":"`+widget.ID+`","changes":{"quantity":11}},{"id":"`+widget.ID+`","changes":{"quantity":4}}]`), &resp)
+	if resp.Results[0].Code != codeValidationFailed || !resp.Results[1].Success {
+		t.Errorf("got patch results %+v, want only the quantity within the bounds applied", resp.Results)
+	}
+}
+
+func TestLongDescriptionsAreRejectedOrTruncated(t *testing.T) {
+	long := `{"name":"a","description":"abcdefghij"}`
+
+	reject := newTestHandler(t, nil, map[string]string{"API_MAX_DESC_LEN": "5"})
+	w := do(reject, http.MethodPost, "/widgets/", long)
+	expectError(t, w, http.StatusUnprocessableEntity, codeValidationFailed)
+	if got := w.Header().Get(truncatedHeader); len(got) > 0 {
+		t.Errorf("got %s %q when rejecting", truncatedHeader, got)
+	}
+
+	truncate := newTestHandler(t, nil, map[string]string{"API_MAX_DESC_LEN": "5", "API_TRUNCATE_DESCRIPTION": "true"})
+	w = do(truncate, http.MethodPost, "/widgets/", long)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create answered %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(truncatedHeader); got != "description" {
+		t.Errorf("got %s %q, want description", truncatedHeader, got)
+	}
+	var resp struct {
+		Widget Widget `json:"widget"`
+	}
+	decodeBody(t, w, &resp)
+	if resp.Widget.Description != "abcd…" {
+		t.Errorf("got description %q, want it cut to the limit with an ellipsis", resp.Widget.Description)
+	}
+
+	// Updates are truncated the same way, and short descriptions are left
+	// alone.
+	w = do(truncate, http.MethodPut, "/widgets/"+resp.Widget.ID, long)
+	if w.Code != http.StatusOK || w.Header().Get(truncatedHeader) != "description" {
+		t.Errorf("update answered %d with %s %q", w.Code, truncatedHeader, w.Header().Get(truncatedHeader))
+	}
+	w = do(truncate, http.MethodPost, "/widgets/", `{"name":"a","description":"abcde"}`)
+	if w.Code != http.StatusCreated || len(w.Header().Get(truncatedHeader)) > 0 {
+		t.Errorf("create at the limit answered %d with %s %q", w.Code, truncatedHeader, w.Header().Get(truncatedHeader))
+	}
+}
+
+func TestStatusTransitions(t *testing.T) {
+	h := newTestHandler(t, nil, nil)
+	widget := createWidget(t, h, `{"name":"a"}`)
+	if widget.Status != statusDraft {
+		t.Fatalf("new widget has status %q, want %q", widget.Status, statusDraft)
+	}
+
+	w := do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"a","status":"active"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("activating answered %d: %s", w.Code, w.Body)
+	}
+	var active struct{ Widget Widget }
+	decodeBody(t, w, &active)
+	if active.Widget.Status != statusActive {
+		t.Errorf("activated widget has status %q, want %q", active.Widget.Status, statusActive)
+	}
+
+	expectError(t, do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"a","status":"draft"}`), http.StatusConflict, codeInvalidTransition)
+	expectError(t, do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"a","status":"gone"}`), http.StatusUnprocessableEntity, codeValidationFailed)
+	if w := do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"a","status":"retired"}`); w.Code != http.StatusOK {
+		t.Fatalf("retiring answered %d: %s", w.Code, w.Body)
+	}
+	expectError(t, do(h, http.MethodPut, "/widgets/"+widget.ID, `{"name":"a","status":"active"}`), http.StatusConflict, codeInvalidTransition)
+}
+
+func TestTagLimits(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_TAGS": "2", "API_MAX_TAG_LEN": "4"})
+
+	e := expectError(t, do(h, http.MethodPost, "/widgets/", `{"name":"a","tags":["x","y","z"]}`), http.StatusUnprocessableEntity, codeValidationFailed)
+	if !strings.Contains(e.Error, "A widget may have at most 2 tags.") {
+		t.Errorf("got %q, want the tag count limit", e.Error)
+	}
+	e = expectError(t, do(h, http.MethodPost, "/widgets/", `{"name":"a","tags":["toolong"]}`), http.StatusUnprocessableEntity, codeValidationFailed)
+	if !strings.Contains(e.Error, "Each tag must be at most 4 characters.") {
+		t.Errorf("got %q, want the tag length limit", e.Error)
+	}
+
+	// Repeated tags only count once.
+	widget := createWidget(t, h, `{"name":"a","tags":["x","X"," x ","y"]}`)
+	if got := strings.Join(widget.Tags, ","); got != "x,y" {
+		t.Errorf("got tags %s, want x,y", got)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	for _, tt := range []struct {
+		tags []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{}, []string{}},
+		{[]string{" Metal ", "metal", "", "  ", "Blue"}, []string{"metal", "blue"}},
+	} {
+		got := Widget{Tags: tt.tags}.normalizeTags().Tags
+		if (got == nil) != (tt.want == nil) || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q normalized to %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestValidateAllReportsWidgetsFailingTighterLimits(t *testing.T) {
+	store := newMemoryStore()
+	loose := newTestHandler(t, store, nil)
+	createWidget(t, loose, `{"name":"ok"}`)
+	long := createWidget(t, loose, `{"name":"toolong"}`)
+
+	h := newTestHandler(t, store, map[string]string{"API_ADMIN_TOKEN": "secret", "API_MAX_NAME_LEN": "3"})
+	expectError(t, do(h, http.MethodPost, "/widgets/validate-all", ""), http.StatusUnauthorized, codeUnauthorized)
+
+	w := do(h, http.MethodPost, "/widgets/validate-all", "", "Authorization", "Bearer secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var report struct {
+		Checked int
+		Invalid []invalidWidget
+	}
+	decodeBody(t, w, &report)
+	if report.Checked != 2 || len(report.Invalid) != 1 || report.Invalid[0].ID != long.ID {
+		t.Fatalf("got report %+v, want only widget %s invalid", report, long.ID)
+	}
+	if got := strings.Join(report.Invalid[0].Violations, " "); !strings.Contains(got, "The name must be at most 3 characters.") {
+		t.Errorf("got violations %q", got)
+	}
+	if got := widgetNames(listWidgets(t, h, "/widgets/").Widgets); got != "ok,toolong" {
+		t.Errorf("listed %s after validating, want nothing changed", got)
+	}
+}
+
+func TestBorderlineValuesWarnWithoutFailing(t *testing.T) {
+	h := newTestHandler(t, nil, map[string]string{"API_MAX_NAME_LEN": "10"})
+	const warning = "The name is close to the limit of 10 characters."
+
+	w := do(h, http.MethodPost, "/widgets/", `{"name":"123456789"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		Widget   Widget
+		Warnings []string
+	}
+	decodeBody(t, w, &created)
+	if len(created.Warnings) != 1 || created.Warnings[0] != warning {
+		t.Errorf("got warnings %q, want %q", created.Warnings, warning)
+	}
+	if got := w.Header().Get("Warning"); got != `299 - "`+warning+`"` {
+		t.Errorf("got Warning header %q", got)
+	}
+
+	w = do(h, http.MethodPut, "/widgets/"+created.Widget.ID, `{"name":"abcdefghi"}`)
+	if w.Code != http.StatusOK || len(w.Header().Get("Warning")) == 0 {
+		t.Errorf("update answered %d with Warning %q", w.Code, w.Header().Get("Warning"))
+	}
+
+	w = do(h, http.MethodPost, "/widgets/", `{"name":"short"}`)
+	if w.Code != http.StatusCreated || len(w.Header().Get("Warning")) > 0 || strings.Contains(w.Body.String(), "warnings") {
+		t.Errorf("a short name answered %d with Warning %q: %s", w.Code, w.Header().Get("Warning"), w.Body)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultWebhookWorkers   = 4
+	defaultWebhookQueueSize = 1024
+
+	webhookAttempts = 3
+	webhookBackoff  = time.Second
+
+	// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body
+	// keyed with the webhook secret, as sha256=<hex>.
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Widget lifecycle event types.
+const (
+	eventWidgetCreated = "widget.created"
+	eventWidgetUpdated = "widget.updated"
+	eventWidgetDeleted = "widget.deleted"
+	eventWidgetRenamed = "widget.renamed"
+)
+
+// webhookEvent is the body POSTed to the webhook URL. PreviousID is the id a
+// renamed widget had before.
+type webhookEvent struct {
+	Type       string `json:"type"`
+	Timestamp  Time   `json:"timestamp"`
+	Widget     Widget `json:"widget"`
+	PreviousID string `json:"previous_id,omitempty"`
+}
+
+// webhookSender POSTs events to a URL from a fixed pool of workers. Events
+// for the same widget always go to the same worker, so they are delivered in
+// order. An event that cannot be delivered after a few attempts is dropped and
+// logged. When a worker's queue is full the event is dropped too, unless block
+// is set, in which case the caller waits for room.
+type webhookSender struct {
+	url    string
+	secret []byte
+	client *http.Client
+	block  bool
+	output outputOptions
+	queues []chan webhookEvent
+}
+
+// newWebhookSender will construct a new webhookSender for url, signing with
+// secret, and start its workers. The queue size is shared between them.
+// Events are written with the given output options, like responses.
+func newWebhookSender(url string, secret string, workers int, queueSize int, block bool, output outputOptions) *webhookSender {
+	s := &webhookSender{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: 5 * time.Second},
+		block:  block,
+		output: output,
+		queues: make([]chan webhookEvent, workers),
+	}
+	size := queueSize / workers
+	if size < 1 {
+		size = 1
+	}
+	for i := range s.queues {
+		s.queues[i] = make(chan webhookEvent, size)
+		go s.run(s.queues[i])
+	}
+	return s
+}
+
+func (s *webhookSender) notify(eventType string, widget Widget) {
+	s.enqueue(webhookEvent{Type: eventType, Timestamp: now(), Widget: widget})
+}
+
+// enqueue queues event for the worker that sends the events of its widget. A
+// rename goes to the worker of the previous id, behind the events still
+// queued under it.
+func (s *webhookSender) enqueue(event webhookEvent) {
+	id := event.Widget.ID
+	if len(event.PreviousID) > 0 {
+		id = event.PreviousID
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	queue := s.queues[h.Sum32()%uint32(len(s.queues))]
+
+	if s.block {
+		queue <- event
+		return
+	}
+	select {
+	case queue <- event:
+	default:
+		log.Printf("dropping %s event for widget %s, webhook queue is full", event.Type, event.Widget.ID)
+	}
+}
+
+func (s *webhookSender) run(events <-chan webhookEvent) {
+	for event := range events {
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = s.send(event); err == nil {
+				break
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(webhookBackoff * time.Duration(attempt))
+			}
+		}
+		if err != nil {
+			log.Printf("unable to deliver %s event for widget %s %s", event.Type, event.Widget.ID, err)
+		}
+	}
+}
+
+func (s *webhookSender) send(event webhookEvent) error {
+	body, err := json.Marshal(s.output.apply(event))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(s.secret, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body keyed with secret.
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookStore is a Store decorator that sends a webhook event for every
+// widget created, updated or deleted through it.
+type webhookStore struct {
+	Store
+
+	sender *webhookSender
+}
+
+// newWebhookStore will construct a new webhookStore around the given Store.
+func newWebhookStore(store Store, sender *webhookSender) webhookStore {
+	return webhookStore{Store: store, sender: sender}
+}
+
+func (s webhookStore) Create(ctx context.Context, widget Widget) (Widget, bool, error) {
+	stored, created, err := s.Store.Create(ctx, widget)
+	if err == nil && created {
+		s.sender.notify(eventWidgetCreated, stored)
+	}
+	return stored, created, err
+}
+
+// Put sends widget.created when the widget is new, which the store reports
+// as its first revision, and widget.updated otherwise.
+func (s webhookStore) Put(ctx context.Context, widget Widget) (Widget, error) {
+	stored, err := s.Store.Put(ctx, widget)
+	if err == nil {
+		eventType := eventWidgetUpdated
+		if stored.Revision == 1 {
+			eventType = eventWidgetCreated
+		}
+		s.sender.notify(eventType, stored)
+	}
+	return stored, err
+}
+
+func (s webhookStore) Update(ctx context.Context, id string, change func(Widget) (Widget, error)) (Widget, error) {
+	stored, err := s.Store.Update(ctx, id, change)
+	if err == nil {
+		s.sender.notify(eventWidgetUpdated, stored)
+	}
+	return stored, err
+}
+
+func (s webhookStore) Delete(ctx context.Context, id string) (Widget, error) {
+	widget, err := s.Store.Delete(ctx, id)
+	if err == nil {
+		s.sender.notify(eventWidgetDeleted, widget)
+	}
+	return widget, err
+}
+
+// Rename sends a single widget.renamed event with the previous id, since the
+// widget was neither deleted nor created.
+func (s webhookStore) Rename(ctx context.Context, id string, newID string) (Widget, error) {
+	renamer, ok := s.Store.(Renamer)
+	if !ok {
+		return Widget{}, ErrNoRename
+	}
+	widget, err := renamer.Rename(ctx, id, newID)
+	if err == nil {
+		s.sender.enqueue(webhookEvent{Type: eventWidgetRenamed, Timestamp: now(), Widget: widget, PreviousID: id})
+	}
+	return widget, err
+}
+
+// History passes through to the wrapped store when it keeps history.
+func (s webhookStore) History(ctx context.Context, id string) ([]Widget, error) {
+	if historian, ok := s.Store.(Historian); ok {
+		return historian.History(ctx, id)
+	}
+	return nil, ErrNoHistory
+}
+
+// Purge passes through to the wrapped store when it can purge.
+func (s webhookStore) Purge(id string) {
+	if purger, ok := s.Store.(Purger); ok {
+		purger.Purge(id)
+	}
+}
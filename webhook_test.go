@@ -0,0 +1,312 @@
+// Copyright 2020 John McKenzie
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// capturedWebhook is a webhook request received by a test server.
+type capturedWebhook struct {
+	body      []byte
+	signature string
+}
+
+// newWebhookCapture starts a server that passes every webhook it receives
+// to the returned channel.
+func newWebhookCapture(t *testing.T) (*httptest.Server, <-chan capturedWebhook) {
+	t.Helper()
+	received := make(chan capturedWebhook, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- capturedWebhook{body: body, signature: r.Header.Get(webhookSignatureHeader)}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+// nextWebhookEvent waits for the next captured webhook and decodes it.
+func nextWebhookEvent(t *testing.T, received <-chan capturedWebhook) (webhookEvent, capturedWebhook) {
+	t.Helper()
+	select {
+	case c := <-received:
+		var event webhookEvent
+		if err := json.Unmarshal(c.body, &event); err != nil {
+			t.Fatalf("unable to decode webhook %q: %s", c.body, err)
+		}
+		return event, c
+	case <-time.After(2 * time.Second):
+		t.Fatal("no webhook received")
+	}
+	return webhookEvent{}, capturedWebhook{}
+}
+
+func TestWebhookStoreSendsSignedLifecycleEvents(t *testing.T) {
+	srv, received := newWebhookCapture(t)
+	store := newWebhookStore(newMemoryStore(), newWebhookSender(srv.URL, "secret", 1, 8, true, defaultOutput))
+	ctx := context.Background()
+
+	if _, _, err := store.Create(ctx, Widget{ID: "1", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Update(ctx, "1", func(w Widget) (Widget, error) {
+		w.Name = "b"
+		return w, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Delete(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		eventType string
+		name      string
+	}{
+		{eventWidgetCreated, "a"},
+		{eventWidgetUpdated, "b"},
+		{eventWidgetDeleted, "b"},
+	} {
+		event, c := nextWebhookEvent(t, received)
+		if event.Type != want.eventType || event.Widget.ID != "1" || event.Widget.Name != want.name {
+			t.Errorf("got %s for %+v, want %s named %s", event.Type, event.Widget, want.eventType, want.name)
+		}
+		if wantSig := "sha256=" + signWebhook([]byte("secret"), c.body); c.signature != wantSig {
+			t.Errorf("got signature %q, want %q", c.signature, wantSig)
+		}
+	}
+}
+
+func TestWebhookStorePutReportsCreatesAndUpdates(t *testing.T) {
+	srv, received := newWebhookCapture(t)
+	store := newWebhookStore(newMemoryStore(), newWebhookSender(srv.URL, "secret", 1, 8, true, defaultOutput))
+	ctx := context.Background()
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := store.Put(ctx, Widget{ID: "1", Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if event, _ := nextWebhookEvent(t, received); event.Type != eventWidgetCreated {
+		t.Errorf("first put sent %s, want %s", event.Type, eventWidgetCreated)
+	}
+	if event, _ := nextWebhookEvent(t, received); event.Type != eventWidgetUpdated {
+		t.Errorf("second put sent %s, want %s", event.Type, eventWidgetUpdated)
+	}
+}
+
+func TestWebhookSenderRetriesFailedDeliveries(t *testing.T) {
+	var count int32
+	attempts := make(chan struct{}, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		attempts <- struct{}{}
+	}))
+	defer srv.Close()
+
+	sender := newWebhookSender(srv.URL, "secret", 1, 1, true, defaultOutput)
+	sender.notify(eventWidgetCreated, Widget{ID: "1"})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("got %d attempts, want 2", i)
+		}
+	}
+}
+
+func TestWebhookSenderBoundsDeliveriesAndKeepsWidgetOrder(t *testing.T) {
+	const workers, widgets, events = 3, 6, 10
+	var inFlight, most int32
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+	done := make(chan struct{}, widgets*events)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			n, _ := strconv.Atoi(event.Widget.Name)
+			mu.Lock()
+			seen[event.Widget.ID] = append(seen[event.Widget.ID], n)
+			mu.Unlock()
+		}
+		done <- struct{}{}
+	}))
+	defer srv.Close()
+
+	sender := newWebhookSender(srv.URL, "secret", workers, 4, true, defaultOutput)
+	for i := 0; i < events; i++ {
+		for id := 0; id < widgets; id++ {
+			sender.notify(eventWidgetUpdated, Widget{ID: strconv.Itoa(id), Name: strconv.Itoa(i)})
+		}
+	}
+	for i := 0; i < widgets*events; i++ {
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("got %d deliveries, want %d", i, widgets*events)
+		}
+	}
+
+	if got := atomic.LoadInt32(&most); got > workers {
+		t.Errorf("got %d concurrent deliveries, want at most %d", got, workers)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for id, names := range seen {
+		for i, n := range names {
+			if n != i {
+				t.Errorf("widget %s events arrived in order %v", id, names)
+				break
+			}
+		}
+	}
+}
+
+func TestWebhookSenderDropsEventsWhenTheQueueIsFull(t *testing.T) {
+	buf := captureLog(t)
+	arrived := make(chan string, 4)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		arrived <- event.Widget.Name
+		select {
+		case <-release:
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	sender := newWebhookSender(srv.URL, "secret", 1, 1, false, defaultOutput)
+	sender.notify(eventWidgetCreated, Widget{ID: "1", Name: "a"})
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the first event was not delivered")
+	}
+	sender.notify(eventWidgetUpdated, Widget{ID: "1", Name: "b"})
+	sender.notify(eventWidgetUpdated, Widget{ID: "1", Name: "c"})
+	if !strings.Contains(buf.String(), "dropping widget.updated event for widget 1") {
+		t.Errorf("got log %q, want a dropped event", buf.String())
+	}
+	close(release)
+
+	select {
+	case name := <-arrived:
+		if name != "b" {
+			t.Errorf("got event for %s, want b", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the queued event was not delivered")
+	}
+	select {
+	case name := <-arrived:
+		t.Errorf("got dropped event for %s", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookStoreRenameSendsOneRenamedEvent(t *testing.T) {
+	srv, received := newWebhookCapture(t)
+	store := newWebhookStore(newMemoryStore(), newWebhookSender(srv.URL, "secret", 1, 8, true, defaultOutput))
+	ctx := context.Background()
+
+	if _, _, err := store.Create(ctx, Widget{ID: "1", Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	nextWebhookEvent(t, received)
+
+	if _, err := store.Rename(ctx, "1", "gear"); err != nil {
+		t.Fatal(err)
+	}
+	event, _ := nextWebhookEvent(t, received)
+	if event.Type != eventWidgetRenamed || event.Widget.ID != "gear" || event.PreviousID != "1" {
+		t.Errorf("got %s event for %s from %q", event.Type, event.Widget.ID, event.PreviousID)
+	}
+	select {
+	case c := <-received:
+		t.Errorf("got another webhook %s", c.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookSenderDeliversARenameBehindTheEventsOfThePreviousID(t *testing.T) {
+	const workers = 2
+	worker := func(id string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		return h.Sum32() % workers
+	}
+	newID := "a"
+	for worker(newID) == worker("1") {
+		newID += "a"
+	}
+
+	arrived := make(chan string, 2)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		arrived <- event.Type
+		if event.Type == eventWidgetUpdated {
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	sender := newWebhookSender(srv.URL, "secret", workers, 8, true, defaultOutput)
+	sender.notify(eventWidgetUpdated, Widget{ID: "1"})
+	if got := <-arrived; got != eventWidgetUpdated {
+		t.Fatalf("got %s first", got)
+	}
+	sender.enqueue(webhookEvent{Type: eventWidgetRenamed, Widget: Widget{ID: newID}, PreviousID: "1"})
+	select {
+	case got := <-arrived:
+		t.Errorf("got %s while the update was still being delivered", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case got := <-arrived:
+		if got != eventWidgetRenamed {
+			t.Errorf("got %s, want %s", got, eventWidgetRenamed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the rename was not delivered")
+	}
+}
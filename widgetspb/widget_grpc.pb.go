@@ -0,0 +1,241 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package widgetspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// WidgetServiceClient is the client API for WidgetService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type WidgetServiceClient interface {
+	ListWidgets(ctx context.Context, in *ListWidgetsRequest, opts ...grpc.CallOption) (*ListWidgetsResponse, error)
+	GetWidget(ctx context.Context, in *GetWidgetRequest, opts ...grpc.CallOption) (*Widget, error)
+	CreateWidget(ctx context.Context, in *CreateWidgetRequest, opts ...grpc.CallOption) (*Widget, error)
+	UpdateWidget(ctx context.Context, in *UpdateWidgetRequest, opts ...grpc.CallOption) (*Widget, error)
+	DeleteWidget(ctx context.Context, in *DeleteWidgetRequest, opts ...grpc.CallOption) (*Widget, error)
+}
+
+type widgetServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewWidgetServiceClient(cc grpc.ClientConnInterface) WidgetServiceClient {
+	return &widgetServiceClient{cc}
+}
+
+func (c *widgetServiceClient) ListWidgets(ctx context.Context, in *ListWidgetsRequest, opts ...grpc.CallOption) (*ListWidgetsResponse, error) {
+	out := new(ListWidgetsResponse)
+	err := c.cc.Invoke(ctx, "/widgets.v1.WidgetService/ListWidgets", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *widgetServiceClient) GetWidget(ctx context.Context, in *GetWidgetRequest, opts ...grpc.CallOption) (*Widget, error) {
+	out := new(Widget)
+	err := c.cc.Invoke(ctx, "/widgets.v1.WidgetService/GetWidget", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *widgetServiceClient) CreateWidget(ctx context.Context, in *CreateWidgetRequest, opts ...grpc.CallOption) (*Widget, error) {
+	out := new(Widget)
+	err := c.cc.Invoke(ctx, "/widgets.v1.WidgetService/CreateWidget", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *widgetServiceClient) UpdateWidget(ctx context.Context, in *UpdateWidgetRequest, opts ...grpc.CallOption) (*Widget, error) {
+	out := new(Widget)
+	err := c.cc.Invoke(ctx, "/widgets.v1.WidgetService/UpdateWidget", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *widgetServiceClient) DeleteWidget(ctx context.Context, in *DeleteWidgetRequest, opts ...grpc.CallOption) (*Widget, error) {
+	out := new(Widget)
+	err := c.cc.Invoke(ctx, "/widgets.v1.WidgetService/DeleteWidget", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WidgetServiceServer is the server API for WidgetService service.
+// All implementations must embed UnimplementedWidgetServiceServer
+// for forward compatibility
+type WidgetServiceServer interface {
+	ListWidgets(context.Context, *ListWidgetsRequest) (*ListWidgetsResponse, error)
+	GetWidget(context.Context, *GetWidgetRequest) (*Widget, error)
+	CreateWidget(context.Context, *CreateWidgetRequest) (*Widget, error)
+	UpdateWidget(context.Context, *UpdateWidgetRequest) (*Widget, error)
+	DeleteWidget(context.Context, *DeleteWidgetRequest) (*Widget, error)
+	mustEmbedUnimplementedWidgetServiceServer()
+}
+
+// UnimplementedWidgetServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedWidgetServiceServer struct {
+}
+
+func (UnimplementedWidgetServiceServer) ListWidgets(context.Context, *ListWidgetsRequest) (*ListWidgetsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListWidgets not implemented")
+}
+func (UnimplementedWidgetServiceServer) GetWidget(context.Context, *GetWidgetRequest) (*Widget, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetWidget not implemented")
+}
+func (UnimplementedWidgetServiceServer) CreateWidget(context.Context, *CreateWidgetRequest) (*Widget, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateWidget not implemented")
+}
+func (UnimplementedWidgetServiceServer) UpdateWidget(context.Context, *UpdateWidgetRequest) (*Widget, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateWidget not implemented")
+}
+func (UnimplementedWidgetServiceServer) DeleteWidget(context.Context, *DeleteWidgetRequest) (*Widget, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteWidget not implemented")
+}
+func (UnimplementedWidgetServiceServer) mustEmbedUnimplementedWidgetServiceServer() {}
+
+// UnsafeWidgetServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to WidgetServiceServer will
+// result in compilation errors.
+type UnsafeWidgetServiceServer interface {
+	mustEmbedUnimplementedWidgetServiceServer()
+}
+
+func RegisterWidgetServiceServer(s grpc.ServiceRegistrar, srv WidgetServiceServer) {
+	s.RegisterService(&_WidgetService_serviceDesc, srv)
+}
+
+func _WidgetService_ListWidgets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListWidgetsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WidgetServiceServer).ListWidgets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/widgets.v1.WidgetService/ListWidgets",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WidgetServiceServer).ListWidgets(ctx, req.(*ListWidgetsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WidgetService_GetWidget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetWidgetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WidgetServiceServer).GetWidget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/widgets.v1.WidgetService/GetWidget",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WidgetServiceServer).GetWidget(ctx, req.(*GetWidgetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WidgetService_CreateWidget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateWidgetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WidgetServiceServer).CreateWidget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/widgets.v1.WidgetService/CreateWidget",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WidgetServiceServer).CreateWidget(ctx, req.(*CreateWidgetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WidgetService_UpdateWidget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateWidgetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WidgetServiceServer).UpdateWidget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/widgets.v1.WidgetService/UpdateWidget",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WidgetServiceServer).UpdateWidget(ctx, req.(*UpdateWidgetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WidgetService_DeleteWidget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteWidgetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WidgetServiceServer).DeleteWidget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/widgets.v1.WidgetService/DeleteWidget",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WidgetServiceServer).DeleteWidget(ctx, req.(*DeleteWidgetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _WidgetService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "widgets.v1.WidgetService",
+	HandlerType: (*WidgetServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListWidgets",
+			Handler:    _WidgetService_ListWidgets_Handler,
+		},
+		{
+			MethodName: "GetWidget",
+			Handler:    _WidgetService_GetWidget_Handler,
+		},
+		{
+			MethodName: "CreateWidget",
+			Handler:    _WidgetService_CreateWidget_Handler,
+		},
+		{
+			MethodName: "UpdateWidget",
+			Handler:    _WidgetService_UpdateWidget_Handler,
+		},
+		{
+			MethodName: "DeleteWidget",
+			Handler:    _WidgetService_DeleteWidget_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "widgetspb/widget.proto",
+}